@@ -1,9 +1,14 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
@@ -89,10 +94,42 @@ func runStart(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to initialize blob store: %w", err)
 	}
+	blobStore.SetRehydrationDelays(cfg.RehydrateDelay, cfg.RehydrateHighPriorityDelay)
+
+	recovery := blobStore.RecoveryReport()
+	logger.Info("blob store loaded",
+		logging.Int("containers", recovery.Containers),
+		logging.Int("blobs", recovery.Blobs),
+		logging.Int("snapshots", recovery.Snapshots),
+		logging.Int("versions", recovery.Versions),
+		logging.Int("soft_deleted", recovery.SoftDeleted),
+		logging.Int("repaired", len(recovery.Repaired)),
+		logging.Int("quarantined", len(recovery.Quarantined)),
+	)
+	for _, entry := range recovery.Repaired {
+		logger.Warn("rebuilt missing or inconsistent blob store record",
+			logging.String("entry", entry),
+		)
+	}
+	for _, entry := range recovery.Quarantined {
+		logger.Warn("moved corrupt blob store entry to quarantine",
+			logging.String("entry", entry),
+		)
+	}
+
+	// Background work and the server stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go runPurger(ctx, blobStore, cfg.PurgeInterval, logger)
 
 	// Create and register services
 	blobService := blob.NewBlobService(blobStore, logger)
+	if cfg.ChangeFeedEnabled {
+		blobService.EnableChangeFeed()
+	}
 	core.RegisterService(blobService)
+	core.RegisterService(blob.NewWebService(blobStore, logger))
 
 	logger.Info("registered services",
 		logging.Int("count", len(core.GetRegisteredServices())),
@@ -107,10 +144,43 @@ func runStart(cmd *cobra.Command, args []string) error {
 		logging.String("address", addr),
 	)
 
-	if err := http.ListenAndServe(addr, router); err != nil {
+	server := &http.Server{Addr: addr, Handler: router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("server error: %w", err)
 	}
 
+	logger.Info("server stopped")
 	return nil
 }
 
+// runPurger permanently deletes soft-deleted blob data whose retention period
+// has ended, once at startup and then every interval, until ctx is done.
+func runPurger(ctx context.Context, store *blob.FileBlobStore, interval time.Duration, logger logging.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := store.PurgeExpired(time.Now())
+		if err != nil {
+			logger.Error("failed to purge soft-deleted blob data",
+				logging.ErrorField(err),
+			)
+		} else if purged > 0 {
+			logger.Info("purged soft-deleted blob data",
+				logging.Int("items", purged),
+			)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
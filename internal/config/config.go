@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds the application configuration loaded from environment variables.
@@ -20,12 +21,31 @@ type Config struct {
 
 	// EnabledServices is a comma-separated list of service names to enable at startup.
 	// Example: "blob,queue,keyvault"
-	// Default: "blob"
+	// Default: "blob,web"
 	EnabledServices []string
 
 	// LogLevel controls the verbosity of logging (debug, info, warn, error).
 	// Default: "info"
 	LogLevel string
+
+	// PurgeInterval is how often soft-deleted data whose retention period has
+	// ended is permanently deleted.
+	// Default: 1h
+	PurgeInterval time.Duration
+
+	// RehydrateDelay is how long rehydrating a blob from the Archive tier takes
+	// at standard priority. Shorten it to test tiering without waiting hours.
+	// Default: 15h
+	RehydrateDelay time.Duration
+
+	// RehydrateHighPriorityDelay is how long a high-priority rehydration takes.
+	// Default: 1h
+	RehydrateHighPriorityDelay time.Duration
+
+	// ChangeFeedEnabled records changes to blobs in each account's
+	// $blobchangefeed container.
+	// Default: false
+	ChangeFeedEnabled bool
 }
 
 // Load creates a Config instance by reading environment variables.
@@ -34,8 +54,12 @@ func Load() *Config {
 	cfg := &Config{
 		EdgePort:        4566,
 		DataDir:         "./data",
-		EnabledServices: []string{"blob"},
+		EnabledServices: []string{"blob", "web"},
 		LogLevel:        "info",
+		PurgeInterval:   time.Hour,
+
+		RehydrateDelay:             15 * time.Hour,
+		RehydrateHighPriorityDelay: time.Hour,
 	}
 
 	// Load EDGE_PORT
@@ -70,6 +94,32 @@ func Load() *Config {
 		cfg.LogLevel = logLevel
 	}
 
+	// Load PURGE_INTERVAL
+	if intervalStr := os.Getenv("PURGE_INTERVAL"); intervalStr != "" {
+		if interval, err := time.ParseDuration(intervalStr); err == nil && interval > 0 {
+			cfg.PurgeInterval = interval
+		}
+	}
+
+	// Load REHYDRATE_DELAY and REHYDRATE_HIGH_PRIORITY_DELAY
+	if delayStr := os.Getenv("REHYDRATE_DELAY"); delayStr != "" {
+		if delay, err := time.ParseDuration(delayStr); err == nil && delay >= 0 {
+			cfg.RehydrateDelay = delay
+		}
+	}
+	if delayStr := os.Getenv("REHYDRATE_HIGH_PRIORITY_DELAY"); delayStr != "" {
+		if delay, err := time.ParseDuration(delayStr); err == nil && delay >= 0 {
+			cfg.RehydrateHighPriorityDelay = delay
+		}
+	}
+
+	// Load CHANGE_FEED_ENABLED
+	if enabledStr := os.Getenv("CHANGE_FEED_ENABLED"); enabledStr != "" {
+		if enabled, err := strconv.ParseBool(enabledStr); err == nil {
+			cfg.ChangeFeedEnabled = enabled
+		}
+	}
+
 	return cfg
 }
 
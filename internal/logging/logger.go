@@ -96,6 +96,11 @@ func Int64(key string, value int64) Field {
 	return zap.Int64(key, value)
 }
 
+// Bool creates a boolean field.
+func Bool(key string, value bool) Field {
+	return zap.Bool(key, value)
+}
+
 // ErrorField creates an error field.
 func ErrorField(err error) Field {
 	return zap.Error(err)
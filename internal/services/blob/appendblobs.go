@@ -0,0 +1,374 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// maxAppendBlockSize is the largest block Append Block accepts.
+const maxAppendBlockSize = 4 << 20
+
+// CreateAppendBlob creates an empty append blob, replacing any existing blob.
+func (s *FileBlobStore) CreateAppendBlob(ctx context.Context, account, containerName, blobName string, opts PutBlobOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(s.baseDir, tmpDirName, "append-"+newUUID())
+	if err := os.WriteFile(tmpPath, nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to create append blob: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	headers := opts.HTTPHeaders
+	if headers.ContentType == "" {
+		headers.ContentType = "application/octet-stream"
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	return s.replaceBlob(entry, account, containerName, existing, tmpPath, &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders: headers,
+			BlobType:        BlobTypeAppend,
+
+			ImmutabilityPolicy: opts.ImmutabilityPolicy,
+			LegalHold:          opts.LegalHold,
+		},
+		Metadata: metadata,
+		Tags:     opts.Tags,
+	}, time.Now().UTC())
+}
+
+// appendBlob returns the record of an append blob that may be written to with
+// opts: it must exist, be an append blob, not be sealed, and meet opts's
+// conditions. The caller holds the lock.
+func (s *FileBlobStore) appendBlob(account, containerName, blobName string, opts AppendBlockOptions) (*blobRecord, error) {
+	record, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, record, true); err != nil {
+		return nil, err
+	}
+	if record.Properties.BlobType != BlobTypeAppend {
+		return nil, ErrInvalidBlobType
+	}
+	if record.Properties.Copy.pending() {
+		return nil, ErrPendingCopyOperation
+	}
+	if opts.AppendPosition != nil && *opts.AppendPosition != record.Properties.Size {
+		return nil, ErrAppendPositionConditionNotMet
+	}
+	return record, nil
+}
+
+func (s *FileBlobStore) AppendBlock(ctx context.Context, account, containerName, blobName string, content io.Reader, opts AppendBlockOptions) (*AppendBlockResult, error) {
+	// As with Put Blob, the block is spooled before taking the lock. Appends
+	// are then applied one at a time, each at the end of the blob as it is then.
+	tmpPath, size, err := s.spoolTemp(io.LimitReader(content, maxAppendBlockSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write block: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	switch {
+	case size == 0:
+		return nil, errInvalidHeaderValue("Content-Length")
+	case size > maxAppendBlockSize:
+		return nil, ErrRequestBodyTooLarge
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.appendBlob(account, containerName, blobName, opts)
+	if err != nil {
+		return nil, err
+	}
+	entry := s.containers[s.containerKey(account, containerName)]
+	if err := entry.checkImmutable(current, true, time.Now()); err != nil {
+		return nil, err
+	}
+	switch {
+	case current.Properties.Sealed:
+		return nil, ErrBlobIsSealed
+	case opts.MaxSize != nil && current.Properties.Size+size > *opts.MaxSize:
+		return nil, ErrMaxBlobSizeConditionNotMet
+	case current.Properties.CommittedBlockCount >= maxCommittedBlocks:
+		return nil, ErrCommittedBlockCountExceedsLimit
+	}
+
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	offset := current.Properties.Size
+	if err := appendFileAt(blobPath, tmpPath, offset); err != nil {
+		return nil, fmt.Errorf("failed to append block: %w", err)
+	}
+
+	record := *current
+	record.Properties.Size += size
+	record.Properties.CommittedBlockCount++
+	record.Properties.ModifiedAt = time.Now().UTC()
+	record.Properties.ETag = newETag()
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	entry.blobs[blobName] = &record
+
+	return &AppendBlockResult{AppendOffset: offset, BlobProperties: record.Properties}, nil
+}
+
+// appendFileAt writes the content of the file at src into the file at path,
+// starting at offset. If the write fails, path is cut back to offset, so bytes
+// past the end of the blob never linger.
+//
+// Unlike other blobs, whose content files never change once renamed into place,
+// an append blob's content file grows in place. That stays safe with hard links:
+// snapshots, versions and soft-deleted copies of an append blob only ever see
+// the first Size bytes of the file, and Copy Blob gives a copy of an append blob
+// a content file of its own.
+func appendFileAt(path, src string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(io.NewOffsetWriter(f, offset), in)
+	if err != nil {
+		f.Truncate(offset)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *FileBlobStore) SealBlob(ctx context.Context, account, containerName, blobName string, opts AppendBlockOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.appendBlob(account, containerName, blobName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	record := *current
+	record.Properties.Sealed = true
+	record.Properties.ModifiedAt = time.Now().UTC()
+	record.Properties.ETag = newETag()
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &record
+
+	props := record.Properties
+	return &props, nil
+}
+
+// parseAppendBlockOptions reads the conditions of Append Block and Seal Blob
+// from their request headers.
+func parseAppendBlockOptions(h http.Header) (AppendBlockOptions, error) {
+	conds, err := parseAccessConditions(h)
+	if err != nil {
+		return AppendBlockOptions{}, err
+	}
+	opts := AppendBlockOptions{Conditions: conds}
+	for _, c := range []struct {
+		header string
+		value  **int64
+	}{
+		{"x-ms-blob-condition-appendpos", &opts.AppendPosition},
+		{"x-ms-blob-condition-maxsize", &opts.MaxSize},
+	} {
+		value := h.Get(c.header)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return AppendBlockOptions{}, errInvalidHeaderValue(c.header)
+		}
+		*c.value = &n
+	}
+	return opts, nil
+}
+
+// handleCreateAppendBlob handles PUT /{account}/{container}/{blobName} with
+// x-ms-blob-type: AppendBlob. It creates an empty append blob, so the request
+// must not have a body.
+func (s *BlobService) handleCreateAppendBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	if r.ContentLength > 0 {
+		s.writeStoreError(w, errInvalidHeaderValue("Content-Length"), "")
+		return
+	}
+	headers, err := parseBlobHTTPHeaders(r.Header, true)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob properties")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+
+	props, err := s.store.CreateAppendBlob(r.Context(), account, containerName, blobName, PutBlobOptions{
+		HTTPHeaders: headers,
+		Metadata:    parseMetadata(r.Header),
+		Tags:        tags,
+		Conditions:  conds,
+
+		ImmutabilityPolicy: policy,
+		LegalHold:          legalHold,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to create append blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobCreated, "PutBlob", props)
+	s.logger.Info("append blob created",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleAppendBlock handles PUT /{account}/{container}/{blobName}?comp=appendblock.
+func (s *BlobService) handleAppendBlock(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parseAppendBlockOptions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	if r.ContentLength > maxAppendBlockSize {
+		s.writeStoreError(w, ErrRequestBodyTooLarge, "")
+		return
+	}
+
+	body := &requestBody{ReadCloser: r.Body}
+	result, err := s.store.AppendBlock(r.Context(), account, containerName, blobName, body, opts)
+	if err != nil {
+		if body.err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidInput", "Failed to read request body")
+			return
+		}
+		s.writeStoreError(w, err, "failed to append block",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Debug("block appended",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Int64("offset", result.AppendOffset),
+		logging.Int64("size", result.Size-result.AppendOffset),
+	)
+	w.Header().Set("ETag", result.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(result.ModifiedAt))
+	w.Header().Set("x-ms-blob-append-offset", strconv.FormatInt(result.AppendOffset, 10))
+	w.Header().Set("x-ms-blob-committed-block-count", strconv.Itoa(result.CommittedBlockCount))
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleSealBlob handles PUT /{account}/{container}/{blobName}?comp=seal.
+// Sealing a sealed blob succeeds and changes nothing but its ETag.
+func (s *BlobService) handleSealBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parseAppendBlockOptions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	props, err := s.store.SealBlob(r.Context(), account, containerName, blobName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to seal blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob sealed",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	w.Header().Set("x-ms-blob-sealed", "true")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,86 @@
+package blob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// avroMagic starts every Avro object container file.
+var avroMagic = []byte("Obj\x01")
+
+// avroEncoder writes values in Avro's binary encoding. It only knows the types
+// the change feed's records use.
+type avroEncoder struct {
+	bytes.Buffer
+}
+
+// writeLong writes an int or long as a zig-zag varint, which is what
+// binary.AppendVarint produces.
+func (e *avroEncoder) writeLong(v int64) {
+	e.Write(binary.AppendVarint(nil, v))
+}
+
+// writeBytes writes bytes prefixed by their length.
+func (e *avroEncoder) writeBytes(b []byte) {
+	e.writeLong(int64(len(b)))
+	e.Write(b)
+}
+
+// writeString writes a string prefixed by its length.
+func (e *avroEncoder) writeString(s string) {
+	e.writeLong(int64(len(s)))
+	e.WriteString(s)
+}
+
+// writeOptionalString writes a ["null", "string"] union, with "" as null.
+func (e *avroEncoder) writeOptionalString(s string) {
+	if s == "" {
+		e.writeLong(0)
+		return
+	}
+	e.writeLong(1)
+	e.writeString(s)
+}
+
+// writeMap writes a map of strings as a single block, in key order.
+func (e *avroEncoder) writeMap(m map[string]string) {
+	if len(m) > 0 {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		e.writeLong(int64(len(keys)))
+		for _, k := range keys {
+			e.writeString(k)
+			e.writeString(m[k])
+		}
+	}
+	e.writeLong(0)
+}
+
+// avroHeader returns the header of an Avro object container file holding
+// uncompressed records of schema, whose blocks end with sync.
+func avroHeader(schema string, sync [16]byte) []byte {
+	var e avroEncoder
+	e.Write(avroMagic)
+	e.writeLong(2)
+	e.writeString("avro.codec")
+	e.writeBytes([]byte("null"))
+	e.writeString("avro.schema")
+	e.writeBytes([]byte(schema))
+	e.writeLong(0)
+	e.Write(sync[:])
+	return e.Bytes()
+}
+
+// avroBlock returns a data block of an Avro object container file holding a
+// single record, already encoded.
+func avroBlock(record []byte, sync [16]byte) []byte {
+	var e avroEncoder
+	e.writeLong(1)
+	e.writeBytes(record)
+	e.Write(sync[:])
+	return e.Bytes()
+}
@@ -0,0 +1,227 @@
+package blob
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// maxBatchRequests is the most sub-requests a Blob Batch request may hold.
+const maxBatchRequests = 256
+
+// maxBatchBodySize is the largest Blob Batch request body Azure accepts.
+const maxBatchBodySize = 4 << 20
+
+// batchRequest is a sub-request of a Blob Batch request.
+type batchRequest struct {
+	contentID string
+	req       *http.Request
+}
+
+// parseBatch reads the sub-requests of a multipart/mixed Blob Batch body. Each
+// part holds an HTTP request with Content-Type: application/http.
+func parseBatch(r *http.Request) ([]batchRequest, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		return nil, errInvalidHeaderValue("Content-Type")
+	}
+	if r.ContentLength > maxBatchBodySize {
+		return nil, ErrRequestBodyTooLarge
+	}
+
+	reader := multipart.NewReader(io.LimitReader(r.Body, maxBatchBodySize), params["boundary"])
+	var batch []batchRequest
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, ErrMalformedBatch
+		}
+		if len(batch) == maxBatchRequests {
+			return nil, ErrTooManyBatchRequests
+		}
+		req, err := http.ReadRequest(bufio.NewReader(part))
+		if err != nil {
+			return nil, ErrMalformedBatch
+		}
+		// The sub-request's body must be read before the next part is.
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, ErrMalformedBatch
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		batch = append(batch, batchRequest{contentID: part.Header.Get("Content-ID"), req: req})
+	}
+	if len(batch) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	return batch, nil
+}
+
+// batchOperation returns the operation a sub-request performs, or "" if it
+// isn't one that may be batched.
+func batchOperation(req *http.Request) string {
+	switch {
+	case req.Method == http.MethodDelete && !req.URL.Query().Has("comp"):
+		return "delete"
+	case req.Method == http.MethodPut && req.URL.Query().Get("comp") == "tier":
+		return "tier"
+	default:
+		return ""
+	}
+}
+
+// resolveBatchPath rewrites the path of a sub-request to the path the service's
+// routes match, /{account}/{container}/{blob}. A sub-request may address a blob
+// by the path it would be sent to on its own, such as /blob/{account}/{container}/{blob}
+// when the service is mounted at /blob, or relative to the account, as in Azure.
+//
+// The path is passed on escaped, as it was sent: the routes match the escaped
+// path and blobNameParam unescapes the blob name once, so it must not be
+// unescaped here as well.
+func resolveBatchPath(req *http.Request, mount, account string) {
+	escaped, path := req.URL.EscapedPath(), req.URL.Path
+	if rest, ok := strings.CutPrefix(escaped, mount+"/"+url.PathEscape(account)+"/"); ok {
+		escaped = "/" + rest
+		path = "/" + strings.TrimPrefix(path, mount+"/"+account+"/")
+	}
+	req.URL.RawPath = "/" + url.PathEscape(account) + escaped
+	req.URL.Path = "/" + account + path
+}
+
+// batchResponseWriter records the response to a sub-request.
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// writeTo writes the recorded response as the application/http body of a
+// batch response part.
+func (w *batchResponseWriter) writeTo(out io.Writer) error {
+	w.header.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	if _, err := fmt.Fprintf(out, "HTTP/1.1 %d %s\r\n", w.status, http.StatusText(w.status)); err != nil {
+		return err
+	}
+	if err := w.header.Write(out); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(out, "\r\n"); err != nil {
+		return err
+	}
+	_, err := out.Write(w.body.Bytes())
+	return err
+}
+
+// handleBlobBatch handles POST /{account}?comp=batch and
+// POST /{account}/{container}?restype=container&comp=batch. The sub-requests,
+// all Delete Blob or all Set Blob Tier, are run in order through the service's
+// own routes, and their responses returned as a multipart/mixed body. A
+// container batch may only address blobs in its container.
+func (s *BlobService) handleBlobBatch(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	batch, err := parseBatch(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid batch request")
+		return
+	}
+
+	// Everything is checked before any sub-request runs.
+	routePath := "/" + account
+	if containerName != "" {
+		routePath += "/" + containerName
+	}
+	mount := strings.TrimSuffix(r.URL.Path, routePath)
+	operation := batchOperation(batch[0].req)
+	for _, sub := range batch {
+		if op := batchOperation(sub.req); op == "" || op != operation {
+			s.writeStoreError(w, ErrInvalidBatchOperation, "invalid batch request")
+			return
+		}
+		resolveBatchPath(sub.req, mount, account)
+		if containerName != "" && !strings.HasPrefix(sub.req.URL.RawPath, routePath+"/") {
+			s.writeStoreError(w, ErrBatchRequestOutsideContainer, "invalid batch request")
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	if err := parts.SetBoundary("batchresponse_" + newUUID()); err != nil {
+		s.writeStoreError(w, err, "failed to write batch response")
+		return
+	}
+	failed := 0
+	for _, sub := range batch {
+		// The sub-request is routed afresh, without the batch request's route context.
+		req := sub.req.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, nil))
+		req.RequestURI = ""
+		rec := &batchResponseWriter{header: make(http.Header)}
+		s.routes.ServeHTTP(rec, req)
+		rec.WriteHeader(http.StatusOK)
+		if rec.status >= 400 {
+			failed++
+		}
+
+		header := textproto.MIMEHeader{"Content-Type": {"application/http"}}
+		if sub.contentID != "" {
+			header.Set("Content-ID", sub.contentID)
+		}
+		part, err := parts.CreatePart(header)
+		if err == nil {
+			err = rec.writeTo(part)
+		}
+		if err != nil {
+			s.writeStoreError(w, err, "failed to write batch response")
+			return
+		}
+	}
+	if err := parts.Close(); err != nil {
+		s.writeStoreError(w, err, "failed to write batch response")
+		return
+	}
+
+	s.logger.Info("blob batch processed",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("operation", operation),
+		logging.Int("requests", len(batch)),
+		logging.Int("failed", failed),
+	)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+parts.Boundary())
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(body.Bytes())
+}
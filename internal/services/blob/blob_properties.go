@@ -0,0 +1,273 @@
+package blob
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// metadataHeaderPrefix is the header prefix Azure uses for user metadata.
+const metadataHeaderPrefix = "x-ms-meta-"
+
+// parseMetadata extracts x-ms-meta-* headers into a metadata map.
+// Keys are stored lowercase since Go canonicalizes header names.
+func parseMetadata(h http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for key, values := range h {
+		lower := strings.ToLower(key)
+		if strings.HasPrefix(lower, metadataHeaderPrefix) && len(values) > 0 {
+			metadata[strings.TrimPrefix(lower, metadataHeaderPrefix)] = values[0]
+		}
+	}
+	return metadata
+}
+
+// parseBlobHTTPHeaders reads the x-ms-blob-* property headers of a request.
+// On uploads (Put Blob) the standard HTTP headers are used as a fallback, since
+// Azure stores e.g. Content-Type when x-ms-blob-content-type is not given.
+func parseBlobHTTPHeaders(h http.Header, upload bool) (BlobHTTPHeaders, error) {
+	get := func(name string) string {
+		if v := h.Get("x-ms-blob-" + name); v != "" || !upload {
+			return v
+		}
+		return h.Get(name)
+	}
+
+	headers := BlobHTTPHeaders{
+		ContentType:        get("Content-Type"),
+		ContentEncoding:    get("Content-Encoding"),
+		ContentLanguage:    get("Content-Language"),
+		ContentDisposition: get("Content-Disposition"),
+		CacheControl:       get("Cache-Control"),
+	}
+
+	if v := h.Get("x-ms-blob-content-md5"); v != "" {
+		md5, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(md5) != 16 {
+			return BlobHTTPHeaders{}, errInvalidHeaderValue("x-ms-blob-content-md5")
+		}
+		headers.ContentMD5 = md5
+	}
+
+	return headers, nil
+}
+
+// setBlobPropertyHeaders writes a blob's properties and metadata as response headers,
+// as returned by Get Blob and Get Blob Properties.
+func setBlobPropertyHeaders(w http.ResponseWriter, blob *Blob) {
+	h := w.Header()
+	h.Set("Content-Type", blob.ContentType)
+	h.Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	h.Set("Last-Modified", formatHTTPDate(blob.ModifiedAt))
+	h.Set("ETag", blob.ETag)
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("x-ms-blob-type", string(blob.BlobType))
+	switch blob.BlobType {
+	case BlobTypeBlock:
+		setAccessTierHeaders(h, &blob.BlobProperties)
+	case BlobTypeAppend:
+		h.Set("x-ms-blob-committed-block-count", strconv.Itoa(blob.CommittedBlockCount))
+		if blob.Sealed {
+			h.Set("x-ms-blob-sealed", "true")
+		}
+	case BlobTypePage:
+		setSequenceNumberHeader(h, &blob.BlobProperties)
+	}
+	h.Set("x-ms-creation-time", formatHTTPDate(blob.CreatedAt))
+	setImmutabilityHeaders(h, &blob.BlobProperties)
+	setLeaseHeaders(h, blob.Lease)
+	h.Set("x-ms-server-encrypted", "false")
+	if blob.VersionID != "" {
+		h.Set("x-ms-version-id", blob.VersionID)
+		h.Set("x-ms-is-current-version", strconv.FormatBool(blob.IsCurrentVersion))
+	}
+	if c := blob.Copy; c != nil {
+		h.Set("x-ms-copy-id", c.ID)
+		h.Set("x-ms-copy-source", c.Source)
+		h.Set("x-ms-copy-status", string(c.Status))
+		h.Set("x-ms-copy-progress", c.progress())
+		if !c.CompletionTime.IsZero() {
+			h.Set("x-ms-copy-completion-time", formatHTTPDate(c.CompletionTime))
+		}
+		if c.StatusDescription != "" {
+			h.Set("x-ms-copy-status-description", c.StatusDescription)
+		}
+	}
+
+	if blob.ContentEncoding != "" {
+		h.Set("Content-Encoding", blob.ContentEncoding)
+	}
+	if blob.ContentLanguage != "" {
+		h.Set("Content-Language", blob.ContentLanguage)
+	}
+	if blob.ContentDisposition != "" {
+		h.Set("Content-Disposition", blob.ContentDisposition)
+	}
+	if blob.CacheControl != "" {
+		h.Set("Cache-Control", blob.CacheControl)
+	}
+	if len(blob.ContentMD5) > 0 {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(blob.ContentMD5))
+	}
+	if len(blob.Tags) > 0 {
+		h.Set("x-ms-tag-count", strconv.Itoa(len(blob.Tags)))
+	}
+
+	setMetadataHeaders(w, blob.Metadata)
+}
+
+// setMetadataHeaders writes user metadata as x-ms-meta-* response headers.
+func setMetadataHeaders(w http.ResponseWriter, metadata map[string]string) {
+	for key, value := range metadata {
+		w.Header().Set(metadataHeaderPrefix+key, value)
+	}
+}
+
+// handleGetBlobProperties handles HEAD /{account}/{container}/{blobName}.
+// It returns the blob's properties and metadata as headers, without a body.
+func (s *BlobService) handleGetBlobProperties(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "invalid snapshot or version")
+		return
+	}
+
+	blob, err := s.store.GetBlobProperties(r.Context(), account, containerName, blobName, GetBlobOptions{Snapshot: snapshot, VersionID: versionID, Conditions: conds})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get blob properties",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	setBlobPropertyHeaders(w, blob)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetBlobProperties handles PUT /{account}/{container}/{blobName}?comp=properties.
+// Like Azure, any HTTP property not present in the request is cleared.
+func (s *BlobService) handleSetBlobProperties(w http.ResponseWriter, r *http.Request) {
+	if isPageBlobPropertiesRequest(r.Header) {
+		s.handleSetPageBlobProperties(w, r)
+		return
+	}
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	headers, err := parseBlobHTTPHeaders(r.Header, false)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob properties")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	props, err := s.store.SetBlobHTTPHeaders(r.Context(), account, containerName, blobName, headers, conds)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set blob properties",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobPropertiesUpdated, "SetBlobProperties", props)
+	s.logger.Info("blob properties set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetBlobMetadata handles PUT /{account}/{container}/{blobName}?comp=metadata.
+// The request's x-ms-meta-* headers replace all existing metadata.
+func (s *BlobService) handleSetBlobMetadata(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	props, err := s.store.SetBlobMetadata(r.Context(), account, containerName, blobName, parseMetadata(r.Header), conds)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set blob metadata",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobPropertiesUpdated, "SetBlobMetadata", props)
+	s.logger.Info("blob metadata set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetBlobMetadata handles GET /{account}/{container}/{blobName}?comp=metadata.
+func (s *BlobService) handleGetBlobMetadata(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "invalid snapshot or version")
+		return
+	}
+
+	blob, err := s.store.GetBlobProperties(r.Context(), account, containerName, blobName, GetBlobOptions{Snapshot: snapshot, VersionID: versionID, Conditions: conds})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get blob metadata",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	setMetadataHeaders(w, blob.Metadata)
+	w.Header().Set("ETag", blob.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(blob.ModifiedAt))
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,12 +1,19 @@
 package blob
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -14,19 +21,40 @@ import (
 	"github.com/asad/bluestack/internal/logging"
 )
 
+// defaultAPIVersion is the x-ms-version reported when the client does not send one.
+const defaultAPIVersion = "2021-12-02"
+
 // BlobService implements the Azure Blob Storage service emulator.
 // It provides HTTP handlers for basic blob operations following Azure REST API patterns.
 type BlobService struct {
 	store  BlobStore
 	logger logging.Logger
+
+	// client reads copy sources outside the emulator.
+	client *http.Client
+
+	// copies holds the cancel functions of background copies, by copy ID.
+	copiesMu sync.Mutex
+	copies   map[string]context.CancelFunc
+
+	// routes are the routes set up by RegisterRoutes, which run the
+	// sub-requests of Blob Batch requests.
+	routes http.Handler
+
+	// changeFeed records changes to blobs; nil unless EnableChangeFeed was called.
+	changeFeed *changeFeed
 }
 
 // NewBlobService creates a new blob service instance.
 func NewBlobService(store BlobStore, logger logging.Logger) *BlobService {
-	return &BlobService{
+	s := &BlobService{
 		store:  store,
 		logger: logger,
+		client: &http.Client{},
+		copies: make(map[string]context.CancelFunc),
 	}
+	store.OnRehydrationComplete(s.rehydrationCompleted)
+	return s
 }
 
 // Name returns the service identifier.
@@ -36,24 +64,346 @@ func (s *BlobService) Name() string {
 
 // RegisterRoutes sets up HTTP routes for blob operations.
 // Routes follow a simplified Azure Blob Storage REST API pattern:
+//   - GET /{account}?restype=service&comp=properties - Get blob service properties
+//   - PUT /{account}?restype=service&comp=properties - Set blob service properties
+//   - GET /{account}?comp=list - List containers
+//   - GET /{account}?comp=blobs&where={expression} - Find blobs by tags
+//   - POST /{account}?comp=batch - Blob batch (multipart/mixed Delete Blob or Set Blob
+//     Tier sub-requests)
 //   - PUT /{account}/{container} - Create container
+//   - PUT /{account}/{container}?restype=container&comp=metadata - Set container metadata
+//   - PUT /{account}/{container}?restype=container&comp=acl - Set container ACL
+//   - PUT /{account}/{container}?restype=container&comp=lease - Lease container
+//   - PUT /{account}/{container}?restype=container&comp=undelete - Restore a soft-deleted container
+//   - PUT /{account}/{container}?restype=container&comp=immutabilityPolicies - Set container
+//     immutability policy (x-ms-immutability-policy-mode: Locked locks it)
+//   - POST /{account}/{container}?restype=container&comp=batch - Blob batch within a container
 //   - DELETE /{account}/{container} - Delete container
-//   - PUT /{account}/{container}/{blobName} - Upload blob
-//   - GET /{account}/{container}/{blobName} - Download blob
-//   - DELETE /{account}/{container}/{blobName} - Delete blob
-//   - GET /{account}/{container}?list - List blobs
+//   - DELETE /{account}/{container}?restype=container&comp=immutabilityPolicies - Delete an
+//     unlocked container immutability policy
+//   - PUT /{account}/{container}/{blobName} - Upload blob (with x-ms-blob-type: AppendBlob
+//     or PageBlob, create an append or page blob; with x-ms-copy-source, copy a blob
+//     or URL; with x-ms-copy-source and x-ms-blob-type, Put Blob From URL)
+//   - PUT /{account}/{container}/{blobName}?comp=copy&copyid={id} - Abort copy
+//   - PUT /{account}/{container}/{blobName}?comp=properties - Set blob properties (with
+//     x-ms-blob-content-length or x-ms-sequence-number-action, resize a page blob or
+//     change its sequence number)
+//   - PUT /{account}/{container}/{blobName}?comp=metadata - Set blob metadata
+//   - PUT /{account}/{container}/{blobName}?comp=block&blockid={id} - Put block
+//   - PUT /{account}/{container}/{blobName}?comp=blocklist - Put block list
+//   - PUT /{account}/{container}/{blobName}?comp=appendblock - Append block
+//   - PUT /{account}/{container}/{blobName}?comp=seal - Seal append blob
+//   - PUT /{account}/{container}/{blobName}?comp=page - Put page (update or clear)
+//   - PUT /{account}/{container}/{blobName}?comp=lease - Lease blob
+//   - PUT /{account}/{container}/{blobName}?comp=snapshot - Snapshot blob
+//   - PUT /{account}/{container}/{blobName}?comp=undelete - Undelete blob
+//   - PUT /{account}/{container}/{blobName}?comp=tags - Set blob tags (?versionid= tags
+//     a previous version)
+//   - PUT /{account}/{container}/{blobName}?comp=tier - Set blob tier (from Archive,
+//     start a rehydration)
+//   - PUT /{account}/{container}/{blobName}?comp=immutabilityPolicies - Set blob immutability
+//     policy (?versionid= for a previous version)
+//   - PUT /{account}/{container}/{blobName}?comp=legalhold - Set or clear a legal hold
+//     (?versionid= for a previous version)
+//   - GET /{account}/{container}/{blobName} - Download blob (Range and x-ms-range supported;
+//     ?snapshot= and ?versionid= read a snapshot or previous version)
+//   - GET /{account}/{container}/{blobName}?comp=metadata - Get blob metadata
+//   - GET /{account}/{container}/{blobName}?comp=blocklist - Get block list
+//   - GET /{account}/{container}/{blobName}?comp=pagelist - Get page ranges (?prevsnapshot=
+//     for the changes since a snapshot)
+//   - GET /{account}/{container}/{blobName}?comp=tags - Get blob tags
+//   - HEAD /{account}/{container}/{blobName} - Get blob properties
+//   - DELETE /{account}/{container}/{blobName} - Delete blob (or a snapshot or version)
+//   - DELETE /{account}/{container}/{blobName}?comp=immutabilityPolicies - Delete an unlocked
+//     blob immutability policy
+//   - GET /{account}/{container}?restype=container&comp=list - List blobs
+//   - GET /{account}/{container}?restype=container - Get container properties
+//   - HEAD /{account}/{container}?restype=container - Get container properties
+//   - GET /{account}/{container}?restype=container&comp=metadata - Get container metadata
+//   - GET /{account}/{container}?restype=container&comp=acl - Get container ACL
+//   - GET /{account}/{container}?restype=container&comp=blobs&where={expression} - Find
+//     blobs by tags in a container
+//   - GET /{account}/{container}?restype=container&comp=immutabilityPolicies - Get container
+//     immutability policy
+//   - OPTIONS /{account}[/{container}[/{blobName}]] - CORS preflight request
+//
+// Blob names may contain slashes, so they are matched with a wildcard. GET and
+// HEAD requests without credentials are anonymous and only succeed if the
+// container's public access level allows them. Requests with an Origin header
+// get the Access-Control-* headers of the account's first matching CORS rule.
 func (s *BlobService) RegisterRoutes(router chi.Router) {
+	router.Use(commonHeaders)
+	s.routes = router
+
+	// Account, container and blob names must be valid before they reach the
+	// store, and the change feed container can only be read
+	named := router.With(s.checkResourceNames, s.protectChangeFeed)
+
+	// CORS preflight requests
+	named.Options("/{account}", s.handlePreflight)
+	named.Options("/{account}/{container}", s.handlePreflight)
+	named.Options("/{account}/{container}/*", s.handlePreflight)
+
+	// Cross-origin requests get the headers of the account's matching CORS rule
+	cors := named.With(s.setCorsHeaders)
+
+	// Reads without credentials must be allowed by the container's public access level
+	reads := cors.With(s.checkAnonymousRead)
+
+	// Account operations
+	reads.Get("/{account}", s.handleAccountGet)
+	cors.Put("/{account}", s.handleAccountPut)
+	cors.Post("/{account}", s.handleAccountPost)
+
 	// Container operations
-	router.Put("/{account}/{container}", s.handleCreateContainer)
-	router.Delete("/{account}/{container}", s.handleDeleteContainer)
+	cors.Put("/{account}/{container}", s.handleContainerPut)
+	cors.Post("/{account}/{container}", s.handleContainerPost)
+	cors.Delete("/{account}/{container}", s.handleContainerDelete)
 
 	// Blob operations
-	router.Put("/{account}/{container}/{blobName:*}", s.handlePutBlob)
-	router.Get("/{account}/{container}/{blobName:*}", s.handleGetBlob)
-	router.Delete("/{account}/{container}/{blobName:*}", s.handleDeleteBlob)
+	cors.Put("/{account}/{container}/*", s.handleBlobPut)
+	reads.Get("/{account}/{container}/*", s.handleBlobGet)
+	reads.Head("/{account}/{container}/*", s.handleGetBlobProperties)
+	cors.Delete("/{account}/{container}/*", s.handleBlobDelete)
+
+	reads.Get("/{account}/{container}", s.handleContainerGet)
+	reads.Head("/{account}/{container}", s.handleGetContainerProperties)
+}
+
+// commonHeaders is middleware that sets the response headers Azure includes on every
+// response: a request ID, the service version and the date. The client request ID
+// is echoed back when present.
+func commonHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get("x-ms-version")
+		if version == "" {
+			version = defaultAPIVersion
+		}
+
+		w.Header().Set("x-ms-request-id", newUUID())
+		w.Header().Set("x-ms-version", version)
+		w.Header().Set("Date", formatHTTPDate(time.Now()))
+		if clientID := r.Header.Get("x-ms-client-request-id"); clientID != "" {
+			w.Header().Set("x-ms-client-request-id", clientID)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// blobNameParam returns the unescaped blob name matched by the route wildcard.
+func blobNameParam(r *http.Request) string {
+	name := chi.URLParam(r, "*")
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
+
+// versionWrites are the PUT comps that may address a previous version of a blob.
+var versionWrites = map[string]bool{
+	"tags":                 true,
+	"immutabilityPolicies": true,
+	"legalhold":            true,
+}
+
+// handleBlobPut dispatches PUT requests on a blob based on the comp query parameter.
+// Snapshots and previous versions are read-only, so no PUT may address one; only
+// a version's index tags, immutability policy and legal hold may be set.
+func (s *BlobService) handleBlobPut(w http.ResponseWriter, r *http.Request) {
+	comp := r.URL.Query().Get("comp")
+	for _, param := range []string{"snapshot", "versionid"} {
+		if r.URL.Query().Has(param) && !(param == "versionid" && versionWrites[comp]) {
+			s.writeStoreError(w, errInvalidQueryParameterValue(param), "")
+			return
+		}
+	}
+
+	switch comp {
+	case "":
+		switch blobType := r.Header.Get("x-ms-blob-type"); {
+		case r.Header.Get("x-ms-copy-source") != "" && blobType != "":
+			s.handlePutBlobFromURL(w, r)
+		case r.Header.Get("x-ms-copy-source") != "":
+			s.handleCopyBlob(w, r)
+		case blobType == string(BlobTypeAppend):
+			s.handleCreateAppendBlob(w, r)
+		case blobType == string(BlobTypePage):
+			s.handleCreatePageBlob(w, r)
+		default:
+			s.handlePutBlob(w, r)
+		}
+	case "copy":
+		s.handleAbortCopy(w, r)
+	case "properties":
+		s.handleSetBlobProperties(w, r)
+	case "metadata":
+		s.handleSetBlobMetadata(w, r)
+	case "block":
+		s.handlePutBlock(w, r)
+	case "blocklist":
+		s.handlePutBlockList(w, r)
+	case "appendblock":
+		s.handleAppendBlock(w, r)
+	case "seal":
+		s.handleSealBlob(w, r)
+	case "page":
+		s.handlePutPage(w, r)
+	case "lease":
+		s.handleLeaseBlob(w, r)
+	case "snapshot":
+		s.handleSnapshotBlob(w, r)
+	case "undelete":
+		s.handleUndeleteBlob(w, r)
+	case "tags":
+		s.handleSetBlobTags(w, r)
+	case "tier":
+		s.handleSetBlobTier(w, r)
+	case "immutabilityPolicies":
+		s.handleSetBlobImmutabilityPolicy(w, r)
+	case "legalhold":
+		s.handleSetBlobLegalHold(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleBlobDelete dispatches DELETE requests on a blob based on the comp query parameter.
+func (s *BlobService) handleBlobDelete(w http.ResponseWriter, r *http.Request) {
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "":
+		s.handleDeleteBlob(w, r)
+	case "immutabilityPolicies":
+		s.handleDeleteBlobImmutabilityPolicy(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleBlobGet dispatches GET requests on a blob based on the comp query parameter.
+func (s *BlobService) handleBlobGet(w http.ResponseWriter, r *http.Request) {
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "":
+		s.handleGetBlob(w, r)
+	case "metadata":
+		s.handleGetBlobMetadata(w, r)
+	case "blocklist":
+		s.handleGetBlockList(w, r)
+	case "pagelist":
+		s.handleGetPageRanges(w, r)
+	case "tags":
+		s.handleGetBlobTags(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleAccountGet dispatches GET requests on an account based on the restype and
+// comp query parameters.
+func (s *BlobService) handleAccountGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch comp := query.Get("comp"); {
+	case comp == "properties" && query.Get("restype") == "service":
+		s.handleGetServiceProperties(w, r)
+	case comp == "list":
+		s.handleListContainers(w, r)
+	case comp == "blobs":
+		s.handleFindBlobsByTags(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleAccountPut dispatches PUT requests on an account based on the restype and
+// comp query parameters.
+func (s *BlobService) handleAccountPut(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch comp := query.Get("comp"); {
+	case comp == "properties" && query.Get("restype") == "service":
+		s.handleSetServiceProperties(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleAccountPost dispatches POST requests on an account based on the comp
+// query parameter.
+func (s *BlobService) handleAccountPost(w http.ResponseWriter, r *http.Request) {
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "batch":
+		s.handleBlobBatch(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleContainerPost dispatches POST requests on a container based on the
+// restype and comp query parameters.
+func (s *BlobService) handleContainerPost(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch comp := query.Get("comp"); {
+	case comp == "batch" && query.Get("restype") == "container":
+		s.handleBlobBatch(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
 
-	// List blobs
-	router.Get("/{account}/{container}", s.handleListBlobs)
+// handleContainerPut dispatches PUT requests on a container based on the comp query parameter.
+func (s *BlobService) handleContainerPut(w http.ResponseWriter, r *http.Request) {
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "":
+		s.handleCreateContainer(w, r)
+	case "metadata":
+		s.handleSetContainerMetadata(w, r)
+	case "acl":
+		s.handleSetContainerACL(w, r)
+	case "lease":
+		s.handleLeaseContainer(w, r)
+	case "undelete":
+		s.handleRestoreContainer(w, r)
+	case "immutabilityPolicies":
+		s.handleSetContainerImmutabilityPolicy(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleContainerDelete dispatches DELETE requests on a container based on the
+// comp query parameter.
+func (s *BlobService) handleContainerDelete(w http.ResponseWriter, r *http.Request) {
+	switch comp := r.URL.Query().Get("comp"); comp {
+	case "":
+		s.handleDeleteContainer(w, r)
+	case "immutabilityPolicies":
+		s.handleDeleteContainerImmutabilityPolicy(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
+}
+
+// handleContainerGet dispatches GET requests on a container based on the comp query
+// parameter. A GET without restype or comp lists blobs, as it always has.
+func (s *BlobService) handleContainerGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch comp := query.Get("comp"); {
+	case comp == "list":
+		s.handleListBlobs(w, r)
+	case comp == "" && query.Get("restype") == "container":
+		s.handleGetContainerProperties(w, r)
+	case comp == "metadata":
+		s.handleGetContainerMetadata(w, r)
+	case comp == "acl":
+		s.handleGetContainerACL(w, r)
+	case comp == "blobs":
+		s.handleFindBlobsByTags(w, r)
+	case comp == "immutabilityPolicies":
+		s.handleGetContainerImmutabilityPolicy(w, r)
+	case comp == "":
+		s.handleListBlobs(w, r)
+	default:
+		s.writeInvalidComp(w, comp)
+	}
 }
 
 // handleCreateContainer handles PUT /{account}/{container} to create a container.
@@ -62,31 +412,34 @@ func (s *BlobService) handleCreateContainer(w http.ResponseWriter, r *http.Reque
 	containerName := chi.URLParam(r, "container")
 
 	if account == "" || containerName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account and container name are required")
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account and container name are required")
 		return
 	}
 
-	err := s.store.CreateContainer(r.Context(), account, containerName)
+	access, err := parsePublicAccess(r.Header)
 	if err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			s.writeError(w, http.StatusConflict, "ContainerAlreadyExists", err.Error())
-		} else {
-			s.logger.Error("failed to create container",
-				logging.String("account", account),
-				logging.String("container", containerName),
-				logging.ErrorField(err),
-			)
-			s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to create container")
-		}
+		s.writeStoreError(w, err, "invalid public access level")
 		return
 	}
+	opts := CreateContainerOptions{Metadata: parseMetadata(r.Header), PublicAccess: access}
+
+	if err := s.store.CreateContainer(r.Context(), account, containerName, opts); err != nil {
+		s.writeStoreError(w, err, "failed to create container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+	if container, err := s.store.GetContainer(r.Context(), account, containerName); err == nil {
+		w.Header().Set("ETag", container.ETag)
+		w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	}
 
 	s.logger.Info("container created",
 		logging.String("account", account),
 		logging.String("container", containerName),
 	)
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf("Container %s created successfully", containerName)))
 }
 
 // handleDeleteContainer handles DELETE /{account}/{container} to delete a container.
@@ -95,22 +448,22 @@ func (s *BlobService) handleDeleteContainer(w http.ResponseWriter, r *http.Reque
 	containerName := chi.URLParam(r, "container")
 
 	if account == "" || containerName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account and container name are required")
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account and container name are required")
 		return
 	}
 
-	err := s.store.DeleteContainer(r.Context(), account, containerName)
+	conds, err := parseAccessConditions(r.Header)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			s.writeError(w, http.StatusNotFound, "ContainerNotFound", err.Error())
-		} else {
-			s.logger.Error("failed to delete container",
-				logging.String("account", account),
-				logging.String("container", containerName),
-				logging.ErrorField(err),
-			)
-			s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to delete container")
-		}
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	err = s.store.DeleteContainer(r.Context(), account, containerName, conds)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to delete container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
 		return
 	}
 
@@ -118,216 +471,413 @@ func (s *BlobService) handleDeleteContainer(w http.ResponseWriter, r *http.Reque
 		logging.String("account", account),
 		logging.String("container", containerName),
 	)
-	w.WriteHeader(http.StatusNoContent)
+	w.WriteHeader(http.StatusAccepted)
 }
 
 // handlePutBlob handles PUT /{account}/{container}/{blobName} to upload a blob.
 func (s *BlobService) handlePutBlob(w http.ResponseWriter, r *http.Request) {
 	account := chi.URLParam(r, "account")
 	containerName := chi.URLParam(r, "container")
-	blobName := chi.URLParam(r, "blobName")
+	blobName := blobNameParam(r)
 
 	if account == "" || containerName == "" || blobName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account, container, and blob name are required")
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account, container, and blob name are required")
 		return
 	}
 
-	// Read request body
-	content, err := io.ReadAll(r.Body)
+	if blobType := r.Header.Get("x-ms-blob-type"); blobType != "" && blobType != string(BlobTypeBlock) {
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-blob-type"), "")
+		return
+	}
+	headers, err := parseBlobHTTPHeaders(r.Header, true)
 	if err != nil {
-		s.logger.Error("failed to read request body",
-			logging.ErrorField(err),
-		)
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Failed to read request body")
+		s.writeStoreError(w, err, "invalid blob properties")
 		return
 	}
-	defer r.Body.Close()
-
-	// Get content type from header or default
-	contentType := r.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	tier, err := parseAccessTier(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid access tier")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+	hashes, err := parseContentHashes(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid content hash")
+		return
 	}
 
-	// Extract metadata from headers (Azure uses x-ms-meta-* prefix)
-	metadata := make(map[string]string)
-	for key, values := range r.Header {
-		if strings.HasPrefix(strings.ToLower(key), "x-ms-meta-") {
-			metaKey := strings.TrimPrefix(strings.ToLower(key), "x-ms-meta-")
-			if len(values) > 0 {
-				metadata[metaKey] = values[0]
-			}
-		}
+	// Fail before touching the body, so clients sending Expect: 100-continue
+	// don't upload content that would be thrown away.
+	if !s.checkContainerExists(w, r, account, containerName) {
+		return
 	}
 
-	err = s.store.PutBlob(r.Context(), account, containerName, blobName, content, contentType, metadata)
+	body := &requestBody{ReadCloser: r.Body}
+	checked := newChecksumReader(body, hashes)
+	props, err := s.store.PutBlob(r.Context(), account, containerName, blobName, checked, PutBlobOptions{
+		HTTPHeaders: headers,
+		Metadata:    parseMetadata(r.Header),
+		Tags:        tags,
+		Tier:        tier,
+		Conditions:  conds,
+
+		ImmutabilityPolicy: policy,
+		LegalHold:          legalHold,
+	})
 	if err != nil {
-		s.logger.Error("failed to put blob",
+		if body.err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidInput", "Failed to read request body")
+			return
+		}
+		s.writeStoreError(w, err, "failed to put blob",
 			logging.String("account", account),
 			logging.String("container", containerName),
 			logging.String("blob", blobName),
-			logging.ErrorField(err),
 		)
-		s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to upload blob")
 		return
 	}
 
+	s.recordChange(w, r, eventBlobCreated, "PutBlob", props)
 	s.logger.Info("blob uploaded",
 		logging.String("account", account),
 		logging.String("container", containerName),
 		logging.String("blob", blobName),
-		logging.Int("size", len(content)),
+		logging.Int64("size", props.Size),
 	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	checked.setHeaders(w.Header())
+	if len(props.ContentMD5) > 0 {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(props.ContentMD5))
+	}
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf("Blob %s uploaded successfully", blobName)))
+}
+
+// checkContainerExists writes ContainerNotFound and returns false if the container
+// doesn't exist.
+func (s *BlobService) checkContainerExists(w http.ResponseWriter, r *http.Request, account, containerName string) bool {
+	exists, err := s.store.ContainerExists(r.Context(), account, containerName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to check container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return false
+	}
+	if !exists {
+		s.writeStoreError(w, ErrContainerNotFound, "")
+		return false
+	}
+	return true
+}
+
+// requestBody wraps a request body and remembers the first read error, so a
+// client that disconnects mid-upload can be told apart from a storage failure.
+// net/http has already decoded chunked transfer encoding by the time it is read.
+type requestBody struct {
+	io.ReadCloser
+	err error
+}
+
+// Read implements io.Reader.
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
 }
 
 // handleGetBlob handles GET /{account}/{container}/{blobName} to download a blob.
 func (s *BlobService) handleGetBlob(w http.ResponseWriter, r *http.Request) {
 	account := chi.URLParam(r, "account")
 	containerName := chi.URLParam(r, "container")
-	blobName := chi.URLParam(r, "blobName")
+	blobName := blobNameParam(r)
 
 	if account == "" || containerName == "" || blobName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account, container, and blob name are required")
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account, container, and blob name are required")
 		return
 	}
 
-	blob, err := s.store.GetBlob(r.Context(), account, containerName, blobName)
+	conds, err := parseAccessConditions(r.Header)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			s.writeError(w, http.StatusNotFound, "BlobNotFound", err.Error())
-		} else {
-			s.logger.Error("failed to get blob",
-				logging.String("account", account),
-				logging.String("container", containerName),
-				logging.String("blob", blobName),
-				logging.ErrorField(err),
-			)
-			s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to retrieve blob")
-		}
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "invalid snapshot or version")
 		return
 	}
 
-	// Set response headers
-	w.Header().Set("Content-Type", blob.ContentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
-	w.Header().Set("Last-Modified", blob.ModifiedAt.Format(http.TimeFormat))
+	blob, err := s.store.GetBlob(r.Context(), account, containerName, blobName, GetBlobOptions{Snapshot: snapshot, VersionID: versionID, Conditions: conds})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+	defer blob.Content.Close()
+
+	rng, ranged, err := requestedRange(r.Header, blob.Size)
+	if err == ErrInvalidRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", blob.Size))
+	}
+	if err != nil {
+		s.writeStoreError(w, err, "invalid range")
+		return
+	}
+	if !ranged {
+		rng = byteRange{start: 0, end: blob.Size - 1}
+	}
+
+	// A range MD5 or CRC64 is only available for ranges of up to 4 MiB, and
+	// only one of them may be requested.
+	wantRangeMD5 := strings.EqualFold(r.Header.Get("x-ms-range-get-content-md5"), "true")
+	if wantRangeMD5 && (!ranged || rng.length() > maxRangeMD5Size) {
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-range-get-content-md5"), "invalid range")
+		return
+	}
+	wantRangeCRC64 := strings.EqualFold(r.Header.Get("x-ms-range-get-content-crc64"), "true")
+	if wantRangeCRC64 && (!ranged || rng.length() > maxRangeMD5Size || wantRangeMD5) {
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-range-get-content-crc64"), "invalid range")
+		return
+	}
+
+	setBlobPropertyHeaders(w, blob)
 
-	// Set metadata headers
-	for key, value := range blob.Metadata {
-		w.Header().Set("x-ms-meta-"+key, value)
+	status := http.StatusOK
+	if ranged {
+		// Content-MD5 describes the body, so for a range it is replaced by the
+		// range's hash (if requested) and the blob's hash moves to x-ms-blob-content-md5.
+		h := w.Header()
+		h.Del("Content-MD5")
+		if len(blob.ContentMD5) > 0 {
+			h.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(blob.ContentMD5))
+		}
+		if wantRangeMD5 {
+			md5, err := rangeContentMD5(blob.Content, rng)
+			if err != nil {
+				s.writeStoreError(w, err, "failed to hash blob range",
+					logging.String("account", account),
+					logging.String("container", containerName),
+					logging.String("blob", blobName),
+				)
+				return
+			}
+			h.Set("Content-MD5", md5)
+		}
+		if wantRangeCRC64 {
+			crc, err := rangeContentCRC64(blob.Content, rng)
+			if err != nil {
+				s.writeStoreError(w, err, "failed to hash blob range",
+					logging.String("account", account),
+					logging.String("container", containerName),
+					logging.String("blob", blobName),
+				)
+				return
+			}
+			h.Set(contentCRC64Header, crc)
+		}
+		h.Set("Content-Range", rng.contentRange(blob.Size))
+		h.Set("Content-Length", strconv.FormatInt(rng.length(), 10))
+		status = http.StatusPartialContent
 	}
 
 	s.logger.Info("blob downloaded",
 		logging.String("account", account),
 		logging.String("container", containerName),
 		logging.String("blob", blobName),
-		logging.Int64("size", blob.Size),
+		logging.Int64("size", rng.length()),
 	)
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(blob.Content)
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, io.NewSectionReader(blob.Content, rng.start, rng.length())); err != nil {
+		s.logger.Debug("blob download interrupted",
+			logging.String("blob", blobName),
+			logging.ErrorField(err),
+		)
+	}
 }
 
 // handleDeleteBlob handles DELETE /{account}/{container}/{blobName} to delete a blob.
 func (s *BlobService) handleDeleteBlob(w http.ResponseWriter, r *http.Request) {
 	account := chi.URLParam(r, "account")
 	containerName := chi.URLParam(r, "container")
-	blobName := chi.URLParam(r, "blobName")
+	blobName := blobNameParam(r)
 
 	if account == "" || containerName == "" || blobName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account, container, and blob name are required")
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account, container, and blob name are required")
 		return
 	}
 
-	err := s.store.DeleteBlob(r.Context(), account, containerName, blobName)
+	conds, err := parseAccessConditions(r.Header)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			s.writeError(w, http.StatusNotFound, "BlobNotFound", err.Error())
-		} else {
-			s.logger.Error("failed to delete blob",
-				logging.String("account", account),
-				logging.String("container", containerName),
-				logging.String("blob", blobName),
-				logging.ErrorField(err),
-			)
-			s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to delete blob")
-		}
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "invalid snapshot or version")
+		return
+	}
+	deleteSnapshots, err := parseDeleteSnapshots(r.Header, snapshot == "" && versionID == "")
+	if err != nil {
+		s.writeStoreError(w, err, "invalid delete snapshots option")
+		return
+	}
+
+	// The change feed reports the properties the blob or snapshot had. Deleting
+	// a previous version or only a blob's snapshots isn't reported.
+	var deleted *Blob
+	if s.changeFeed != nil && versionID == "" && deleteSnapshots != DeleteSnapshotsOnly {
+		deleted, _ = s.store.GetBlobProperties(r.Context(), account, containerName, blobName, GetBlobOptions{Snapshot: snapshot})
+	}
+
+	err = s.store.DeleteBlob(r.Context(), account, containerName, blobName, DeleteBlobOptions{
+		Snapshot:        snapshot,
+		VersionID:       versionID,
+		DeleteSnapshots: deleteSnapshots,
+		Conditions:      conds,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to delete blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
 		return
 	}
 
+	if deleted != nil {
+		s.recordChange(w, r, eventBlobDeleted, "DeleteBlob", &deleted.BlobProperties)
+	}
 	s.logger.Info("blob deleted",
 		logging.String("account", account),
 		logging.String("container", containerName),
 		logging.String("blob", blobName),
+		logging.String("snapshot", snapshot),
+		logging.String("versionId", versionID),
 	)
-	w.WriteHeader(http.StatusNoContent)
+	w.WriteHeader(http.StatusAccepted)
 }
 
-// handleListBlobs handles GET /{account}/{container}?list to list blobs in a container.
-func (s *BlobService) handleListBlobs(w http.ResponseWriter, r *http.Request) {
-	account := chi.URLParam(r, "account")
-	containerName := chi.URLParam(r, "container")
+// writeInvalidComp reports an unsupported comp query parameter value.
+func (s *BlobService) writeInvalidComp(w http.ResponseWriter, comp string) {
+	s.writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue",
+		fmt.Sprintf("Value for one of the query parameters specified in the request URI is invalid. comp=%s", comp))
+}
 
-	if account == "" || containerName == "" {
-		s.writeError(w, http.StatusBadRequest, "InvalidRequest", "Account and container name are required")
-		return
+// serviceEndpoint returns the base URL of the account as seen by the client.
+// It is reported in the ServiceEndpoint attribute of enumeration results and
+// includes the prefix the service is mounted under (e.g. /blob).
+func serviceEndpoint(r *http.Request, account string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
 	}
 
-	// Parse query parameters
-	prefix := r.URL.Query().Get("prefix")
-	maxResultsStr := r.URL.Query().Get("maxresults")
-	maxResults := 0
-	if maxResultsStr != "" {
-		if val, err := strconv.Atoi(maxResultsStr); err == nil && val > 0 {
-			maxResults = val
+	prefix := ""
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		path := r.URL.RawPath
+		if path == "" {
+			path = r.URL.Path
 		}
+		prefix = strings.TrimSuffix(path, rctx.RoutePath)
 	}
+	return fmt.Sprintf("%s://%s%s/%s/", scheme, r.Host, prefix, account)
+}
 
-	blobs, err := s.store.ListBlobs(r.Context(), account, containerName, prefix, maxResults)
+// writeXML writes v as an XML response body with the standard XML declaration.
+func (s *BlobService) writeXML(w http.ResponseWriter, statusCode int, v interface{}) {
+	body, err := xml.Marshal(v)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			s.writeError(w, http.StatusNotFound, "ContainerNotFound", err.Error())
-		} else {
-			s.logger.Error("failed to list blobs",
-				logging.String("account", account),
-				logging.String("container", containerName),
-				logging.ErrorField(err),
-			)
-			s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to list blobs")
-		}
-		return
-	}
-
-	result := BlobListResult{
-		Blobs:      blobs,
-		Prefix:     prefix,
-		MaxResults: maxResults,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(result); err != nil {
 		s.logger.Error("failed to encode response",
 			logging.ErrorField(err),
 		)
+		s.writeError(w, http.StatusInternalServerError, "InternalError", "Failed to encode response")
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(statusCode)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
 }
 
-// writeError writes an error response in a consistent format.
-// TODO: Match Azure Blob Storage error response format more closely.
+// writeError writes an error response in Azure's <Error> XML format.
+// The error code is also returned in the x-ms-error-code header, which is what
+// the Azure SDKs use to classify failures.
 func (s *BlobService) writeError(w http.ResponseWriter, statusCode int, code, message string) {
-	w.Header().Set("Content-Type", "application/json")
+	if statusCode == http.StatusNotModified {
+		// A 304 response can't carry a body.
+		w.Header().Set("x-ms-error-code", code)
+		w.WriteHeader(statusCode)
+		return
+	}
+
+	message = fmt.Sprintf("%s\nRequestId:%s\nTime:%s",
+		message,
+		w.Header().Get("x-ms-request-id"),
+		time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	body, _ := xml.Marshal(storageErrorXML{Code: code, Message: message})
+
+	w.Header().Set("x-ms-error-code", code)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]string{
-			"code":    code,
-			"message": message,
-		},
-	})
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// writeStoreError translates an error returned by the store into an HTTP response.
+// StorageErrors are returned to the client as-is; anything else is logged with the
+// given message and fields and reported as an internal error.
+func (s *BlobService) writeStoreError(w http.ResponseWriter, err error, msg string, fields ...logging.Field) {
+	var storageErr *StorageError
+	if errors.As(err, &storageErr) {
+		s.writeError(w, storageErr.StatusCode, storageErr.Code, storageErr.Message)
+		return
+	}
+
+	s.logger.Error(msg, append(fields, logging.ErrorField(err))...)
+	s.writeError(w, http.StatusInternalServerError, "InternalError",
+		"Server encountered an internal error. Please try again after some time.")
+}
+
+// newUUID generates a random version 4 UUID, used for request and lease IDs.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
 // Ensure BlobService implements the Service interface.
 var _ core.Service = (*BlobService)(nil)
-
@@ -1,14 +1,31 @@
 package blob
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 
@@ -47,14 +64,37 @@ func setupTestService(t *testing.T) (*BlobService, BlobStore, func()) {
 	return service, store, cleanup
 }
 
+// newTestRouter mounts the service under /blob, the same way the edge router does.
+// Requests without an Authorization header get one, as they would from an SDK
+// client; tests of anonymous access use newAnonymousTestRouter.
+func newTestRouter(service *BlobService) chi.Router {
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "SharedKey testaccount:c2lnbmF0dXJl")
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	router.Route("/"+service.Name(), service.RegisterRoutes)
+	return router
+}
+
+// newAnonymousTestRouter mounts the service under /blob without adding credentials to requests.
+func newAnonymousTestRouter(service *BlobService) chi.Router {
+	router := chi.NewRouter()
+	router.Route("/"+service.Name(), service.RegisterRoutes)
+	return router
+}
+
 // TestBlobService_CreateContainer tests container creation.
 func TestBlobService_CreateContainer(t *testing.T) {
 	service, store, cleanup := setupTestService(t)
 	defer cleanup()
 
 	// Create router and register routes
-	router := chi.NewRouter()
-	service.RegisterRoutes(router)
+	router := newTestRouter(service)
 
 	// Test creating a container
 	req := httptest.NewRequest("PUT", "/blob/testaccount/testcontainer", nil)
@@ -81,14 +121,13 @@ func TestBlobService_PutGetBlob(t *testing.T) {
 	defer cleanup()
 
 	// Create container first
-	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer")
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
 	if err != nil {
 		t.Fatalf("failed to create container: %v", err)
 	}
 
 	// Create router and register routes
-	router := chi.NewRouter()
-	service.RegisterRoutes(router)
+	router := newTestRouter(service)
 
 	// Test uploading a blob
 	blobContent := []byte("test blob content")
@@ -121,31 +160,30 @@ func TestBlobService_DeleteBlob(t *testing.T) {
 	defer cleanup()
 
 	// Create container and blob
-	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer")
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
 	if err != nil {
 		t.Fatalf("failed to create container: %v", err)
 	}
 
-	err = store.PutBlob(context.Background(), "testaccount", "testcontainer", "testblob.txt", []byte("content"), "text/plain", nil)
+	_, err = store.PutBlob(context.Background(), "testaccount", "testcontainer", "testblob.txt", strings.NewReader("content"), PutBlobOptions{})
 	if err != nil {
 		t.Fatalf("failed to put blob: %v", err)
 	}
 
 	// Create router and register routes
-	router := chi.NewRouter()
-	service.RegisterRoutes(router)
+	router := newTestRouter(service)
 
 	// Test deleting the blob
 	req := httptest.NewRequest("DELETE", "/blob/testaccount/testcontainer/testblob.txt", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
-	if w.Code != http.StatusNoContent {
-		t.Errorf("expected status %d, got %d", http.StatusNoContent, w.Code)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected status %d, got %d", http.StatusAccepted, w.Code)
 	}
 
 	// Verify blob is deleted
-	_, err = store.GetBlob(context.Background(), "testaccount", "testcontainer", "testblob.txt")
+	_, err = store.GetBlob(context.Background(), "testaccount", "testcontainer", "testblob.txt", GetBlobOptions{})
 	if err == nil {
 		t.Error("blob should not exist after deletion")
 	}
@@ -157,25 +195,24 @@ func TestBlobService_ListBlobs(t *testing.T) {
 	defer cleanup()
 
 	// Create container and multiple blobs
-	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer")
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
 	if err != nil {
 		t.Fatalf("failed to create container: %v", err)
 	}
 
 	blobs := []string{"blob1.txt", "blob2.txt", "prefix/blob3.txt"}
 	for _, blobName := range blobs {
-		err = store.PutBlob(context.Background(), "testaccount", "testcontainer", blobName, []byte("content"), "text/plain", nil)
+		_, err = store.PutBlob(context.Background(), "testaccount", "testcontainer", blobName, strings.NewReader("content"), PutBlobOptions{})
 		if err != nil {
 			t.Fatalf("failed to put blob %s: %v", blobName, err)
 		}
 	}
 
 	// Create router and register routes
-	router := chi.NewRouter()
-	service.RegisterRoutes(router)
+	router := newTestRouter(service)
 
 	// Test listing blobs
-	req := httptest.NewRequest("GET", "/blob/testaccount/testcontainer?list", nil)
+	req := httptest.NewRequest("GET", "/blob/testaccount/testcontainer?restype=container&comp=list", nil)
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
@@ -184,15 +221,3093 @@ func TestBlobService_ListBlobs(t *testing.T) {
 	}
 
 	var result BlobListResult
-	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+	if err := xml.NewDecoder(w.Body).Decode(&result); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
 
-	if len(result.Blobs) < len(blobs) {
-		t.Errorf("expected at least %d blobs, got %d", len(blobs), len(result.Blobs))
+	if len(result.Blobs.Blob) < len(blobs) {
+		t.Errorf("expected at least %d blobs, got %d", len(blobs), len(result.Blobs.Blob))
+	}
+	if result.ServiceEndpoint != "http://example.com/blob/testaccount/" {
+		t.Errorf("unexpected service endpoint %q", result.ServiceEndpoint)
+	}
+}
+
+// TestBlobService_ErrorResponse tests that failures are reported as Azure <Error> XML.
+func TestBlobService_ErrorResponse(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	router := newTestRouter(service)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"missing blob", "GET", "/blob/testaccount/testcontainer/missing.txt", http.StatusNotFound, "BlobNotFound"},
+		{"missing container", "DELETE", "/blob/testaccount/missing", http.StatusNotFound, "ContainerNotFound"},
+		{"duplicate container", "PUT", "/blob/testaccount/testcontainer", http.StatusConflict, "ContainerAlreadyExists"},
+		{"put into missing container", "PUT", "/blob/testaccount/missing/a/b.txt", http.StatusNotFound, "ContainerNotFound"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			if got := w.Header().Get("x-ms-error-code"); got != tt.wantCode {
+				t.Errorf("expected x-ms-error-code %q, got %q", tt.wantCode, got)
+			}
+
+			var body storageErrorXML
+			if err := xml.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatalf("failed to decode error body: %v", err)
+			}
+			if body.Code != tt.wantCode {
+				t.Errorf("expected <Code> %q, got %q", tt.wantCode, body.Code)
+			}
+		})
+	}
+}
+
+// TestBlobService_NestedBlobName tests that blob names containing slashes are routed correctly.
+func TestBlobService_NestedBlobName(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	router := newTestRouter(service)
+
+	req := httptest.NewRequest("PUT", "/blob/testaccount/testcontainer/dir/sub/blob.txt", bytes.NewReader([]byte("nested")))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	blob, err := store.GetBlob(context.Background(), "testaccount", "testcontainer", "dir/sub/blob.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get nested blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "nested" {
+		t.Errorf("expected content %q, got %q", "nested", got)
+	}
+}
+
+// TestBlobService_BlobPropertiesAndMetadata tests that HTTP properties and metadata
+// are persisted on upload and can be read and replaced.
+func TestBlobService_BlobPropertiesAndMetadata(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	router := newTestRouter(service)
+	blobURL := "/blob/testaccount/testcontainer/doc.html"
+
+	// Upload with properties and metadata
+	req := httptest.NewRequest("PUT", blobURL, bytes.NewReader([]byte("<html></html>")))
+	req.Header.Set("x-ms-blob-content-type", "text/html")
+	req.Header.Set("x-ms-blob-cache-control", "max-age=60")
+	req.Header.Set("Content-Language", "en-US")
+	req.Header.Set("x-ms-meta-owner", "alice")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	// Get Blob Properties
+	req = httptest.NewRequest("HEAD", blobURL, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	for header, want := range map[string]string{
+		"Content-Type":     "text/html",
+		"Cache-Control":    "max-age=60",
+		"Content-Language": "en-US",
+		"Content-Length":   "13",
+		"x-ms-meta-owner":  "alice",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("expected %s %q, got %q", header, want, got)
+		}
+	}
+
+	// Set Blob Properties clears properties that are not sent
+	req = httptest.NewRequest("PUT", blobURL+"?comp=properties", nil)
+	req.Header.Set("x-ms-blob-content-type", "text/plain")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// Set Blob Metadata replaces all metadata
+	req = httptest.NewRequest("PUT", blobURL+"?comp=metadata", nil)
+	req.Header.Set("x-ms-meta-reviewer", "bob")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	blob, err := store.GetBlobProperties(context.Background(), "testaccount", "testcontainer", "doc.html", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob properties: %v", err)
+	}
+	if blob.ContentType != "text/plain" || blob.CacheControl != "" || blob.ContentLanguage != "" {
+		t.Errorf("unexpected HTTP properties after set: %+v", blob.BlobHTTPHeaders)
+	}
+	if len(blob.Metadata) != 1 || blob.Metadata["reviewer"] != "bob" {
+		t.Errorf("unexpected metadata after set: %v", blob.Metadata)
+	}
+
+	// Get Blob Metadata
+	req = httptest.NewRequest("GET", blobURL+"?comp=metadata", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if got := w.Header().Get("x-ms-meta-reviewer"); got != "bob" {
+		t.Errorf("expected x-ms-meta-reviewer %q, got %q", "bob", got)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty body, got %q", w.Body.String())
+	}
+}
+
+// TestBlobService_BlockBlobUpload tests staging blocks and committing block lists.
+func TestBlobService_BlockBlobUpload(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{})
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	router := newTestRouter(service)
+	blobURL := "/blob/testaccount/testcontainer/big.bin"
+	blockA := base64.StdEncoding.EncodeToString([]byte("block-a"))
+	blockB := base64.StdEncoding.EncodeToString([]byte("block-b"))
+	blockC := base64.StdEncoding.EncodeToString([]byte("block-c"))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	getBlockList := func(listType string) blockListXML {
+		w := do("GET", blobURL+"?comp=blocklist&blocklisttype="+listType, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		var result blockListXML
+		if err := xml.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("failed to decode block list: %v", err)
+		}
+		return result
+	}
+
+	// Stage two blocks and commit them
+	for id, content := range map[string]string{blockA: "Hello, ", blockB: "World"} {
+		if w := do("PUT", blobURL+"?comp=block&blockid="+url.QueryEscape(id), content); w.Code != http.StatusCreated {
+			t.Fatalf("expected status %d staging block, got %d", http.StatusCreated, w.Code)
+		}
+	}
+
+	list := getBlockList("uncommitted")
+	if list.UncommittedBlocks == nil || len(list.UncommittedBlocks.Block) != 2 || list.CommittedBlocks != nil {
+		t.Fatalf("unexpected uncommitted block list: %+v", list)
+	}
+
+	body := "<BlockList><Latest>" + blockA + "</Latest><Latest>" + blockB + "</Latest></BlockList>"
+	w := do("PUT", blobURL+"?comp=blocklist", body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d committing, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	blob, err := store.GetBlob(context.Background(), "testaccount", "testcontainer", "big.bin", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "Hello, World" {
+		t.Errorf("expected content %q, got %q", "Hello, World", got)
+	}
+
+	// Replace the first block, keeping the committed second block
+	do("PUT", blobURL+"?comp=block&blockid="+url.QueryEscape(blockC), "Goodbye, ")
+	body = "<BlockList><Uncommitted>" + blockC + "</Uncommitted><Committed>" + blockB + "</Committed></BlockList>"
+	if w := do("PUT", blobURL+"?comp=blocklist", body); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d committing, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	blob, err = store.GetBlob(context.Background(), "testaccount", "testcontainer", "big.bin", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "Goodbye, World" {
+		t.Errorf("expected content %q, got %q", "Goodbye, World", got)
+	}
+
+	list = getBlockList("all")
+	if list.CommittedBlocks == nil || len(list.CommittedBlocks.Block) != 2 {
+		t.Fatalf("unexpected committed block list: %+v", list)
+	}
+	if list.CommittedBlocks.Block[0].Name != blockC || list.CommittedBlocks.Block[0].Size != 9 {
+		t.Errorf("unexpected first committed block: %+v", list.CommittedBlocks.Block[0])
+	}
+	if list.UncommittedBlocks == nil || len(list.UncommittedBlocks.Block) != 0 {
+		t.Errorf("expected uncommitted blocks to be discarded, got %+v", list.UncommittedBlocks)
+	}
+
+	// Blocks that were dropped from the committed list can no longer be used
+	body = "<BlockList><Committed>" + blockA + "</Committed></BlockList>"
+	w = do("PUT", blobURL+"?comp=blocklist", body)
+	if w.Code != http.StatusBadRequest || w.Header().Get("x-ms-error-code") != "InvalidBlockList" {
+		t.Errorf("expected InvalidBlockList, got %d %q", w.Code, w.Header().Get("x-ms-error-code"))
+	}
+
+	// Invalid block IDs are rejected
+	w = do("PUT", blobURL+"?comp=block&blockid=not-base64!", "x")
+	if w.Header().Get("x-ms-error-code") != "InvalidBlockId" {
+		t.Errorf("expected InvalidBlockId, got %d %q", w.Code, w.Header().Get("x-ms-error-code"))
 	}
 }
 
+// TestBlobService_RangeReads tests Range and x-ms-range handling on Get Blob.
+func TestBlobService_RangeReads(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const content = "Hello, World"
+	blobMD5 := md5.Sum([]byte(content))
+	req := httptest.NewRequest("PUT", "/blob/testaccount/testcontainer/range.txt", strings.NewReader(content))
+	req.Header.Set("x-ms-blob-content-md5", base64.StdEncoding.EncodeToString(blobMD5[:]))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantBody   string
+		wantRange  string
+		wantCode   string
+	}{
+		{"full", nil, http.StatusOK, content, "", ""},
+		{"bounded", map[string]string{"Range": "bytes=0-4"}, http.StatusPartialContent, "Hello", "bytes 0-4/12", ""},
+		{"open ended", map[string]string{"Range": "bytes=7-"}, http.StatusPartialContent, "World", "bytes 7-11/12", ""},
+		{"suffix", map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, "World", "bytes 7-11/12", ""},
+		{"clamped", map[string]string{"Range": "bytes=7-100"}, http.StatusPartialContent, "World", "bytes 7-11/12", ""},
+		{"x-ms-range wins", map[string]string{"Range": "bytes=0-4", "x-ms-range": "bytes=5-6"}, http.StatusPartialContent, ", ", "bytes 5-6/12", ""},
+		{"unsatisfiable", map[string]string{"x-ms-range": "bytes=12-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */12", "InvalidRange"},
+		{"multiple ranges", map[string]string{"Range": "bytes=0-1,4-5"}, http.StatusBadRequest, "", "", "InvalidHeaderValue"},
+		{"malformed", map[string]string{"x-ms-range": "bytes=5-1"}, http.StatusBadRequest, "", "", "InvalidHeaderValue"},
+		{"md5 without range", map[string]string{"x-ms-range-get-content-md5": "true"}, http.StatusBadRequest, "", "", "InvalidHeaderValue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/blob/testaccount/testcontainer/range.txt", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("x-ms-error-code"); got != tt.wantCode {
+				t.Errorf("expected error code %q, got %q", tt.wantCode, got)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.wantRange, got)
+			}
+			if tt.wantCode == "" && w.Body.String() != tt.wantBody {
+				t.Errorf("expected body %q, got %q", tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	// A range can carry its own MD5; the blob's moves to x-ms-blob-content-md5
+	req = httptest.NewRequest("GET", "/blob/testaccount/testcontainer/range.txt", nil)
+	req.Header.Set("x-ms-range", "bytes=0-4")
+	req.Header.Set("x-ms-range-get-content-md5", "true")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	rangeMD5 := md5.Sum([]byte("Hello"))
+	if got := w.Header().Get("Content-MD5"); got != base64.StdEncoding.EncodeToString(rangeMD5[:]) {
+		t.Errorf("unexpected range Content-MD5 %q", got)
+	}
+	if got := w.Header().Get("x-ms-blob-content-md5"); got != base64.StdEncoding.EncodeToString(blobMD5[:]) {
+		t.Errorf("unexpected x-ms-blob-content-md5 %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "5" {
+		t.Errorf("expected Content-Length 5, got %q", got)
+	}
+}
+
+// TestBlobService_ContainerProperties tests HEAD and GET with restype=container.
+func TestBlobService_ContainerProperties(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	for _, method := range []string{"HEAD", "GET"} {
+		req := httptest.NewRequest(method, "/blob/testaccount/testcontainer?restype=container", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", method, http.StatusOK, w.Code)
+		}
+		if w.Header().Get("Last-Modified") == "" || w.Header().Get("x-ms-lease-state") != "available" {
+			t.Errorf("%s: missing container properties: %v", method, w.Header())
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: expected empty body, got %q", method, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest("HEAD", "/blob/testaccount/missing?restype=container", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound || w.Header().Get("x-ms-error-code") != "ContainerNotFound" {
+		t.Errorf("expected ContainerNotFound, got %d %q", w.Code, w.Header().Get("x-ms-error-code"))
+	}
+}
+
+// TestBlobService_ConditionalRequests tests ETags and the If-* request headers.
+func TestBlobService_ConditionalRequests(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/cond.txt"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	// Create-only upload
+	w := do("PUT", blobURL, "v1", map[string]string{"If-None-Match": "*"})
+	expect(w, http.StatusCreated, "")
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"0x`) {
+		t.Fatalf("expected a quoted ETag, got %q", etag)
+	}
+	expect(do("PUT", blobURL, "v2", map[string]string{"If-None-Match": "*"}), http.StatusConflict, "BlobAlreadyExists")
+
+	// Reads
+	w = do("GET", blobURL, "", map[string]string{"If-None-Match": etag})
+	expect(w, http.StatusNotModified, "ConditionNotMet")
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty 304 body, got %q", w.Body.String())
+	}
+	expect(do("HEAD", blobURL, "", map[string]string{"If-Match": `"0x1"`}), http.StatusPreconditionFailed, "ConditionNotMet")
+	w = do("GET", blobURL, "", map[string]string{"If-Match": etag})
+	expect(w, http.StatusOK, "")
+	if w.Header().Get("ETag") != etag || w.Body.String() != "v1" {
+		t.Errorf("unexpected response: ETag %q body %q", w.Header().Get("ETag"), w.Body.String())
+	}
+	future := formatHTTPDate(time.Now().Add(time.Hour))
+	past := formatHTTPDate(time.Now().Add(-time.Hour))
+	expect(do("GET", blobURL, "", map[string]string{"If-Modified-Since": future}), http.StatusNotModified, "ConditionNotMet")
+	expect(do("GET", blobURL, "", map[string]string{"If-Modified-Since": past}), http.StatusOK, "")
+	expect(do("GET", blobURL, "", map[string]string{"If-Modified-Since": "yesterday"}), http.StatusBadRequest, "InvalidHeaderValue")
+
+	// Read-modify-write: every mutation changes the ETag
+	w = do("PUT", blobURL+"?comp=metadata", "", map[string]string{"If-Match": etag, "x-ms-meta-k": "v"})
+	expect(w, http.StatusOK, "")
+	updatedETag := w.Header().Get("ETag")
+	if updatedETag == "" || updatedETag == etag {
+		t.Fatalf("expected a new ETag, got %q", updatedETag)
+	}
+	expect(do("PUT", blobURL, "v2", map[string]string{"If-Match": etag}), http.StatusPreconditionFailed, "ConditionNotMet")
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"If-Match": etag}), http.StatusPreconditionFailed, "ConditionNotMet")
+	expect(do("PUT", blobURL, "v2", map[string]string{"If-Match": updatedETag}), http.StatusCreated, "")
+	expect(do("PUT", "/blob/testaccount/testcontainer/missing.txt", "x", map[string]string{"If-Match": "*"}), http.StatusPreconditionFailed, "ConditionNotMet")
+
+	// Deletes
+	expect(do("DELETE", blobURL, "", map[string]string{"If-Unmodified-Since": past}), http.StatusPreconditionFailed, "ConditionNotMet")
+	expect(do("DELETE", blobURL, "", map[string]string{"If-Unmodified-Since": future}), http.StatusAccepted, "")
+	expect(do("DELETE", "/blob/testaccount/testcontainer", "", map[string]string{"If-Modified-Since": future}), http.StatusPreconditionFailed, "ConditionNotMet")
+
+	w = do("HEAD", "/blob/testaccount/testcontainer?restype=container", "", nil)
+	if w.Header().Get("ETag") == "" {
+		t.Error("expected container ETag")
+	}
+}
+
+// TestBlobService_Leases tests blob and container leases over HTTP.
+func TestBlobService_Leases(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/lock"
+	const leaseID = "3c8b1a8e-5f5e-4c1a-9a4e-2f0d8c7b6a51"
+	do := func(method, url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader("data"))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	expect(do("PUT", blobURL, nil), http.StatusCreated, "")
+
+	// Acquire
+	expect(do("PUT", blobURL+"?comp=lease", map[string]string{"x-ms-lease-action": "acquire", "x-ms-lease-duration": "10"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL+"?comp=lease", map[string]string{"x-ms-lease-action": "acquire"}), http.StatusBadRequest, "MissingRequiredHeader")
+	w := do("PUT", blobURL+"?comp=lease", map[string]string{
+		"x-ms-lease-action":      "acquire",
+		"x-ms-lease-duration":    "15",
+		"x-ms-proposed-lease-id": leaseID,
+	})
+	expect(w, http.StatusCreated, "")
+	if w.Header().Get("x-ms-lease-id") != leaseID {
+		t.Errorf("expected lease ID %q, got %q", leaseID, w.Header().Get("x-ms-lease-id"))
+	}
+	expect(do("PUT", blobURL+"?comp=lease", map[string]string{"x-ms-lease-action": "acquire", "x-ms-lease-duration": "-1"}), http.StatusConflict, "LeaseAlreadyPresent")
+
+	w = do("HEAD", blobURL, nil)
+	if w.Header().Get("x-ms-lease-status") != "locked" || w.Header().Get("x-ms-lease-state") != "leased" || w.Header().Get("x-ms-lease-duration") != "fixed" {
+		t.Errorf("unexpected lease headers: %v", w.Header())
+	}
+
+	// Writes need the lease ID
+	expect(do("PUT", blobURL, nil), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expect(do("PUT", blobURL, map[string]string{"x-ms-lease-id": "00000000-0000-0000-0000-000000000000"}), http.StatusPreconditionFailed, "LeaseIdMismatchWithBlobOperation")
+	expect(do("PUT", blobURL+"?comp=metadata", nil), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expect(do("PUT", blobURL+"?comp=block&blockid=YWFh", nil), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expect(do("DELETE", blobURL, nil), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expect(do("PUT", blobURL, map[string]string{"x-ms-lease-id": leaseID}), http.StatusCreated, "")
+	expect(do("GET", blobURL, nil), http.StatusOK, "")
+	expect(do("PUT", "/blob/testaccount/testcontainer/other", map[string]string{"x-ms-lease-id": leaseID}), http.StatusPreconditionFailed, "LeaseNotPresentWithBlobOperation")
+
+	// The lease survives the overwrite and shows up in listings
+	w = do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list", nil)
+	var result BlobListResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode list response: %v", err)
+	}
+	if props := result.Blobs.Blob[0].Properties; props.LeaseState != "leased" || props.LeaseStatus != "locked" || props.LeaseDuration != "fixed" {
+		t.Errorf("unexpected listed lease: %+v", props)
+	}
+
+	// Break
+	w = do("PUT", blobURL+"?comp=lease", map[string]string{"x-ms-lease-action": "break", "x-ms-lease-break-period": "0"})
+	expect(w, http.StatusAccepted, "")
+	if w.Header().Get("x-ms-lease-time") != "0" {
+		t.Errorf("expected x-ms-lease-time 0, got %q", w.Header().Get("x-ms-lease-time"))
+	}
+	if w := do("HEAD", blobURL, nil); w.Header().Get("x-ms-lease-state") != "broken" {
+		t.Errorf("expected broken lease, got %q", w.Header().Get("x-ms-lease-state"))
+	}
+	expect(do("PUT", blobURL, nil), http.StatusCreated, "")
+
+	// Container leases protect deletes
+	const containerURL = "/blob/testaccount/testcontainer?restype=container"
+	w = do("PUT", containerURL+"&comp=lease", map[string]string{"x-ms-lease-action": "acquire", "x-ms-lease-duration": "-1"})
+	expect(w, http.StatusCreated, "")
+	containerLease := w.Header().Get("x-ms-lease-id")
+	if !isUUID(containerLease) {
+		t.Errorf("expected a generated lease ID, got %q", containerLease)
+	}
+	if w := do("HEAD", containerURL, nil); w.Header().Get("x-ms-lease-duration") != "infinite" {
+		t.Errorf("expected infinite container lease, got %q", w.Header().Get("x-ms-lease-duration"))
+	}
+	expect(do("DELETE", containerURL, nil), http.StatusPreconditionFailed, "LeaseIdMissing")
+	expect(do("PUT", containerURL+"&comp=lease", map[string]string{"x-ms-lease-action": "release", "x-ms-lease-id": leaseID}), http.StatusConflict, "LeaseIdMismatchWithLeaseOperation")
+	expect(do("DELETE", containerURL, map[string]string{"x-ms-lease-id": containerLease}), http.StatusAccepted, "")
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// TestBlobService_StreamingUpload tests chunked uploads with Expect: 100-continue
+// over a real connection, and that downloads stream the stored content back.
+func TestBlobService_StreamingUpload(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	server := httptest.NewServer(newTestRouter(service))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	const size = 4<<20 + 123
+	pattern := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	want := sha256.Sum256(pattern)
+
+	put := func(path string, body io.Reader) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("PUT", server.URL+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := put("/blob/testaccount/testcontainer/large.bin", struct{ io.Reader }{bytes.NewReader(pattern)})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	resp, err := client.Get(server.URL + "/blob/testaccount/testcontainer/large.bin")
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size {
+		t.Fatalf("expected 200 with %d bytes, got %d with %d", size, resp.StatusCode, resp.ContentLength)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		t.Fatalf("failed to read download: %v", err)
+	}
+	if !bytes.Equal(hash.Sum(nil), want[:]) {
+		t.Error("downloaded content doesn't match upload")
+	}
+
+	// A request that fails up front is answered without the body being sent
+	body := &countingReader{r: bytes.NewReader(pattern)}
+	resp = put("/blob/testaccount/missing/large.bin", body)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("x-ms-error-code") != "ContainerNotFound" {
+		t.Errorf("expected ContainerNotFound, got %d %q", resp.StatusCode, resp.Header.Get("x-ms-error-code"))
+	}
+	if body.n != 0 {
+		t.Errorf("expected body not to be sent, %d bytes were read", body.n)
+	}
+}
+
+// TestBlobService_Snapshots tests creating, reading, listing and deleting blob snapshots.
+func TestBlobService_Snapshots(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/report.txt"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	w := do("PUT", blobURL, "v1", map[string]string{"x-ms-meta-stage": "draft"})
+	expect(w, http.StatusCreated, "")
+	etag := w.Header().Get("ETag")
+
+	w = do("PUT", blobURL+"?comp=snapshot", "", nil)
+	expect(w, http.StatusCreated, "")
+	first := w.Header().Get("x-ms-snapshot")
+	if _, err := time.Parse(time.RFC3339Nano, first); err != nil {
+		t.Fatalf("expected a snapshot timestamp, got %q", first)
+	}
+	if w.Header().Get("ETag") != etag {
+		t.Errorf("expected the blob's ETag %s, got %s", etag, w.Header().Get("ETag"))
+	}
+	w = do("PUT", blobURL+"?comp=snapshot", "", map[string]string{"x-ms-meta-stage": "final"})
+	expect(w, http.StatusCreated, "")
+	second := w.Header().Get("x-ms-snapshot")
+	if second <= first {
+		t.Errorf("expected snapshot %q to sort after %q", second, first)
+	}
+
+	// Snapshots keep the content they were taken with and are read-only
+	expect(do("PUT", blobURL, "v2", nil), http.StatusCreated, "")
+	w = do("GET", blobURL+"?snapshot="+url.QueryEscape(first), "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Body.String() != "v1" || w.Header().Get("x-ms-meta-stage") != "draft" {
+		t.Errorf("unexpected first snapshot: %q %v", w.Body.String(), w.Header())
+	}
+	if w := do("HEAD", blobURL+"?snapshot="+url.QueryEscape(second), "", nil); w.Header().Get("x-ms-meta-stage") != "final" {
+		t.Errorf("expected snapshot metadata from the request, got %q", w.Header().Get("x-ms-meta-stage"))
+	}
+	if w := do("GET", blobURL, "", nil); w.Body.String() != "v2" {
+		t.Errorf("expected base blob %q, got %q", "v2", w.Body.String())
+	}
+	expect(do("PUT", blobURL+"?comp=metadata&snapshot="+url.QueryEscape(first), "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+	expect(do("GET", blobURL+"?snapshot=yesterday", "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+	expect(do("GET", blobURL+"?snapshot=2001-01-01T00:00:00.0000000Z", "", nil), http.StatusNotFound, "BlobNotFound")
+
+	// Listing
+	list := func(query string) []blobItemXML {
+		t.Helper()
+		w := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list"+query, "", nil)
+		expect(w, http.StatusOK, "")
+		var result BlobListResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode list response: %v", err)
+		}
+		return result.Blobs.Blob
+	}
+	if items := list(""); len(items) != 1 || items[0].Snapshot != "" {
+		t.Errorf("expected only the base blob, got %+v", items)
+	}
+	items := list("&include=snapshots,metadata")
+	if len(items) != 3 || items[0].Snapshot != first || items[1].Snapshot != second || items[2].Snapshot != "" {
+		t.Errorf("expected snapshots oldest first, then the base blob, got %+v", items)
+	}
+	expect(do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list&include=everything", "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+
+	// Deletes
+	expect(do("DELETE", blobURL, "", nil), http.StatusConflict, "SnapshotsPresent")
+	expect(do("DELETE", blobURL, "", map[string]string{"x-ms-delete-snapshots": "some"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("DELETE", blobURL+"?snapshot="+url.QueryEscape(first), "", map[string]string{"x-ms-delete-snapshots": "only"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("DELETE", blobURL+"?snapshot="+url.QueryEscape(first), "", nil), http.StatusAccepted, "")
+	expect(do("GET", blobURL+"?snapshot="+url.QueryEscape(first), "", nil), http.StatusNotFound, "BlobNotFound")
+	expect(do("DELETE", blobURL, "", map[string]string{"x-ms-delete-snapshots": "only"}), http.StatusAccepted, "")
+	if items := list("&include=snapshots"); len(items) != 1 {
+		t.Errorf("expected only the base blob after deleting snapshots, got %+v", items)
+	}
+	expect(do("PUT", blobURL+"?comp=snapshot", "", nil), http.StatusCreated, "")
+	expect(do("DELETE", blobURL, "", map[string]string{"x-ms-delete-snapshots": "include"}), http.StatusAccepted, "")
+	if items := list("&include=snapshots"); len(items) != 0 {
+		t.Errorf("expected no blobs, got %+v", items)
+	}
+}
+
+func TestBlobService_Versioning(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/doc.txt"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	// A blob written before versioning is enabled has no version ID
+	w := do("PUT", blobURL, "v0", nil)
+	expect(w, http.StatusCreated, "")
+	if id := w.Header().Get("x-ms-version-id"); id != "" {
+		t.Errorf("expected no version ID while versioning is disabled, got %q", id)
+	}
+
+	const enable = "<StorageServiceProperties><IsVersioningEnabled>true</IsVersioningEnabled></StorageServiceProperties>"
+	expect(do("PUT", "/blob/testaccount?restype=service&comp=properties", enable, nil), http.StatusAccepted, "")
+	expect(do("PUT", "/blob/testaccount?restype=service&comp=properties", "<StorageServiceProperties>", nil), http.StatusBadRequest, "InvalidXmlDocument")
+	w = do("GET", "/blob/testaccount?restype=service&comp=properties", "", nil)
+	expect(w, http.StatusOK, "")
+	if !strings.Contains(w.Body.String(), "<IsVersioningEnabled>true</IsVersioningEnabled>") {
+		t.Errorf("expected versioning to be enabled, got %s", w.Body.String())
+	}
+	expect(do("GET", "/blob/testaccount?comp=stats&restype=service", "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+
+	w = do("PUT", blobURL, "v1", nil)
+	expect(w, http.StatusCreated, "")
+	v1 := w.Header().Get("x-ms-version-id")
+	if _, err := time.Parse(time.RFC3339Nano, v1); err != nil {
+		t.Fatalf("expected a version ID, got %q", v1)
+	}
+	w = do("PUT", blobURL+"?comp=metadata", "", map[string]string{"x-ms-meta-stage": "final"})
+	expect(w, http.StatusOK, "")
+	v2 := w.Header().Get("x-ms-version-id")
+	if v2 <= v1 {
+		t.Errorf("expected version %q to sort after %q", v2, v1)
+	}
+
+	w = do("HEAD", blobURL, "", nil)
+	if w.Header().Get("x-ms-version-id") != v2 || w.Header().Get("x-ms-is-current-version") != "true" {
+		t.Errorf("expected current version %s, got %v", v2, w.Header())
+	}
+	w = do("GET", blobURL+"?versionid="+url.QueryEscape(v1), "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Body.String() != "v1" || w.Header().Get("x-ms-meta-stage") != "" {
+		t.Errorf("unexpected version %s: %q %v", v1, w.Body.String(), w.Header())
+	}
+	expect(do("GET", blobURL+"?versionid=2001-01-01T00:00:00.0000000Z", "", nil), http.StatusNotFound, "BlobNotFound")
+	expect(do("GET", blobURL+"?versionid="+url.QueryEscape(v1)+"&snapshot="+url.QueryEscape(v1), "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+
+	list := func(query string) []blobItemXML {
+		t.Helper()
+		w := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list"+query, "", nil)
+		expect(w, http.StatusOK, "")
+		var result BlobListResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode list response: %v", err)
+		}
+		return result.Blobs.Blob
+	}
+	items := list("&include=versions")
+	if len(items) != 3 || items[1].VersionID != v1 || items[2].VersionID != v2 || !items[2].IsCurrentVersion || items[1].IsCurrentVersion {
+		t.Errorf("expected the pre-versioning blob, %s and current %s, got %+v", v1, v2, items)
+	}
+	if items := list(""); len(items) != 1 || items[0].VersionID != v2 {
+		t.Errorf("expected only the current version, got %+v", items)
+	}
+
+	// Deleting the blob keeps its versions, and copying one back promotes it
+	expect(do("DELETE", blobURL, "", nil), http.StatusAccepted, "")
+	expect(do("GET", blobURL, "", nil), http.StatusNotFound, "BlobNotFound")
+	if items := list("&include=versions"); len(items) != 3 {
+		t.Errorf("expected 3 previous versions, got %+v", items)
+	}
+	source := "http://example.com/blob/testaccount/testcontainer/doc.txt?versionid=" + url.QueryEscape(v1)
+	w = do("PUT", blobURL, "", map[string]string{"x-ms-copy-source": source})
+	expect(w, http.StatusAccepted, "")
+	if w.Header().Get("x-ms-copy-status") != "success" || w.Header().Get("x-ms-version-id") == "" {
+		t.Errorf("unexpected copy response: %v", w.Header())
+	}
+	if w := do("GET", blobURL, "", nil); w.Body.String() != "v1" {
+		t.Errorf("expected promoted content %q, got %q", "v1", w.Body.String())
+	}
+
+	expect(do("PUT", blobURL, "", map[string]string{"x-ms-copy-source": "http://example.com/blob/testaccount/testcontainer/missing.txt"}), http.StatusNotFound, "CannotVerifyCopySource")
+	expect(do("PUT", blobURL, "", map[string]string{"x-ms-copy-source": "not a url"}), http.StatusBadRequest, "InvalidHeaderValue")
+
+	// Previous versions can be deleted individually
+	expect(do("DELETE", blobURL+"?versionid="+url.QueryEscape(v1), "", nil), http.StatusAccepted, "")
+	expect(do("GET", blobURL+"?versionid="+url.QueryEscape(v1), "", nil), http.StatusNotFound, "BlobNotFound")
+}
+
+func TestBlobService_SoftDelete(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/notes.txt"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	list := func(query string) []blobItemXML {
+		t.Helper()
+		w := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list"+query, "", nil)
+		expect(w, http.StatusOK, "")
+		var result BlobListResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode list response: %v", err)
+		}
+		return result.Blobs.Blob
+	}
+
+	const propsURL = "/blob/testaccount?restype=service&comp=properties"
+	expect(do("PUT", propsURL, "<StorageServiceProperties><DeleteRetentionPolicy><Enabled>true</Enabled><Days>0</Days></DeleteRetentionPolicy></StorageServiceProperties>", nil),
+		http.StatusBadRequest, "InvalidXmlNodeValue")
+	expect(do("PUT", propsURL, "<StorageServiceProperties><DeleteRetentionPolicy><Enabled>true</Enabled><Days>7</Days></DeleteRetentionPolicy></StorageServiceProperties>", nil),
+		http.StatusAccepted, "")
+	w := do("GET", propsURL, "", nil)
+	if !strings.Contains(w.Body.String(), "<DeleteRetentionPolicy><Enabled>true</Enabled><Days>7</Days></DeleteRetentionPolicy>") {
+		t.Errorf("expected a 7 day retention policy, got %s", w.Body.String())
+	}
+
+	// A deleted blob is listed with include=deleted until it is undeleted
+	expect(do("PUT", blobURL, "v1", map[string]string{"x-ms-meta-owner": "ops"}), http.StatusCreated, "")
+	expect(do("DELETE", blobURL, "", nil), http.StatusAccepted, "")
+	expect(do("GET", blobURL, "", nil), http.StatusNotFound, "BlobNotFound")
+	if items := list(""); len(items) != 0 {
+		t.Errorf("expected no live blobs, got %+v", items)
+	}
+	items := list("&include=deleted")
+	if len(items) != 1 || !items[0].Deleted || items[0].Properties.RemainingRetentionDays != 7 || items[0].Properties.DeletedTime == "" {
+		t.Errorf("expected a soft-deleted blob with 7 days left, got %+v", items)
+	}
+	expect(do("PUT", blobURL+"?comp=undelete", "", nil), http.StatusOK, "")
+	w = do("GET", blobURL, "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Body.String() != "v1" || w.Header().Get("x-ms-meta-owner") != "ops" {
+		t.Errorf("expected the undeleted blob, got %q %v", w.Body.String(), w.Header())
+	}
+	expect(do("PUT", "/blob/testaccount/testcontainer/never.txt?comp=undelete", "", nil), http.StatusNotFound, "BlobNotFound")
+
+	// Overwrites keep the previous content as a soft-deleted snapshot
+	expect(do("PUT", blobURL, "v2", nil), http.StatusCreated, "")
+	items = list("&include=snapshots")
+	if len(items) != 1 {
+		t.Errorf("expected soft-deleted snapshots to be hidden, got %+v", items)
+	}
+	items = list("&include=snapshots,deleted")
+	if len(items) != 2 || items[0].Snapshot == "" || !items[0].Deleted {
+		t.Fatalf("expected a soft-deleted snapshot and the blob, got %+v", items)
+	}
+	snapshotURL := blobURL + "?snapshot=" + url.QueryEscape(items[0].Snapshot)
+	expect(do("GET", snapshotURL, "", nil), http.StatusNotFound, "BlobNotFound")
+	expect(do("PUT", blobURL+"?comp=undelete", "", nil), http.StatusOK, "")
+	if w := do("GET", snapshotURL, "", nil); w.Code != http.StatusOK || w.Body.String() != "v1" {
+		t.Errorf("expected the restored snapshot, got %d %q", w.Code, w.Body.String())
+	}
+	blockID := base64.StdEncoding.EncodeToString([]byte("block-1"))
+	expect(do("PUT", blobURL+"?comp=block&blockid="+url.QueryEscape(blockID), "v3", nil), http.StatusCreated, "")
+	expect(do("PUT", blobURL+"?comp=blocklist", "<BlockList><Latest>"+blockID+"</Latest></BlockList>", nil), http.StatusCreated, "")
+	if items := list("&include=snapshots,deleted"); len(items) != 3 || !items[1].Deleted {
+		t.Errorf("expected a block list commit to keep a soft-deleted snapshot, got %+v", items)
+	}
+
+	// Containers
+	expect(do("PUT", "/blob/testaccount/testcontainer?restype=container&comp=undelete", "", nil), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(do("PUT", "/blob/testaccount/restored?restype=container&comp=undelete", "", map[string]string{
+		"x-ms-deleted-container-name":    "testcontainer",
+		"x-ms-deleted-container-version": "0000000000000000",
+	}), http.StatusNotFound, "ContainerNotFound")
+	expect(do("PUT", "/blob/testaccount/testcontainer?restype=container&comp=undelete", "", map[string]string{
+		"x-ms-deleted-container-name":    "testcontainer",
+		"x-ms-deleted-container-version": "0000000000000000",
+	}), http.StatusConflict, "ContainerAlreadyExists")
+}
+
+func TestBlobService_CopyFromURL(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	// A stub HTTP server stands in for a copy source outside the emulator
+	release := make(chan struct{})
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("x-ms-meta-origin", "stub")
+			w.Write([]byte("hello from stub"))
+		case "/slow.bin":
+			w.Header().Set("Content-Length", "8")
+			w.Write([]byte("half"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+	defer close(release)
+
+	const blobURL = "/blob/testaccount/testcontainer/copied.txt"
+	do := func(method, url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	// waitForCopy polls Get Blob Properties until the copy is no longer pending.
+	waitForCopy := func() *httptest.ResponseRecorder {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			w := do("HEAD", blobURL, nil)
+			if w.Header().Get("x-ms-copy-status") != "pending" || time.Now().After(deadline) {
+				return w
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Copies of URLs run in the background and copy the source's properties and metadata
+	w := do("PUT", blobURL, map[string]string{"x-ms-copy-source": stub.URL + "/data.txt"})
+	expect(w, http.StatusAccepted, "")
+	copyID := w.Header().Get("x-ms-copy-id")
+	if copyID == "" || w.Header().Get("x-ms-copy-status") != "pending" {
+		t.Fatalf("expected a pending copy, got %v", w.Header())
+	}
+	w = waitForCopy()
+	if w.Header().Get("x-ms-copy-status") != "success" || w.Header().Get("x-ms-copy-id") != copyID ||
+		w.Header().Get("x-ms-copy-progress") != "15/15" || w.Header().Get("x-ms-copy-source") != stub.URL+"/data.txt" ||
+		w.Header().Get("x-ms-copy-completion-time") == "" {
+		t.Errorf("unexpected copy properties: %v", w.Header())
+	}
+	w = do("GET", blobURL, nil)
+	if w.Body.String() != "hello from stub" || w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("x-ms-meta-origin") != "stub" {
+		t.Errorf("unexpected copied blob: %q %v", w.Body.String(), w.Header())
+	}
+
+	// The copy properties are listed with include=copy
+	w = do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list&include=copy", nil)
+	if !strings.Contains(w.Body.String(), "<CopyId>"+copyID+"</CopyId>") || !strings.Contains(w.Body.String(), "<CopyStatus>success</CopyStatus>") {
+		t.Errorf("expected copy properties in the listing, got %s", w.Body.String())
+	}
+	w = do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list", nil)
+	if strings.Contains(w.Body.String(), "<CopyId>") {
+		t.Errorf("expected no copy properties without include=copy, got %s", w.Body.String())
+	}
+
+	// Unreadable sources fail the request
+	expect(do("PUT", blobURL, map[string]string{"x-ms-copy-source": stub.URL + "/missing.txt"}), http.StatusNotFound, "CannotVerifyCopySource")
+	expect(do("PUT", blobURL, map[string]string{"x-ms-copy-source": "ftp://example.com/data.txt"}), http.StatusBadRequest, "InvalidHeaderValue")
+
+	// x-ms-requires-sync completes the copy before responding
+	w = do("PUT", blobURL, map[string]string{"x-ms-copy-source": stub.URL + "/data.txt", "x-ms-requires-sync": "true", "x-ms-meta-owner": "ops"})
+	expect(w, http.StatusAccepted, "")
+	if w.Header().Get("x-ms-copy-status") != "success" {
+		t.Errorf("expected a synchronous copy, got %v", w.Header())
+	}
+	if w := do("HEAD", blobURL, nil); w.Header().Get("x-ms-meta-owner") != "ops" || w.Header().Get("x-ms-meta-origin") != "" {
+		t.Errorf("expected the request's metadata to replace the source's, got %v", w.Header())
+	}
+
+	// A pending copy blocks writes to its destination until it is aborted
+	w = do("PUT", blobURL, map[string]string{"x-ms-copy-source": stub.URL + "/slow.bin"})
+	expect(w, http.StatusAccepted, "")
+	copyID = w.Header().Get("x-ms-copy-id")
+	expect(do("PUT", blobURL, map[string]string{"x-ms-blob-type": "BlockBlob"}), http.StatusConflict, "PendingCopyOperation")
+	expect(do("PUT", blobURL+"?comp=copy&copyid="+copyID, nil), http.StatusBadRequest, "MissingRequiredHeader")
+	abort := map[string]string{"x-ms-copy-action": "abort"}
+	expect(do("PUT", blobURL+"?comp=copy&copyid=other", abort), http.StatusConflict, "CopyIdMismatch")
+	expect(do("PUT", blobURL+"?comp=copy&copyid="+copyID, abort), http.StatusNoContent, "")
+	w = do("HEAD", blobURL, nil)
+	if w.Header().Get("x-ms-copy-status") != "aborted" || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("expected an empty blob with an aborted copy, got %v", w.Header())
+	}
+	expect(do("PUT", blobURL+"?comp=copy&copyid="+copyID, abort), http.StatusConflict, "NoPendingCopyOperation")
+
+	// Put Blob From URL writes a new blob from a blob in the emulator or any URL
+	fromURL := map[string]string{
+		"x-ms-copy-source":        "http://example.com/blob/testaccount/testcontainer/copied.txt",
+		"x-ms-blob-type":          "BlockBlob",
+		"x-ms-blob-cache-control": "no-cache",
+	}
+	expect(do("PUT", blobURL, fromURL), http.StatusCreated, "")
+	fromURL["x-ms-copy-source"] = stub.URL + "/data.txt"
+	expect(do("PUT", blobURL, fromURL), http.StatusCreated, "")
+	w = do("GET", blobURL, nil)
+	if w.Body.String() != "hello from stub" || w.Header().Get("Content-Type") != "text/plain" ||
+		w.Header().Get("Cache-Control") != "no-cache" || w.Header().Get("x-ms-meta-origin") != "" || w.Header().Get("x-ms-copy-id") != "" {
+		t.Errorf("unexpected blob put from URL: %q %v", w.Body.String(), w.Header())
+	}
+	fromURL["x-ms-copy-source-blob-properties"] = "false"
+	expect(do("PUT", blobURL, fromURL), http.StatusCreated, "")
+	if w := do("HEAD", blobURL, nil); w.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("expected the source's properties to be ignored, got %v", w.Header())
+	}
+}
+
+func TestBlobService_ListContainers(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	for _, name := range []string{"logs-b", "logs-a", "data", "logs-c"} {
+		if err := store.CreateContainer(ctx, "testaccount", name, CreateContainerOptions{}); err != nil {
+			t.Fatalf("failed to create container: %v", err)
+		}
+	}
+	if err := store.CreateContainer(ctx, "otheraccount", "logs-z", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	list := func(query string) ContainerListResult {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/blob/testaccount?comp=list"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var result ContainerListResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode list response: %v", err)
+		}
+		return result
+	}
+	names := func(result ContainerListResult) []string {
+		var names []string
+		for _, c := range result.Containers.Container {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+
+	if got := names(list("")); !reflect.DeepEqual(got, []string{"data", "logs-a", "logs-b", "logs-c"}) {
+		t.Errorf("unexpected containers: %v", got)
+	}
+
+	// Pages continue from NextMarker
+	page := list("&prefix=logs-&maxresults=2")
+	if got := names(page); !reflect.DeepEqual(got, []string{"logs-a", "logs-b"}) || page.NextMarker == "" || page.MaxResults != 2 {
+		t.Fatalf("unexpected first page: %v, %+v", got, page)
+	}
+	page = list("&prefix=logs-&maxresults=2&marker=" + url.QueryEscape(page.NextMarker))
+	if got := names(page); !reflect.DeepEqual(got, []string{"logs-c"}) || page.NextMarker != "" {
+		t.Errorf("unexpected last page: %v, %+v", got, page)
+	}
+
+	for _, query := range []string{"&maxresults=0", "&maxresults=x", "&include=snapshots"} {
+		req := httptest.NewRequest("GET", "/blob/testaccount?comp=list"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+
+	// Soft-deleted containers are listed with include=deleted, after a live one of the same name
+	if err := store.SetServiceProperties(ctx, "testaccount", ServiceProperties{ContainerDeleteRetentionPolicy: RetentionPolicy{Enabled: true, Days: 3}}); err != nil {
+		t.Fatalf("failed to enable container soft delete: %v", err)
+	}
+	if err := store.DeleteContainer(ctx, "testaccount", "logs-a", AccessConditions{}); err != nil {
+		t.Fatalf("failed to delete container: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "logs-a", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to recreate container: %v", err)
+	}
+	if got := names(list("&prefix=logs-a")); !reflect.DeepEqual(got, []string{"logs-a"}) {
+		t.Errorf("expected only the live container, got %v", got)
+	}
+	page = list("&prefix=logs-a&include=deleted&maxresults=1")
+	if items := page.Containers.Container; len(items) != 1 || items[0].Deleted || page.NextMarker == "" {
+		t.Fatalf("expected the live container first, got %+v", page)
+	}
+	page = list("&prefix=logs-a&include=deleted&marker=" + url.QueryEscape(page.NextMarker))
+	items := page.Containers.Container
+	if len(items) != 1 || !items[0].Deleted || items[0].Version == "" || items[0].Properties.RemainingRetentionDays != 3 {
+		t.Errorf("expected the soft-deleted container, got %+v", items)
+	}
+}
+
+// TestBlobService_HierarchicalListing tests List Blobs with a delimiter, markers and include options.
+func TestBlobService_HierarchicalListing(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	for _, name := range []string{"b.txt", "a/1.txt", "a/2/x.txt", "a.txt", "c/1.txt", "c/2.txt"} {
+		opts := PutBlobOptions{Metadata: map[string]string{"name": name}}
+		if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", name, strings.NewReader(name), opts); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+	if _, err := store.CreateSnapshot(ctx, "testaccount", "testcontainer", "b.txt", SnapshotOptions{}); err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	if err := store.StageBlock(ctx, "testaccount", "testcontainer", "d.txt", "YWFh", strings.NewReader("staged"), StageBlockOptions{}); err != nil {
+		t.Fatalf("failed to stage block: %v", err)
+	}
+	router := newTestRouter(service)
+
+	list := func(query string) BlobListResult {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/blob/testaccount/testcontainer?restype=container&comp=list"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var result BlobListResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode list response: %v", err)
+		}
+		return result
+	}
+	// names lists the blobs and prefixes of a page in order, prefixes with their delimiter.
+	names := func(result BlobListResult) (blobs, prefixes []string) {
+		for _, b := range result.Blobs.Blob {
+			blobs = append(blobs, b.Name)
+		}
+		for _, p := range result.Blobs.BlobPrefix {
+			prefixes = append(prefixes, p.Name)
+		}
+		return blobs, prefixes
+	}
+
+	// Blobs are listed in lexicographic order
+	if blobs, _ := names(list("")); !reflect.DeepEqual(blobs, []string{"a.txt", "a/1.txt", "a/2/x.txt", "b.txt", "c/1.txt", "c/2.txt"}) {
+		t.Errorf("unexpected blobs: %v", blobs)
+	}
+
+	// A delimiter rolls names up into BlobPrefix entries
+	result := list("&delimiter=/")
+	blobs, prefixes := names(result)
+	if !reflect.DeepEqual(blobs, []string{"a.txt", "b.txt"}) || !reflect.DeepEqual(prefixes, []string{"a/", "c/"}) || result.Delimiter != "/" {
+		t.Errorf("unexpected delimited listing: %v, %v", blobs, prefixes)
+	}
+	blobs, prefixes = names(list("&delimiter=/&prefix=a/"))
+	if !reflect.DeepEqual(blobs, []string{"a/1.txt"}) || !reflect.DeepEqual(prefixes, []string{"a/2/"}) {
+		t.Errorf("unexpected listing under a/: %v, %v", blobs, prefixes)
+	}
+
+	// Pages continue from NextMarker, counting prefixes and snapshots as results
+	var pages [][]string
+	marker := ""
+	for {
+		page := list("&delimiter=/&include=snapshots&maxresults=2&marker=" + url.QueryEscape(marker))
+		blobs, prefixes := names(page)
+		pages = append(pages, append(blobs, prefixes...))
+		if marker = page.NextMarker; marker == "" {
+			break
+		}
+	}
+	want := [][]string{{"a.txt", "a/"}, {"b.txt", "b.txt"}, {"c/"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("expected pages %v, got %v", want, pages)
+	}
+
+	// Metadata is only listed with include=metadata
+	if items := list("&prefix=b.txt").Blobs.Blob; len(items) != 1 || items[0].Metadata != nil {
+		t.Errorf("expected no metadata, got %+v", items)
+	}
+	if items := list("&prefix=b.txt&include=metadata").Blobs.Blob; len(items) != 1 || items[0].Metadata["name"] != "b.txt" {
+		t.Errorf("expected metadata, got %+v", items)
+	}
+
+	// Blobs with only uncommitted blocks are listed with include=uncommittedblobs
+	if blobs, _ := names(list("&prefix=d")); len(blobs) != 0 {
+		t.Errorf("expected no committed blob, got %v", blobs)
+	}
+	if items := list("&prefix=d&include=uncommittedblobs").Blobs.Blob; len(items) != 1 || items[0].Name != "d.txt" || items[0].Properties.ContentLength != 0 {
+		t.Errorf("expected the uncommitted blob, got %+v", items)
+	}
+
+	for _, query := range []string{"&marker=not-a-marker!", "&maxresults=0", "&include=bogus"} {
+		req := httptest.NewRequest("GET", "/blob/testaccount/testcontainer?restype=container&comp=list"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+// TestBlobService_ContainerMetadataAndACL tests container metadata, ACLs and anonymous access.
+func TestBlobService_ContainerMetadataAndACL(t *testing.T) {
+	service, _, cleanup := setupTestService(t)
+	defer cleanup()
+
+	router := newTestRouter(service)
+	anonymous := newAnonymousTestRouter(service)
+
+	const containerURL = "/blob/testaccount/testcontainer"
+	send := func(router chi.Router, method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		return send(router, method, url, body, headers)
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	// Create Container takes metadata and a public access level
+	expect(do("PUT", containerURL, "", map[string]string{"x-ms-blob-public-access": "public"}), http.StatusBadRequest, "InvalidHeaderValue")
+	w := do("PUT", containerURL, "", map[string]string{"x-ms-meta-owner": "alice", "x-ms-blob-public-access": "blob"})
+	expect(w, http.StatusCreated, "")
+	etag := w.Header().Get("ETag")
+	w = do("HEAD", containerURL+"?restype=container", "", nil)
+	if w.Header().Get("x-ms-meta-owner") != "alice" || w.Header().Get("x-ms-blob-public-access") != "blob" {
+		t.Errorf("unexpected container properties: %v", w.Header())
+	}
+
+	// Set Container Metadata replaces all metadata and changes the ETag
+	w = do("PUT", containerURL+"?restype=container&comp=metadata", "", map[string]string{"x-ms-meta-team": "storage"})
+	expect(w, http.StatusOK, "")
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("expected a new ETag, got %q", etag)
+	}
+	w = do("GET", containerURL+"?restype=container&comp=metadata", "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Header().Get("x-ms-meta-team") != "storage" || w.Header().Get("x-ms-meta-owner") != "" {
+		t.Errorf("unexpected container metadata: %v", w.Header())
+	}
+	expect(do("PUT", containerURL+"?restype=container&comp=metadata", "", map[string]string{"If-Modified-Since": formatHTTPDate(time.Now().Add(time.Hour))}), http.StatusPreconditionFailed, "ConditionNotMet")
+
+	// Set Container ACL replaces the public access level and stored access policies
+	const acl = `<SignedIdentifiers>
+		<SignedIdentifier><Id>read-only</Id><AccessPolicy><Start>2024-01-01T00:00:00Z</Start><Expiry>2024-12-31T00:00:00.5Z</Expiry><Permission>rl</Permission></AccessPolicy></SignedIdentifier>
+		<SignedIdentifier><Id>writer</Id><AccessPolicy><Permission>rwdl</Permission></AccessPolicy></SignedIdentifier>
+	</SignedIdentifiers>`
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", acl, map[string]string{"x-ms-blob-public-access": "container"}), http.StatusOK, "")
+	w = do("GET", containerURL+"?restype=container&comp=acl", "", nil)
+	expect(w, http.StatusOK, "")
+	var got signedIdentifiersXML
+	if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode ACL: %v", err)
+	}
+	want := []signedIdentifierXML{
+		{ID: "read-only", AccessPolicy: accessPolicyXML{Start: "2024-01-01T00:00:00.0000000Z", Expiry: "2024-12-31T00:00:00.5000000Z", Permission: "rl"}},
+		{ID: "writer", AccessPolicy: accessPolicyXML{Permission: "rwdl"}},
+	}
+	if w.Header().Get("x-ms-blob-public-access") != "container" || !reflect.DeepEqual(got.SignedIdentifiers, want) {
+		t.Errorf("unexpected ACL: %v %+v", w.Header(), got)
+	}
+
+	tooMany := "<SignedIdentifiers>" + strings.Repeat("<SignedIdentifier><Id>id</Id></SignedIdentifier>", 6) + "</SignedIdentifiers>"
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", tooMany, nil), http.StatusBadRequest, "InvalidXmlDocument")
+	longID := "<SignedIdentifiers><SignedIdentifier><Id>" + strings.Repeat("x", 65) + "</Id></SignedIdentifier></SignedIdentifiers>"
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", longID, nil), http.StatusBadRequest, "InvalidXmlNodeValue")
+	badPermission := "<SignedIdentifiers><SignedIdentifier><Id>id</Id><AccessPolicy><Permission>rz</Permission></AccessPolicy></SignedIdentifier></SignedIdentifiers>"
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", badPermission, nil), http.StatusBadRequest, "InvalidXmlNodeValue")
+
+	w = do("GET", "/blob/testaccount?comp=list&prefix=test", "", nil)
+	if !strings.Contains(w.Body.String(), "<PublicAccess>container</PublicAccess>") {
+		t.Errorf("expected the public access level in the container listing, got %s", w.Body.String())
+	}
+
+	// Anonymous reads follow the public access level
+	expect(do("PUT", containerURL+"/doc.txt", "hello", nil), http.StatusCreated, "")
+	anonymousReads := func(blob, list, acl int) {
+		t.Helper()
+		for url, status := range map[string]int{
+			containerURL + "/doc.txt":                           blob,
+			containerURL + "?restype=container&comp=list":       list,
+			containerURL + "?restype=container":                 list,
+			containerURL + "?restype=container&comp=acl":        acl,
+			"/blob/testaccount?restype=service&comp=properties": http.StatusNotFound,
+		} {
+			w := send(anonymous, "GET", url, "", nil)
+			if w.Code != status {
+				t.Errorf("GET %s: expected status %d, got %d", url, status, w.Code)
+			}
+			if w.Code == http.StatusNotFound && w.Header().Get("x-ms-error-code") != "ResourceNotFound" {
+				t.Errorf("GET %s: expected ResourceNotFound, got %q", url, w.Header().Get("x-ms-error-code"))
+			}
+		}
+	}
+	anonymousReads(http.StatusOK, http.StatusOK, http.StatusNotFound)
+
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", "", map[string]string{"x-ms-blob-public-access": "blob"}), http.StatusOK, "")
+	anonymousReads(http.StatusOK, http.StatusNotFound, http.StatusNotFound)
+
+	// An ACL without a body or public access level makes the container private
+	expect(do("PUT", containerURL+"?restype=container&comp=acl", "", nil), http.StatusOK, "")
+	anonymousReads(http.StatusNotFound, http.StatusNotFound, http.StatusNotFound)
+	w = do("GET", containerURL+"?restype=container&comp=acl", "", nil)
+	if w.Header().Get("x-ms-blob-public-access") != "" || strings.Contains(w.Body.String(), "<SignedIdentifier>") {
+		t.Errorf("expected an empty private ACL, got %v %s", w.Header(), w.Body.String())
+	}
+
+	// Any credentials, including a shared access signature, make a request authorized
+	if w := send(anonymous, "GET", containerURL+"/doc.txt?sv=2021-12-02&sp=r&sig=c2ln", "", nil); w.Code != http.StatusOK {
+		t.Errorf("expected a SAS read to succeed, got %d", w.Code)
+	}
+}
+
+// TestBlobService_AppendBlobs tests append blob creation, Append Block and its conditions, and sealing.
+func TestBlobService_AppendBlobs(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/log.txt"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	appendBlob := map[string]string{"x-ms-blob-type": "AppendBlob"}
+
+	// An append blob is created empty
+	expect(do("PUT", blobURL, "content", appendBlob), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, "", map[string]string{"x-ms-blob-type": "CubeBlob"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, "", appendBlob), http.StatusCreated, "")
+	w := do("HEAD", blobURL, "", nil)
+	if w.Header().Get("x-ms-blob-type") != "AppendBlob" || w.Header().Get("x-ms-blob-committed-block-count") != "0" || w.Header().Get("Content-Length") != "0" {
+		t.Errorf("unexpected append blob properties: %v", w.Header())
+	}
+
+	w = do("PUT", blobURL+"?comp=appendblock", "hello ", nil)
+	expect(w, http.StatusCreated, "")
+	if w.Header().Get("x-ms-blob-append-offset") != "0" || w.Header().Get("x-ms-blob-committed-block-count") != "1" {
+		t.Errorf("unexpected first append: %v", w.Header())
+	}
+	w = do("PUT", blobURL+"?comp=snapshot", "", nil)
+	expect(w, http.StatusCreated, "")
+	snapshot := w.Header().Get("x-ms-snapshot")
+	w = do("PUT", blobURL+"?comp=appendblock", "world", map[string]string{"x-ms-blob-condition-appendpos": "6"})
+	expect(w, http.StatusCreated, "")
+	if w.Header().Get("x-ms-blob-append-offset") != "6" || w.Header().Get("x-ms-blob-committed-block-count") != "2" {
+		t.Errorf("unexpected second append: %v", w.Header())
+	}
+	if body := do("GET", blobURL, "", nil).Body.String(); body != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", body)
+	}
+	if body := do("GET", blobURL+"?snapshot="+url.QueryEscape(snapshot), "", nil).Body.String(); body != "hello " {
+		t.Errorf("expected the snapshot to keep its content, got %q", body)
+	}
+
+	expect(do("PUT", blobURL+"?comp=appendblock", "!", map[string]string{"x-ms-blob-condition-appendpos": "6"}), http.StatusPreconditionFailed, "AppendPositionConditionNotMet")
+	expect(do("PUT", blobURL+"?comp=appendblock", "!!", map[string]string{"x-ms-blob-condition-maxsize": "12"}), http.StatusPreconditionFailed, "MaxBlobSizeConditionNotMet")
+	expect(do("PUT", blobURL+"?comp=appendblock", "!", map[string]string{"x-ms-blob-condition-maxsize": "x"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL+"?comp=appendblock", "", nil), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL+"?comp=appendblock", strings.Repeat("x", 4<<20+1), nil), http.StatusRequestEntityTooLarge, "RequestBodyTooLarge")
+	expect(do("PUT", blobURL+"?comp=block&blockid=YWFh", "x", nil), http.StatusConflict, "InvalidBlobType")
+	expect(do("PUT", "/blob/testaccount/testcontainer/missing.txt?comp=appendblock", "x", nil), http.StatusNotFound, "BlobNotFound")
+	expect(do("PUT", "/blob/testaccount/testcontainer/block.txt", "block", nil), http.StatusCreated, "")
+	expect(do("PUT", "/blob/testaccount/testcontainer/block.txt?comp=appendblock", "x", nil), http.StatusConflict, "InvalidBlobType")
+
+	// Concurrent appends are serialized, each block landing whole
+	const writers, chunk = 16, 64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			line := fmt.Sprintf("%02d", i) + strings.Repeat(".", chunk-3) + "\n"
+			if w := do("PUT", blobURL+"?comp=appendblock", line, nil); w.Code != http.StatusCreated {
+				t.Errorf("append %d: expected status %d, got %d", i, http.StatusCreated, w.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+	w = do("GET", blobURL, "", nil)
+	lines := strings.Split(strings.TrimPrefix(w.Body.String(), "hello world"), "\n")
+	if len(lines) != writers+1 || w.Header().Get("x-ms-blob-committed-block-count") != strconv.Itoa(2+writers) {
+		t.Fatalf("expected %d appended lines, got %q", writers, w.Body.String())
+	}
+	for _, line := range lines[:writers] {
+		if len(line) != chunk-1 {
+			t.Errorf("interleaved append: %q", line)
+		}
+	}
+
+	// A copy of an append blob is an append blob of its own
+	copyURL := "/blob/testaccount/testcontainer/copy.txt"
+	expect(do("PUT", copyURL, "", map[string]string{"x-ms-copy-source": "http://example.com" + blobURL}), http.StatusAccepted, "")
+	expect(do("PUT", copyURL+"?comp=appendblock", "copy", nil), http.StatusCreated, "")
+	if size := do("HEAD", blobURL, "", nil).Header().Get("Content-Length"); size != strconv.Itoa(11+writers*chunk) {
+		t.Errorf("expected appending to the copy to leave the source alone, got size %s", size)
+	}
+
+	// A sealed blob can't be appended to
+	w = do("PUT", blobURL+"?comp=seal", "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Header().Get("x-ms-blob-sealed") != "true" {
+		t.Errorf("expected x-ms-blob-sealed, got %v", w.Header())
+	}
+	expect(do("PUT", blobURL+"?comp=appendblock", "x", nil), http.StatusConflict, "BlobIsSealed")
+	expect(do("PUT", blobURL+"?comp=seal", "", nil), http.StatusOK, "")
+	if sealed := do("HEAD", blobURL, "", nil).Header().Get("x-ms-blob-sealed"); sealed != "true" {
+		t.Errorf("expected a sealed blob, got %q", sealed)
+	}
+	body := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list&prefix=log", "", nil).Body.String()
+	if !strings.Contains(body, "<BlobType>AppendBlob</BlobType>") || !strings.Contains(body, "<Sealed>true</Sealed>") {
+		t.Errorf("expected a sealed append blob in the listing, got %s", body)
+	}
+}
+
+// TestBlobService_PageBlobs tests page blob creation, Put Page, Get Page Ranges
+// with and without a previous snapshot, and resizing and sequence numbers.
+func TestBlobService_PageBlobs(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/disk.vhd"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	type pageList struct {
+		Ranges []struct {
+			XMLName xml.Name
+			Start   int64 `xml:"Start"`
+			End     int64 `xml:"End"`
+		} `xml:",any"`
+	}
+	pageRanges := func(query string) string {
+		t.Helper()
+		w := do("GET", blobURL+"?comp=pagelist"+query, "", nil)
+		expect(w, http.StatusOK, "")
+		var list pageList
+		if err := xml.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("failed to parse page list: %v", err)
+		}
+		var ranges []string
+		for _, r := range list.Ranges {
+			ranges = append(ranges, fmt.Sprintf("%s %d-%d", r.XMLName.Local, r.Start, r.End))
+		}
+		return strings.Join(ranges, ", ")
+	}
+	putPage := func(start, end int, fill string) *httptest.ResponseRecorder {
+		return do("PUT", blobURL+"?comp=page", strings.Repeat(fill, end-start+1), map[string]string{
+			"x-ms-page-write": "update",
+			"x-ms-range":      fmt.Sprintf("bytes=%d-%d", start, end),
+		})
+	}
+	clearPage := func(start, end int) *httptest.ResponseRecorder {
+		return do("PUT", blobURL+"?comp=page", "", map[string]string{
+			"x-ms-page-write": "clear",
+			"x-ms-range":      fmt.Sprintf("bytes=%d-%d", start, end),
+		})
+	}
+
+	// A page blob is created empty, with a size that is a multiple of 512
+	pageBlob := func(size string) map[string]string {
+		return map[string]string{
+			"x-ms-blob-type":            "PageBlob",
+			"x-ms-blob-content-length":  size,
+			"x-ms-blob-sequence-number": "3",
+			"x-ms-blob-content-type":    "application/x-vhd",
+		}
+	}
+	expect(do("PUT", blobURL, "", pageBlob("1000")), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, "", map[string]string{"x-ms-blob-type": "PageBlob"}), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(do("PUT", blobURL, "", pageBlob("2048")), http.StatusCreated, "")
+	w := do("HEAD", blobURL, "", nil)
+	if w.Header().Get("x-ms-blob-type") != "PageBlob" || w.Header().Get("Content-Length") != "2048" || w.Header().Get("x-ms-blob-sequence-number") != "3" {
+		t.Errorf("unexpected page blob properties: %v", w.Header())
+	}
+	if ranges := pageRanges(""); ranges != "" {
+		t.Errorf("expected no page ranges, got %s", ranges)
+	}
+
+	// Pages are written on 512-byte boundaries within the blob
+	w = putPage(512, 1023, "a")
+	expect(w, http.StatusCreated, "")
+	if w.Header().Get("x-ms-blob-sequence-number") != "3" {
+		t.Errorf("expected the sequence number on Put Page, got %v", w.Header())
+	}
+	expect(putPage(100, 611, "x"), http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange")
+	expect(putPage(2048, 2559, "x"), http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange")
+	expect(do("PUT", blobURL+"?comp=page", "short", map[string]string{"x-ms-page-write": "update", "x-ms-range": "bytes=0-511"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL+"?comp=page", "", map[string]string{"x-ms-range": "bytes=0-511"}), http.StatusBadRequest, "MissingRequiredHeader")
+	content := do("GET", blobURL, "", nil).Body.String()
+	if content != strings.Repeat("\x00", 512)+strings.Repeat("a", 512)+strings.Repeat("\x00", 1024) {
+		t.Errorf("unexpected page blob content: %q", content)
+	}
+	if ranges := pageRanges(""); ranges != "PageRange 512-1023" {
+		t.Errorf("unexpected page ranges: %s", ranges)
+	}
+
+	// A diff against a snapshot lists what was written and cleared since, in offset order
+	w = do("PUT", blobURL+"?comp=snapshot", "", nil)
+	expect(w, http.StatusCreated, "")
+	snapshot := url.QueryEscape(w.Header().Get("x-ms-snapshot"))
+	expect(putPage(0, 511, "b"), http.StatusCreated, "")
+	expect(clearPage(512, 1023), http.StatusCreated, "")
+	expect(putPage(1536, 2047, "c"), http.StatusCreated, "")
+	if ranges := pageRanges(""); ranges != "PageRange 0-511, PageRange 1536-2047" {
+		t.Errorf("unexpected page ranges: %s", ranges)
+	}
+	if ranges := pageRanges("&prevsnapshot=" + snapshot); ranges != "PageRange 0-511, ClearRange 512-1023, PageRange 1536-2047" {
+		t.Errorf("unexpected page range diff: %s", ranges)
+	}
+	w = do("GET", blobURL+"?comp=pagelist", "", map[string]string{"x-ms-range": "bytes=1024-2047"})
+	if !strings.Contains(w.Body.String(), "<Start>1536</Start>") || strings.Contains(w.Body.String(), "<Start>0</Start>") {
+		t.Errorf("expected only the pages within the range, got %s", w.Body.String())
+	}
+	if ranges := pageRanges("&snapshot=" + snapshot); ranges != "PageRange 512-1023" {
+		t.Errorf("unexpected snapshot page ranges: %s", ranges)
+	}
+	if body := do("GET", blobURL+"?snapshot="+snapshot, "", nil).Body.String(); body != strings.Repeat("\x00", 512)+strings.Repeat("a", 512)+strings.Repeat("\x00", 1024) {
+		t.Errorf("expected the snapshot to keep its content, got %q", body)
+	}
+	content = do("GET", blobURL, "", nil).Body.String()
+	if content != strings.Repeat("b", 512)+strings.Repeat("\x00", 1024)+strings.Repeat("c", 512) {
+		t.Errorf("unexpected page blob content: %q", content)
+	}
+	expect(do("GET", blobURL+"?comp=pagelist&prevsnapshot=2020-01-01T00:00:00.0000000Z", "", nil), http.StatusConflict, "PreviousSnapshotNotFound")
+
+	// Sequence numbers can guard page writes and are changed with Set Blob Properties
+	w = do("PUT", blobURL+"?comp=page", strings.Repeat("d", 512), map[string]string{
+		"x-ms-page-write":            "update",
+		"x-ms-range":                 "bytes=0-511",
+		"x-ms-if-sequence-number-lt": "3",
+	})
+	expect(w, http.StatusPreconditionFailed, "SequenceNumberConditionNotMet")
+	for _, step := range []struct {
+		action, value, want string
+	}{
+		{"increment", "", "4"},
+		{"max", "2", "4"},
+		{"update", "10", "10"},
+	} {
+		headers := map[string]string{"x-ms-sequence-number-action": step.action}
+		if step.value != "" {
+			headers["x-ms-blob-sequence-number"] = step.value
+		}
+		w = do("PUT", blobURL+"?comp=properties", "", headers)
+		expect(w, http.StatusOK, "")
+		if got := w.Header().Get("x-ms-blob-sequence-number"); got != step.want {
+			t.Errorf("%s: expected sequence number %s, got %s", step.action, step.want, got)
+		}
+	}
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"x-ms-sequence-number-action": "update"}), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"x-ms-sequence-number-action": "decrement"}), http.StatusBadRequest, "InvalidHeaderValue")
+
+	// Resizing discards pages beyond the new size and keeps the HTTP properties
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"x-ms-blob-content-length": "1024"}), http.StatusOK, "")
+	w = do("HEAD", blobURL, "", nil)
+	if w.Header().Get("Content-Length") != "1024" || w.Header().Get("Content-Type") != "application/x-vhd" {
+		t.Errorf("unexpected resized blob properties: %v", w.Header())
+	}
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"x-ms-blob-content-length": "2048"}), http.StatusOK, "")
+	if ranges := pageRanges(""); ranges != "PageRange 0-511" {
+		t.Errorf("unexpected page ranges after resizing: %s", ranges)
+	}
+	if content := do("GET", blobURL, "", nil).Body.String(); content != strings.Repeat("b", 512)+strings.Repeat("\x00", 1536) {
+		t.Errorf("expected pages beyond a shrunk size to be gone, got %q", content)
+	}
+
+	// A copy of a page blob is a page blob of its own
+	copyURL := "/blob/testaccount/testcontainer/copy.vhd"
+	expect(do("PUT", copyURL, "", map[string]string{"x-ms-copy-source": "http://example.com" + blobURL}), http.StatusAccepted, "")
+	expect(clearPage(0, 511), http.StatusCreated, "")
+	if content := do("GET", copyURL, "", nil).Body.String(); content != strings.Repeat("b", 512)+strings.Repeat("\x00", 1536) {
+		t.Errorf("expected clearing the source to leave the copy alone, got %q", content)
+	}
+	if w := do("GET", copyURL+"?comp=pagelist", "", nil); !strings.Contains(w.Body.String(), "<PageRange><Start>0</Start><End>511</End></PageRange>") {
+		t.Errorf("unexpected page ranges of the copy: %s", w.Body.String())
+	}
+
+	// Other blob types reject page operations, and page blobs reject theirs
+	expect(do("PUT", blobURL+"?comp=block&blockid=YWFh", "x", nil), http.StatusConflict, "InvalidBlobType")
+	expect(do("PUT", blobURL+"?comp=appendblock", "x", nil), http.StatusConflict, "InvalidBlobType")
+	expect(do("PUT", "/blob/testaccount/testcontainer/block.txt", "block", nil), http.StatusCreated, "")
+	expect(do("GET", "/blob/testaccount/testcontainer/block.txt?comp=pagelist", "", nil), http.StatusConflict, "InvalidBlobType")
+	expect(do("PUT", "/blob/testaccount/testcontainer/block.txt?comp=properties", "", map[string]string{"x-ms-blob-content-length": "512"}), http.StatusConflict, "InvalidBlobType")
+	body := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list&prefix=disk", "", nil).Body.String()
+	if !strings.Contains(body, "<BlobType>PageBlob</BlobType>") || !strings.Contains(body, "<x-ms-blob-sequence-number>10</x-ms-blob-sequence-number>") {
+		t.Errorf("expected a page blob in the listing, got %s", body)
+	}
+}
+
+// TestBlobService_BlobTags tests Get and Set Blob Tags, x-ms-tags and Find Blobs by Tags.
+func TestBlobService_BlobTags(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	for _, name := range []string{"alpha", "beta"} {
+		if err := store.CreateContainer(context.Background(), "testaccount", name, CreateContainerOptions{}); err != nil {
+			t.Fatalf("failed to create container: %v", err)
+		}
+	}
+	router := newTestRouter(service)
+
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	getTags := func(path string) string {
+		t.Helper()
+		w := do("GET", path+"?comp=tags", "", nil)
+		expect(w, http.StatusOK, "")
+		var body tagsXML
+		if err := xml.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to parse tags: %v", err)
+		}
+		var tags []string
+		for _, tag := range body.TagSet.Tags {
+			tags = append(tags, tag.Key+"="+tag.Value)
+		}
+		return strings.Join(tags, "&")
+	}
+	find := func(path, where string) string {
+		t.Helper()
+		w := do("GET", path+"&where="+url.QueryEscape(where), "", nil)
+		expect(w, http.StatusOK, "")
+		var result filterBlobsResultXML
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to parse Find Blobs by Tags response: %v", err)
+		}
+		var blobs []string
+		for _, blob := range result.Blobs.Blob {
+			blobs = append(blobs, blob.ContainerName+"/"+blob.Name)
+		}
+		return strings.Join(blobs, ", ")
+	}
+
+	// Tags are set on upload with x-ms-tags
+	upload := func(path, tags string) *httptest.ResponseRecorder {
+		return do("PUT", path, "data", map[string]string{"x-ms-blob-type": "BlockBlob", "x-ms-tags": tags})
+	}
+	expect(upload("/blob/testaccount/alpha/a1", "project=bluestack&env=dev"), http.StatusCreated, "")
+	expect(upload("/blob/testaccount/alpha/a2", "project=bluestack&env=prod&year=2024"), http.StatusCreated, "")
+	expect(upload("/blob/testaccount/beta/b1", "project=bluestack&env=prod&year=2021"), http.StatusCreated, "")
+	expect(upload("/blob/testaccount/beta/b2", "project=other"), http.StatusCreated, "")
+	if tags := getTags("/blob/testaccount/alpha/a1"); tags != "env=dev&project=bluestack" {
+		t.Errorf("unexpected tags: %s", tags)
+	}
+	w := do("HEAD", "/blob/testaccount/alpha/a2", "", nil)
+	if w.Header().Get("x-ms-tag-count") != "3" {
+		t.Errorf("expected x-ms-tag-count 3, got %q", w.Header().Get("x-ms-tag-count"))
+	}
+
+	// Azure's limits on tag count, key and value length and characters
+	var many []string
+	for i := 0; i < 11; i++ {
+		many = append(many, fmt.Sprintf("k%d=v", i))
+	}
+	expect(upload("/blob/testaccount/alpha/bad", strings.Join(many, "&")), http.StatusBadRequest, "TagsTooLarge")
+	expect(upload("/blob/testaccount/alpha/bad", strings.Repeat("k", 129)+"=v"), http.StatusBadRequest, "InvalidTag")
+	expect(upload("/blob/testaccount/alpha/bad", "k="+strings.Repeat("v", 257)), http.StatusBadRequest, "InvalidTag")
+	expect(upload("/blob/testaccount/alpha/bad", "k=v&k=w"), http.StatusBadRequest, "InvalidTag")
+	expect(upload("/blob/testaccount/alpha/bad", "k%21=v"), http.StatusBadRequest, "InvalidTag")
+	expect(do("GET", "/blob/testaccount/alpha/bad", "", nil), http.StatusNotFound, "BlobNotFound")
+
+	// Set Blob Tags replaces all tags without changing the ETag
+	etag := do("HEAD", "/blob/testaccount/beta/b2", "", nil).Header().Get("ETag")
+	body := `<Tags><TagSet><Tag><Key>project</Key><Value>bluestack</Value></Tag><Tag><Key>env</Key><Value>test</Value></Tag></TagSet></Tags>`
+	expect(do("PUT", "/blob/testaccount/beta/b2?comp=tags", body, nil), http.StatusNoContent, "")
+	if tags := getTags("/blob/testaccount/beta/b2"); tags != "env=test&project=bluestack" {
+		t.Errorf("unexpected tags after Set Blob Tags: %s", tags)
+	}
+	if got := do("HEAD", "/blob/testaccount/beta/b2", "", nil).Header().Get("ETag"); got != etag {
+		t.Errorf("expected Set Blob Tags to keep ETag %s, got %s", etag, got)
+	}
+	duplicate := `<Tags><TagSet><Tag><Key>a</Key><Value>1</Value></Tag><Tag><Key>a</Key><Value>2</Value></Tag></TagSet></Tags>`
+	expect(do("PUT", "/blob/testaccount/beta/b2?comp=tags", duplicate, nil), http.StatusBadRequest, "InvalidTag")
+	expect(do("PUT", "/blob/testaccount/beta/missing?comp=tags", body, nil), http.StatusNotFound, "BlobNotFound")
+
+	// Find Blobs by Tags across the account and within a container
+	if blobs := find("/blob/testaccount?comp=blobs", `"project" = 'bluestack'`); blobs != "alpha/a1, alpha/a2, beta/b1, beta/b2" {
+		t.Errorf("unexpected blobs for project: %s", blobs)
+	}
+	if blobs := find("/blob/testaccount?comp=blobs", `"project"='bluestack' AND "env"='prod'`); blobs != "alpha/a2, beta/b1" {
+		t.Errorf("unexpected blobs for project and env: %s", blobs)
+	}
+	if blobs := find("/blob/testaccount?comp=blobs", `"year" >= '2022' and "year" < '2025'`); blobs != "alpha/a2" {
+		t.Errorf("unexpected blobs for year range: %s", blobs)
+	}
+	if blobs := find("/blob/testaccount?comp=blobs", `@container = 'beta' AND "project" = 'bluestack'`); blobs != "beta/b1, beta/b2" {
+		t.Errorf("unexpected blobs for @container: %s", blobs)
+	}
+	if blobs := find("/blob/testaccount/beta?restype=container&comp=blobs", `"env" = 'prod'`); blobs != "beta/b1" {
+		t.Errorf("unexpected blobs in container: %s", blobs)
+	}
+
+	// Only the tags in the expression are returned
+	w = do("GET", "/blob/testaccount?comp=blobs&where="+url.QueryEscape(`"env"='dev'`), "", nil)
+	if !strings.Contains(w.Body.String(), "<Key>env</Key>") || strings.Contains(w.Body.String(), "<Key>project</Key>") {
+		t.Errorf("unexpected tags in Find Blobs by Tags response: %s", w.Body.String())
+	}
+
+	// Results are paged with maxresults and marker
+	w = do("GET", "/blob/testaccount?comp=blobs&maxresults=3&where="+url.QueryEscape(`"project"='bluestack'`), "", nil)
+	var page filterBlobsResultXML
+	if err := xml.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Blobs.Blob) != 3 || page.NextMarker == "" {
+		t.Fatalf("unexpected first page: %s", w.Body.String())
+	}
+	if blobs := find("/blob/testaccount?comp=blobs&marker="+page.NextMarker, `"project"='bluestack'`); blobs != "beta/b2" {
+		t.Errorf("unexpected second page: %s", blobs)
+	}
+
+	// Invalid filter expressions
+	for _, where := range []string{
+		`project = 'bluestack'`,
+		`"project" = "bluestack"`,
+		`"project" != 'bluestack'`,
+		`"project" = 'bluestack' OR "env" = 'dev'`,
+		`"project" = 'bluestack' AND`,
+		`@container = 'alpha'`,
+		`@container > 'alpha' AND "env" = 'dev'`,
+	} {
+		w := do("GET", "/blob/testaccount?comp=blobs&where="+url.QueryEscape(where), "", nil)
+		expect(w, http.StatusBadRequest, "InvalidQueryParameterValue")
+	}
+	expect(do("GET", "/blob/testaccount/alpha?restype=container&comp=blobs&where="+url.QueryEscape(`@container = 'alpha' AND "env" = 'dev'`), "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+	expect(do("GET", "/blob/testaccount?comp=blobs", "", nil), http.StatusBadRequest, "MissingRequiredQueryParameter")
+
+	// Overwriting and deleting a blob update the index
+	expect(upload("/blob/testaccount/alpha/a1", "project=retired"), http.StatusCreated, "")
+	expect(do("DELETE", "/blob/testaccount/beta/b1", "", nil), http.StatusAccepted, "")
+	if blobs := find("/blob/testaccount?comp=blobs", `"project" = 'bluestack'`); blobs != "alpha/a2, beta/b2" {
+		t.Errorf("unexpected blobs after overwrite and delete: %s", blobs)
+	}
+
+	// Listings report the tag count, and the tags with include=tags
+	w = do("GET", "/blob/testaccount/alpha?restype=container&comp=list&include=tags", "", nil)
+	if !strings.Contains(w.Body.String(), "<TagCount>3</TagCount>") || !strings.Contains(w.Body.String(), "<Key>year</Key><Value>2024</Value>") {
+		t.Errorf("unexpected tags in listing: %s", w.Body.String())
+	}
+
+	// Tags are never readable anonymously
+	if _, err := store.SetContainerACL(context.Background(), "testaccount", "alpha", ContainerACL{PublicAccess: PublicAccessContainer}, AccessConditions{}); err != nil {
+		t.Fatalf("failed to set container ACL: %v", err)
+	}
+	anonymous := newAnonymousTestRouter(service)
+	for _, path := range []string{
+		"/blob/testaccount/alpha/a2?comp=tags",
+		"/blob/testaccount/alpha?restype=container&comp=blobs&where=" + url.QueryEscape(`"env"='prod'`),
+	} {
+		w := httptest.NewRecorder()
+		anonymous.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		expect(w, http.StatusNotFound, "ResourceNotFound")
+	}
+}
+
+// TestBlobService_AccessTiers tests x-ms-access-tier, Set Blob Tier, reads of
+// archived blobs and rehydration.
+func TestBlobService_AccessTiers(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	store.(*FileBlobStore).SetRehydrationDelays(time.Hour, 50*time.Millisecond)
+	router := newTestRouter(service)
+
+	const blobURL = "/blob/testaccount/testcontainer/backup.tar"
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	setTier := func(tier, priority string) *httptest.ResponseRecorder {
+		headers := map[string]string{"x-ms-access-tier": tier}
+		if priority != "" {
+			headers["x-ms-rehydrate-priority"] = priority
+		}
+		return do("PUT", blobURL+"?comp=tier", "", headers)
+	}
+	tierHeaders := func() string {
+		t.Helper()
+		h := do("HEAD", blobURL, "", nil).Header()
+		return strings.TrimSpace(fmt.Sprintf("%s %s %s", h.Get("x-ms-access-tier"), h.Get("x-ms-access-tier-inferred"), h.Get("x-ms-archive-status")))
+	}
+
+	// Blobs without a tier are reported in the inferred Hot tier
+	expect(do("PUT", blobURL, "data", map[string]string{"x-ms-blob-type": "BlockBlob"}), http.StatusCreated, "")
+	if got := tierHeaders(); got != "Hot true" {
+		t.Errorf("expected inferred Hot tier, got %q", got)
+	}
+	expect(do("PUT", blobURL, "data", map[string]string{"x-ms-blob-type": "BlockBlob", "x-ms-access-tier": "Frozen"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, "data", map[string]string{"x-ms-blob-type": "BlockBlob", "x-ms-access-tier": "Cool"}), http.StatusCreated, "")
+	if got := tierHeaders(); got != "Cool" {
+		t.Errorf("expected Cool tier, got %q", got)
+	}
+
+	// Set Blob Tier between online tiers keeps the ETag
+	etag := do("HEAD", blobURL, "", nil).Header().Get("ETag")
+	expect(setTier("Cold", ""), http.StatusOK, "")
+	h := do("HEAD", blobURL, "", nil).Header()
+	if h.Get("x-ms-access-tier") != "Cold" || h.Get("x-ms-access-tier-change-time") == "" || h.Get("ETag") != etag {
+		t.Errorf("unexpected properties after Set Blob Tier: %v", h)
+	}
+	expect(do("PUT", blobURL+"?comp=tier", "", nil), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(setTier("Hot", "Urgent"), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", "/blob/testaccount/testcontainer/missing?comp=tier", "", map[string]string{"x-ms-access-tier": "Hot"}), http.StatusNotFound, "BlobNotFound")
+	expect(do("PUT", "/blob/testaccount/testcontainer/log", "", map[string]string{"x-ms-blob-type": "AppendBlob"}), http.StatusCreated, "")
+	expect(do("PUT", "/blob/testaccount/testcontainer/log?comp=tier", "", map[string]string{"x-ms-access-tier": "Cool"}), http.StatusConflict, "InvalidBlobType")
+
+	// Archived blobs can't be read or modified, but their properties can be
+	expect(setTier("Archive", ""), http.StatusOK, "")
+	expect(do("GET", blobURL, "", nil), http.StatusConflict, "BlobArchived")
+	expect(do("PUT", blobURL+"?comp=metadata", "", map[string]string{"x-ms-meta-a": "b"}), http.StatusConflict, "BlobArchived")
+	expect(do("PUT", blobURL+"?comp=snapshot", "", nil), http.StatusConflict, "BlobArchived")
+	expect(do("PUT", "/blob/testaccount/testcontainer/copy.tar", "", map[string]string{
+		"x-ms-copy-source": "http://example.com/blob/testaccount/testcontainer/backup.tar",
+	}), http.StatusConflict, "BlobArchived")
+	expect(do("HEAD", blobURL, "", nil), http.StatusOK, "")
+
+	// Rehydration is accepted, and the blob stays archived until it completes
+	expect(setTier("Hot", ""), http.StatusAccepted, "")
+	if got := tierHeaders(); got != "Archive  rehydrate-pending-to-hot" {
+		t.Errorf("expected a pending rehydration, got %q", got)
+	}
+	expect(do("GET", blobURL, "", nil), http.StatusConflict, "BlobArchived")
+	expect(setTier("Cool", ""), http.StatusConflict, "BlobBeingRehydrated")
+	expect(setTier("Archive", ""), http.StatusConflict, "BlobBeingRehydrated")
+	w := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list", "", nil)
+	if !strings.Contains(w.Body.String(), "<ArchiveStatus>rehydrate-pending-to-hot</ArchiveStatus>") {
+		t.Errorf("expected the listing to report the rehydration: %s", w.Body.String())
+	}
+
+	// Raising the priority brings the rehydration forward
+	expect(setTier("Hot", "High"), http.StatusAccepted, "")
+	if h := do("HEAD", blobURL, "", nil).Header(); h.Get("x-ms-rehydrate-priority") != "High" {
+		t.Errorf("expected High rehydrate priority, got %q", h.Get("x-ms-rehydrate-priority"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tierHeaders() != "Hot" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := tierHeaders(); got != "Hot" {
+		t.Fatalf("expected the rehydration to complete, got %q", got)
+	}
+	w = do("GET", blobURL, "", nil)
+	expect(w, http.StatusOK, "")
+	if w.Body.String() != "data" {
+		t.Errorf("unexpected content after rehydration: %q", w.Body.String())
+	}
+}
+
+// TestBlobService_BlobBatch tests Blob Batch requests of Delete Blob and Set Blob
+// Tier sub-requests at the account and container level.
+func TestBlobService_BlobBatch(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	for _, name := range []string{"alpha", "beta"} {
+		if err := store.CreateContainer(context.Background(), "testaccount", name, CreateContainerOptions{}); err != nil {
+			t.Fatalf("failed to create container: %v", err)
+		}
+		for _, blob := range []string{"one", "two", "dir/three"} {
+			if _, err := store.PutBlob(context.Background(), "testaccount", name, blob, strings.NewReader("data"), PutBlobOptions{}); err != nil {
+				t.Fatalf("failed to put blob: %v", err)
+			}
+		}
+	}
+	router := newTestRouter(service)
+
+	const boundary = "batch_6c2f1d0e"
+	batchBody := func(requests ...string) string {
+		var b strings.Builder
+		for i, req := range requests {
+			fmt.Fprintf(&b, "--%s\r\nContent-Type: application/http\r\nContent-Transfer-Encoding: binary\r\nContent-ID: %d\r\n\r\n%s\r\n", boundary, i, req)
+		}
+		fmt.Fprintf(&b, "--%s--\r\n", boundary)
+		return b.String()
+	}
+	subRequest := func(method, path string, headers ...string) string {
+		return method + " " + path + " HTTP/1.1\r\n" + strings.Join(append(headers, "Content-Length: 0"), "\r\n") + "\r\n\r\n"
+	}
+	post := func(url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "multipart/mixed; boundary="+boundary)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// responses returns the Content-ID, status and error code of each sub-response.
+	responses := func(w *httptest.ResponseRecorder) []string {
+		t.Helper()
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202 Accepted, got %d: %s", w.Code, w.Body.String())
+		}
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" {
+			t.Fatalf("unexpected Content-Type %q", w.Header().Get("Content-Type"))
+		}
+		var results []string
+		reader := multipart.NewReader(w.Body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read batch response: %v", err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(part), nil)
+			if err != nil {
+				t.Fatalf("failed to read sub-response: %v", err)
+			}
+			results = append(results, fmt.Sprintf("%s %d %s", part.Header.Get("Content-ID"), resp.StatusCode, resp.Header.Get("x-ms-error-code")))
+		}
+		return results
+	}
+	exists := func(container, blob string) bool {
+		_, err := store.GetBlobProperties(context.Background(), "testaccount", container, blob, GetBlobOptions{})
+		return err == nil
+	}
+	expectError := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	// Sub-requests address blobs by their full path or relative to the account,
+	// and each gets its own response
+	w := post("/blob/testaccount?comp=batch", batchBody(
+		subRequest("DELETE", "/blob/testaccount/alpha/one", "x-ms-date: Mon, 01 Jan 2024 00:00:00 GMT"),
+		subRequest("DELETE", "/alpha/dir%2Fthree"),
+		subRequest("DELETE", "/alpha/missing"),
+	))
+	if got := strings.Join(responses(w), ", "); got != "0 202 , 1 202 , 2 404 BlobNotFound" {
+		t.Errorf("unexpected batch responses: %s", got)
+	}
+	if exists("alpha", "one") || exists("alpha", "dir/three") || !exists("alpha", "two") {
+		t.Errorf("expected the batch to delete alpha/one and alpha/dir/three only")
+	}
+
+	// Set Blob Tier sub-requests, within a container
+	w = post("/blob/testaccount/beta?restype=container&comp=batch", batchBody(
+		subRequest("PUT", "/beta/one?comp=tier", "x-ms-access-tier: Cool"),
+		subRequest("PUT", "/blob/testaccount/beta/two?comp=tier", "x-ms-access-tier: Archive"),
+	))
+	if got := strings.Join(responses(w), ", "); got != "0 200 , 1 200 " {
+		t.Errorf("unexpected batch responses: %s", got)
+	}
+	if blob, err := store.GetBlobProperties(context.Background(), "testaccount", "beta", "two", GetBlobOptions{}); err != nil || blob.AccessTier != AccessTierArchive {
+		t.Errorf("expected beta/two to be archived, got %+v, %v", blob, err)
+	}
+
+	// Sub-request paths are unescaped once, like any other request's, so an
+	// encoded ".." can't reach outside the container
+	w = post("/blob/testaccount/alpha?restype=container&comp=batch", batchBody(
+		subRequest("DELETE", "/alpha/..%2Fbeta%2Fone"),
+		subRequest("DELETE", "/alpha/%2E%2E/beta/one"),
+		subRequest("DELETE", "/alpha/%252E%252E%252Fbeta%252Fone"),
+	))
+	if got := strings.Join(responses(w), ", "); got != "0 400 InvalidUri, 1 400 InvalidUri, 2 404 BlobNotFound" {
+		t.Errorf("unexpected batch responses: %s", got)
+	}
+
+	// The whole batch is rejected if any sub-request can't be batched
+	expectError(post("/blob/testaccount/beta?restype=container&comp=batch", batchBody(
+		subRequest("DELETE", "/beta/one"),
+		subRequest("DELETE", "/alpha/two"),
+	)), http.StatusBadRequest, "InvalidInput")
+	expectError(post("/blob/testaccount?comp=batch", batchBody(
+		subRequest("DELETE", "/beta/one"),
+		subRequest("PUT", "/beta/two?comp=tier", "x-ms-access-tier: Hot"),
+	)), http.StatusBadRequest, "InvalidInput")
+	expectError(post("/blob/testaccount?comp=batch", batchBody(
+		subRequest("GET", "/beta/one"),
+	)), http.StatusBadRequest, "InvalidInput")
+	if !exists("beta", "one") {
+		t.Errorf("expected rejected batches to delete nothing")
+	}
+	var many []string
+	for i := 0; i < 257; i++ {
+		many = append(many, subRequest("DELETE", fmt.Sprintf("/beta/blob%d", i)))
+	}
+	expectError(post("/blob/testaccount?comp=batch", batchBody(many...)), http.StatusBadRequest, "InvalidInput")
+	expectError(post("/blob/testaccount?comp=batch", batchBody()), http.StatusBadRequest, "InvalidInput")
+	expectError(post("/blob/testaccount?comp=batch", "not multipart"), http.StatusBadRequest, "InvalidInput")
+	req := httptest.NewRequest("POST", "/blob/testaccount?comp=batch", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/xml")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	expectError(w, http.StatusBadRequest, "InvalidHeaderValue")
+}
+
+// TestBlobService_Immutability tests container retention policies, blob and
+// version immutability policies and legal holds, and the writes they refuse.
+func TestBlobService_Immutability(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	for _, name := range []string{"archive", "holds", "logs"} {
+		if err := store.CreateContainer(context.Background(), "testaccount", name, CreateContainerOptions{}); err != nil {
+			t.Fatalf("failed to create container: %v", err)
+		}
+	}
+	router := newTestRouter(service)
+
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	put := func(url string, headers map[string]string) *httptest.ResponseRecorder {
+		h := map[string]string{"x-ms-blob-type": "BlockBlob"}
+		for k, v := range headers {
+			h[k] = v
+		}
+		return do("PUT", url, "data", h)
+	}
+	policyBody := func(days int, appendWrites bool) string {
+		return fmt.Sprintf("<ImmutabilityPolicy><ImmutabilityPeriodSinceCreationInDays>%d</ImmutabilityPeriodSinceCreationInDays>"+
+			"<AllowProtectedAppendWrites>%t</AllowProtectedAppendWrites></ImmutabilityPolicy>", days, appendWrites)
+	}
+	const policyURL = "/blob/testaccount/archive?restype=container&comp=immutabilityPolicies"
+	const blobURL = "/blob/testaccount/archive/2024/ledger.csv"
+
+	// A container retention policy protects existing blobs but allows new ones
+	expect(put(blobURL, nil), http.StatusCreated, "")
+	expect(do("GET", policyURL, "", nil), http.StatusNotFound, "ImmutabilityPolicyNotFound")
+	expect(do("PUT", policyURL, policyBody(0, false), nil), http.StatusBadRequest, "InvalidXmlNodeValue")
+	expect(do("PUT", policyURL, policyBody(7, false), nil), http.StatusOK, "")
+	if h := do("HEAD", "/blob/testaccount/archive?restype=container", "", nil).Header(); h.Get("x-ms-has-immutability-policy") != "true" {
+		t.Errorf("expected x-ms-has-immutability-policy: true, got %q", h.Get("x-ms-has-immutability-policy"))
+	}
+	expect(put(blobURL, nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("DELETE", blobURL, "", nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("PUT", blobURL+"?comp=metadata", "", map[string]string{"x-ms-meta-note": "x"}), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("PUT", blobURL+"?comp=blocklist", "<BlockList></BlockList>", nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("DELETE", "/blob/testaccount/archive", "", nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(put("/blob/testaccount/archive/2024/new.csv", nil), http.StatusCreated, "")
+	if w := do("GET", blobURL, "", nil); w.Code != http.StatusOK || w.Body.String() != "data" {
+		t.Errorf("expected protected blob to stay readable, got %d %q", w.Code, w.Body.String())
+	}
+
+	// An unlocked policy can be shortened; a locked one can only be extended
+	expect(do("PUT", policyURL, policyBody(3, false), nil), http.StatusOK, "")
+	expect(do("PUT", policyURL, policyBody(5, false), map[string]string{"x-ms-immutability-policy-mode": "Locked"}), http.StatusOK, "")
+	var policy struct {
+		Days  int    `xml:"ImmutabilityPeriodSinceCreationInDays"`
+		State string `xml:"State"`
+	}
+	if err := xml.Unmarshal(do("GET", policyURL, "", nil).Body.Bytes(), &policy); err != nil || policy.Days != 5 || policy.State != "Locked" {
+		t.Errorf("expected a locked 5 day policy, got %+v, %v", policy, err)
+	}
+	expect(do("PUT", policyURL, policyBody(4, false), nil), http.StatusConflict, "ImmutabilityPolicyLocked")
+	expect(do("PUT", policyURL, policyBody(5, false), map[string]string{"x-ms-immutability-policy-mode": "Unlocked"}), http.StatusConflict, "ImmutabilityPolicyLocked")
+	expect(do("DELETE", policyURL, "", nil), http.StatusConflict, "ImmutabilityPolicyLocked")
+	expect(do("PUT", policyURL, policyBody(10, false), nil), http.StatusOK, "")
+
+	// Protected append writes let an append blob grow but not be rewritten
+	const logURL = "/blob/testaccount/logs/audit.log"
+	const logPolicyURL = "/blob/testaccount/logs?restype=container&comp=immutabilityPolicies"
+	expect(do("PUT", logURL, "", map[string]string{"x-ms-blob-type": "AppendBlob"}), http.StatusCreated, "")
+	expect(do("PUT", logPolicyURL, policyBody(1, false), nil), http.StatusOK, "")
+	expect(do("PUT", logURL+"?comp=appendblock", "entry", nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("PUT", logPolicyURL, policyBody(1, true), nil), http.StatusOK, "")
+	expect(do("PUT", logURL+"?comp=appendblock", "entry", nil), http.StatusCreated, "")
+	expect(do("PUT", logURL, "", map[string]string{"x-ms-blob-type": "AppendBlob"}), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("DELETE", logPolicyURL, "", nil), http.StatusOK, "")
+	expect(do("DELETE", logURL, "", nil), http.StatusAccepted, "")
+
+	// A legal hold protects a blob until it is cleared
+	const heldURL = "/blob/testaccount/holds/evidence.bin"
+	expect(put(heldURL, map[string]string{"x-ms-legal-hold": "true"}), http.StatusCreated, "")
+	if h := do("HEAD", heldURL, "", nil).Header(); h.Get("x-ms-legal-hold") != "true" {
+		t.Errorf("expected x-ms-legal-hold: true, got %q", h.Get("x-ms-legal-hold"))
+	}
+	expect(do("DELETE", heldURL, "", nil), http.StatusConflict, "BlobImmutableDueToLegalHold")
+	expect(do("DELETE", "/blob/testaccount/holds", "", nil), http.StatusConflict, "BlobImmutableDueToLegalHold")
+	expect(do("PUT", heldURL+"?comp=legalhold", "", nil), http.StatusBadRequest, "MissingRequiredHeader")
+	w := do("PUT", heldURL+"?comp=legalhold", "", map[string]string{"x-ms-legal-hold": "false"})
+	expect(w, http.StatusOK, "")
+	if w.Header().Get("x-ms-legal-hold") != "false" {
+		t.Errorf("expected x-ms-legal-hold: false, got %q", w.Header().Get("x-ms-legal-hold"))
+	}
+	expect(do("DELETE", heldURL, "", nil), http.StatusAccepted, "")
+
+	// A blob immutability policy protects a blob until it expires or is deleted
+	until := formatHTTPDate(time.Now().Add(time.Hour))
+	expect(put(heldURL, map[string]string{"x-ms-immutability-policy-until-date": formatHTTPDate(time.Now().Add(-time.Hour))}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(put(heldURL, map[string]string{"x-ms-immutability-policy-mode": "Locked"}), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(put(heldURL, map[string]string{"x-ms-immutability-policy-until-date": until}), http.StatusCreated, "")
+	if h := do("HEAD", heldURL, "", nil).Header(); h.Get("x-ms-immutability-policy-until-date") != until || h.Get("x-ms-immutability-policy-mode") != "Unlocked" {
+		t.Errorf("unexpected immutability policy headers: %v", h)
+	}
+	expect(put(heldURL, nil), http.StatusConflict, "BlobImmutableDueToPolicy")
+	expect(do("DELETE", heldURL+"?comp=immutabilityPolicies", "", nil), http.StatusOK, "")
+	expect(put(heldURL, nil), http.StatusCreated, "")
+	expect(do("PUT", heldURL+"?comp=immutabilityPolicies", "", nil), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(do("PUT", heldURL+"?comp=immutabilityPolicies", "", map[string]string{
+		"x-ms-immutability-policy-until-date": until,
+		"x-ms-immutability-policy-mode":       "Locked",
+	}), http.StatusOK, "")
+	expect(do("DELETE", heldURL+"?comp=immutabilityPolicies", "", nil), http.StatusConflict, "ImmutabilityPolicyLocked")
+	expect(do("PUT", heldURL+"?comp=immutabilityPolicies", "", map[string]string{
+		"x-ms-immutability-policy-until-date": formatHTTPDate(time.Now().Add(time.Minute)),
+		"x-ms-immutability-policy-mode":       "Locked",
+	}), http.StatusConflict, "ImmutabilityPolicyLocked")
+
+	// Listings report immutability policies and legal holds when asked to
+	w = do("GET", "/blob/testaccount/holds?restype=container&comp=list&include=immutabilitypolicy,legalhold", "", nil)
+	for _, want := range []string{"<ImmutabilityPolicyUntilDate>" + until, "<ImmutabilityPolicyMode>Locked", "<LegalHold>false"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected listing to contain %q, got %s", want, w.Body.String())
+		}
+	}
+
+	// Append blobs, page blobs and copies can be protected when they are created
+	creates := map[string]map[string]string{
+		"/blob/testaccount/holds/held.log":  {"x-ms-blob-type": "AppendBlob"},
+		"/blob/testaccount/holds/held.vhd":  {"x-ms-blob-type": "PageBlob", "x-ms-blob-content-length": "512"},
+		"/blob/testaccount/holds/held.copy": {"x-ms-copy-source": "http://example.com" + heldURL},
+		"/blob/testaccount/holds/held.url":  {"x-ms-blob-type": "BlockBlob", "x-ms-copy-source": "http://example.com" + heldURL},
+	}
+	for createURL, headers := range creates {
+		created := map[string]string{"x-ms-immutability-policy-until-date": formatHTTPDate(time.Now().Add(-time.Hour))}
+		for k, v := range headers {
+			created[k] = v
+		}
+		expect(do("PUT", createURL, "", created), http.StatusBadRequest, "InvalidHeaderValue")
+		created["x-ms-immutability-policy-until-date"] = until
+		created["x-ms-legal-hold"] = "true"
+		if w := do("PUT", createURL, "", created); w.Code != http.StatusCreated && w.Code != http.StatusAccepted {
+			t.Errorf("%s: expected the blob to be created, got %d: %s", createURL, w.Code, w.Body.String())
+		}
+		h := do("HEAD", createURL, "", nil).Header()
+		if h.Get("x-ms-legal-hold") != "true" || h.Get("x-ms-immutability-policy-until-date") != until {
+			t.Errorf("%s: expected a legal hold and immutability policy, got %v", createURL, h)
+		}
+		expect(do("DELETE", createURL, "", nil), http.StatusConflict, "BlobImmutableDueToLegalHold")
+	}
+
+	// Previous versions can be protected on their own
+	expect(do("PUT", "/blob/testaccount?restype=service&comp=properties",
+		"<StorageServiceProperties><IsVersioningEnabled>true</IsVersioningEnabled></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	const versionedURL = "/blob/testaccount/holds/contract.pdf"
+	versionID := put(versionedURL, nil).Header().Get("x-ms-version-id")
+	expect(put(versionedURL, nil), http.StatusCreated, "")
+	expect(do("PUT", versionedURL+"?comp=legalhold&versionid="+url.QueryEscape(versionID), "", map[string]string{"x-ms-legal-hold": "true"}), http.StatusOK, "")
+	expect(do("PUT", versionedURL+"?comp=metadata&versionid="+url.QueryEscape(versionID), "", nil), http.StatusBadRequest, "InvalidQueryParameterValue")
+	expect(do("DELETE", versionedURL+"?versionid="+url.QueryEscape(versionID), "", nil), http.StatusConflict, "BlobImmutableDueToLegalHold")
+	expect(do("DELETE", versionedURL, "", nil), http.StatusAccepted, "")
+}
+
+// TestBlobService_ContentHashes tests that uploads are checked against their
+// Content-MD5 or x-ms-content-crc64, that Put Blob stores the blob's MD5, and
+// that range reads can return a transactional MD5 or CRC64.
+func TestBlobService_ContentHashes(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	md5Of := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	crc64Of := func(s string) string {
+		return encodeCRC64(crc64.Checksum([]byte(s), crc64Table))
+	}
+	const blobURL = "/blob/testaccount/testcontainer/greeting.txt"
+	const content = "hello world"
+
+	// A matching hash is accepted and echoed; a mismatched one leaves the blob alone
+	w := do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob", "Content-MD5": md5Of(content)})
+	expect(w, http.StatusCreated, "")
+	if got := w.Header().Get("Content-MD5"); got != md5Of(content) {
+		t.Errorf("expected Content-MD5 %q, got %q", md5Of(content), got)
+	}
+	expect(do("PUT", blobURL, "goodbye", map[string]string{"x-ms-blob-type": "BlockBlob", "Content-MD5": md5Of(content)}), http.StatusBadRequest, "Md5Mismatch")
+	expect(do("PUT", blobURL, "goodbye", map[string]string{"x-ms-blob-type": "BlockBlob", contentCRC64Header: crc64Of(content)}), http.StatusBadRequest, "Crc64Mismatch")
+	if w := do("GET", blobURL, "", nil); w.Body.String() != content {
+		t.Errorf("expected a rejected upload to leave %q, got %q", content, w.Body.String())
+	}
+	w = do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob", contentCRC64Header: crc64Of(content)})
+	expect(w, http.StatusCreated, "")
+	if got := w.Header().Get(contentCRC64Header); got != crc64Of(content) {
+		t.Errorf("expected %s %q, got %q", contentCRC64Header, crc64Of(content), got)
+	}
+
+	// Malformed hashes, or both at once, are rejected
+	expect(do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob", "Content-MD5": "not-a-hash"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob", contentCRC64Header: md5Of(content)}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("PUT", blobURL, content, map[string]string{
+		"x-ms-blob-type":   "BlockBlob",
+		"Content-MD5":      md5Of(content),
+		contentCRC64Header: crc64Of(content),
+	}), http.StatusBadRequest, "InvalidHeaderValue")
+
+	// The blob's MD5 is computed when none is sent, and returned on reads and in listings
+	expect(do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob"}), http.StatusCreated, "")
+	for _, method := range []string{"GET", "HEAD"} {
+		if got := do(method, blobURL, "", nil).Header().Get("Content-MD5"); got != md5Of(content) {
+			t.Errorf("expected %s Content-MD5 %q, got %q", method, md5Of(content), got)
+		}
+	}
+	if w := do("GET", "/blob/testaccount/testcontainer?restype=container&comp=list", "", nil); !strings.Contains(w.Body.String(), "<Content-MD5>"+md5Of(content)+"</Content-MD5>") {
+		t.Errorf("expected listing to contain the blob's MD5, got %s", w.Body.String())
+	}
+	expect(do("PUT", blobURL, content, map[string]string{"x-ms-blob-type": "BlockBlob", "x-ms-blob-content-md5": md5Of("other")}), http.StatusCreated, "")
+	if got := do("HEAD", blobURL, "", nil).Header().Get("Content-MD5"); got != md5Of("other") {
+		t.Errorf("expected the MD5 set by the client to be kept, got %q", got)
+	}
+
+	// A mismatched block isn't staged
+	blockID := base64.StdEncoding.EncodeToString([]byte("block-0"))
+	blockURL := "/blob/testaccount/testcontainer/blocks.txt?comp=block&blockid=" + url.QueryEscape(blockID)
+	expect(do("PUT", blockURL, "goodbye", map[string]string{"Content-MD5": md5Of(content)}), http.StatusBadRequest, "Md5Mismatch")
+	expect(do("PUT", blockURL, "goodbye", map[string]string{contentCRC64Header: crc64Of(content)}), http.StatusBadRequest, "Crc64Mismatch")
+	blockList := "<BlockList><Latest>" + blockID + "</Latest></BlockList>"
+	expect(do("PUT", "/blob/testaccount/testcontainer/blocks.txt?comp=blocklist", blockList, nil), http.StatusBadRequest, "InvalidBlockList")
+	w = do("PUT", blockURL, content, map[string]string{contentCRC64Header: crc64Of(content)})
+	expect(w, http.StatusCreated, "")
+	if got := w.Header().Get(contentCRC64Header); got != crc64Of(content) {
+		t.Errorf("expected %s %q, got %q", contentCRC64Header, crc64Of(content), got)
+	}
+	expect(do("PUT", "/blob/testaccount/testcontainer/blocks.txt?comp=blocklist", blockList, nil), http.StatusCreated, "")
+
+	// Range reads return the hash of the range, and the blob's MD5 separately
+	w = do("GET", blobURL, "", map[string]string{"Range": "bytes=0-4", "x-ms-range-get-content-crc64": "true"})
+	expect(w, http.StatusPartialContent, "")
+	if got := w.Header().Get(contentCRC64Header); got != crc64Of("hello") {
+		t.Errorf("expected range CRC64 %q, got %q", crc64Of("hello"), got)
+	}
+	if w.Header().Get("Content-MD5") != "" || w.Header().Get("x-ms-blob-content-md5") != md5Of("other") {
+		t.Errorf("expected only x-ms-blob-content-md5 on a range read, got %v", w.Header())
+	}
+	w = do("GET", blobURL, "", map[string]string{"Range": "bytes=6-10", "x-ms-range-get-content-md5": "true"})
+	if got := w.Header().Get("Content-MD5"); got != md5Of("world") {
+		t.Errorf("expected range MD5 %q, got %q", md5Of("world"), got)
+	}
+	expect(do("GET", blobURL, "", map[string]string{"x-ms-range-get-content-crc64": "true"}), http.StatusBadRequest, "InvalidHeaderValue")
+	expect(do("GET", blobURL, "", map[string]string{
+		"Range":                        "bytes=0-4",
+		"x-ms-range-get-content-md5":   "true",
+		"x-ms-range-get-content-crc64": "true",
+	}), http.StatusBadRequest, "InvalidHeaderValue")
+}
+
+// readAvroRecords decodes the records of an uncompressed Avro object container
+// file, using the schema in its header.
+func readAvroRecords(t *testing.T, data []byte) []map[string]any {
+	t.Helper()
+	r := bytes.NewReader(data)
+	read := func(n int64) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatalf("truncated Avro file: %v", err)
+		}
+		return b
+	}
+	readLong := func() int64 {
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			t.Fatalf("truncated Avro file: %v", err)
+		}
+		return v
+	}
+	readBytes := func() []byte { return read(readLong()) }
+
+	if string(read(4)) != "Obj\x01" {
+		t.Fatalf("expected an Avro object container file")
+	}
+	meta := make(map[string]string)
+	for n := readLong(); n != 0; n = readLong() {
+		for ; n > 0; n-- {
+			key := string(readBytes())
+			meta[key] = string(readBytes())
+		}
+	}
+	var schema any
+	if err := json.Unmarshal([]byte(meta["avro.schema"]), &schema); err != nil || meta["avro.codec"] != "null" {
+		t.Fatalf("unexpected Avro file metadata %v", meta)
+	}
+	sync := read(16)
+
+	var decode func(schema any) any
+	decode = func(schema any) any {
+		switch s := schema.(type) {
+		case string:
+			switch s {
+			case "null":
+				return nil
+			case "int", "long":
+				return readLong()
+			case "string":
+				return string(readBytes())
+			}
+		case []any:
+			return decode(s[readLong()])
+		case map[string]any:
+			switch s["type"] {
+			case "record":
+				record := make(map[string]any)
+				for _, f := range s["fields"].([]any) {
+					field := f.(map[string]any)
+					record[field["name"].(string)] = decode(field["type"])
+				}
+				return record
+			case "enum":
+				return s["symbols"].([]any)[readLong()]
+			case "map":
+				m := make(map[string]any)
+				for n := readLong(); n != 0; n = readLong() {
+					for ; n > 0; n-- {
+						key := string(readBytes())
+						m[key] = decode(s["values"])
+					}
+				}
+				return m
+			}
+		}
+		t.Fatalf("unsupported Avro schema %v", schema)
+		return nil
+	}
+
+	var records []map[string]any
+	for r.Len() > 0 {
+		count := readLong()
+		readLong() // block size
+		for ; count > 0; count-- {
+			records = append(records, decode(schema).(map[string]any))
+		}
+		if !bytes.Equal(read(16), sync) {
+			t.Fatalf("Avro block doesn't end with the file's sync marker")
+		}
+	}
+	return records
+}
+
+// TestBlobService_ChangeFeed tests that blob changes are recorded in the
+// $blobchangefeed container in the layout Azure's change feed readers expect.
+func TestBlobService_ChangeFeed(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	service.EnableChangeFeed()
+	if err := store.CreateContainer(context.Background(), "testaccount", "photos", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	router := newTestRouter(service)
+
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("expected %d, got %d: %s", status, w.Code, w.Body.String())
+		}
+	}
+	const blobURL = "/blob/testaccount/photos/2024/cat.jpg"
+	const clientRequestID = "6d4b1a5e-3f0c-4a7e-9c59-2f1f8e0b7a11"
+
+	// Nothing is published until something changes
+	if exists, _ := store.ContainerExists(context.Background(), "testaccount", changeFeedContainer); exists {
+		t.Fatalf("expected no change feed container before any change")
+	}
+
+	put := do("PUT", blobURL, "meow", map[string]string{
+		"x-ms-blob-type":         "BlockBlob",
+		"Content-Type":           "image/jpeg",
+		"x-ms-client-request-id": clientRequestID,
+	})
+	expect(put, http.StatusCreated)
+	expect(do("PUT", blobURL+"?comp=properties", "", map[string]string{"x-ms-blob-content-type": "image/png"}), http.StatusOK)
+	expect(do("PUT", blobURL+"?comp=metadata", "", map[string]string{"x-ms-meta-owner": "alice"}), http.StatusOK)
+	expect(do("PUT", blobURL+"?comp=tier", "", map[string]string{"x-ms-access-tier": "Sideways"}), http.StatusBadRequest)
+	expect(do("PUT", blobURL+"?comp=tier", "", map[string]string{"x-ms-access-tier": "Cool"}), http.StatusOK)
+	snapshot := do("PUT", blobURL+"?comp=snapshot", "", nil).Header().Get("x-ms-snapshot")
+	expect(do("DELETE", blobURL+"?snapshot="+url.QueryEscape(snapshot), "", nil), http.StatusAccepted)
+	expect(do("GET", blobURL, "", nil), http.StatusOK)
+	expect(do("DELETE", blobURL, "", nil), http.StatusAccepted)
+
+	// A service started later on the same store carries on with the same feed
+	restarted := NewBlobService(store, service.logger)
+	restarted.EnableChangeFeed()
+	router = newTestRouter(restarted)
+	expect(do("PUT", "/blob/testaccount/photos/disk.vhd", "", map[string]string{
+		"x-ms-blob-type":           "PageBlob",
+		"x-ms-blob-content-length": "512",
+	}), http.StatusCreated)
+
+	// meta/segments.json points at the segment being written, which lists its chunks
+	var segments struct {
+		LastConsumable time.Time `json:"lastConsumable"`
+	}
+	w := do("GET", "/blob/testaccount/$blobchangefeed/meta/segments.json", "", nil)
+	expect(w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &segments); err != nil {
+		t.Fatalf("failed to parse segments.json: %v", err)
+	}
+	var manifest struct {
+		Status         string   `json:"status"`
+		ChunkFilePaths []string `json:"chunkFilePaths"`
+	}
+	w = do("GET", "/blob/testaccount/$blobchangefeed/idx/segments/"+segments.LastConsumable.Format("2006/01/02/1504")+"/meta.json", "", nil)
+	expect(w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("failed to parse segment manifest: %v", err)
+	}
+	wantChunks := "$blobchangefeed/log/00/" + segments.LastConsumable.Format("2006/01/02/1504") + "/"
+	if manifest.Status != "Publishing" || len(manifest.ChunkFilePaths) != 1 || manifest.ChunkFilePaths[0] != wantChunks {
+		t.Errorf("expected a Publishing segment with chunks in %s, got %+v", wantChunks, manifest)
+	}
+
+	// The records are read from the chunks of every segment, oldest first
+	chunks, err := store.ListBlobs(context.Background(), "testaccount", changeFeedContainer, ListBlobsOptions{Prefix: "log/"})
+	if err != nil {
+		t.Fatalf("failed to list change feed chunks: %v", err)
+	}
+	var events []map[string]any
+	for _, chunk := range chunks.Blobs {
+		w := do("GET", "/blob/testaccount/$blobchangefeed/"+chunk.Name, "", nil)
+		expect(w, http.StatusOK)
+		events = append(events, readAvroRecords(t, w.Body.Bytes())...)
+	}
+
+	want := []struct {
+		eventType, api, subject, blobType, snapshot string
+		contentLength                               int64
+	}{
+		{"BlobCreated", "PutBlob", "photos/blobs/2024/cat.jpg", "BlockBlob", "", 4},
+		{"BlobPropertiesUpdated", "SetBlobProperties", "photos/blobs/2024/cat.jpg", "BlockBlob", "", 4},
+		{"BlobPropertiesUpdated", "SetBlobMetadata", "photos/blobs/2024/cat.jpg", "BlockBlob", "", 4},
+		{"BlobTierChanged", "SetBlobTier", "photos/blobs/2024/cat.jpg", "BlockBlob", "", 4},
+		{"BlobDeleted", "DeleteBlob", "photos/blobs/2024/cat.jpg", "BlockBlob", snapshot, 4},
+		{"BlobDeleted", "DeleteBlob", "photos/blobs/2024/cat.jpg", "BlockBlob", "", 4},
+		{"BlobCreated", "PutBlob", "photos/blobs/disk.vhd", "PageBlob", "", 512},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d change feed events, got %d: %v", len(want), len(events), events)
+	}
+	lastSequencer := ""
+	for i, event := range events {
+		data := event["data"].(map[string]any)
+		snapshot, _ := data["snapshot"].(string)
+		if event["eventType"] != want[i].eventType || data["api"] != want[i].api ||
+			event["subject"] != "/blobServices/default/containers/"+want[i].subject ||
+			data["blobType"] != want[i].blobType || data["contentLength"] != want[i].contentLength || snapshot != want[i].snapshot {
+			t.Errorf("event %d: expected %+v, got %v", i, want[i], event)
+		}
+		if event["topic"] != "/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/bluestack/providers/Microsoft.Storage/storageAccounts/testaccount" {
+			t.Errorf("event %d: unexpected topic %v", i, event["topic"])
+		}
+		if sequencer := data["sequencer"].(string); sequencer <= lastSequencer {
+			t.Errorf("event %d: expected sequencer after %s, got %s", i, lastSequencer, sequencer)
+		} else {
+			lastSequencer = sequencer
+		}
+	}
+
+	first := events[0]["data"].(map[string]any)
+	if first["clientRequestId"] != clientRequestID || first["requestId"] != put.Header().Get("x-ms-request-id") {
+		t.Errorf("expected the request IDs of the Put Blob request, got %v", first)
+	}
+	if first["contentType"] != "image/jpeg" || first["etag"] != strings.Trim(put.Header().Get("ETag"), `"`) {
+		t.Errorf("expected the blob's content type and ETag, got %v", first)
+	}
+	if first["url"] != "http://example.com/blob/testaccount/photos/2024/cat.jpg" {
+		t.Errorf("unexpected blob URL %v", first["url"])
+	}
+
+	// Clients can read the change feed but not write to or delete it
+	for _, req := range []struct{ method, url string }{
+		{"PUT", "/blob/testaccount/$blobchangefeed/meta/segments.json"},
+		{"DELETE", "/blob/testaccount/$blobchangefeed/" + chunks.Blobs[0].Name},
+		{"PUT", "/blob/testaccount/$blobchangefeed?restype=container&comp=metadata"},
+		{"DELETE", "/blob/testaccount/$blobchangefeed?restype=container"},
+	} {
+		w := do(req.method, req.url, "{}", map[string]string{"x-ms-blob-type": "BlockBlob"})
+		if w.Code != http.StatusForbidden || w.Header().Get("x-ms-error-code") != "AuthorizationPermissionMismatch" {
+			t.Errorf("%s %s: expected 403 AuthorizationPermissionMismatch, got %d %q", req.method, req.url, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	expect(do("GET", "/blob/testaccount/$blobchangefeed/meta/segments.json", "", nil), http.StatusOK)
+	expect(do("GET", "/blob/testaccount/$blobchangefeed?restype=container&comp=list", "", nil), http.StatusOK)
+}
+
+// TestBlobService_ChangeFeedBackgroundChanges tests that changes completed
+// after their request, by background copies and rehydrations, are recorded in
+// the change feed when they complete.
+func TestBlobService_ChangeFeedBackgroundChanges(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	service.EnableChangeFeed()
+	if err := store.CreateContainer(context.Background(), "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	store.(*FileBlobStore).SetRehydrationDelays(time.Hour, 50*time.Millisecond)
+	router := newTestRouter(service)
+
+	release := make(chan struct{})
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.txt":
+			w.Write([]byte("hello from stub"))
+		case "/slow.bin":
+			w.Header().Set("Content-Length", "8")
+			w.Write([]byte("half"))
+			w.(http.Flusher).Flush()
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer stub.Close()
+	defer close(release)
+
+	do := func(method, url string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("expected %d, got %d: %s", status, w.Code, w.Body.String())
+		}
+	}
+	// waitFor polls Get Blob Properties until header no longer has the value it
+	// has while the change is in progress.
+	waitFor := func(url, header, inProgress string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for do("HEAD", url, nil).Header().Get(header) == inProgress {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s to change", header)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	events := func() []string {
+		t.Helper()
+		chunks, err := store.ListBlobs(context.Background(), "testaccount", changeFeedContainer, ListBlobsOptions{Prefix: "log/"})
+		if err != nil {
+			t.Fatalf("failed to list change feed chunks: %v", err)
+		}
+		var events []string
+		for _, chunk := range chunks.Blobs {
+			w := do("GET", "/blob/testaccount/$blobchangefeed/"+chunk.Name, nil)
+			expect(w, http.StatusOK)
+			for _, event := range readAvroRecords(t, w.Body.Bytes()) {
+				data := event["data"].(map[string]any)
+				subject := strings.TrimPrefix(event["subject"].(string), "/blobServices/default/containers/testcontainer/blobs/")
+				events = append(events, fmt.Sprintf("%s %s %s %d", event["eventType"], data["api"], subject, data["contentLength"]))
+			}
+		}
+		return events
+	}
+
+	// A copy from a URL is recorded once it completes, and not if it is aborted
+	copied := "/blob/testaccount/testcontainer/copied.txt"
+	expect(do("PUT", copied, map[string]string{"x-ms-copy-source": stub.URL + "/data.txt"}), http.StatusAccepted)
+	waitFor(copied, "x-ms-copy-status", "pending")
+	aborted := "/blob/testaccount/testcontainer/aborted.bin"
+	w := do("PUT", aborted, map[string]string{"x-ms-copy-source": stub.URL + "/slow.bin"})
+	expect(w, http.StatusAccepted)
+	expect(do("PUT", aborted+"?comp=copy&copyid="+w.Header().Get("x-ms-copy-id"), map[string]string{"x-ms-copy-action": "abort"}), http.StatusNoContent)
+	expect(do("PUT", copied, map[string]string{"x-ms-copy-source": stub.URL + "/data.txt", "x-ms-requires-sync": "true"}), http.StatusAccepted)
+
+	// A rehydration is recorded when it starts and when it completes
+	archived := "/blob/testaccount/testcontainer/backup.tar"
+	expect(do("PUT", archived, map[string]string{"x-ms-blob-type": "BlockBlob", "x-ms-access-tier": "Archive"}), http.StatusCreated)
+	expect(do("PUT", archived+"?comp=tier", map[string]string{"x-ms-access-tier": "Hot", "x-ms-rehydrate-priority": "High"}), http.StatusAccepted)
+	waitFor(archived, "x-ms-access-tier", "Archive")
+
+	want := []string{
+		"BlobCreated CopyBlob copied.txt 15",
+		"BlobCreated CopyBlob copied.txt 15",
+		"BlobCreated PutBlob backup.tar 0",
+		"BlobTierChanged SetBlobTier backup.tar 0",
+		"BlobTierChanged SetBlobTier backup.tar 0",
+	}
+	// The rehydration is recorded after the blob's tier changes
+	deadline := time.Now().Add(5 * time.Second)
+	got := events()
+	for len(got) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got = events()
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// TestWebService_StaticWebsite tests enabling a static website through the blob
+// service properties and serving the $web container on the web endpoint.
+func TestWebService_StaticWebsite(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	router := newTestRouter(service)
+	web := chi.NewRouter()
+	web.Route("/web", NewWebService(store, service.logger).RegisterRoutes)
+
+	do := func(router http.Handler, method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	expectPage := func(url, body, contentType string) {
+		t.Helper()
+		w := do(web, "GET", url, "", nil)
+		if w.Code != http.StatusOK || w.Body.String() != body || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("GET %s: expected 200 %q (%s), got %d %q (%s)", url, body, contentType, w.Code, w.Body.String(), w.Header().Get("Content-Type"))
+		}
+	}
+	const propertiesURL = "/blob/testaccount?restype=service&comp=properties"
+
+	// The website is disabled until the service properties enable it
+	expect(do(web, "GET", "/web/testaccount/", "", nil), http.StatusNotFound, "WebsiteDisabled")
+	if w := do(router, "GET", propertiesURL, "", nil); !strings.Contains(w.Body.String(), "<StaticWebsite><Enabled>false</Enabled></StaticWebsite>") {
+		t.Errorf("expected a disabled static website, got %s", w.Body.String())
+	}
+	expect(do(router, "PUT", propertiesURL, "<StorageServiceProperties><StaticWebsite><Enabled>true</Enabled>"+
+		"<IndexDocument>index.html</IndexDocument><ErrorDocument404Path>/404.html</ErrorDocument404Path>"+
+		"</StaticWebsite></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	if exists, _ := store.ContainerExists(context.Background(), "testaccount", "$web"); !exists {
+		t.Fatalf("expected enabling the static website to create $web")
+	}
+	if w := do(router, "GET", propertiesURL, "", nil); !strings.Contains(w.Body.String(),
+		"<StaticWebsite><Enabled>true</Enabled><IndexDocument>index.html</IndexDocument><ErrorDocument404Path>404.html</ErrorDocument404Path></StaticWebsite>") {
+		t.Errorf("expected the static website settings, got %s", w.Body.String())
+	}
+
+	for name, content := range map[string]string{
+		"index.html":      "<h1>home</h1>",
+		"docs/index.html": "<h1>docs</h1>",
+		"app.js":          "console.log(1)",
+		"404.html":        "<h1>not found</h1>",
+	} {
+		expect(do(router, "PUT", "/blob/testaccount/$web/"+name, content, map[string]string{"x-ms-blob-type": "BlockBlob"}), http.StatusCreated, "")
+	}
+	expect(do(router, "PUT", "/blob/testaccount/$web/about.html", "<h1>about</h1>", map[string]string{
+		"x-ms-blob-type": "BlockBlob",
+		"Content-Type":   "text/html",
+		"Cache-Control":  "max-age=60",
+	}), http.StatusCreated, "")
+
+	// Directories resolve to their index document, and content types follow extensions
+	html := mime.TypeByExtension(".html")
+	expectPage("/web/testaccount", "<h1>home</h1>", html)
+	expectPage("/web/testaccount/", "<h1>home</h1>", html)
+	expectPage("/web/testaccount/docs", "<h1>docs</h1>", html)
+	expectPage("/web/testaccount/docs/", "<h1>docs</h1>", html)
+	expectPage("/web/testaccount/app.js", "console.log(1)", mime.TypeByExtension(".js"))
+	expectPage("/web/testaccount/about.html", "<h1>about</h1>", "text/html")
+	if w := do(web, "HEAD", "/web/testaccount/about.html", "", nil); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "max-age=60" {
+		t.Errorf("expected HEAD to return the blob's headers, got %d %v", w.Code, w.Header())
+	}
+	etag := do(web, "GET", "/web/testaccount/app.js", "", nil).Header().Get("ETag")
+	expect(do(web, "GET", "/web/testaccount/app.js", "", map[string]string{"If-None-Match": etag}), http.StatusNotModified, "")
+
+	// Anything else gets the 404 document
+	w := do(web, "GET", "/web/testaccount/no/such/page", "", nil)
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>not found</h1>" {
+		t.Errorf("expected the 404 document, got %d %q", w.Code, w.Body.String())
+	}
+	expect(do(web, "PUT", "/web/testaccount/index.html", "x", nil), http.StatusMethodNotAllowed, "")
+
+	// $web is only public on the web endpoint
+	expect(do(newAnonymousTestRouter(service), "GET", "/blob/testaccount/$web/index.html", "", nil), http.StatusNotFound, "ResourceNotFound")
+
+	// Without a 404 document, missing pages get an error page
+	expect(do(router, "PUT", propertiesURL, "<StorageServiceProperties><StaticWebsite><Enabled>true</Enabled>"+
+		"<IndexDocument>index.html</IndexDocument></StaticWebsite></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	w = do(web, "GET", "/web/testaccount/missing.html", "", nil)
+	expect(w, http.StatusNotFound, "WebContentNotFound")
+	if w.Header().Get("Content-Type") != "text/html" {
+		t.Errorf("expected an HTML error page, got %s", w.Header().Get("Content-Type"))
+	}
+
+	// Disabling the website keeps $web but stops serving it
+	expect(do(router, "PUT", propertiesURL, "<StorageServiceProperties><StaticWebsite><Enabled>false</Enabled>"+
+		"<IndexDocument>index.html</IndexDocument></StaticWebsite></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	expect(do(web, "GET", "/web/testaccount/index.html", "", nil), http.StatusNotFound, "WebsiteDisabled")
+	if w := do(router, "GET", propertiesURL, "", nil); !strings.Contains(w.Body.String(), "<StaticWebsite><Enabled>false</Enabled></StaticWebsite>") {
+		t.Errorf("expected a disabled static website, got %s", w.Body.String())
+	}
+}
+
+// TestBlobService_Cors tests storing CORS rules in the service properties,
+// preflight requests, and the CORS headers of cross-origin requests.
+func TestBlobService_Cors(t *testing.T) {
+	service, _, cleanup := setupTestService(t)
+	defer cleanup()
+
+	router := newTestRouter(service)
+	do := func(method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+	expectHeaders := func(w *httptest.ResponseRecorder, want map[string]string) {
+		t.Helper()
+		for k, v := range want {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("expected %s %q, got %q", k, v, got)
+			}
+		}
+	}
+	preflight := func(url, origin, method, headers string) *httptest.ResponseRecorder {
+		h := map[string]string{"Origin": origin, "Access-Control-Request-Method": method}
+		if headers != "" {
+			h["Access-Control-Request-Headers"] = headers
+		}
+		return do("OPTIONS", url, "", h)
+	}
+	const (
+		propertiesURL = "/blob/testaccount?restype=service&comp=properties"
+		blobURL       = "/blob/testaccount/uploads/photo.jpg"
+		app           = "https://app.example.com"
+		other         = "https://other.example.com"
+	)
+	const rules = "<Cors>" +
+		"<CorsRule><AllowedOrigins>https://app.example.com,https://admin.example.com</AllowedOrigins>" +
+		"<AllowedMethods>GET,PUT</AllowedMethods><MaxAgeInSeconds>300</MaxAgeInSeconds>" +
+		"<ExposedHeaders>x-ms-request-id,ETag</ExposedHeaders><AllowedHeaders>x-ms-blob-type,x-ms-meta-*</AllowedHeaders></CorsRule>" +
+		"<CorsRule><AllowedOrigins>*</AllowedOrigins><AllowedMethods>GET</AllowedMethods><MaxAgeInSeconds>60</MaxAgeInSeconds>" +
+		"<ExposedHeaders></ExposedHeaders><AllowedHeaders></AllowedHeaders></CorsRule>" +
+		"</Cors>"
+
+	// Preflight requests fail until the account has rules
+	expect(preflight(blobURL, app, "PUT", ""), http.StatusForbidden, "CorsPreflightFailure")
+	expect(do("OPTIONS", blobURL, "", map[string]string{"Access-Control-Request-Method": "PUT"}), http.StatusBadRequest, "MissingRequiredHeader")
+	expect(do("OPTIONS", blobURL, "", map[string]string{"Origin": app}), http.StatusBadRequest, "MissingRequiredHeader")
+	if w := do("GET", propertiesURL, "", nil); !strings.Contains(w.Body.String(), "<Cors></Cors>") {
+		t.Errorf("expected no CORS rules, got %s", w.Body.String())
+	}
+
+	expect(do("PUT", propertiesURL, "<StorageServiceProperties>"+rules+"</StorageServiceProperties>", nil), http.StatusAccepted, "")
+	if w := do("GET", propertiesURL, "", nil); !strings.Contains(w.Body.String(), rules) {
+		t.Errorf("expected the CORS rules, got %s", w.Body.String())
+	}
+	expect(do("PUT", "/blob/testaccount/uploads?restype=container", "", nil), http.StatusCreated, "")
+
+	// Preflight requests match the origin, method and every requested header
+	w := preflight(blobURL, app, "PUT", "x-ms-blob-type,X-MS-Meta-Owner")
+	expect(w, http.StatusOK, "")
+	expectHeaders(w, map[string]string{
+		"Access-Control-Allow-Origin":      app,
+		"Access-Control-Allow-Methods":     "PUT",
+		"Access-Control-Allow-Headers":     "x-ms-blob-type,X-MS-Meta-Owner",
+		"Access-Control-Max-Age":           "300",
+		"Access-Control-Allow-Credentials": "true",
+	})
+	expect(preflight(blobURL, app, "PUT", "x-ms-blob-type,content-type"), http.StatusForbidden, "CorsPreflightFailure")
+	expect(preflight(blobURL, app, "DELETE", ""), http.StatusForbidden, "CorsPreflightFailure")
+	expect(preflight(blobURL, app, "put", ""), http.StatusForbidden, "CorsPreflightFailure")
+	expect(preflight(blobURL, other, "PUT", ""), http.StatusForbidden, "CorsPreflightFailure")
+	w = preflight("/blob/testaccount/uploads?restype=container&comp=list", other, "GET", "")
+	expect(w, http.StatusOK, "")
+	expectHeaders(w, map[string]string{"Access-Control-Allow-Origin": other, "Access-Control-Max-Age": "60"})
+
+	// Actual requests get the headers of the first rule matching their origin and method
+	w = do("PUT", blobURL, "jpeg", map[string]string{"x-ms-blob-type": "BlockBlob", "Origin": app})
+	expect(w, http.StatusCreated, "")
+	expectHeaders(w, map[string]string{
+		"Access-Control-Allow-Origin":      app,
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    "x-ms-request-id,ETag",
+		"Vary":                             "Origin",
+	})
+	w = do("GET", blobURL, "", map[string]string{"Origin": other})
+	expect(w, http.StatusOK, "")
+	expectHeaders(w, map[string]string{
+		"Access-Control-Allow-Origin":      "*",
+		"Access-Control-Allow-Credentials": "",
+		"Access-Control-Expose-Headers":    "",
+		"Vary":                             "",
+	})
+	w = do("GET", "/blob/testaccount/uploads/missing.jpg", "", map[string]string{"Origin": app})
+	expect(w, http.StatusNotFound, "BlobNotFound")
+	expectHeaders(w, map[string]string{"Access-Control-Allow-Origin": app})
+	w = do("DELETE", blobURL, "", map[string]string{"Origin": app})
+	expect(w, http.StatusAccepted, "")
+	expectHeaders(w, map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"})
+	w = do("GET", "/blob/testaccount/uploads?restype=container", "", nil)
+	expectHeaders(w, map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""})
+
+	// Invalid rules are rejected and leave the existing ones in place
+	rule := func(origins, methods string) string {
+		return "<CorsRule><AllowedOrigins>" + origins + "</AllowedOrigins><AllowedMethods>" + methods + "</AllowedMethods>" +
+			"<MaxAgeInSeconds>0</MaxAgeInSeconds><ExposedHeaders></ExposedHeaders><AllowedHeaders></AllowedHeaders></CorsRule>"
+	}
+	for _, cors := range []string{
+		"<Cors>" + strings.Repeat(rule("*", "GET"), 6) + "</Cors>",
+		"<Cors>" + rule("", "GET") + "</Cors>",
+		"<Cors>" + rule("*", "GET,FETCH") + "</Cors>",
+		"<Cors>" + rule("*", "") + "</Cors>",
+		"<Cors><CorsRule><AllowedOrigins>*</AllowedOrigins><AllowedMethods>GET</AllowedMethods>" +
+			"<AllowedHeaders>x-ms-meta-*,x-ms-tag-*,x-ms-blob-*</AllowedHeaders></CorsRule></Cors>",
+	} {
+		expect(do("PUT", propertiesURL, "<StorageServiceProperties>"+cors+"</StorageServiceProperties>", nil), http.StatusBadRequest, "InvalidXmlNodeValue")
+	}
+	expect(preflight(blobURL, app, "PUT", ""), http.StatusOK, "")
+
+	// Other settings leave the rules alone, and an empty element removes them
+	expect(do("PUT", propertiesURL, "<StorageServiceProperties><IsVersioningEnabled>true</IsVersioningEnabled></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	expect(preflight(blobURL, app, "PUT", ""), http.StatusOK, "")
+	expect(do("PUT", propertiesURL, "<StorageServiceProperties><Cors/></StorageServiceProperties>", nil), http.StatusAccepted, "")
+	expect(preflight(blobURL, app, "PUT", ""), http.StatusForbidden, "CorsPreflightFailure")
+	w = do("GET", blobURL, "", map[string]string{"Origin": app})
+	expectHeaders(w, map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""})
+}
+
+// TestBlobService_ResourceNames tests that invalid account, container and blob
+// names are rejected, and that blob names can't reach outside their container.
+func TestBlobService_ResourceNames(t *testing.T) {
+	service, store, cleanup := setupTestService(t)
+	defer cleanup()
+
+	router := newTestRouter(service)
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("x-ms-error-code") != code {
+			t.Errorf("expected %d %q, got %d %q", status, code, w.Code, w.Header().Get("x-ms-error-code"))
+		}
+	}
+
+	// Container names follow Azure's rules; the reserved $ containers are allowed
+	expect(do("PUT", "/blob/testaccount/testcontainer?restype=container", ""), http.StatusCreated, "")
+	for _, name := range []string{"ab", "Upper", "under_score", "-lead", "trail-", "dou--ble", "$logs", strings.Repeat("a", 64)} {
+		expect(do("PUT", "/blob/testaccount/"+name+"?restype=container", ""), http.StatusBadRequest, "InvalidResourceName")
+	}
+	expect(do("PUT", "/blob/testaccount/$root?restype=container", ""), http.StatusCreated, "")
+	expect(do("PUT", "/blob/testaccount/a-1?restype=container", ""), http.StatusCreated, "")
+
+	// So do account names
+	expect(do("PUT", "/blob/../testcontainer?restype=container", ""), http.StatusBadRequest, "InvalidResourceName")
+	expect(do("GET", "/blob/.meta?comp=list", ""), http.StatusBadRequest, "InvalidResourceName")
+	expect(do("GET", "/blob/TestAccount?comp=list", ""), http.StatusBadRequest, "InvalidResourceName")
+
+	// Blob names can't have empty, "." or ".." segments, escaped or not
+	for _, name := range []string{
+		"..%2F..%2Fescape.txt",
+		"../../escape.txt",
+		"dir/../../../escape.txt",
+		"a//b",
+		"a/./b",
+		"dir/",
+		"%2E%2E/escape.txt",
+	} {
+		expect(do("PUT", "/blob/testaccount/testcontainer/"+name, "pwned"), http.StatusBadRequest, "InvalidUri")
+	}
+	expect(do("GET", "/blob/testaccount/testcontainer/..%2F..%2Fescape.txt", ""), http.StatusBadRequest, "InvalidUri")
+	expect(do("DELETE", "/blob/testaccount/testcontainer/..%2Ftestcontainer", ""), http.StatusBadRequest, "InvalidUri")
+	baseDir := store.(*FileBlobStore).baseDir
+	if _, err := os.Stat(filepath.Join(baseDir, "escape.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the container, got %v", err)
+	}
+
+	// Names may be up to 1024 characters long
+	long := strings.Repeat(strings.Repeat("a", 99)+"/", 10) + strings.Repeat("b", 24)
+	expect(do("PUT", "/blob/testaccount/testcontainer/"+long, "ok"), http.StatusCreated, "")
+	expect(do("PUT", "/blob/testaccount/testcontainer/"+long+"b", "no"), http.StatusBadRequest, "InvalidResourceName")
+	expect(do("PUT", "/blob/testaccount/testcontainer/dir/..name./.x", "ok"), http.StatusCreated, "")
+}
+
 // TODO: Add integration tests using official Azure SDKs pointing at the local endpoint.
 // Example:
 //   - Use azure-sdk-for-go to create a blob client pointing to http://localhost:4566
@@ -2,10 +2,16 @@ package blob
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 // BlobStore defines the interface for blob storage operations.
@@ -13,59 +19,317 @@ import (
 // to be swapped in without changing the service implementation.
 type BlobStore interface {
 	// CreateContainer creates a new container with the given name in the specified account.
-	CreateContainer(ctx context.Context, account, containerName string) error
+	CreateContainer(ctx context.Context, account, containerName string, opts CreateContainerOptions) error
 
-	// DeleteContainer deletes a container and all its blobs.
-	DeleteContainer(ctx context.Context, account, containerName string) error
+	// DeleteContainer deletes a container and all its blobs. With container soft
+	// delete enabled, the container is kept until its retention period ends. A
+	// container holding protected blobs can't be deleted.
+	DeleteContainer(ctx context.Context, account, containerName string, conds AccessConditions) error
+
+	// RestoreContainer restores a soft-deleted container, identified by its name
+	// and version, as containerName.
+	RestoreContainer(ctx context.Context, account, containerName, deletedName, deletedVersion string) error
 
 	// ContainerExists checks if a container exists.
 	ContainerExists(ctx context.Context, account, containerName string) (bool, error)
 
-	// PutBlob stores a blob in the specified container.
-	PutBlob(ctx context.Context, account, containerName, blobName string, content []byte, contentType string, metadata map[string]string) error
+	// GetContainer retrieves a container's properties and metadata.
+	GetContainer(ctx context.Context, account, containerName string) (*Container, error)
+
+	// ListContainers returns a page of an account's containers, in name order.
+	ListContainers(ctx context.Context, account string, opts ListContainersOptions) (*ContainerList, error)
+
+	// SetContainerMetadata replaces a container's metadata.
+	SetContainerMetadata(ctx context.Context, account, containerName string, metadata map[string]string, conds AccessConditions) (*Container, error)
+
+	// SetContainerACL replaces a container's public access level and stored access policies.
+	SetContainerACL(ctx context.Context, account, containerName string, acl ContainerACL, conds AccessConditions) (*Container, error)
+
+	// SetContainerImmutabilityPolicy sets a container's time-based retention policy,
+	// which keeps its blobs from being modified or deleted for a period after
+	// they are created. A locked policy can only be extended.
+	SetContainerImmutabilityPolicy(ctx context.Context, account, containerName string, policy ContainerImmutabilityPolicy) (*Container, error)
+
+	// DeleteContainerImmutabilityPolicy removes a container's unlocked retention policy.
+	DeleteContainerImmutabilityPolicy(ctx context.Context, account, containerName string) error
+
+	// GetServiceProperties returns the blob service settings of an account.
+	GetServiceProperties(ctx context.Context, account string) (*ServiceProperties, error)
+
+	// SetServiceProperties replaces the blob service settings of an account.
+	SetServiceProperties(ctx context.Context, account string, props ServiceProperties) error
+
+	// PutBlob stores a blob in the specified container, replacing any existing blob
+	// with the same name. The content is streamed until EOF and the blob is only
+	// replaced once all of it has been written. It returns the properties of the stored blob.
+	PutBlob(ctx context.Context, account, containerName, blobName string, content io.Reader, opts PutBlobOptions) (*BlobProperties, error)
+
+	// GetBlob opens a blob, or one of its snapshots or versions, for reading. The
+	// caller must close the returned blob's Content.
+	GetBlob(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (*Blob, error)
+
+	// GetBlobProperties retrieves a blob's properties and metadata without its content.
+	GetBlobProperties(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (*Blob, error)
+
+	// SetBlobHTTPHeaders replaces the HTTP properties of a blob.
+	SetBlobHTTPHeaders(ctx context.Context, account, containerName, blobName string, headers BlobHTTPHeaders, conds AccessConditions) (*BlobProperties, error)
+
+	// SetBlobMetadata replaces the user metadata of a blob.
+	SetBlobMetadata(ctx context.Context, account, containerName, blobName string, metadata map[string]string, conds AccessConditions) (*BlobProperties, error)
+
+	// SetBlobTier changes the access tier of a block blob. Moving an archived
+	// blob to an online tier starts a rehydration, which is reported in the
+	// returned properties; the blob stays archived until it completes.
+	SetBlobTier(ctx context.Context, account, containerName, blobName string, tier AccessTier, opts SetBlobTierOptions) (*BlobProperties, error)
+
+	// OnRehydrationComplete sets a function to be called, without the store
+	// locked, whenever a rehydration completes.
+	OnRehydrationComplete(fn RehydrationFunc)
+
+	// GetBlobTags returns the index tags of a blob, snapshot or version.
+	GetBlobTags(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (map[string]string, error)
+
+	// SetBlobTags replaces the index tags of a blob or version. Unlike other
+	// updates, it doesn't change the blob's ETag or modification time.
+	SetBlobTags(ctx context.Context, account, containerName, blobName string, tags map[string]string, opts SetBlobTagsOptions) error
+
+	// FindBlobsByTags returns the current blobs of an account, or of one of its
+	// containers, whose index tags meet a filter expression.
+	FindBlobsByTags(ctx context.Context, account string, opts FindBlobsByTagsOptions) (*TaggedBlobList, error)
+
+	// SetBlobImmutabilityPolicy sets the immutability policy of a blob or version,
+	// which keeps it from being modified or deleted until the policy expires.
+	SetBlobImmutabilityPolicy(ctx context.Context, account, containerName, blobName string, policy ImmutabilityPolicy, opts ImmutabilityOptions) (*BlobProperties, error)
+
+	// DeleteBlobImmutabilityPolicy removes the unlocked immutability policy of a blob or version.
+	DeleteBlobImmutabilityPolicy(ctx context.Context, account, containerName, blobName string, opts ImmutabilityOptions) error
+
+	// SetBlobLegalHold sets or clears the legal hold of a blob or version, which
+	// keeps it from being modified or deleted while set.
+	SetBlobLegalHold(ctx context.Context, account, containerName, blobName string, hold bool, opts ImmutabilityOptions) (*BlobProperties, error)
+
+	// StageBlock stores an uncommitted block for a block blob.
+	StageBlock(ctx context.Context, account, containerName, blobName, blockID string, content io.Reader, opts StageBlockOptions) error
+
+	// CommitBlockList writes a block blob from a list of staged and committed blocks.
+	CommitBlockList(ctx context.Context, account, containerName, blobName string, blocks []BlockListEntry, opts PutBlobOptions) (*BlobProperties, error)
+
+	// GetBlockList returns the committed and uncommitted blocks of a block blob.
+	GetBlockList(ctx context.Context, account, containerName, blobName string) (*BlockList, error)
+
+	// CreateAppendBlob creates an empty append blob, replacing any existing blob.
+	CreateAppendBlob(ctx context.Context, account, containerName, blobName string, opts PutBlobOptions) (*BlobProperties, error)
+
+	// AppendBlock appends content to the end of an append blob as a single block.
+	// Concurrent appends to a blob are serialized.
+	AppendBlock(ctx context.Context, account, containerName, blobName string, content io.Reader, opts AppendBlockOptions) (*AppendBlockResult, error)
+
+	// SealBlob makes an append blob read-only. opts.MaxSize is ignored.
+	SealBlob(ctx context.Context, account, containerName, blobName string, opts AppendBlockOptions) (*BlobProperties, error)
+
+	// CreatePageBlob creates a page blob of opts.Size bytes with no pages
+	// written, replacing any existing blob.
+	CreatePageBlob(ctx context.Context, account, containerName, blobName string, opts CreatePageBlobOptions) (*BlobProperties, error)
+
+	// UploadPages writes content to the pages of a page blob in rng. The content
+	// must be exactly as long as the range.
+	UploadPages(ctx context.Context, account, containerName, blobName string, rng PageRange, content io.Reader, opts PageWriteOptions) (*BlobProperties, error)
+
+	// ClearPages empties the pages of a page blob in rng.
+	ClearPages(ctx context.Context, account, containerName, blobName string, rng PageRange, opts PageWriteOptions) (*BlobProperties, error)
 
-	// GetBlob retrieves a blob from storage.
-	GetBlob(ctx context.Context, account, containerName, blobName string) (*Blob, error)
+	// GetPageRanges returns the ranges of a page blob that hold data, or those
+	// that changed since a previous snapshot.
+	GetPageRanges(ctx context.Context, account, containerName, blobName string, opts GetPageRangesOptions) (*PageList, error)
 
-	// DeleteBlob removes a blob from storage.
-	DeleteBlob(ctx context.Context, account, containerName, blobName string) error
+	// SetPageBlobProperties resizes a page blob or changes its sequence number.
+	SetPageBlobProperties(ctx context.Context, account, containerName, blobName string, opts PageBlobPropertiesOptions) (*BlobProperties, error)
 
-	// ListBlobs returns a list of blobs in the specified container.
-	// prefix can be used to filter blob names, and maxResults limits the number returned.
-	ListBlobs(ctx context.Context, account, containerName, prefix string, maxResults int) ([]BlobInfo, error)
+	// DeleteBlob removes a blob, its snapshots, or a single snapshot or version from
+	// storage. With versioning enabled, deleting a blob keeps it as a previous version;
+	// with blob soft delete enabled, deleted data is kept until its retention period ends.
+	DeleteBlob(ctx context.Context, account, containerName, blobName string, opts DeleteBlobOptions) error
+
+	// UndeleteBlob restores a soft-deleted blob and its soft-deleted snapshots and versions.
+	UndeleteBlob(ctx context.Context, account, containerName, blobName string) error
+
+	// CopyBlob replaces a blob with a copy of another blob, snapshot or version in
+	// the store. The copy completes before CopyBlob returns.
+	CopyBlob(ctx context.Context, account, containerName, blobName string, source CopySource, opts CopyBlobOptions) (*BlobProperties, error)
+
+	// StartCopy replaces a blob with an empty blob whose copy, identified by
+	// copyID, is pending. The copy ends with CompleteCopy, FailCopy or AbortCopy.
+	StartCopy(ctx context.Context, account, containerName, blobName, copyID string, opts StartCopyOptions) (*BlobProperties, error)
+
+	// UpdateCopyProgress records the number of bytes a pending copy has read so far.
+	UpdateCopyProgress(ctx context.Context, account, containerName, blobName, copyID string, bytesCopied int64) error
+
+	// CompleteCopy stores the content of a pending copy and marks it successful.
+	CompleteCopy(ctx context.Context, account, containerName, blobName, copyID string, content io.Reader) (*BlobProperties, error)
+
+	// FailCopy marks a pending copy as failed, with a description of the failure.
+	FailCopy(ctx context.Context, account, containerName, blobName, copyID, description string) error
+
+	// AbortCopy aborts a pending copy, leaving an empty destination blob.
+	AbortCopy(ctx context.Context, account, containerName, blobName, copyID, leaseID string) error
+
+	// CreateSnapshot creates a read-only snapshot of a blob's current content,
+	// properties and metadata.
+	CreateSnapshot(ctx context.Context, account, containerName, blobName string, opts SnapshotOptions) (*SnapshotResult, error)
+
+	// LeaseBlob acquires, renews, changes, releases or breaks a blob's lease.
+	LeaseBlob(ctx context.Context, account, containerName, blobName string, req LeaseRequest) (*LeaseResult, error)
+
+	// LeaseContainer acquires, renews, changes, releases or breaks a container's lease.
+	LeaseContainer(ctx context.Context, account, containerName string, req LeaseRequest) (*LeaseResult, error)
+
+	// ListBlobs returns a page of the blobs in a container, in name order.
+	ListBlobs(ctx context.Context, account, containerName string, opts ListBlobsOptions) (*BlobList, error)
+}
+
+// Names of the bookkeeping directories under DATA_DIR/blob. Azure account names are
+// lowercase alphanumeric, so they can't collide with an account directory.
+const (
+	metaDirName       = ".meta"
+	tmpDirName        = ".tmp"
+	quarantineDirName = ".quarantine"
+	deletedDirName    = ".deleted"
+)
+
+// blobRecord is the persisted properties record of a blob.
+// It is stored as JSON next to any other per-blob state, outside the content tree.
+type blobRecord struct {
+	Name       string            `json:"name"`
+	Properties BlobProperties    `json:"properties"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	// CommittedBlocks is the committed block list, in content order.
+	// It is empty for blobs uploaded with a single Put Blob.
+	CommittedBlocks []Block `json:"committedBlocks,omitempty"`
+
+	// Tags are the blob's index tags.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Pages records which pages of a page blob were written or cleared, and
+	// by which page write; PageWrites counts the page writes so far.
+	Pages      []pageSegment `json:"pages,omitempty"`
+	PageWrites int64         `json:"pageWrites,omitempty"`
+
+	// Snapshot is the snapshot timestamp of a snapshot's record, empty for the base blob.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// setDefaults fills in what records written before a property existed lack:
+// metadata is never nil, and blobs without a type are block blobs.
+func (r *blobRecord) setDefaults() {
+	if r.Metadata == nil {
+		r.Metadata = make(map[string]string)
+	}
+	if r.Properties.BlobType == "" {
+		r.Properties.BlobType = BlobTypeBlock
+	}
+}
+
+// containerEntry is the in-memory index entry of a container and its blobs.
+type containerEntry struct {
+	container Container
+	blobs     map[string]*blobRecord   // key: blob name
+	staged    map[string]*stagedBlocks // key: blob name; uncommitted blocks
+	snapshots map[string][]*blobRecord // key: blob name; oldest first
+	versions  map[string][]*blobRecord // key: blob name; previous versions, oldest first
+	deleted   map[string]*blobRecord   // key: blob name; soft-deleted blob
+	tags      tagIndex                 // index tags of the current blobs
 }
 
 // FileBlobStore is a file-based implementation of BlobStore.
 // It stores blobs as files under DATA_DIR/blob/<account>/<container>/<blobName>.
+// Container records and per-blob properties records live under
+// DATA_DIR/blob/.meta/<account>/<container>/, with blob records keyed by a hash of the blob name.
+// The whole index is kept in memory and rebuilt from disk when the store is opened.
 // This is a simple but effective approach for local development and testing.
 type FileBlobStore struct {
 	baseDir string
 	mu      sync.RWMutex
 	// In-memory index for quick lookups (could be replaced with SQLite later)
-	containers map[string]bool // key: account/container
+	containers map[string]*containerEntry   // key: account/container
+	services   map[string]ServiceProperties // key: account
+	// Soft-deleted containers, oldest first. Their blobs aren't indexed until restored.
+	deletedContainers map[string][]*Container // key: account/container
+	recovery          RecoveryReport
+	// How long a rehydration from the Archive tier takes, by priority
+	rehydrationDelays map[RehydratePriority]time.Duration
+	onRehydrated      RehydrationFunc
+
+	// Open handles on page blob content, by account/container/blob. A page
+	// write doesn't write a blob's content file in place while any are open.
+	readersMu sync.Mutex
+	readers   map[string]int
 }
 
 // NewFileBlobStore creates a new file-based blob store.
+// Existing data under baseDir is scanned and indexed; see RecoveryReport for
+// what was found and repaired.
 func NewFileBlobStore(baseDir string) (*FileBlobStore, error) {
 	blobDir := filepath.Join(baseDir, "blob")
 	if err := os.MkdirAll(blobDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create blob directory: %w", err)
 	}
 
-	return &FileBlobStore{
+	s := &FileBlobStore{
 		baseDir:    blobDir,
-		containers: make(map[string]bool),
-	}, nil
+		containers: make(map[string]*containerEntry),
+		services:   make(map[string]ServiceProperties),
+
+		deletedContainers: make(map[string][]*Container),
+		rehydrationDelays: defaultRehydrationDelays,
+		readers:           make(map[string]int),
+	}
+	// Pending rehydrations found by the scan are scheduled as it goes, so the
+	// lock keeps them waiting until the index is complete.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.recover(); err != nil {
+		return nil, fmt.Errorf("failed to load blob store: %w", err)
+	}
+	return s, nil
 }
 
-// containerPath returns the filesystem path for a container.
-func (s *FileBlobStore) containerPath(account, containerName string) string {
-	return filepath.Join(s.baseDir, account, containerName)
+// containerPath returns the filesystem path for a container, or
+// ErrInvalidResourceName if the names don't map to a directory under DATA_DIR/blob.
+func (s *FileBlobStore) containerPath(account, containerName string) (string, error) {
+	accountPath, err := joinWithin(s.baseDir, account)
+	if err != nil {
+		return "", err
+	}
+	return joinWithin(accountPath, containerName)
+}
+
+// blobPath returns the filesystem path for a blob, or ErrInvalidResourceName if
+// the name doesn't map to a file inside the container's directory.
+func (s *FileBlobStore) blobPath(account, containerName, blobName string) (string, error) {
+	containerPath, err := s.containerPath(account, containerName)
+	if err != nil {
+		return "", err
+	}
+	return joinWithin(containerPath, blobName)
+}
+
+// containerMetaPath returns the directory holding the records of a container and its blobs.
+func (s *FileBlobStore) containerMetaPath(account, containerName string) string {
+	return filepath.Join(s.baseDir, metaDirName, account, containerName)
 }
 
-// blobPath returns the filesystem path for a blob.
-func (s *FileBlobStore) blobPath(account, containerName, blobName string) string {
-	return filepath.Join(s.containerPath(account, containerName), blobName)
+// blobMetaPath returns the directory holding a blob's properties record.
+// Blob names are hashed so that arbitrary names map to safe, fixed-length paths.
+func (s *FileBlobStore) blobMetaPath(account, containerName, blobName string) string {
+	hash := blobNameHash(blobName)
+	return filepath.Join(s.containerMetaPath(account, containerName), "blobs", hash[:2], hash)
+}
+
+// blobNameHash returns the hex SHA-256 of a blob name, which names its record directory.
+func blobNameHash(blobName string) string {
+	sum := sha256.Sum256([]byte(blobName))
+	return hex.EncodeToString(sum[:])
 }
 
 // containerKey returns a unique key for a container.
@@ -73,39 +337,172 @@ func (s *FileBlobStore) containerKey(account, containerName string) string {
 	return fmt.Sprintf("%s/%s", account, containerName)
 }
 
-func (s *FileBlobStore) CreateContainer(ctx context.Context, account, containerName string) error {
+// container returns the index entry of a container, or ErrContainerNotFound.
+func (s *FileBlobStore) container(account, containerName string) (*containerEntry, error) {
+	entry, ok := s.containers[s.containerKey(account, containerName)]
+	if !ok {
+		return nil, ErrContainerNotFound
+	}
+	return entry, nil
+}
+
+// blob returns the index record of a blob, or ErrContainerNotFound/ErrBlobNotFound.
+func (s *FileBlobStore) blob(account, containerName, blobName string) (*blobRecord, error) {
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	record, ok := entry.blobs[blobName]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return record, nil
+}
+
+// writeJSON persists v as JSON at path, creating parent directories as needed.
+func (s *FileBlobStore) writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(path), err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create record directory: %w", err)
+	}
+	if err := s.writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// writeContainerRecord persists a container's record.
+func (s *FileBlobStore) writeContainerRecord(account string, container *Container) error {
+	return s.writeJSON(filepath.Join(s.containerMetaPath(account, container.Name), "container.json"), container)
+}
+
+// writeBlobRecord persists a blob's properties record.
+func (s *FileBlobStore) writeBlobRecord(account, containerName string, record *blobRecord) error {
+	return s.writeJSON(filepath.Join(s.blobMetaPath(account, containerName, record.Name), "blob.json"), record)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so readers never observe a partially written file. Temporary files live in
+// DATA_DIR/blob/.tmp so an interrupted write never leaves debris in a container.
+func (s *FileBlobStore) writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Join(s.baseDir, tmpDirName), "write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// spoolTemp streams content into a new file in DATA_DIR/blob/.tmp and returns its
+// path and size. Callers rename the file into place or remove it.
+func (s *FileBlobStore) spoolTemp(content io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.baseDir, tmpDirName), "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+
+	size, err := io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), size, nil
+}
+
+func (s *FileBlobStore) CreateContainer(ctx context.Context, account, containerName string, opts CreateContainerOptions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	key := s.containerKey(account, containerName)
-	if s.containers[key] {
-		return fmt.Errorf("container %s already exists", containerName)
+	if _, exists := s.containers[key]; exists {
+		return ErrContainerAlreadyExists
 	}
 
-	path := s.containerPath(account, containerName)
+	path, err := s.containerPath(account, containerName)
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return fmt.Errorf("failed to create container directory: %w", err)
 	}
 
-	s.containers[key] = true
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	now := time.Now().UTC()
+	container := Container{
+		Name:         containerName,
+		CreatedAt:    now,
+		ModifiedAt:   now,
+		ETag:         newETag(),
+		Metadata:     metadata,
+		PublicAccess: opts.PublicAccess,
+	}
+	if err := s.writeContainerRecord(account, &container); err != nil {
+		return err
+	}
+
+	s.containers[key] = &containerEntry{
+		container: container,
+		blobs:     make(map[string]*blobRecord),
+		staged:    make(map[string]*stagedBlocks),
+		snapshots: make(map[string][]*blobRecord),
+		versions:  make(map[string][]*blobRecord),
+		deleted:   make(map[string]*blobRecord),
+		tags:      make(tagIndex),
+	}
 	return nil
 }
 
-func (s *FileBlobStore) DeleteContainer(ctx context.Context, account, containerName string) error {
+func (s *FileBlobStore) DeleteContainer(ctx context.Context, account, containerName string, conds AccessConditions) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	key := s.containerKey(account, containerName)
-	if !s.containers[key] {
-		return fmt.Errorf("container %s does not exist", containerName)
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	if err := entry.container.Lease.checkAccess(conds.LeaseID, true, containerLeaseErrors, time.Now()); err != nil {
+		return err
+	}
+	if err := conds.check(true, entry.container.ETag, entry.container.ModifiedAt, false); err != nil {
+		return err
+	}
+	if err := entry.checkDeletable(time.Now()); err != nil {
+		return err
 	}
 
-	path := s.containerPath(account, containerName)
+	if policy := s.services[account].ContainerDeleteRetentionPolicy; policy.Enabled {
+		return s.softDeleteContainer(entry, account, policy, time.Now())
+	}
+
+	path, err := s.containerPath(account, containerName)
+	if err != nil {
+		return err
+	}
 	if err := os.RemoveAll(path); err != nil {
 		return fmt.Errorf("failed to delete container directory: %w", err)
 	}
+	if err := os.RemoveAll(s.containerMetaPath(account, containerName)); err != nil {
+		return fmt.Errorf("failed to delete container records: %w", err)
+	}
 
-	delete(s.containers, key)
+	delete(s.containers, s.containerKey(account, containerName))
 	return nil
 }
 
@@ -113,135 +510,380 @@ func (s *FileBlobStore) ContainerExists(ctx context.Context, account, containerN
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	key := s.containerKey(account, containerName)
-	return s.containers[key], nil
+	_, exists := s.containers[s.containerKey(account, containerName)]
+	return exists, nil
 }
 
-func (s *FileBlobStore) PutBlob(ctx context.Context, account, containerName, blobName string, content []byte, contentType string, metadata map[string]string) error {
+func (s *FileBlobStore) GetContainer(ctx context.Context, account, containerName string) (*Container, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+
+	container := entry.container
+	return &container, nil
+}
+
+func (s *FileBlobStore) PutBlob(ctx context.Context, account, containerName, blobName string, content io.Reader, opts PutBlobOptions) (*BlobProperties, error) {
+	// The upload is spooled without holding the lock, so a slow client doesn't
+	// block other requests. Only the final rename happens under the lock.
+	hash := md5.New()
+	tmpPath, size, err := s.spoolTemp(io.TeeReader(content, hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Ensure container exists
-	key := s.containerKey(account, containerName)
-	if !s.containers[key] {
-		path := s.containerPath(account, containerName)
-		if err := os.MkdirAll(path, 0755); err != nil {
-			return fmt.Errorf("failed to ensure container directory: %w", err)
-		}
-		s.containers[key] = true
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
 	}
 
-	// Write blob file
-	blobPath := s.blobPath(account, containerName, blobName)
-	blobDir := filepath.Dir(blobPath)
-	if err := os.MkdirAll(blobDir, 0755); err != nil {
-		return fmt.Errorf("failed to create blob directory: %w", err)
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := os.WriteFile(blobPath, content, 0644); err != nil {
-		return fmt.Errorf("failed to write blob: %w", err)
+	// Overwriting a blob keeps its original creation time and lease.
+	now := time.Now().UTC()
+	createdAt := now
+	var lease Lease
+	if existing != nil {
+		createdAt = existing.Properties.CreatedAt
+		lease = existing.Properties.Lease
+	}
+	versionID, err := s.keepPreviousState(entry, account, containerName, blobName, existing, now)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Store metadata and content type in a separate metadata file or SQLite
-	return nil
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	headers := opts.HTTPHeaders
+	if headers.ContentType == "" {
+		headers.ContentType = "application/octet-stream"
+	}
+	// Like Azure, the blob's MD5 is computed unless the client set one.
+	if len(headers.ContentMD5) == 0 {
+		headers.ContentMD5 = hash.Sum(nil)
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+
+	record := &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders: headers,
+			Size:            size,
+			CreatedAt:       createdAt,
+			ModifiedAt:      now,
+			ETag:            newETag(),
+			BlobType:        BlobTypeBlock,
+			AccessTier:      opts.Tier,
+			Lease:           lease,
+			VersionID:       versionID,
+
+			ImmutabilityPolicy: opts.ImmutabilityPolicy,
+			LegalHold:          opts.LegalHold,
+		},
+		Metadata: metadata,
+		Tags:     opts.Tags,
+	}
+	if err := s.writeBlobRecord(account, containerName, record); err != nil {
+		return nil, err
+	}
+	entry.blobs[blobName] = record
+	entry.tags.update(blobName, existing.tags(), record.Tags)
+
+	// Put Blob discards any uncommitted blocks.
+	if err := s.discardStagedBlocks(entry, account, containerName, blobName); err != nil {
+		return nil, err
+	}
+
+	props := record.Properties
+	return &props, nil
 }
 
-func (s *FileBlobStore) GetBlob(ctx context.Context, account, containerName, blobName string) (*Blob, error) {
+func (s *FileBlobStore) GetBlob(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (*Blob, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	blobPath := s.blobPath(account, containerName, blobName)
-	content, err := os.ReadFile(blobPath)
+	record, path, err := s.readableBlob(account, containerName, blobName, opts.Snapshot, opts.VersionID)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("blob %s does not exist", blobName)
-		}
-		return nil, fmt.Errorf("failed to read blob: %w", err)
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, record, false); err != nil {
+		return nil, err
+	}
+	if record.Properties.archived() {
+		return nil, ErrBlobArchived
 	}
 
-	info, err := os.Stat(blobPath)
+	// Opening the file under the lock pairs the handle with the record; a later
+	// overwrite renames a new file into place and leaves this one readable.
+	content, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to stat blob: %w", err)
+		return nil, fmt.Errorf("failed to open blob: %w", err)
 	}
 
-	// TODO: Load metadata and content type from metadata store
-	return &Blob{
-		Name:        blobName,
-		Container:   containerName,
-		Account:     account,
-		Content:     content,
-		ContentType: "application/octet-stream", // Default
-		Size:        info.Size(),
-		CreatedAt:   info.ModTime(),
-		ModifiedAt:  info.ModTime(),
-		Metadata:    make(map[string]string),
-	}, nil
-}
-
-func (s *FileBlobStore) DeleteBlob(ctx context.Context, account, containerName, blobName string) error {
+	blob := s.newBlobFromRecord(account, containerName, record)
+	blob.Content = content
+	if record.Properties.BlobType == BlobTypePage {
+		blob.Content = s.trackReader(account, containerName, blobName, content)
+	}
+	return blob, nil
+}
+
+func (s *FileBlobStore) GetBlobProperties(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (*Blob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, _, err := s.readableBlob(account, containerName, blobName, opts.Snapshot, opts.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, record, false); err != nil {
+		return nil, err
+	}
+	return s.newBlobFromRecord(account, containerName, record), nil
+}
+
+// readableBlob returns the record and content path of a blob, or of one of its
+// snapshots or versions if snapshot or versionID is set. The current version may
+// also be read by its version ID.
+func (s *FileBlobStore) readableBlob(account, containerName, blobName, snapshot, versionID string) (*blobRecord, string, error) {
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	current := entry.blobs[blobName]
+	switch {
+	case snapshot != "":
+		if record := findSnapshot(entry.snapshots[blobName], snapshot); record != nil {
+			return record, s.snapshotPath(account, containerName, blobName, snapshot), nil
+		}
+	case versionID != "" && (current == nil || current.Properties.VersionID != versionID):
+		if record := findVersion(entry.versions[blobName], versionID); record != nil {
+			return record, s.versionPath(account, containerName, blobName, versionID), nil
+		}
+	case current != nil:
+		path, err := s.blobPath(account, containerName, blobName)
+		return current, path, err
+	}
+	return nil, "", ErrBlobNotFound
+}
+
+func (s *FileBlobStore) SetBlobHTTPHeaders(ctx context.Context, account, containerName, blobName string, headers BlobHTTPHeaders, conds AccessConditions) (*BlobProperties, error) {
+	return s.updateBlobRecord(account, containerName, blobName, conds, false, func(record *blobRecord) {
+		record.Properties.BlobHTTPHeaders = headers
+		// As in Azure, setting the properties of a copied blob drops its copy state.
+		record.Properties.Copy = nil
+	})
+}
+
+func (s *FileBlobStore) SetBlobMetadata(ctx context.Context, account, containerName, blobName string, metadata map[string]string, conds AccessConditions) (*BlobProperties, error) {
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	return s.updateBlobRecord(account, containerName, blobName, conds, true, func(record *blobRecord) {
+		record.Metadata = metadata
+	})
+}
+
+// updateBlobRecord checks conds against an existing blob, applies update to a copy
+// of its record, bumps its modification time and ETag, persists it and swaps it
+// into the index. If newVersion is set, the update creates a new version of the blob.
+func (s *FileBlobStore) updateBlobRecord(account, containerName, blobName string, conds AccessConditions, newVersion bool, update func(*blobRecord)) (*BlobProperties, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	blobPath := s.blobPath(account, containerName, blobName)
-	if err := os.Remove(blobPath); err != nil {
-		if os.IsNotExist(err) {
-			return fmt.Errorf("blob %s does not exist", blobName)
+	current, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(conds, current, true); err != nil {
+		return nil, err
+	}
+	if current.Properties.Copy.pending() {
+		return nil, ErrPendingCopyOperation
+	}
+	if current.Properties.archived() {
+		return nil, ErrBlobArchived
+	}
+	entry := s.containers[s.containerKey(account, containerName)]
+	if err := entry.checkImmutable(current, false, time.Now()); err != nil {
+		return nil, err
+	}
+
+	record := *current
+	update(&record)
+	record.Properties.ModifiedAt = time.Now().UTC()
+	record.Properties.ETag = newETag()
+	if newVersion {
+		versionID, err := s.keepPreviousState(entry, account, containerName, blobName, current, record.Properties.ModifiedAt)
+		if err != nil {
+			return nil, err
 		}
-		return fmt.Errorf("failed to delete blob: %w", err)
+		record.Properties.VersionID = versionID
 	}
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	entry.blobs[blobName] = &record
 
-	return nil
+	props := record.Properties
+	return &props, nil
 }
 
-func (s *FileBlobStore) ListBlobs(ctx context.Context, account, containerName, prefix string, maxResults int) ([]BlobInfo, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *FileBlobStore) DeleteBlob(ctx context.Context, account, containerName, blobName string, opts DeleteBlobOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	containerPath := s.containerPath(account, containerName)
-	if _, err := os.Stat(containerPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("container %s does not exist", containerName)
+	if opts.Snapshot != "" {
+		return s.deleteSnapshot(account, containerName, blobName, opts)
 	}
 
-	var results []BlobInfo
-	err := filepath.Walk(containerPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	record := entry.blobs[blobName]
+	if opts.VersionID != "" && (record == nil || record.Properties.VersionID != opts.VersionID) {
+		return s.deleteVersion(entry, account, containerName, blobName, opts)
+	}
+	if record == nil {
+		return ErrBlobNotFound
+	}
+	if err := checkBlobAccess(opts.Conditions, record, true); err != nil {
+		return err
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	if opts.DeleteSnapshots != DeleteSnapshotsOnly {
+		if err := entry.checkImmutable(record, false, time.Now()); err != nil {
 			return err
 		}
+	}
 
-		if info.IsDir() {
-			return nil // Skip directories
+	switch opts.DeleteSnapshots {
+	case "":
+		if len(liveRecords(entry.snapshots[blobName])) > 0 {
+			return ErrSnapshotsPresent
 		}
-
-		// Get relative blob name
-		relPath, err := filepath.Rel(containerPath, path)
-		if err != nil {
+	case DeleteSnapshotsOnly:
+		return s.deleteAllSnapshots(entry, account, containerName, blobName)
+	case DeleteSnapshotsInclude:
+		if err := s.deleteAllSnapshots(entry, account, containerName, blobName); err != nil {
 			return err
 		}
+	}
 
-		blobName := filepath.ToSlash(relPath) // Normalize path separators
-
-		// Apply prefix filter
-		if prefix != "" && !filepath.HasPrefix(blobName, prefix) {
-			return nil
+	// With versioning the blob lives on as a previous version, and with soft
+	// delete as a soft-deleted blob; either way its content is linked elsewhere first.
+	now := time.Now()
+	props := s.services[account]
+	if props.VersioningEnabled {
+		if _, err := s.keepPreviousVersion(entry, account, containerName, blobName, record, now); err != nil {
+			return err
 		}
-
-		// Apply max results limit
-		if maxResults > 0 && len(results) >= maxResults {
-			return filepath.SkipAll // Stop walking
+	} else if props.DeleteRetentionPolicy.Enabled {
+		if err := s.keepDeletedBlob(entry, account, containerName, blobName, record, props.DeleteRetentionPolicy, now); err != nil {
+			return err
 		}
+	}
 
-		// TODO: Load metadata and content type from metadata store
-		results = append(results, BlobInfo{
-			Name:         blobName,
-			ContentType:  "application/octet-stream",
-			Size:         info.Size(),
-			LastModified: info.ModTime(),
-			Metadata:     make(map[string]string),
-		})
+	if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	if err := os.Remove(filepath.Join(s.blobMetaPath(account, containerName, blobName), "blob.json")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob record: %w", err)
+	}
+	delete(entry.blobs, blobName)
+	entry.tags.update(blobName, record.Tags, nil)
+	if err := s.discardStagedBlocks(entry, account, containerName, blobName); err != nil {
+		return err
+	}
+	return s.pruneBlobMetaDir(entry, account, containerName, blobName)
+}
 
+// pruneBlobMetaDir deletes the record directory of a blob once nothing is left
+// in it: no blob, uncommitted blocks, snapshots, versions or soft-deleted blob.
+// The caller holds the lock.
+func (s *FileBlobStore) pruneBlobMetaDir(entry *containerEntry, account, containerName, blobName string) error {
+	if entry.blobs[blobName] != nil || entry.staged[blobName] != nil || entry.deleted[blobName] != nil ||
+		len(entry.snapshots[blobName]) > 0 || len(entry.versions[blobName]) > 0 {
 		return nil
-	})
+	}
+	if err := os.RemoveAll(s.blobMetaPath(account, containerName, blobName)); err != nil {
+		return fmt.Errorf("failed to delete blob record: %w", err)
+	}
+	return nil
+}
 
-	return results, err
+// checkBlobAccess enforces the lease and conditions of an operation on an existing blob.
+func checkBlobAccess(conds AccessConditions, record *blobRecord, write bool) error {
+	if err := record.Properties.Lease.checkAccess(conds.LeaseID, write, blobLeaseErrors, time.Now()); err != nil {
+		return err
+	}
+	return conds.check(true, record.Properties.ETag, record.Properties.ModifiedAt, !write)
 }
 
+// checkBlobWrite enforces the lease and conditions of a request that creates or
+// replaces a blob; existing is nil if the blob doesn't exist yet.
+// If-None-Match: * on an existing blob fails with BlobAlreadyExists, as in Azure,
+// and the destination of a pending copy can't be replaced until the copy ends.
+func checkBlobWrite(conds AccessConditions, existing *blobRecord) error {
+	if existing == nil {
+		if conds.LeaseID != "" {
+			return ErrLeaseNotPresentWithBlobOperation
+		}
+		return conds.check(false, "", time.Time{}, false)
+	}
+	if conds.IfNoneMatch == "*" {
+		return ErrBlobAlreadyExists
+	}
+	if err := checkBlobAccess(conds, existing, true); err != nil {
+		return err
+	}
+	if existing.Properties.Copy.pending() {
+		return ErrPendingCopyOperation
+	}
+	return nil
+}
+
+// newBlobFromRecord builds a Blob (without content) from a properties record.
+func (s *FileBlobStore) newBlobFromRecord(account, containerName string, record *blobRecord) *Blob {
+	return &Blob{
+		Name:             record.Name,
+		Container:        containerName,
+		Account:          account,
+		Snapshot:         record.Snapshot,
+		IsCurrentVersion: isCurrentVersion(s.containers[s.containerKey(account, containerName)], record),
+		BlobProperties:   record.Properties,
+		Metadata:         record.Metadata,
+		Tags:             record.Tags,
+	}
+}
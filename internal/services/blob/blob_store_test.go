@@ -0,0 +1,1199 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readBlobContent reads and closes the content of a blob returned by GetBlob.
+func readBlobContent(t *testing.T, blob *Blob) string {
+	t.Helper()
+	defer blob.Content.Close()
+	data, err := io.ReadAll(io.NewSectionReader(blob.Content, 0, blob.Size))
+	if err != nil {
+		t.Fatalf("failed to read blob content: %v", err)
+	}
+	return string(data)
+}
+
+// TestFileBlobStore_RecoverAfterRestart tests that containers, blobs and their
+// properties survive reopening the store on the same data directory.
+func TestFileBlobStore_RecoverAfterRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	_, err = store.PutBlob(ctx, "testaccount", "testcontainer", "dir/blob.txt", strings.NewReader("content"), PutBlobOptions{
+		HTTPHeaders: BlobHTTPHeaders{ContentType: "text/plain"},
+		Metadata:    map[string]string{"owner": "alice"},
+	})
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	// Reopen the store
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+
+	report := store.RecoveryReport()
+	if report.Containers != 1 || report.Blobs != 1 {
+		t.Errorf("expected 1 container and 1 blob, got %d and %d", report.Containers, report.Blobs)
+	}
+	if len(report.Repaired) != 0 || len(report.Quarantined) != 0 {
+		t.Errorf("expected clean recovery, got %+v", report)
+	}
+
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != ErrContainerAlreadyExists {
+		t.Errorf("expected ErrContainerAlreadyExists, got %v", err)
+	}
+
+	blob, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "dir/blob.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob properties: %v", err)
+	}
+	if blob.ContentType != "text/plain" || blob.Metadata["owner"] != "alice" {
+		t.Errorf("properties not recovered: %+v", blob)
+	}
+
+	if err := store.DeleteContainer(ctx, "testaccount", "testcontainer", AccessConditions{}); err != nil {
+		t.Errorf("failed to delete recovered container: %v", err)
+	}
+}
+
+// TestFileBlobStore_RecoverRepairsAndQuarantines tests that the startup scan rebuilds
+// missing records and moves corrupt or orphaned entries to quarantine.
+func TestFileBlobStore_RecoverRepairsAndQuarantines(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	for _, name := range []string{"corrupt.txt", "orphan.txt"} {
+		if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", name, strings.NewReader("content"), PutBlobOptions{}); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+
+	blobRoot := filepath.Join(tmpDir, "blob")
+
+	// A container copied in by hand, without any records
+	if err := os.MkdirAll(filepath.Join(blobRoot, "testaccount", "manual"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blobRoot, "testaccount", "manual", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt record, a record whose content is gone, and a stray file at container level
+	corruptRecord := filepath.Join(store.blobMetaPath("testaccount", "testcontainer", "corrupt.txt"), "blob.json")
+	if err := os.WriteFile(corruptRecord, []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(blobRoot, "testaccount", "testcontainer", "orphan.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blobRoot, "testaccount", "stray.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+
+	report := store.RecoveryReport()
+	if report.Containers != 2 || report.Blobs != 2 {
+		t.Errorf("expected 2 containers and 2 blobs, got %d and %d", report.Containers, report.Blobs)
+	}
+	if len(report.Quarantined) != 3 {
+		t.Errorf("expected 3 quarantined entries, got %v", report.Quarantined)
+	}
+	// manual container, manual/file.txt and the rebuilt corrupt.txt record
+	if len(report.Repaired) != 3 {
+		t.Errorf("expected 3 repaired entries, got %v", report.Repaired)
+	}
+
+	blob, err := store.GetBlob(ctx, "testaccount", "manual", "file.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get recovered blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "hello" {
+		t.Errorf("expected content %q, got %q", "hello", got)
+	}
+	if _, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "corrupt.txt", GetBlobOptions{}); err != nil {
+		t.Errorf("expected blob with corrupt record to be recovered, got %v", err)
+	}
+	if _, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "orphan.txt", GetBlobOptions{}); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound for orphaned record, got %v", err)
+	}
+}
+
+// TestFileBlobStore_StagedBlocks tests that uncommitted blocks survive a restart and
+// are garbage collected once they expire.
+func TestFileBlobStore_StagedBlocks(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	for _, id := range []string{"YWFh", "YmJi"} {
+		if err := store.StageBlock(ctx, "testaccount", "testcontainer", "staged.bin", id, strings.NewReader(id), StageBlockOptions{}); err != nil {
+			t.Fatalf("failed to stage block: %v", err)
+		}
+	}
+
+	// Uncommitted blobs don't exist yet
+	if _, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "staged.bin", GetBlobOptions{}); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	list, err := store.GetBlockList(ctx, "testaccount", "testcontainer", "staged.bin")
+	if err != nil {
+		t.Fatalf("failed to get block list: %v", err)
+	}
+	if len(list.Uncommitted) != 2 || list.Blob != nil {
+		t.Fatalf("unexpected block list after restart: %+v", list)
+	}
+	if report := store.RecoveryReport(); len(report.Quarantined) != 0 {
+		t.Errorf("expected no quarantined entries, got %v", report.Quarantined)
+	}
+
+	// Age the blocks past the garbage collection window
+	entry := store.containers[store.containerKey("testaccount", "testcontainer")]
+	entry.staged["staged.bin"].LastStagedAt = time.Now().Add(-uncommittedBlockTTL - time.Minute)
+
+	if _, err := store.GetBlockList(ctx, "testaccount", "testcontainer", "staged.bin"); err != ErrBlobNotFound {
+		t.Errorf("expected expired blocks to be collected, got %v", err)
+	}
+	if _, err := os.Stat(store.blobMetaPath("testaccount", "testcontainer", "staged.bin")); !os.IsNotExist(err) {
+		t.Errorf("expected block data to be removed, got %v", err)
+	}
+}
+
+// TestFileBlobStore_ConditionalWritesAreAtomic tests that concurrent writers using
+// the same If-Match ETag can't both succeed.
+func TestFileBlobStore_ConditionalWritesAreAtomic(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	props, err := store.PutBlob(ctx, "testaccount", "testcontainer", "counter", strings.NewReader("0"), PutBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	const writers = 8
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.PutBlob(ctx, "testaccount", "testcontainer", "counter", strings.NewReader("1"), PutBlobOptions{
+				Conditions: AccessConditions{IfMatch: props.ETag},
+			})
+			results <- err
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for err := range results {
+		switch err {
+		case nil:
+			succeeded++
+		case ErrConditionNotMet:
+		default:
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one conditional write to succeed, got %d", succeeded)
+	}
+}
+
+// TestLease_Transitions tests lease state changes over time, including expiry
+// and break periods, without waiting in real time.
+func TestLease_Transitions(t *testing.T) {
+	const id = "11111111-1111-1111-1111-111111111111"
+	const other = "22222222-2222-2222-2222-222222222222"
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	period := func(seconds int) *int { return &seconds }
+
+	// A 15 second lease expires on time and can then be taken by someone else.
+	lease, _, err := Lease{}.apply(LeaseRequest{Action: LeaseActionAcquire, ProposedLeaseID: id, Duration: 15}, at(0))
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if state := lease.state(at(14)); state != LeaseStateLeased {
+		t.Errorf("expected leased before expiry, got %s", state)
+	}
+	if _, _, err := lease.apply(LeaseRequest{Action: LeaseActionAcquire, ProposedLeaseID: other, Duration: 15}, at(14)); err != ErrLeaseAlreadyPresent {
+		t.Errorf("expected ErrLeaseAlreadyPresent, got %v", err)
+	}
+	if state := lease.state(at(15)); state != LeaseStateExpired {
+		t.Errorf("expected expired, got %s", state)
+	}
+	if err := lease.checkAccess("", true, blobLeaseErrors, at(15)); err != nil {
+		t.Errorf("expected writes without a lease ID after expiry, got %v", err)
+	}
+
+	// An expired lease can still be renewed by its holder.
+	renewed, _, err := lease.apply(LeaseRequest{Action: LeaseActionRenew, LeaseID: id}, at(20))
+	if err != nil || renewed.state(at(34)) != LeaseStateLeased {
+		t.Fatalf("renew failed: %v", err)
+	}
+	if err := renewed.checkAccess("", true, blobLeaseErrors, at(21)); err != ErrLeaseIDMissing {
+		t.Errorf("expected ErrLeaseIDMissing, got %v", err)
+	}
+	if err := renewed.checkAccess(other, false, blobLeaseErrors, at(21)); err != ErrLeaseIDMismatchWithBlobOperation {
+		t.Errorf("expected ErrLeaseIDMismatchWithBlobOperation, got %v", err)
+	}
+
+	// Breaking a finite lease waits for the shorter of the break period and the remaining time.
+	broken, leaseTime, err := renewed.apply(LeaseRequest{Action: LeaseActionBreak, BreakPeriod: period(60)}, at(25))
+	if err != nil || leaseTime != 10 {
+		t.Fatalf("expected break with 10s remaining, got %d, %v", leaseTime, err)
+	}
+	if state := broken.state(at(34)); state != LeaseStateBreaking {
+		t.Errorf("expected breaking, got %s", state)
+	}
+	if _, _, err := broken.apply(LeaseRequest{Action: LeaseActionAcquire, ProposedLeaseID: other, Duration: -1}, at(34)); err != ErrLeaseIsBreakingAndCannotBeAcquired {
+		t.Errorf("expected ErrLeaseIsBreakingAndCannotBeAcquired, got %v", err)
+	}
+	if _, _, err := broken.apply(LeaseRequest{Action: LeaseActionRenew, LeaseID: id}, at(36)); err != ErrLeaseIsBrokenAndCannotBeRenewed {
+		t.Errorf("expected ErrLeaseIsBrokenAndCannotBeRenewed, got %v", err)
+	}
+	if state := broken.state(at(35)); state != LeaseStateBroken {
+		t.Errorf("expected broken, got %s", state)
+	}
+
+	// An infinite lease breaks immediately unless a break period is given.
+	infinite, _, _ := Lease{}.apply(LeaseRequest{Action: LeaseActionAcquire, ProposedLeaseID: id, Duration: -1}, at(0))
+	if infinite.state(at(100000)) != LeaseStateLeased {
+		t.Error("expected infinite lease to stay leased")
+	}
+	if _, leaseTime, _ := infinite.apply(LeaseRequest{Action: LeaseActionBreak}, at(10)); leaseTime != 0 {
+		t.Errorf("expected immediate break, got %ds", leaseTime)
+	}
+	if _, leaseTime, _ := infinite.apply(LeaseRequest{Action: LeaseActionBreak, BreakPeriod: period(30)}, at(10)); leaseTime != 30 {
+		t.Errorf("expected 30s break period, got %ds", leaseTime)
+	}
+
+	// Change and release require the current lease ID.
+	changed, _, err := infinite.apply(LeaseRequest{Action: LeaseActionChange, LeaseID: id, ProposedLeaseID: other}, at(1))
+	if err != nil || changed.ID != other {
+		t.Fatalf("change failed: %+v, %v", changed, err)
+	}
+	if _, _, err := changed.apply(LeaseRequest{Action: LeaseActionRelease, LeaseID: id}, at(2)); err != ErrLeaseIDMismatchWithLeaseOperation {
+		t.Errorf("expected ErrLeaseIDMismatchWithLeaseOperation, got %v", err)
+	}
+	released, _, err := changed.apply(LeaseRequest{Action: LeaseActionRelease, LeaseID: other}, at(2))
+	if err != nil || released.state(at(2)) != LeaseStateAvailable {
+		t.Fatalf("release failed: %v", err)
+	}
+	if _, _, err := released.apply(LeaseRequest{Action: LeaseActionBreak}, at(3)); err != ErrLeaseNotPresentWithLeaseOperation {
+		t.Errorf("expected ErrLeaseNotPresentWithLeaseOperation, got %v", err)
+	}
+}
+
+// TestFileBlobStore_SnapshotsSurviveRestart tests that snapshots keep their content
+// when the blob is overwritten and are reloaded when the store is reopened.
+func TestFileBlobStore_SnapshotsSurviveRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "blob.txt", strings.NewReader("original"), PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	var snapshots []string
+	for i := 0; i < 2; i++ {
+		result, err := store.CreateSnapshot(ctx, "testaccount", "testcontainer", "blob.txt", SnapshotOptions{})
+		if err != nil {
+			t.Fatalf("failed to create snapshot: %v", err)
+		}
+		snapshots = append(snapshots, result.Snapshot)
+	}
+	if snapshots[0] == snapshots[1] {
+		t.Fatalf("expected unique snapshot timestamps, got %q twice", snapshots[0])
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "blob.txt", strings.NewReader("overwritten"), PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to overwrite blob: %v", err)
+	}
+
+	// An orphaned snapshot file is quarantined on restart
+	orphan := store.snapshotPath("testaccount", "testcontainer", "blob.txt", "2001-01-01T00:00:00.0000000Z")
+	if err := os.WriteFile(orphan, []byte("stray"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	report := store.RecoveryReport()
+	if report.Snapshots != 2 || len(report.Quarantined) != 1 {
+		t.Errorf("expected 2 snapshots and 1 quarantined file, got %+v", report)
+	}
+
+	for _, snapshot := range snapshots {
+		blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "blob.txt", GetBlobOptions{Snapshot: snapshot})
+		if err != nil {
+			t.Fatalf("failed to get snapshot: %v", err)
+		}
+		if got := readBlobContent(t, blob); got != "original" || blob.Snapshot != snapshot {
+			t.Errorf("expected snapshot %s with %q, got %s with %q", snapshot, "original", blob.Snapshot, got)
+		}
+	}
+
+	err = store.DeleteBlob(ctx, "testaccount", "testcontainer", "blob.txt", DeleteBlobOptions{})
+	if err != ErrSnapshotsPresent {
+		t.Errorf("expected ErrSnapshotsPresent, got %v", err)
+	}
+}
+
+func TestFileBlobStore_VersionsSurviveRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.SetServiceProperties(ctx, "testaccount", ServiceProperties{VersioningEnabled: true}); err != nil {
+		t.Fatalf("failed to enable versioning: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	props, err := store.PutBlob(ctx, "testaccount", "testcontainer", "blob.txt", strings.NewReader("first"), PutBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	first := props.VersionID
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "blob.txt", strings.NewReader("second"), PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to overwrite blob: %v", err)
+	}
+	// Deleting the current version leaves only previous versions on disk
+	if err := store.DeleteBlob(ctx, "testaccount", "testcontainer", "blob.txt", DeleteBlobOptions{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	report := store.RecoveryReport()
+	if report.Versions != 2 || len(report.Quarantined) != 0 {
+		t.Errorf("expected 2 versions and nothing quarantined, got %+v", report)
+	}
+	if service, err := store.GetServiceProperties(ctx, "testaccount"); err != nil || !service.VersioningEnabled {
+		t.Errorf("expected versioning to stay enabled, got %+v, %v", service, err)
+	}
+
+	blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "blob.txt", GetBlobOptions{VersionID: first})
+	if err != nil {
+		t.Fatalf("failed to get version: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "first" {
+		t.Errorf("expected %q, got %q", "first", got)
+	}
+	if _, err := store.GetBlob(ctx, "testaccount", "testcontainer", "blob.txt", GetBlobOptions{}); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound for the deleted blob, got %v", err)
+	}
+}
+
+func TestFileBlobStore_SoftDeleteRestoreAndPurge(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	policy := RetentionPolicy{Enabled: true, Days: 2}
+	if err := store.SetServiceProperties(ctx, "testaccount", ServiceProperties{
+		DeleteRetentionPolicy:          policy,
+		ContainerDeleteRetentionPolicy: policy,
+	}); err != nil {
+		t.Fatalf("failed to set retention policies: %v", err)
+	}
+	for _, name := range []string{"kept", "dropped"} {
+		if err := store.CreateContainer(ctx, "testaccount", name, CreateContainerOptions{}); err != nil {
+			t.Fatalf("failed to create container: %v", err)
+		}
+		if _, err := store.PutBlob(ctx, "testaccount", name, "dir/blob.txt", strings.NewReader(name), PutBlobOptions{}); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+	if err := store.DeleteBlob(ctx, "testaccount", "kept", "dir/blob.txt", DeleteBlobOptions{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	for _, name := range []string{"kept", "dropped"} {
+		if err := store.DeleteContainer(ctx, "testaccount", name, AccessConditions{}); err != nil {
+			t.Fatalf("failed to delete container: %v", err)
+		}
+	}
+	// A new container may reuse the name of a soft-deleted one
+	if err := store.CreateContainer(ctx, "testaccount", "dropped", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to recreate container: %v", err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	if report := store.RecoveryReport(); report.SoftDeleted != 2 || len(report.Quarantined) != 0 {
+		t.Errorf("expected 2 soft-deleted containers and nothing quarantined, got %+v", report)
+	}
+
+	kept := store.deletedContainers["testaccount/kept"]
+	if len(kept) != 1 || kept[0].RemainingRetentionDays(time.Now()) != 2 {
+		t.Fatalf("expected one deleted container with 2 days left, got %+v", kept)
+	}
+	if err := store.RestoreContainer(ctx, "testaccount", "kept", "kept", kept[0].Version); err != nil {
+		t.Fatalf("failed to restore container: %v", err)
+	}
+	if err := store.RestoreContainer(ctx, "testaccount", "kept", "kept", kept[0].Version); err != ErrContainerAlreadyExists {
+		t.Errorf("expected ErrContainerAlreadyExists, got %v", err)
+	}
+	// The restored container still has its soft-deleted blob
+	if err := store.UndeleteBlob(ctx, "testaccount", "kept", "dir/blob.txt"); err != nil {
+		t.Fatalf("failed to undelete blob: %v", err)
+	}
+	blob, err := store.GetBlob(ctx, "testaccount", "kept", "dir/blob.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get restored blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != "kept" {
+		t.Errorf("expected %q, got %q", "kept", got)
+	}
+	if err := store.DeleteBlob(ctx, "testaccount", "kept", "dir/blob.txt", DeleteBlobOptions{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+
+	// Nothing is purged before the retention period ends
+	dropped := store.deletedContainerPath("testaccount", "dropped", store.deletedContainers["testaccount/dropped"][0].Version)
+	if purged, err := store.PurgeExpired(time.Now().Add(24 * time.Hour)); err != nil || purged != 0 {
+		t.Errorf("expected nothing to purge yet, got %d, %v", purged, err)
+	}
+	purged, err := store.PurgeExpired(time.Now().Add(49 * time.Hour))
+	if err != nil || purged != 2 {
+		t.Errorf("expected the deleted blob and container to be purged, got %d, %v", purged, err)
+	}
+	if err := store.UndeleteBlob(ctx, "testaccount", "kept", "dir/blob.txt"); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound after purge, got %v", err)
+	}
+	if _, err := os.Stat(dropped); !os.IsNotExist(err) {
+		t.Errorf("expected the deleted container's directory to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(store.blobMetaPath("testaccount", "kept", "dir/blob.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected the purged blob's record directory to be deleted, got %v", err)
+	}
+}
+
+func TestFileBlobStore_PendingCopyFailsOnRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.StartCopy(ctx, "testaccount", "testcontainer", "blob.txt", "copy-1", StartCopyOptions{SourceURL: "http://stub/blob.txt", Size: -1}); err != nil {
+		t.Fatalf("failed to start copy: %v", err)
+	}
+	if err := store.UpdateCopyProgress(ctx, "testaccount", "testcontainer", "blob.txt", "copy-1", 512); err != nil {
+		t.Fatalf("failed to update copy progress: %v", err)
+	}
+	blob, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "blob.txt", GetBlobOptions{})
+	if err != nil || blob.Copy.progress() != "512/*" {
+		t.Fatalf("expected progress 512/*, got %+v, %v", blob, err)
+	}
+
+	// A copy can't resume after a restart, so it is reported as failed
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	blob, err = store.GetBlobProperties(ctx, "testaccount", "testcontainer", "blob.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob properties: %v", err)
+	}
+	if blob.Copy == nil || blob.Copy.Status != CopyStatusFailed || blob.Copy.StatusDescription == "" || blob.Size != 0 {
+		t.Errorf("expected an empty blob with a failed copy, got %+v", blob)
+	}
+	if _, err := store.CompleteCopy(ctx, "testaccount", "testcontainer", "blob.txt", "copy-1", strings.NewReader("late")); err != ErrNoPendingCopyOperation {
+		t.Errorf("expected ErrNoPendingCopyOperation, got %v", err)
+	}
+}
+
+// TestFileBlobStore_ContainerACLSurvivesRestart tests that container metadata,
+// public access levels and stored access policies are persisted.
+func TestFileBlobStore_ContainerACLSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{PublicAccess: PublicAccessBlob}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.SetContainerMetadata(ctx, "testaccount", "testcontainer", map[string]string{"owner": "alice"}, AccessConditions{}); err != nil {
+		t.Fatalf("failed to set container metadata: %v", err)
+	}
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	acl := ContainerACL{
+		PublicAccess:      PublicAccessContainer,
+		SignedIdentifiers: []SignedIdentifier{{ID: "reader", Expiry: expiry, Permission: "rl"}},
+	}
+	if _, err := store.SetContainerACL(ctx, "testaccount", "testcontainer", acl, AccessConditions{}); err != nil {
+		t.Fatalf("failed to set container ACL: %v", err)
+	}
+
+	// Reopen the store
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	container, err := store.GetContainer(ctx, "testaccount", "testcontainer")
+	if err != nil {
+		t.Fatalf("failed to get container: %v", err)
+	}
+	if container.Metadata["owner"] != "alice" || container.PublicAccess != PublicAccessContainer {
+		t.Errorf("unexpected container after restart: %+v", container)
+	}
+	if ids := container.SignedIdentifiers; len(ids) != 1 || ids[0].ID != "reader" || !ids[0].Expiry.Equal(expiry) || !ids[0].Start.IsZero() {
+		t.Errorf("unexpected stored access policies after restart: %+v", ids)
+	}
+}
+
+// TestFileBlobStore_AppendBlobLimits tests the append block count limit and that
+// append blobs keep their type, block count and seal across a restart.
+func TestFileBlobStore_AppendBlobLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.CreateAppendBlob(ctx, "testaccount", "testcontainer", "log.txt", PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to create append blob: %v", err)
+	}
+	if _, err := store.AppendBlock(ctx, "testaccount", "testcontainer", "log.txt", strings.NewReader("entry"), AppendBlockOptions{}); err != nil {
+		t.Fatalf("failed to append block: %v", err)
+	}
+
+	// Appending 50,000 blocks takes too long, so the count is raised directly.
+	record := store.containers["testaccount/testcontainer"].blobs["log.txt"]
+	record.Properties.CommittedBlockCount = maxCommittedBlocks
+	if _, err := store.AppendBlock(ctx, "testaccount", "testcontainer", "log.txt", strings.NewReader("entry"), AppendBlockOptions{}); err != ErrCommittedBlockCountExceedsLimit {
+		t.Errorf("expected ErrCommittedBlockCountExceedsLimit, got %v", err)
+	}
+	record.Properties.CommittedBlockCount = 1
+
+	if _, err := store.SealBlob(ctx, "testaccount", "testcontainer", "log.txt", AppendBlockOptions{}); err != nil {
+		t.Fatalf("failed to seal blob: %v", err)
+	}
+
+	// Reopen the store
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	blob, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "log.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob properties: %v", err)
+	}
+	if blob.BlobType != BlobTypeAppend || blob.CommittedBlockCount != 1 || !blob.Sealed || blob.Size != 5 {
+		t.Errorf("unexpected append blob after restart: %+v", blob.BlobProperties)
+	}
+	if _, err := store.AppendBlock(ctx, "testaccount", "testcontainer", "log.txt", strings.NewReader("entry"), AppendBlockOptions{}); err != ErrBlobIsSealed {
+		t.Errorf("expected ErrBlobIsSealed, got %v", err)
+	}
+}
+
+// TestFileBlobStore_PageBlobsSurviveRestart tests that a large page blob is
+// stored as a file of its declared size, and that its pages, sequence number
+// and the page writes its snapshots saw survive a restart.
+func TestFileBlobStore_PageBlobsSurviveRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	const size = 1 << 30
+	if _, err := store.CreatePageBlob(ctx, "testaccount", "testcontainer", "disk.vhd", CreatePageBlobOptions{Size: size, SequenceNumber: 7}); err != nil {
+		t.Fatalf("failed to create page blob: %v", err)
+	}
+	page := PageRange{Start: size / 2, End: size/2 + PageSize - 1}
+	if _, err := store.UploadPages(ctx, "testaccount", "testcontainer", "disk.vhd", page, strings.NewReader(strings.Repeat("p", PageSize)), PageWriteOptions{}); err != nil {
+		t.Fatalf("failed to upload pages: %v", err)
+	}
+	snap, err := store.CreateSnapshot(ctx, "testaccount", "testcontainer", "disk.vhd", SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("failed to snapshot blob: %v", err)
+	}
+	if _, err := store.ClearPages(ctx, "testaccount", "testcontainer", "disk.vhd", page, PageWriteOptions{}); err != nil {
+		t.Fatalf("failed to clear pages: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(store.baseDir, "testaccount", "testcontainer", "disk.vhd"))
+	if err != nil || info.Size() != size {
+		t.Fatalf("expected a content file of %d bytes, got %v, %v", size, info, err)
+	}
+
+	// Reopen the store
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	if len(store.RecoveryReport().Repaired) != 0 {
+		t.Errorf("expected nothing to repair, got %v", store.RecoveryReport().Repaired)
+	}
+	list, err := store.GetPageRanges(ctx, "testaccount", "testcontainer", "disk.vhd", GetPageRangesOptions{PrevSnapshot: snap.Snapshot})
+	if err != nil {
+		t.Fatalf("failed to get page ranges: %v", err)
+	}
+	if len(list.PageRanges) != 0 || len(list.ClearRanges) != 1 || list.ClearRanges[0] != page {
+		t.Errorf("unexpected page range diff after restart: %+v", list)
+	}
+	if list.Blob.SequenceNumber != 7 || list.Blob.BlobType != BlobTypePage {
+		t.Errorf("unexpected page blob properties after restart: %+v", list.Blob)
+	}
+	list, err = store.GetPageRanges(ctx, "testaccount", "testcontainer", "disk.vhd", GetPageRangesOptions{Snapshot: snap.Snapshot})
+	if err != nil {
+		t.Fatalf("failed to get snapshot page ranges: %v", err)
+	}
+	if len(list.PageRanges) != 1 || list.PageRanges[0] != page {
+		t.Errorf("unexpected snapshot page ranges after restart: %+v", list.PageRanges)
+	}
+	blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "disk.vhd", GetBlobOptions{Snapshot: snap.Snapshot})
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	defer blob.Content.Close()
+	data := make([]byte, PageSize)
+	if _, err := blob.Content.ReadAt(data, page.Start); err != nil || string(data) != strings.Repeat("p", PageSize) {
+		t.Errorf("expected the snapshot to keep its page, got %q, %v", data[:8], err)
+	}
+}
+
+func TestFileBlobStore_TagIndexSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if err := store.SetServiceProperties(ctx, "testaccount", ServiceProperties{VersioningEnabled: true}); err != nil {
+		t.Fatalf("failed to enable versioning: %v", err)
+	}
+	first, err := store.PutBlob(ctx, "testaccount", "testcontainer", "report.csv", strings.NewReader("v1"), PutBlobOptions{Tags: map[string]string{"status": "draft"}})
+	if err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "report.csv", strings.NewReader("v2"), PutBlobOptions{Tags: map[string]string{"status": "final"}}); err != nil {
+		t.Fatalf("failed to overwrite blob: %v", err)
+	}
+	if err := store.SetBlobTags(ctx, "testaccount", "testcontainer", "report.csv", map[string]string{"status": "archived"}, SetBlobTagsOptions{VersionID: first.VersionID}); err != nil {
+		t.Fatalf("failed to tag previous version: %v", err)
+	}
+
+	// Reopen the store
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	find := func(value string) int {
+		t.Helper()
+		list, err := store.FindBlobsByTags(ctx, "testaccount", FindBlobsByTagsOptions{
+			Where: []TagCondition{{Key: "status", Op: "=", Value: value}},
+		})
+		if err != nil {
+			t.Fatalf("failed to find blobs by tags: %v", err)
+		}
+		return len(list.Blobs)
+	}
+	// Only the current version is indexed
+	if find("final") != 1 || find("draft") != 0 || find("archived") != 0 {
+		t.Errorf("unexpected tag index after restart")
+	}
+	tags, err := store.GetBlobTags(ctx, "testaccount", "testcontainer", "report.csv", GetBlobOptions{VersionID: first.VersionID})
+	if err != nil || tags["status"] != "archived" {
+		t.Errorf("expected the previous version's tags to survive a restart, got %v, %v", tags, err)
+	}
+}
+
+func TestFileBlobStore_RehydrationSurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	store.SetRehydrationDelays(100*time.Millisecond, time.Millisecond)
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "backup.tar", strings.NewReader("data"), PutBlobOptions{Tier: AccessTierArchive}); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	props, err := store.SetBlobTier(ctx, "testaccount", "testcontainer", "backup.tar", AccessTierCool, SetBlobTierOptions{})
+	if err != nil || props.Rehydration == nil {
+		t.Fatalf("expected a pending rehydration, got %+v, %v", props, err)
+	}
+
+	// Reopen the store before the rehydration is due
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	blob, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "backup.tar", GetBlobOptions{})
+	if err != nil || blob.Rehydration == nil || blob.Rehydration.Tier != AccessTierCool {
+		t.Fatalf("expected the rehydration to survive a restart, got %+v, %v", blob, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for blob.AccessTier != AccessTierCool && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if blob, err = store.GetBlobProperties(ctx, "testaccount", "testcontainer", "backup.tar", GetBlobOptions{}); err != nil {
+			t.Fatalf("failed to get blob properties: %v", err)
+		}
+	}
+	if blob.AccessTier != AccessTierCool || blob.Rehydration != nil || !blob.AccessTierChangedAt.Equal(props.Rehydration.CompletesAt) {
+		t.Errorf("expected the rehydration to complete after a restart, got %+v", blob.BlobProperties)
+	}
+}
+
+func TestFileBlobStore_ImmutabilitySurvivesRestart(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	for _, name := range []string{"held.csv", "expiring.csv"} {
+		if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", name, strings.NewReader("data"), PutBlobOptions{}); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+	if _, err := store.SetBlobLegalHold(ctx, "testaccount", "testcontainer", "held.csv", true, ImmutabilityOptions{}); err != nil {
+		t.Fatalf("failed to set legal hold: %v", err)
+	}
+	expiresOn := time.Now().Add(200 * time.Millisecond)
+	if _, err := store.SetBlobImmutabilityPolicy(ctx, "testaccount", "testcontainer", "expiring.csv", ImmutabilityPolicy{
+		ExpiresOn: expiresOn,
+		Mode:      ImmutabilityPolicyLocked,
+	}, ImmutabilityOptions{}); err != nil {
+		t.Fatalf("failed to set immutability policy: %v", err)
+	}
+	if _, err := store.SetContainerImmutabilityPolicy(ctx, "testaccount", "testcontainer", ContainerImmutabilityPolicy{PeriodDays: 1}); err != nil {
+		t.Fatalf("failed to set container immutability policy: %v", err)
+	}
+	if err := store.DeleteContainerImmutabilityPolicy(ctx, "testaccount", "testcontainer"); err != nil {
+		t.Fatalf("failed to delete unlocked container immutability policy: %v", err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	if err := store.DeleteBlob(ctx, "testaccount", "testcontainer", "held.csv", DeleteBlobOptions{}); err != ErrBlobImmutableDueToLegalHold {
+		t.Errorf("expected the legal hold to survive a restart, got %v", err)
+	}
+	if err := store.DeleteBlob(ctx, "testaccount", "testcontainer", "expiring.csv", DeleteBlobOptions{}); err != ErrBlobImmutableDueToPolicy {
+		t.Errorf("expected the immutability policy to survive a restart, got %v", err)
+	}
+	if err := store.DeleteBlobImmutabilityPolicy(ctx, "testaccount", "testcontainer", "expiring.csv", ImmutabilityOptions{}); err != ErrImmutabilityPolicyLocked {
+		t.Errorf("expected the locked policy to refuse deletion, got %v", err)
+	}
+	if err := store.DeleteContainer(ctx, "testaccount", "testcontainer", AccessConditions{}); err != ErrBlobImmutableDueToLegalHold && err != ErrBlobImmutableDueToPolicy {
+		t.Errorf("expected the container to be protected by its blobs, got %v", err)
+	}
+
+	// An expired policy no longer protects the blob
+	time.Sleep(time.Until(expiresOn))
+	if err := store.DeleteBlob(ctx, "testaccount", "testcontainer", "expiring.csv", DeleteBlobOptions{}); err != nil {
+		t.Errorf("expected the blob to be deletable once its policy expired, got %v", err)
+	}
+	if _, err := store.SetBlobLegalHold(ctx, "testaccount", "testcontainer", "held.csv", false, ImmutabilityOptions{}); err != nil {
+		t.Fatalf("failed to clear legal hold: %v", err)
+	}
+	if err := store.DeleteContainer(ctx, "testaccount", "testcontainer", AccessConditions{}); err != nil {
+		t.Errorf("expected the container to be deletable once nothing is protected, got %v", err)
+	}
+}
+
+func TestFileBlobStore_PutBlobComputesContentMD5(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "test.txt", strings.NewReader("hello world"), PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	store, err = NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to reopen blob store: %v", err)
+	}
+	props, err := store.GetBlobProperties(ctx, "testaccount", "testcontainer", "test.txt", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob properties: %v", err)
+	}
+	want := md5.Sum([]byte("hello world"))
+	if !bytes.Equal(props.ContentMD5, want[:]) {
+		t.Errorf("expected Content-MD5 %x, got %x", want, props.ContentMD5)
+	}
+}
+
+func TestFileBlobStore_PathsStayInsideDataDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(filepath.Join(tmpDir, "data"))
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	for _, name := range []string{"..", "../escape", "."} {
+		if err := store.CreateContainer(ctx, "testaccount", name, CreateContainerOptions{}); !errors.Is(err, ErrInvalidResourceName) {
+			t.Errorf("expected container %q to be rejected, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"../../../escape.txt", "../testcontainer2/escape.txt", ".", "a/../../escape.txt"} {
+		if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", name, strings.NewReader("pwned"), PutBlobOptions{}); !errors.Is(err, ErrInvalidResourceName) {
+			t.Errorf("expected blob %q to be rejected, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "escape.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the data directory, got %v", err)
+	}
+}
+
+func TestFileBlobStore_PageWritesDontAffectOpenHandles(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	const size = 4 * PageSize
+	if _, err := store.CreatePageBlob(ctx, "testaccount", "testcontainer", "disk.vhd", CreatePageBlobOptions{Size: size}); err != nil {
+		t.Fatalf("failed to create page blob: %v", err)
+	}
+	first := PageRange{Start: 0, End: PageSize - 1}
+	second := PageRange{Start: PageSize, End: 2*PageSize - 1}
+	for _, rng := range []PageRange{first, second} {
+		if _, err := store.UploadPages(ctx, "testaccount", "testcontainer", "disk.vhd", rng, strings.NewReader(strings.Repeat("a", PageSize)), PageWriteOptions{}); err != nil {
+			t.Fatalf("failed to upload pages: %v", err)
+		}
+	}
+
+	blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "disk.vhd", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	want := strings.Repeat("a", 2*PageSize) + strings.Repeat("\x00", 2*PageSize)
+
+	if _, err := store.UploadPages(ctx, "testaccount", "testcontainer", "disk.vhd", first, strings.NewReader(strings.Repeat("b", PageSize)), PageWriteOptions{}); err != nil {
+		t.Fatalf("failed to upload pages: %v", err)
+	}
+	if _, err := store.ClearPages(ctx, "testaccount", "testcontainer", "disk.vhd", second, PageWriteOptions{}); err != nil {
+		t.Fatalf("failed to clear pages: %v", err)
+	}
+	newSize := int64(PageSize)
+	if _, err := store.SetPageBlobProperties(ctx, "testaccount", "testcontainer", "disk.vhd", PageBlobPropertiesOptions{Size: &newSize}); err != nil {
+		t.Fatalf("failed to resize blob: %v", err)
+	}
+
+	if got := readBlobContent(t, blob); got != want {
+		t.Errorf("expected the open handle to keep its content, got %q", got)
+	}
+	blob, err = store.GetBlob(ctx, "testaccount", "testcontainer", "disk.vhd", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != strings.Repeat("b", PageSize) {
+		t.Errorf("expected the written and resized content, got %q", got)
+	}
+}
+
+func TestFileBlobStore_PageWritesInPlaceUnlessShared(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.CreatePageBlob(ctx, "testaccount", "testcontainer", "disk.vhd", CreatePageBlobOptions{Size: 4 * PageSize}); err != nil {
+		t.Fatalf("failed to create page blob: %v", err)
+	}
+	writePage := func(page int64, fill string) {
+		t.Helper()
+		rng := PageRange{Start: page * PageSize, End: (page+1)*PageSize - 1}
+		if _, err := store.UploadPages(ctx, "testaccount", "testcontainer", "disk.vhd", rng, strings.NewReader(strings.Repeat(fill, PageSize)), PageWriteOptions{}); err != nil {
+			t.Fatalf("failed to upload pages: %v", err)
+		}
+	}
+	path := filepath.Join(store.baseDir, "testaccount", "testcontainer", "disk.vhd")
+	stat := func() os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat content file: %v", err)
+		}
+		return fi
+	}
+	writePage(0, "a")
+
+	// Without snapshots or readers, a write only touches its own pages
+	before := stat()
+	writePage(2, "b")
+	if !os.SameFile(before, stat()) {
+		t.Errorf("expected the page write to change the content file in place")
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read content file: %v", err)
+	}
+	want := strings.Repeat("a", PageSize) + strings.Repeat("\x00", PageSize) + strings.Repeat("b", PageSize) + strings.Repeat("\x00", PageSize)
+	if string(content) != want {
+		t.Errorf("unexpected content after the page write")
+	}
+
+	// A snapshot shares the file, so the next write replaces it
+	snap, err := store.CreateSnapshot(ctx, "testaccount", "testcontainer", "disk.vhd", SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %v", err)
+	}
+	before = stat()
+	writePage(0, "c")
+	if os.SameFile(before, stat()) {
+		t.Errorf("expected the page write to replace a content file shared with a snapshot")
+	}
+	blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "disk.vhd", GetBlobOptions{Snapshot: snap.Snapshot})
+	if err != nil {
+		t.Fatalf("failed to get snapshot: %v", err)
+	}
+	if got := readBlobContent(t, blob); got != want {
+		t.Errorf("expected the snapshot to keep its content")
+	}
+
+	// Once the new file isn't shared, writes are in place again
+	before = stat()
+	writePage(1, "d")
+	if !os.SameFile(before, stat()) {
+		t.Errorf("expected the page write to change the unshared content file in place")
+	}
+}
+
+func TestFileBlobStore_CommitBlockListWhileStaging(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+
+	// A block restaged while a commit copies it must not end up in the blob
+	// with the size of the block it replaced.
+	const id = "YmxvY2sx"
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			content := strings.Repeat(string(rune('a'+i%26)), i)
+			if err := store.StageBlock(ctx, "testaccount", "testcontainer", "blob", id, strings.NewReader(content), StageBlockOptions{}); err != nil {
+				t.Errorf("failed to stage block: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		props, err := store.CommitBlockList(ctx, "testaccount", "testcontainer", "blob", []BlockListEntry{{ID: id, Source: BlockSourceUncommitted}}, PutBlobOptions{})
+		if err == ErrInvalidBlockList {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to commit block list: %v", err)
+		}
+		blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "blob", GetBlobOptions{})
+		if err != nil {
+			t.Fatalf("failed to get blob: %v", err)
+		}
+		content := readBlobContent(t, blob)
+		if int64(len(content)) != props.Size || content != strings.Repeat(content[:1], len(content)) {
+			t.Fatalf("expected %d bytes of one block, got %q", props.Size, content)
+		}
+	}
+	wg.Wait()
+
+	// A commit whose request has gone away isn't attempted
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.CommitBlockList(cancelled, "testaccount", "testcontainer", "blob", []BlockListEntry{{ID: id, Source: BlockSourceLatest}}, PutBlobOptions{}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	// The fallback commit assembles the blob under the write lock
+	if err := store.StageBlock(ctx, "testaccount", "testcontainer", "blob", id, strings.NewReader("locked"), StageBlockOptions{}); err != nil {
+		t.Fatalf("failed to stage block: %v", err)
+	}
+	props, retry, err := store.commitBlockList("testaccount", "testcontainer", "blob", []BlockListEntry{{ID: id, Source: BlockSourceUncommitted}}, PutBlobOptions{}, true)
+	if err != nil || retry || props.Size != int64(len("locked")) {
+		t.Fatalf("expected a 6 byte blob without a retry, got %+v, %t, %v", props, retry, err)
+	}
+	blob, err := store.GetBlob(ctx, "testaccount", "testcontainer", "blob", GetBlobOptions{})
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if content := readBlobContent(t, blob); content != "locked" {
+		t.Errorf("expected %q, got %q", "locked", content)
+	}
+}
+
+func TestFileBlobStore_PurgeKeepsRecordsItCouldNotRemove(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(tmpDir)
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	if err := store.SetServiceProperties(ctx, "testaccount", ServiceProperties{
+		DeleteRetentionPolicy: RetentionPolicy{Enabled: true, Days: 1},
+	}); err != nil {
+		t.Fatalf("failed to set retention policy: %v", err)
+	}
+	if err := store.CreateContainer(ctx, "testaccount", "testcontainer", CreateContainerOptions{}); err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	if _, err := store.PutBlob(ctx, "testaccount", "testcontainer", "blob.txt", strings.NewReader("data"), PutBlobOptions{}); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateSnapshot(ctx, "testaccount", "testcontainer", "blob.txt", SnapshotOptions{}); err != nil {
+			t.Fatalf("failed to create snapshot: %v", err)
+		}
+	}
+	if err := store.DeleteBlob(ctx, "testaccount", "testcontainer", "blob.txt", DeleteBlobOptions{DeleteSnapshots: DeleteSnapshotsOnly}); err != nil {
+		t.Fatalf("failed to delete snapshots: %v", err)
+	}
+
+	// A directory in place of the second snapshot's content can't be removed
+	entry := store.containers["testaccount/testcontainer"]
+	blocked := store.snapshotPath("testaccount", "testcontainer", "blob.txt", entry.snapshots["blob.txt"][1].Snapshot)
+	if err := os.Remove(blocked); err != nil {
+		t.Fatalf("failed to remove snapshot content: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(blocked, "child"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	purged, err := store.PurgeExpired(time.Now().Add(25 * time.Hour))
+	if err == nil || purged != 1 {
+		t.Fatalf("expected one snapshot purged and an error, got %d, %v", purged, err)
+	}
+	if remaining := entry.snapshots["blob.txt"]; len(remaining) != 2 {
+		t.Fatalf("expected the 2 snapshots not purged to stay indexed, got %d", len(remaining))
+	}
+
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatalf("failed to remove directory: %v", err)
+	}
+	purged, err = store.PurgeExpired(time.Now().Add(25 * time.Hour))
+	if err != nil || purged != 2 {
+		t.Errorf("expected the remaining snapshots to be purged, got %d, %v", purged, err)
+	}
+	if remaining := entry.snapshots["blob.txt"]; len(remaining) != 0 {
+		t.Errorf("expected no snapshots left, got %d", len(remaining))
+	}
+}
@@ -0,0 +1,707 @@
+package blob
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// Block blob limits enforced by Azure.
+const (
+	maxBlockIDLength     = 64
+	maxUncommittedBlocks = 100000
+	maxCommittedBlocks   = 50000
+
+	// uncommittedBlockTTL is how long uncommitted blocks are kept after the last
+	// Put Block on a blob before they are garbage collected.
+	uncommittedBlockTTL = 7 * 24 * time.Hour
+)
+
+// maxOptimisticAttempts is how many times a write that prepares its content
+// without the write lock is attempted before it prepares it under the lock
+// instead, so that steady concurrent writes to the same blob can't starve it.
+const maxOptimisticAttempts = 3
+
+// stagedBlocks is the persisted list of a blob's uncommitted blocks. It is stored
+// as blocks.json in the blob's record directory, with the block data under blocks/.
+type stagedBlocks struct {
+	Name         string    `json:"name"`
+	Blocks       []Block   `json:"blocks"`
+	LastStagedAt time.Time `json:"lastStagedAt"`
+}
+
+// expired reports whether the uncommitted blocks are due for garbage collection.
+func (b *stagedBlocks) expired(now time.Time) bool {
+	return now.Sub(b.LastStagedAt) > uncommittedBlockTTL
+}
+
+// find returns the staged block with the given ID.
+func (b *stagedBlocks) find(id string) (Block, bool) {
+	for _, block := range b.Blocks {
+		if block.ID == id {
+			return block, true
+		}
+	}
+	return Block{}, false
+}
+
+// blockPath returns the file holding an uncommitted block's data.
+func (s *FileBlobStore) blockPath(account, containerName, blobName, blockID string) string {
+	return filepath.Join(s.blobMetaPath(account, containerName, blobName), "blocks", hex.EncodeToString([]byte(blockID)))
+}
+
+// stagedBlocksPath returns the path of a blob's uncommitted block list.
+func (s *FileBlobStore) stagedBlocksPath(account, containerName, blobName string) string {
+	return filepath.Join(s.blobMetaPath(account, containerName, blobName), "blocks.json")
+}
+
+// liveStagedBlocks returns a blob's uncommitted blocks, or nil if it has none.
+// Blocks that have outlived uncommittedBlockTTL are garbage collected first.
+func (s *FileBlobStore) liveStagedBlocks(entry *containerEntry, account, containerName, blobName string) (*stagedBlocks, error) {
+	staged, ok := entry.staged[blobName]
+	if !ok {
+		return nil, nil
+	}
+	if staged.expired(time.Now()) {
+		return nil, s.discardStagedBlocks(entry, account, containerName, blobName)
+	}
+	return staged, nil
+}
+
+// discardStagedBlocks removes all uncommitted blocks of a blob.
+func (s *FileBlobStore) discardStagedBlocks(entry *containerEntry, account, containerName, blobName string) error {
+	if _, ok := entry.staged[blobName]; !ok {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(s.blobMetaPath(account, containerName, blobName), "blocks")); err != nil {
+		return fmt.Errorf("failed to delete uncommitted blocks: %w", err)
+	}
+	if err := os.Remove(s.stagedBlocksPath(account, containerName, blobName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete uncommitted block list: %w", err)
+	}
+	delete(entry.staged, blobName)
+	return s.pruneBlobMetaDir(entry, account, containerName, blobName)
+}
+
+// validateBlockID checks that a block ID is valid base64 of at most 64 bytes and
+// has the same length as the blob's other block IDs.
+func validateBlockID(id string, record *blobRecord, staged *stagedBlocks) error {
+	decoded, err := base64.StdEncoding.DecodeString(id)
+	if err != nil || len(decoded) == 0 || len(decoded) > maxBlockIDLength {
+		return ErrInvalidBlockID
+	}
+
+	var other string
+	switch {
+	case staged != nil && len(staged.Blocks) > 0:
+		other = staged.Blocks[0].ID
+	case record != nil && len(record.CommittedBlocks) > 0:
+		other = record.CommittedBlocks[0].ID
+	}
+	if other != "" && len(other) != len(id) {
+		return ErrInvalidBlobOrBlock
+	}
+	return nil
+}
+
+// StageBlock stores an uncommitted block for a blob. Staging a block with an ID that
+// is already staged replaces it. The blob itself doesn't need to exist yet.
+func (s *FileBlobStore) StageBlock(ctx context.Context, account, containerName, blobName, blockID string, content io.Reader, opts StageBlockOptions) error {
+	tmpPath, size, err := s.spoolTemp(content)
+	if err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	staged, err := s.liveStagedBlocks(entry, account, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(AccessConditions{LeaseID: opts.LeaseID}, existing); err != nil {
+		return err
+	}
+	if existing != nil && existing.Properties.BlobType != BlobTypeBlock {
+		return ErrInvalidBlobType
+	}
+	if err := validateBlockID(blockID, existing, staged); err != nil {
+		return err
+	}
+
+	if staged == nil {
+		staged = &stagedBlocks{Name: blobName}
+	}
+	_, replacing := staged.find(blockID)
+	if !replacing && len(staged.Blocks) >= maxUncommittedBlocks {
+		return ErrBlockCountExceedsLimit
+	}
+
+	path := s.blockPath(account, containerName, blobName, blockID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create block directory: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+
+	updated := &stagedBlocks{Name: blobName, LastStagedAt: time.Now().UTC()}
+	for _, block := range staged.Blocks {
+		if block.ID != blockID {
+			updated.Blocks = append(updated.Blocks, block)
+		}
+	}
+	updated.Blocks = append(updated.Blocks, Block{ID: blockID, Size: size})
+
+	if err := s.writeJSON(s.stagedBlocksPath(account, containerName, blobName), updated); err != nil {
+		return err
+	}
+	entry.staged[blobName] = updated
+	return nil
+}
+
+// CommitBlockList writes a blob from a list of committed and uncommitted blocks,
+// replacing its current content. All uncommitted blocks are discarded afterwards,
+// as are committed blocks that aren't part of the new list.
+func (s *FileBlobStore) CommitBlockList(ctx context.Context, account, containerName, blobName string, blocks []BlockListEntry, opts PutBlobOptions) (*BlobProperties, error) {
+	if len(blocks) > maxCommittedBlocks {
+		return nil, ErrBlockListTooLong
+	}
+	for attempt := 0; attempt < maxOptimisticAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		props, retry, err := s.commitBlockList(account, containerName, blobName, blocks, opts, false)
+		if !retry {
+			return props, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	props, _, err := s.commitBlockList(account, containerName, blobName, blocks, opts, true)
+	return props, err
+}
+
+// blockListPlan is a block list resolved against a blob and its staged blocks.
+type blockListPlan struct {
+	// etag and staged identify the state the list was resolved against: the
+	// blob's ETag, empty if it doesn't exist, and its staged blocks record.
+	etag   string
+	staged *stagedBlocks
+
+	sources []blockSource
+
+	// current is a handle on the blob's content, nil if it doesn't exist.
+	current *os.File
+}
+
+// blockSource is where a block of a new block list comes from: a staged block,
+// or a range of the blob's current content.
+type blockSource struct {
+	block       Block
+	uncommitted bool
+	offset      int64
+}
+
+// commitBlockList makes one attempt at committing a block list. Like PutBlob,
+// it assembles the new content without holding the write lock, so a large
+// commit doesn't block other requests: the list is resolved under the read
+// lock, and the blocks are copied from the staged block files and an open
+// handle on the current content. The write lock is only taken to check that
+// neither the blob nor its staged blocks changed meanwhile, and to swap the
+// content in. The bool result is true if they did change, and the commit must
+// be retried. With locked set, the write lock is held throughout instead, and
+// the commit can't need a retry.
+func (s *FileBlobStore) commitBlockList(account, containerName, blobName string, blocks []BlockListEntry, opts PutBlobOptions, locked bool) (*BlobProperties, bool, error) {
+	if locked {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+	}
+	plan, err := s.resolveBlockList(account, containerName, blobName, blocks, opts.Conditions)
+	if !locked {
+		s.mu.RUnlock()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if plan.current != nil {
+		defer plan.current.Close()
+	}
+	tmpPath, size, assembleErr := s.assembleBlockList(account, containerName, blobName, plan)
+	if tmpPath != "" {
+		defer os.Remove(tmpPath)
+	}
+
+	if !locked {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, false, err
+	}
+	existing := entry.blobs[blobName]
+	etag := ""
+	if existing != nil {
+		etag = existing.Properties.ETag
+	}
+	if etag != plan.etag || entry.staged[blobName] != plan.staged {
+		return nil, true, nil
+	}
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, false, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, false, err
+	}
+	if assembleErr != nil {
+		return nil, false, fmt.Errorf("failed to assemble blob: %w", assembleErr)
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC()
+	versionID, err := s.keepPreviousState(entry, account, containerName, blobName, existing, now)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return nil, false, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return nil, false, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	createdAt := now
+	var lease Lease
+	if existing != nil {
+		createdAt = existing.Properties.CreatedAt
+		lease = existing.Properties.Lease
+	}
+	headers := opts.HTTPHeaders
+	if headers.ContentType == "" {
+		headers.ContentType = "application/octet-stream"
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	committedBlocks := make([]Block, 0, len(plan.sources))
+	for _, src := range plan.sources {
+		committedBlocks = append(committedBlocks, src.block)
+	}
+
+	record := &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders: headers,
+			Size:            size,
+			CreatedAt:       createdAt,
+			ModifiedAt:      now,
+			ETag:            newETag(),
+			BlobType:        BlobTypeBlock,
+			AccessTier:      opts.Tier,
+			Lease:           lease,
+			VersionID:       versionID,
+
+			ImmutabilityPolicy: opts.ImmutabilityPolicy,
+			LegalHold:          opts.LegalHold,
+		},
+		Metadata:        metadata,
+		Tags:            opts.Tags,
+		CommittedBlocks: committedBlocks,
+	}
+	if err := s.writeBlobRecord(account, containerName, record); err != nil {
+		return nil, false, err
+	}
+	entry.blobs[blobName] = record
+	entry.tags.update(blobName, existing.tags(), record.Tags)
+
+	if err := s.discardStagedBlocks(entry, account, containerName, blobName); err != nil {
+		return nil, false, err
+	}
+
+	props := record.Properties
+	return &props, false, nil
+}
+
+// resolveBlockList checks a block list against a blob and resolves every entry
+// to either a staged block or a range of the current content, which it opens.
+// Expired staged blocks are treated as gone; the commit discards them. The
+// caller holds the lock, for reading at least.
+func (s *FileBlobStore) resolveBlockList(account, containerName, blobName string, blocks []BlockListEntry, conds AccessConditions) (*blockListPlan, error) {
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	plan := &blockListPlan{staged: entry.staged[blobName]}
+	staged := plan.staged
+	if staged != nil && staged.expired(time.Now()) {
+		staged = nil
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(conds, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Properties.BlobType != BlobTypeBlock {
+		return nil, ErrInvalidBlobType
+	}
+
+	// Offsets of the committed blocks within the current content file.
+	committed := make(map[string][2]int64)
+	if existing != nil {
+		var offset int64
+		for _, block := range existing.CommittedBlocks {
+			if _, ok := committed[block.ID]; !ok {
+				committed[block.ID] = [2]int64{offset, block.Size}
+			}
+			offset += block.Size
+		}
+	}
+
+	uncommitted := make(map[string]Block)
+	if staged != nil {
+		for _, block := range staged.Blocks {
+			uncommitted[block.ID] = block
+		}
+	}
+	plan.sources = make([]blockSource, 0, len(blocks))
+	for _, b := range blocks {
+		stagedBlock, isStaged := uncommitted[b.ID]
+		committedRange, isCommitted := committed[b.ID]
+
+		switch {
+		case isStaged && b.Source != BlockSourceCommitted:
+			plan.sources = append(plan.sources, blockSource{block: stagedBlock, uncommitted: true})
+		case isCommitted && b.Source != BlockSourceUncommitted:
+			plan.sources = append(plan.sources, blockSource{
+				block:  Block{ID: b.ID, Size: committedRange[1]},
+				offset: committedRange[0],
+			})
+		default:
+			return nil, ErrInvalidBlockList
+		}
+	}
+
+	if existing != nil {
+		plan.etag = existing.Properties.ETag
+		blobPath, err := s.blobPath(account, containerName, blobName)
+		if err != nil {
+			return nil, err
+		}
+		// Opening the file under the lock pairs the handle with the ETag.
+		if plan.current, err = os.Open(blobPath); err != nil {
+			return nil, fmt.Errorf("failed to open blob: %w", err)
+		}
+	}
+	return plan, nil
+}
+
+// assembleBlockList writes the content of a resolved block list to a temporary
+// file. Staged block files are only ever replaced, never written in place, so
+// a block replaced meanwhile is caught by the commit's check of the staged
+// blocks record, as is one whose file has been discarded.
+func (s *FileBlobStore) assembleBlockList(account, containerName, blobName string, plan *blockListPlan) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.baseDir, tmpDirName), "commit-*")
+	if err != nil {
+		return "", 0, err
+	}
+
+	var size int64
+	for _, src := range plan.sources {
+		if src.uncommitted {
+			err = appendFile(tmp, s.blockPath(account, containerName, blobName, src.block.ID))
+		} else {
+			_, err = io.Copy(tmp, io.NewSectionReader(plan.current, src.offset, src.block.Size))
+		}
+		if err != nil {
+			break
+		}
+		size += src.block.Size
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	return tmp.Name(), size, err
+}
+
+// GetBlockList returns the committed and uncommitted blocks of a blob.
+// It returns ErrBlobNotFound if the blob has neither.
+func (s *FileBlobStore) GetBlockList(ctx context.Context, account, containerName, blobName string) (*BlockList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := s.liveStagedBlocks(entry, account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	record, committed := entry.blobs[blobName]
+	if !committed && staged == nil {
+		return nil, ErrBlobNotFound
+	}
+
+	list := &BlockList{}
+	if committed {
+		list.Committed = append(list.Committed, record.CommittedBlocks...)
+		props := record.Properties
+		list.Blob = &props
+	}
+	if staged != nil {
+		list.Uncommitted = append(list.Uncommitted, staged.Blocks...)
+	}
+	return list, nil
+}
+
+// appendFile copies the contents of the file at path to w.
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// handlePutBlock handles PUT /{account}/{container}/{blobName}?comp=block&blockid=<id>.
+func (s *BlobService) handlePutBlock(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+	blockID := r.URL.Query().Get("blockid")
+
+	hashes, err := parseContentHashes(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid content hash")
+		return
+	}
+	if !s.checkContainerExists(w, r, account, containerName) {
+		return
+	}
+
+	body := &requestBody{ReadCloser: r.Body}
+	checked := newChecksumReader(body, hashes)
+	opts := StageBlockOptions{LeaseID: r.Header.Get("x-ms-lease-id")}
+	if err := s.store.StageBlock(r.Context(), account, containerName, blobName, blockID, checked, opts); err != nil {
+		if body.err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidInput", "Failed to read request body")
+			return
+		}
+		s.writeStoreError(w, err, "failed to stage block",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Debug("block staged",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("block_id", blockID),
+	)
+	checked.setHeaders(w.Header())
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlePutBlockList handles PUT /{account}/{container}/{blobName}?comp=blocklist.
+// The body is a <BlockList> of <Latest>, <Committed> and <Uncommitted> block IDs.
+func (s *BlobService) handlePutBlockList(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	blocks, err := parseBlockList(r.Body)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid block list")
+		return
+	}
+
+	headers, err := parseBlobHTTPHeaders(r.Header, false)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob properties")
+		return
+	}
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	tier, err := parseAccessTier(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid access tier")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+
+	props, err := s.store.CommitBlockList(r.Context(), account, containerName, blobName, blocks, PutBlobOptions{
+		HTTPHeaders: headers,
+		Metadata:    parseMetadata(r.Header),
+		Tags:        tags,
+		Tier:        tier,
+		Conditions:  conds,
+
+		ImmutabilityPolicy: policy,
+		LegalHold:          legalHold,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to commit block list",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobCreated, "PutBlockList", props)
+	s.logger.Info("block list committed",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Int("blocks", len(blocks)),
+		logging.Int64("size", props.Size),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleGetBlockList handles GET /{account}/{container}/{blobName}?comp=blocklist.
+// blocklisttype selects committed (default), uncommitted or all blocks.
+func (s *BlobService) handleGetBlockList(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	listType := strings.ToLower(r.URL.Query().Get("blocklisttype"))
+	if listType == "" {
+		listType = "committed"
+	}
+	if listType != "committed" && listType != "uncommitted" && listType != "all" {
+		s.writeError(w, http.StatusBadRequest, "InvalidQueryParameterValue",
+			"Value for one of the query parameters specified in the request URI is invalid. blocklisttype="+listType)
+		return
+	}
+
+	list, err := s.store.GetBlockList(r.Context(), account, containerName, blobName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get block list",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	result := blockListXML{}
+	if listType != "uncommitted" {
+		result.CommittedBlocks = newBlockListBlocksXML(list.Committed)
+	}
+	if listType != "committed" {
+		result.UncommittedBlocks = newBlockListBlocksXML(list.Uncommitted)
+	}
+
+	if list.Blob != nil {
+		w.Header().Set("ETag", list.Blob.ETag)
+		w.Header().Set("Last-Modified", formatHTTPDate(list.Blob.ModifiedAt))
+		w.Header().Set("x-ms-blob-content-length", strconv.FormatInt(list.Blob.Size, 10))
+	}
+	s.writeXML(w, http.StatusOK, result)
+}
+
+// parseBlockList decodes a Put Block List request body, preserving the order of
+// the <Latest>, <Committed> and <Uncommitted> entries.
+func parseBlockList(body io.Reader) ([]BlockListEntry, error) {
+	decoder := xml.NewDecoder(body)
+	var blocks []BlockListEntry
+	depth := 0
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrInvalidXMLDocument
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if t.Name.Local != "BlockList" {
+					return nil, ErrInvalidXMLDocument
+				}
+				continue
+			}
+
+			source := BlockListSource(t.Name.Local)
+			if depth != 2 || (source != BlockSourceLatest && source != BlockSourceCommitted && source != BlockSourceUncommitted) {
+				return nil, ErrInvalidXMLDocument
+			}
+			var id string
+			if err := decoder.DecodeElement(&id, &t); err != nil {
+				return nil, ErrInvalidXMLDocument
+			}
+			depth--
+			blocks = append(blocks, BlockListEntry{ID: strings.TrimSpace(id), Source: source})
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if depth != 0 {
+		return nil, ErrInvalidXMLDocument
+	}
+	return blocks, nil
+}
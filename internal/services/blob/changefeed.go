@@ -0,0 +1,441 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// changeFeedContainer is the container an account's change feed is published in.
+const changeFeedContainer = "$blobchangefeed"
+
+// changeFeedSegmentInterval is how much time a segment of the change feed
+// covers. As in Azure, segments start on the hour.
+const changeFeedSegmentInterval = time.Hour
+
+// Paths of the change feed's manifests within its container.
+const (
+	changeFeedSegmentsPath = "meta/segments.json"
+	changeFeedSegmentsDir  = "idx/segments/"
+	changeFeedLogDir       = "log/"
+)
+
+// Change feed event types.
+const (
+	eventBlobCreated           = "BlobCreated"
+	eventBlobDeleted           = "BlobDeleted"
+	eventBlobPropertiesUpdated = "BlobPropertiesUpdated"
+	eventBlobTierChanged       = "BlobTierChanged"
+)
+
+// changeFeedEventTypes are the symbols of the BlobChangeEventType enum, in
+// schema order, and changeFeedOperations those of BlobOperationName.
+var (
+	changeFeedEventTypes = []string{
+		"UnspecifiedEventType", eventBlobCreated, eventBlobDeleted, eventBlobPropertiesUpdated,
+		"BlobSnapshotCreated", "Control", eventBlobTierChanged, "BlobAsyncOperationInitiated",
+		"BlobMetadataUpdated", "RestorePointMarkerCreated",
+	}
+	changeFeedOperations = []string{
+		"UnspecifiedApi", "PutBlob", "PutBlockList", "CopyBlob", "DeleteBlob", "AbortCopyBlob",
+		"SetBlobProperties", "SetBlobMetadata", "SnapshotBlob", "SetBlobTier", "PutBlobFromUrl",
+	}
+	changeFeedBlobTypes = []string{string(BlobTypeBlock), string(BlobTypePage), string(BlobTypeAppend)}
+)
+
+// changeFeedSchema is the Avro schema of change feed records, a subset of
+// version 1 of Azure's BlobChangeEvent schema.
+var changeFeedSchema = fmt.Sprintf(`{"type":"record","name":"BlobChangeEvent","namespace":"com.microsoft.azure.storage.blob","fields":[`+
+	`{"name":"schemaVersion","type":"int"},`+
+	`{"name":"topic","type":"string"},`+
+	`{"name":"subject","type":"string"},`+
+	`{"name":"eventType","type":{"type":"enum","name":"BlobChangeEventType","symbols":%s}},`+
+	`{"name":"eventTime","type":"string"},`+
+	`{"name":"id","type":"string"},`+
+	`{"name":"data","type":{"type":"record","name":"BlobChangeEventData","fields":[`+
+	`{"name":"api","type":{"type":"enum","name":"BlobOperationName","symbols":%s}},`+
+	`{"name":"clientRequestId","type":"string"},`+
+	`{"name":"requestId","type":"string"},`+
+	`{"name":"etag","type":"string"},`+
+	`{"name":"contentType","type":"string"},`+
+	`{"name":"contentLength","type":"long"},`+
+	`{"name":"blobType","type":{"type":"enum","name":"BlobType","symbols":%s}},`+
+	`{"name":"url","type":"string"},`+
+	`{"name":"sequencer","type":"string"},`+
+	`{"name":"snapshot","type":["null","string"]},`+
+	`{"name":"storageDiagnostics","type":{"type":"map","values":"string"}}]}}]}`,
+	jsonSymbols(changeFeedEventTypes), jsonSymbols(changeFeedOperations), jsonSymbols(changeFeedBlobTypes))
+
+// jsonSymbols returns the symbols of an Avro enum as a JSON array.
+func jsonSymbols(symbols []string) string {
+	b, _ := json.Marshal(symbols)
+	return string(b)
+}
+
+// changeEvent is a change to a blob, as recorded in the change feed.
+type changeEvent struct {
+	EventType string
+	API       string
+	Account   string
+	Container string
+	Blob      string
+	Snapshot  string
+	Time      time.Time
+
+	// Properties are those of the blob after the change, or before it was deleted.
+	Properties BlobProperties
+
+	RequestID       string
+	ClientRequestID string
+	URL             string
+}
+
+// segmentsManifest is meta/segments.json, which tells readers up to which
+// segment the change feed can be read.
+type segmentsManifest struct {
+	Version        int    `json:"version"`
+	LastConsumable string `json:"lastConsumable"`
+}
+
+// segmentManifest is the meta.json of a segment, listing the directories its
+// records are in.
+type segmentManifest struct {
+	Version        int           `json:"version"`
+	Begin          string        `json:"begin"`
+	IntervalSecs   int           `json:"intervalSecs"`
+	Status         string        `json:"status"`
+	Config         segmentConfig `json:"config"`
+	ChunkFilePaths []string      `json:"chunkFilePaths"`
+}
+
+type segmentConfig struct {
+	Version             int    `json:"version"`
+	NumShards           int    `json:"numShards"`
+	RecordsFormat       string `json:"recordsFormat"`
+	FormatSchemaVersion int    `json:"formatSchemaVersion"`
+	ShardDistFnVersion  int    `json:"shardDistFnVersion"`
+}
+
+// changeFeed publishes changes to blobs in each account's $blobchangefeed
+// container, laid out as Azure's change feed is so its client libraries can
+// read it:
+//
+//   - meta/segments.json holds lastConsumable, the start of the newest segment.
+//   - idx/segments/YYYY/MM/DD/hhmm/meta.json describes the segment starting then.
+//     It is Publishing until a later segment starts, then Finalized.
+//   - log/00/YYYY/MM/DD/hhmm/NNNNN.avro are the segment's chunks: append blobs
+//     holding an Avro object container file, with one block per record.
+//
+// Unlike Azure, which publishes a segment once it ends, records can be read as
+// soon as they are written. The feed is kept only in the blob store, so it
+// picks up where it left off after a restart.
+type changeFeed struct {
+	store BlobStore
+
+	mu       sync.Mutex
+	segments map[string]time.Time // key: account; start of the segment being written
+	chunks   map[string]string    // key: account; chunk being appended to
+	sequence int64
+}
+
+func newChangeFeed(store BlobStore) *changeFeed {
+	return &changeFeed{
+		store:    store,
+		segments: make(map[string]time.Time),
+		chunks:   make(map[string]string),
+	}
+}
+
+// record appends an event to its account's change feed.
+func (f *changeFeed) record(ctx context.Context, event changeEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	begin := event.Time.UTC().Truncate(changeFeedSegmentInterval)
+	if err := f.openSegment(ctx, event.Account, begin); err != nil {
+		return err
+	}
+	return f.appendRecord(ctx, event.Account, begin, f.encode(event))
+}
+
+// openSegment makes the segment starting at begin the one an account's records
+// are written to, publishing it and finalizing the previous one if it is new.
+func (f *changeFeed) openSegment(ctx context.Context, account string, begin time.Time) error {
+	if current, ok := f.segments[account]; ok && current.Equal(begin) {
+		return nil
+	}
+
+	err := f.store.CreateContainer(ctx, account, changeFeedContainer, CreateContainerOptions{})
+	if err != nil && !errors.Is(err, ErrContainerAlreadyExists) {
+		return err
+	}
+	_, err = f.store.GetBlobProperties(ctx, account, changeFeedContainer, segmentManifestPath(begin), GetBlobOptions{})
+	if errors.Is(err, ErrBlobNotFound) {
+		err = f.publishSegment(ctx, account, begin)
+	}
+	if err != nil {
+		return err
+	}
+	f.segments[account] = begin
+	delete(f.chunks, account)
+	return nil
+}
+
+// publishSegment writes the manifest of a new segment, finalizes the one before
+// it and moves lastConsumable to it.
+func (f *changeFeed) publishSegment(ctx context.Context, account string, begin time.Time) error {
+	var segments segmentsManifest
+	err := f.readJSON(ctx, account, changeFeedSegmentsPath, &segments)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	if previous, err := time.Parse(changeFeedTimeLayout, segments.LastConsumable); err == nil && previous.Before(begin) {
+		if err := f.writeJSON(ctx, account, segmentManifestPath(previous), newSegmentManifest(previous, "Finalized")); err != nil {
+			return err
+		}
+	}
+	if err := f.writeJSON(ctx, account, segmentManifestPath(begin), newSegmentManifest(begin, "Publishing")); err != nil {
+		return err
+	}
+	return f.writeJSON(ctx, account, changeFeedSegmentsPath, segmentsManifest{LastConsumable: begin.Format(changeFeedTimeLayout)})
+}
+
+// appendRecord appends a record to the current chunk of a segment. A chunk
+// holds as many records as an append blob holds blocks; once it is full, the
+// next chunk is started.
+func (f *changeFeed) appendRecord(ctx context.Context, account string, begin time.Time, record []byte) error {
+	chunk, err := f.currentChunk(ctx, account, begin)
+	if err != nil {
+		return err
+	}
+	_, err = f.store.AppendBlock(ctx, account, changeFeedContainer, chunk, bytes.NewReader(avroBlock(record, chunkSync(account, chunk))), AppendBlockOptions{})
+	if errors.Is(err, ErrCommittedBlockCountExceedsLimit) {
+		var index int
+		fmt.Sscanf(path.Base(chunk), "%05d.avro", &index)
+		if chunk, err = f.createChunk(ctx, account, chunkPath(begin, index+1)); err != nil {
+			return err
+		}
+		_, err = f.store.AppendBlock(ctx, account, changeFeedContainer, chunk, bytes.NewReader(avroBlock(record, chunkSync(account, chunk))), AppendBlockOptions{})
+	}
+	return err
+}
+
+// currentChunk returns the last chunk of a segment, creating the first one if
+// there is none yet.
+func (f *changeFeed) currentChunk(ctx context.Context, account string, begin time.Time) (string, error) {
+	if chunk, ok := f.chunks[account]; ok {
+		return chunk, nil
+	}
+	list, err := f.store.ListBlobs(ctx, account, changeFeedContainer, ListBlobsOptions{Prefix: chunkDir(begin)})
+	if err != nil {
+		return "", err
+	}
+	if n := len(list.Blobs); n > 0 {
+		f.chunks[account] = list.Blobs[n-1].Name
+		return list.Blobs[n-1].Name, nil
+	}
+	return f.createChunk(ctx, account, chunkPath(begin, 0))
+}
+
+// createChunk creates a chunk holding just the Avro file header.
+func (f *changeFeed) createChunk(ctx context.Context, account, chunk string) (string, error) {
+	_, err := f.store.CreateAppendBlob(ctx, account, changeFeedContainer, chunk, PutBlobOptions{
+		HTTPHeaders: BlobHTTPHeaders{ContentType: "avro/binary"},
+	})
+	if err != nil {
+		return "", err
+	}
+	header := avroHeader(changeFeedSchema, chunkSync(account, chunk))
+	if _, err := f.store.AppendBlock(ctx, account, changeFeedContainer, chunk, bytes.NewReader(header), AppendBlockOptions{}); err != nil {
+		return "", err
+	}
+	f.chunks[account] = chunk
+	return chunk, nil
+}
+
+// encode encodes an event as a BlobChangeEvent record.
+func (f *changeFeed) encode(event changeEvent) []byte {
+	// The sequencer orders records; like Azure's, it is a fixed-width hex
+	// string that only ever grows.
+	sequence := event.Time.UnixNano()
+	if sequence <= f.sequence {
+		sequence = f.sequence + 1
+	}
+	f.sequence = sequence
+
+	props := event.Properties
+	var e avroEncoder
+	e.writeLong(1)
+	e.writeString("/subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/bluestack/providers/Microsoft.Storage/storageAccounts/" + event.Account)
+	e.writeString("/blobServices/default/containers/" + event.Container + "/blobs/" + event.Blob)
+	e.writeLong(int64(symbolIndex(changeFeedEventTypes, event.EventType)))
+	e.writeString(event.Time.UTC().Format(changeFeedEventTimeLayout))
+	e.writeString(newUUID())
+	e.writeLong(int64(symbolIndex(changeFeedOperations, event.API)))
+	e.writeString(event.ClientRequestID)
+	e.writeString(event.RequestID)
+	e.writeString(strings.Trim(props.ETag, `"`))
+	e.writeString(props.ContentType)
+	e.writeLong(props.Size)
+	e.writeLong(int64(symbolIndex(changeFeedBlobTypes, string(props.BlobType))))
+	e.writeString(event.URL)
+	e.writeString(fmt.Sprintf("%048x", sequence))
+	e.writeOptionalString(event.Snapshot)
+	e.writeMap(nil)
+	return e.Bytes()
+}
+
+// symbolIndex returns the index of an Avro enum symbol, or 0 for one that
+// isn't in the enum.
+func symbolIndex(symbols []string, symbol string) int {
+	for i, s := range symbols {
+		if s == symbol {
+			return i
+		}
+	}
+	return 0
+}
+
+// Layouts of the times in change feed manifests and records.
+const (
+	changeFeedTimeLayout      = "2006-01-02T15:04:05.000Z"
+	changeFeedEventTimeLayout = "2006-01-02T15:04:05.0000000Z"
+)
+
+func newSegmentManifest(begin time.Time, status string) segmentManifest {
+	return segmentManifest{
+		Begin:        begin.Format(changeFeedTimeLayout),
+		IntervalSecs: int(changeFeedSegmentInterval / time.Second),
+		Status:       status,
+		Config: segmentConfig{
+			NumShards:           1,
+			RecordsFormat:       "avro",
+			FormatSchemaVersion: 1,
+			ShardDistFnVersion:  1,
+		},
+		ChunkFilePaths: []string{changeFeedContainer + "/" + chunkDir(begin)},
+	}
+}
+
+// segmentManifestPath returns the path of the meta.json of the segment starting at begin.
+func segmentManifestPath(begin time.Time) string {
+	return changeFeedSegmentsDir + begin.Format("2006/01/02/1504") + "/meta.json"
+}
+
+// chunkDir returns the directory of the chunks of the segment starting at
+// begin. All records are written to a single shard, 00.
+func chunkDir(begin time.Time) string {
+	return changeFeedLogDir + "00/" + begin.Format("2006/01/02/1504") + "/"
+}
+
+func chunkPath(begin time.Time, index int) string {
+	return chunkDir(begin) + fmt.Sprintf("%05d.avro", index)
+}
+
+// chunkSync returns the sync marker of a chunk's Avro blocks. It is derived from
+// the chunk's name, so records can be appended to a chunk without reading it.
+func chunkSync(account, chunk string) [16]byte {
+	return md5.Sum([]byte(account + "/" + chunk))
+}
+
+func (f *changeFeed) readJSON(ctx context.Context, account, blobName string, v any) error {
+	blob, err := f.store.GetBlob(ctx, account, changeFeedContainer, blobName, GetBlobOptions{})
+	if err != nil {
+		return err
+	}
+	defer blob.Content.Close()
+	return json.NewDecoder(io.NewSectionReader(blob.Content, 0, blob.Size)).Decode(v)
+}
+
+func (f *changeFeed) writeJSON(ctx context.Context, account, blobName string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = f.store.PutBlob(ctx, account, changeFeedContainer, blobName, bytes.NewReader(data), PutBlobOptions{
+		HTTPHeaders: BlobHTTPHeaders{ContentType: "application/json"},
+	})
+	return err
+}
+
+// EnableChangeFeed makes the service record the blobs created, deleted, and
+// whose properties, metadata or tier are changed, in each account's change feed.
+func (s *BlobService) EnableChangeFeed() {
+	s.changeFeed = newChangeFeed(s.store)
+}
+
+// protectChangeFeed is middleware that refuses requests that would write to or
+// delete the change feed container or its blobs. The feed is only written by
+// the service itself, through the store; clients may only read it.
+func (s *BlobService) protectChangeFeed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "container") == changeFeedContainer && (r.Method == http.MethodPut || r.Method == http.MethodDelete) {
+			s.writeStoreError(w, ErrChangeFeedReadOnly, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordChange records a change a request made to a blob in the change feed,
+// if it is enabled.
+func (s *BlobService) recordChange(w http.ResponseWriter, r *http.Request, eventType, api string, props *BlobProperties) {
+	if s.changeFeed == nil {
+		return
+	}
+	s.publishChange(r.Context(), s.requestChange(w, r, eventType, api), props)
+}
+
+// requestChange returns the change feed event for a change a request makes to
+// a blob, less the time and the blob's properties, which publishChange adds.
+func (s *BlobService) requestChange(w http.ResponseWriter, r *http.Request, eventType, api string) changeEvent {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	// Azure's client libraries expect the client request ID to be a UUID.
+	clientRequestID := r.Header.Get("x-ms-client-request-id")
+	if clientRequestID == "" {
+		clientRequestID = "00000000-0000-0000-0000-000000000000"
+	}
+	return changeEvent{
+		EventType:       eventType,
+		API:             api,
+		Account:         account,
+		Container:       containerName,
+		Blob:            blobNameParam(r),
+		Snapshot:        r.URL.Query().Get("snapshot"),
+		RequestID:       w.Header().Get("x-ms-request-id"),
+		ClientRequestID: clientRequestID,
+		URL:             serviceEndpoint(r, account) + containerName + "/" + chi.URLParam(r, "*"),
+	}
+}
+
+// publishChange records event in the change feed with the blob's properties
+// as of now. The change has already been made, so failing to record it is
+// logged rather than returned.
+func (s *BlobService) publishChange(ctx context.Context, event changeEvent, props *BlobProperties) {
+	event.Time = time.Now()
+	event.Properties = *props
+	if err := s.changeFeed.record(ctx, event); err != nil {
+		s.logger.Error("failed to record change in change feed",
+			logging.String("account", event.Account),
+			logging.String("container", event.Container),
+			logging.String("blob", event.Blob),
+			logging.String("event", event.EventType),
+			logging.ErrorField(err),
+		)
+	}
+}
@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"hash/crc64"
+	"io"
+	"net/http"
+)
+
+// contentCRC64Header carries the CRC64 of a request or response body.
+const contentCRC64Header = "x-ms-content-crc64"
+
+// crc64Table is the CRC-64 polynomial Azure Storage uses for x-ms-content-crc64.
+var crc64Table = crc64.MakeTable(0x9A6C9329AC4BC9B5)
+
+// encodeCRC64 formats a CRC64 as Azure sends it: base64 of its little-endian bytes.
+func encodeCRC64(sum uint64) string {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], sum)
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// contentHashes are the transactional hashes a client sent of a request body,
+// in Content-MD5 or x-ms-content-crc64. Either may be nil.
+type contentHashes struct {
+	md5   []byte
+	crc64 []byte
+}
+
+// parseContentHashes reads the transactional hashes of a request body. As in
+// Azure, a request may send at most one of them.
+func parseContentHashes(h http.Header) (contentHashes, error) {
+	var hashes contentHashes
+	if v := h.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return contentHashes{}, errInvalidHeaderValue("Content-MD5")
+		}
+		hashes.md5 = sum
+	}
+	if v := h.Get(contentCRC64Header); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != crc64.Size || hashes.md5 != nil {
+			return contentHashes{}, errInvalidHeaderValue(contentCRC64Header)
+		}
+		hashes.crc64 = sum
+	}
+	return hashes, nil
+}
+
+// checksumReader hashes a request body as it is read and fails the read that
+// reaches its end with Md5Mismatch or Crc64Mismatch if the body doesn't match
+// the hashes sent with it. The store only keeps content it has read to the
+// end, so a mismatched upload never replaces anything.
+type checksumReader struct {
+	r    io.Reader
+	want contentHashes
+	md5  hash.Hash
+	crc  hash.Hash64
+}
+
+// newChecksumReader returns a reader of r that checks it against want. Only
+// the hashes that were sent are computed.
+func newChecksumReader(r io.Reader, want contentHashes) *checksumReader {
+	c := &checksumReader{r: r, want: want}
+	if want.md5 != nil {
+		c.md5 = md5.New()
+	}
+	if want.crc64 != nil {
+		c.crc = crc64.New(crc64Table)
+	}
+	return c
+}
+
+// Read implements io.Reader.
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.md5 != nil {
+		c.md5.Write(p[:n])
+	}
+	if c.crc != nil {
+		c.crc.Write(p[:n])
+	}
+	if err == io.EOF {
+		if c.md5 != nil && !bytes.Equal(c.md5.Sum(nil), c.want.md5) {
+			return n, ErrMd5Mismatch
+		}
+		if c.crc != nil && encodeCRC64(c.crc.Sum64()) != base64.StdEncoding.EncodeToString(c.want.crc64) {
+			return n, ErrCrc64Mismatch
+		}
+	}
+	return n, err
+}
+
+// setHeaders returns the verified hashes on the response to an upload, as
+// Content-MD5 and x-ms-content-crc64.
+func (c *checksumReader) setHeaders(h http.Header) {
+	if c.want.md5 != nil {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(c.want.md5))
+	}
+	if c.want.crc64 != nil {
+		h.Set(contentCRC64Header, base64.StdEncoding.EncodeToString(c.want.crc64))
+	}
+}
@@ -0,0 +1,104 @@
+package blob
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// etagClock holds the last value used for an ETag, so that ETags generated in
+// the same nanosecond are still unique.
+var etagClock atomic.Int64
+
+// newETag returns a new strong ETag in Azure's quoted hexadecimal format.
+func newETag() string {
+	for {
+		last := etagClock.Load()
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if etagClock.CompareAndSwap(last, next) {
+			return fmt.Sprintf("\"0x%X\"", next)
+		}
+	}
+}
+
+// parseAccessConditions reads the conditional and x-ms-lease-id headers of a request.
+func parseAccessConditions(h http.Header) (AccessConditions, error) {
+	conds := AccessConditions{
+		IfMatch:     strings.TrimSpace(h.Get("If-Match")),
+		IfNoneMatch: strings.TrimSpace(h.Get("If-None-Match")),
+		LeaseID:     strings.TrimSpace(h.Get("x-ms-lease-id")),
+	}
+
+	for _, header := range []string{"If-Modified-Since", "If-Unmodified-Since"} {
+		value := h.Get(header)
+		if value == "" {
+			continue
+		}
+		t, err := http.ParseTime(value)
+		if err != nil {
+			return AccessConditions{}, errInvalidHeaderValue(header)
+		}
+		if header == "If-Modified-Since" {
+			conds.IfModifiedSince = &t
+		} else {
+			conds.IfUnmodifiedSince = &t
+		}
+	}
+	return conds, nil
+}
+
+// check evaluates the conditions against a resource with the given ETag and
+// modification time; exists is false if there is no such resource. Failed
+// If-None-Match and If-Modified-Since conditions on reads return ErrNotModified,
+// any other failure returns ErrConditionNotMet.
+//
+// Like HTTP, If-Unmodified-Since is ignored when If-Match is present and
+// If-Modified-Since is ignored when If-None-Match is present. Times are compared
+// at the one-second resolution of HTTP dates.
+func (c AccessConditions) check(exists bool, etag string, modifiedAt time.Time, read bool) error {
+	modifiedAt = modifiedAt.Truncate(time.Second)
+
+	switch {
+	case c.IfMatch != "":
+		if !exists || !etagListMatches(c.IfMatch, etag) {
+			return ErrConditionNotMet
+		}
+	case c.IfUnmodifiedSince != nil:
+		if exists && modifiedAt.After(*c.IfUnmodifiedSince) {
+			return ErrConditionNotMet
+		}
+	}
+
+	notModified := ErrConditionNotMet
+	if read {
+		notModified = ErrNotModified
+	}
+	switch {
+	case c.IfNoneMatch != "":
+		if exists && etagListMatches(c.IfNoneMatch, etag) {
+			return notModified
+		}
+	case c.IfModifiedSince != nil:
+		if exists && !modifiedAt.After(*c.IfModifiedSince) {
+			return notModified
+		}
+	}
+	return nil
+}
+
+// etagListMatches reports whether etag is in a comma-separated list of ETags,
+// or the list is "*". Unquoted ETags in the list are accepted too.
+func etagListMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.Trim(candidate, `"`) == strings.Trim(etag, `"`) {
+			return true
+		}
+	}
+	return false
+}
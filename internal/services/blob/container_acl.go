@@ -0,0 +1,251 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// publicAccessHeader is the header that carries a container's public access level.
+const publicAccessHeader = "x-ms-blob-public-access"
+
+// maxSignedIdentifierIDLength is the longest ID a stored access policy may have.
+const maxSignedIdentifierIDLength = 64
+
+// containerPermissions are the permission letters a container's stored access
+// policies may grant.
+const containerPermissions = "racwdxyltfmeopi"
+
+// parsePublicAccess returns the public access level in x-ms-blob-public-access.
+// A request without the header makes the container private.
+func parsePublicAccess(h http.Header) (PublicAccess, error) {
+	switch access := PublicAccess(h.Get(publicAccessHeader)); access {
+	case PublicAccessNone, PublicAccessBlob, PublicAccessContainer:
+		return access, nil
+	default:
+		return "", errInvalidHeaderValue(publicAccessHeader)
+	}
+}
+
+// setPublicAccessHeader reports a container's public access level. Private
+// containers are reported by leaving the header out.
+func setPublicAccessHeader(h http.Header, access PublicAccess) {
+	if access != PublicAccessNone {
+		h.Set(publicAccessHeader, string(access))
+	}
+}
+
+// signedIdentifiersXML is the body of Get and Set Container ACL.
+type signedIdentifiersXML struct {
+	XMLName           xml.Name              `xml:"SignedIdentifiers"`
+	SignedIdentifiers []signedIdentifierXML `xml:"SignedIdentifier"`
+}
+
+// signedIdentifierXML is a stored access policy in a container ACL.
+type signedIdentifierXML struct {
+	ID           string          `xml:"Id"`
+	AccessPolicy accessPolicyXML `xml:"AccessPolicy"`
+}
+
+// accessPolicyXML holds a stored access policy's times and permissions.
+type accessPolicyXML struct {
+	Start      string `xml:"Start,omitempty"`
+	Expiry     string `xml:"Expiry,omitempty"`
+	Permission string `xml:"Permission,omitempty"`
+}
+
+// signedIdentifiers validates the stored access policies of a Set Container ACL body.
+func (b signedIdentifiersXML) signedIdentifiers() ([]SignedIdentifier, error) {
+	if len(b.SignedIdentifiers) > maxSignedIdentifiers {
+		return nil, ErrInvalidXMLDocument
+	}
+	parseTime := func(value, node string) (time.Time, error) {
+		if value == "" {
+			return time.Time{}, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, errInvalidXMLNodeValue(node)
+		}
+		return t.UTC(), nil
+	}
+
+	identifiers := make([]SignedIdentifier, 0, len(b.SignedIdentifiers))
+	for _, si := range b.SignedIdentifiers {
+		if si.ID == "" || len(si.ID) > maxSignedIdentifierIDLength {
+			return nil, errInvalidXMLNodeValue("Id")
+		}
+		start, err := parseTime(si.AccessPolicy.Start, "Start")
+		if err != nil {
+			return nil, err
+		}
+		expiry, err := parseTime(si.AccessPolicy.Expiry, "Expiry")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range si.AccessPolicy.Permission {
+			if !strings.ContainsRune(containerPermissions, p) {
+				return nil, errInvalidXMLNodeValue("Permission")
+			}
+		}
+		identifiers = append(identifiers, SignedIdentifier{
+			ID:         si.ID,
+			Start:      start,
+			Expiry:     expiry,
+			Permission: si.AccessPolicy.Permission,
+		})
+	}
+	return identifiers, nil
+}
+
+// newSignedIdentifiersXML converts a container's stored access policies into
+// their Get Container ACL representation.
+func newSignedIdentifiersXML(identifiers []SignedIdentifier) signedIdentifiersXML {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(snapshotTimeFormat)
+	}
+
+	body := signedIdentifiersXML{}
+	for _, si := range identifiers {
+		body.SignedIdentifiers = append(body.SignedIdentifiers, signedIdentifierXML{
+			ID: si.ID,
+			AccessPolicy: accessPolicyXML{
+				Start:      formatTime(si.Start),
+				Expiry:     formatTime(si.Expiry),
+				Permission: si.Permission,
+			},
+		})
+	}
+	return body
+}
+
+func (s *FileBlobStore) SetContainerACL(ctx context.Context, account, containerName string, acl ContainerACL, conds AccessConditions) (*Container, error) {
+	return s.updateContainer(account, containerName, conds, func(c *Container) {
+		c.PublicAccess = acl.PublicAccess
+		c.SignedIdentifiers = acl.SignedIdentifiers
+	})
+}
+
+// handleGetContainerACL handles GET /{account}/{container}?restype=container&comp=acl.
+// The public access level is returned as a header and the stored access
+// policies as a <SignedIdentifiers> body.
+func (s *BlobService) handleGetContainerACL(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	container, err := s.store.GetContainer(r.Context(), account, containerName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get container ACL",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	setPublicAccessHeader(w.Header(), container.PublicAccess)
+	s.writeXML(w, http.StatusOK, newSignedIdentifiersXML(container.SignedIdentifiers))
+}
+
+// handleSetContainerACL handles PUT /{account}/{container}?restype=container&comp=acl.
+// The request replaces both the public access level and the stored access
+// policies; a request without a body removes all policies.
+func (s *BlobService) handleSetContainerACL(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	access, err := parsePublicAccess(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid public access level")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	var body signedIdentifiersXML
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		s.writeStoreError(w, ErrInvalidXMLDocument, "invalid container ACL")
+		return
+	}
+	identifiers, err := body.signedIdentifiers()
+	if err != nil {
+		s.writeStoreError(w, err, "invalid container ACL")
+		return
+	}
+
+	acl := ContainerACL{PublicAccess: access, SignedIdentifiers: identifiers}
+	container, err := s.store.SetContainerACL(r.Context(), account, containerName, acl, conds)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set container ACL",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	s.logger.Info("container ACL set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("public_access", string(access)),
+		logging.Int("signed_identifiers", len(identifiers)),
+	)
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	w.WriteHeader(http.StatusOK)
+}
+
+// isAnonymous reports whether a request carries no credentials: neither an
+// Authorization header nor a shared access signature. Bluestack doesn't verify
+// credentials, so a request that carries any is treated as authorized.
+func isAnonymous(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && r.URL.Query().Get("sig") == ""
+}
+
+// checkAnonymousRead is middleware for read routes that enforces the public
+// access level of the addressed container on requests without credentials.
+// Reads the level doesn't allow get ResourceNotFound, as they do from Azure.
+func (s *BlobService) checkAnonymousRead(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAnonymous(r) && !s.anonymousReadAllowed(r) {
+			s.writeStoreError(w, ErrResourceNotFound, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// anonymousReadAllowed reports whether a container's public access level allows
+// an anonymous read. Blob-level access allows reading blobs; container-level
+// access also allows the container's properties, metadata and blob list. The
+// ACL, index tags, immutability policy and account-level operations are never public.
+func (s *BlobService) anonymousReadAllowed(r *http.Request) bool {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	if containerName == "" {
+		return false
+	}
+	container, err := s.store.GetContainer(r.Context(), account, containerName)
+	if err != nil {
+		return false
+	}
+
+	comp := r.URL.Query().Get("comp")
+	if blobNameParam(r) != "" {
+		return container.PublicAccess != PublicAccessNone && comp != "tags"
+	}
+	return container.PublicAccess == PublicAccessContainer && comp != "acl" && comp != "blobs" && comp != "immutabilityPolicies"
+}
@@ -0,0 +1,133 @@
+package blob
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// updateContainer applies update to a copy of a container's record, persists it
+// with a new ETag and swaps it into the index. A lease ID passed in conds must
+// match the container's active lease, but writes don't need one.
+func (s *FileBlobStore) updateContainer(account, containerName string, conds AccessConditions, update func(*Container)) (*Container, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := entry.container.Lease.checkAccess(conds.LeaseID, false, containerLeaseErrors, now); err != nil {
+		return nil, err
+	}
+	if err := conds.check(true, entry.container.ETag, entry.container.ModifiedAt, false); err != nil {
+		return nil, err
+	}
+
+	container := entry.container
+	update(&container)
+	container.ModifiedAt = now.UTC()
+	container.ETag = newETag()
+	if err := s.writeContainerRecord(account, &container); err != nil {
+		return nil, err
+	}
+	entry.container = container
+
+	return &container, nil
+}
+
+func (s *FileBlobStore) SetContainerMetadata(ctx context.Context, account, containerName string, metadata map[string]string, conds AccessConditions) (*Container, error) {
+	return s.updateContainer(account, containerName, conds, func(c *Container) {
+		c.Metadata = metadata
+	})
+}
+
+// setContainerPropertyHeaders writes a container's properties and metadata as
+// response headers, as returned by Get Container Properties.
+func setContainerPropertyHeaders(w http.ResponseWriter, container *Container) {
+	h := w.Header()
+	h.Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	h.Set("ETag", container.ETag)
+	setLeaseHeaders(h, container.Lease)
+	setPublicAccessHeader(h, container.PublicAccess)
+	h.Set("x-ms-has-immutability-policy", strconv.FormatBool(container.ImmutabilityPolicy != nil))
+	h.Set("x-ms-has-legal-hold", "false")
+
+	setMetadataHeaders(w, container.Metadata)
+}
+
+// handleGetContainerProperties handles GET and HEAD /{account}/{container}?restype=container.
+// It returns the container's properties and metadata as headers, without a body.
+func (s *BlobService) handleGetContainerProperties(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	container, err := s.store.GetContainer(r.Context(), account, containerName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get container properties",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	setContainerPropertyHeaders(w, container)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGetContainerMetadata handles GET /{account}/{container}?restype=container&comp=metadata.
+// It returns only the container's metadata, ETag and Last-Modified as headers.
+func (s *BlobService) handleGetContainerMetadata(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	container, err := s.store.GetContainer(r.Context(), account, containerName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get container metadata",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	setMetadataHeaders(w, container.Metadata)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetContainerMetadata handles PUT /{account}/{container}?restype=container&comp=metadata.
+// The request's x-ms-meta-* headers replace all existing metadata.
+func (s *BlobService) handleSetContainerMetadata(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	container, err := s.store.SetContainerMetadata(r.Context(), account, containerName, parseMetadata(r.Header), conds)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set container metadata",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	s.logger.Info("container metadata set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+	)
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	w.WriteHeader(http.StatusOK)
+}
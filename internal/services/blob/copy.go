@@ -0,0 +1,833 @@
+package blob
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// copyProgressInterval is how often, in bytes read, a running copy records its progress.
+const copyProgressInterval = 1 << 20
+
+// pending reports whether c is a copy that hasn't ended yet.
+func (c *CopyState) pending() bool {
+	return c != nil && c.Status == CopyStatusPending
+}
+
+// progress formats the progress of a copy for x-ms-copy-progress, as bytes copied
+// and total bytes. An unknown total is shown as *.
+func (c *CopyState) progress() string {
+	if c.TotalBytes < 0 {
+		return fmt.Sprintf("%d/*", c.BytesCopied)
+	}
+	return fmt.Sprintf("%d/%d", c.BytesCopied, c.TotalBytes)
+}
+
+// endedCopy returns a copy of c that ended with status at now.
+func endedCopy(c *CopyState, status CopyStatus, description string, now time.Time) *CopyState {
+	ended := *c
+	ended.Status = status
+	ended.StatusDescription = description
+	ended.CompletionTime = now
+	return &ended
+}
+
+func (s *FileBlobStore) CopyBlob(ctx context.Context, account, containerName, blobName string, source CopySource, opts CopyBlobOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, srcPath, err := s.readableBlob(source.Account, source.Container, source.Blob, source.Snapshot, source.VersionID)
+	if errors.Is(err, ErrBlobNotFound) || errors.Is(err, ErrContainerNotFound) {
+		return nil, errCannotVerifyCopySource(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src.Properties.archived() {
+		return nil, ErrBlobArchived
+	}
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Properties.BlobType != src.Properties.BlobType {
+		return nil, ErrInvalidBlobType
+	}
+
+	// Stage the copy outside the content tree first, so that a blob can be
+	// replaced by one of its own versions or snapshots. Append blobs grow in
+	// place, so a copy of one gets a content file of its own.
+	tmpPath := filepath.Join(s.baseDir, tmpDirName, "copy-"+newUUID())
+	if src.Properties.BlobType == BlobTypeAppend {
+		err = copyFile(srcPath, tmpPath, src.Properties.Size)
+	} else {
+		err = linkOrCopyFile(srcPath, tmpPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy blob: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string, len(src.Metadata))
+		for k, v := range src.Metadata {
+			metadata[k] = v
+		}
+	}
+	now := time.Now().UTC()
+	size := src.Properties.Size
+	record := &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders:     src.Properties.BlobHTTPHeaders,
+			Size:                size,
+			BlobType:            src.Properties.BlobType,
+			CommittedBlockCount: src.Properties.CommittedBlockCount,
+			SequenceNumber:      src.Properties.SequenceNumber,
+			ImmutabilityPolicy:  opts.ImmutabilityPolicy,
+			LegalHold:           opts.LegalHold,
+			Copy: &CopyState{
+				ID:             newUUID(),
+				Source:         source.URL,
+				Status:         CopyStatusSuccess,
+				BytesCopied:    size,
+				TotalBytes:     size,
+				CompletionTime: now,
+			},
+		},
+		Metadata:        metadata,
+		Tags:            opts.Tags,
+		CommittedBlocks: src.CommittedBlocks,
+	}
+	switch src.Properties.BlobType {
+	case BlobTypeBlock:
+		record.Properties.AccessTier = opts.Tier
+	case BlobTypePage:
+		s.replacePages(entry, record, existing, src.Pages)
+	}
+	return s.replaceBlob(entry, account, containerName, existing, tmpPath, record, now)
+}
+
+func (s *FileBlobStore) StartCopy(ctx context.Context, account, containerName, blobName, copyID string, opts StartCopyOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// As in Azure, the destination is empty until the copy completes.
+	tmpPath := filepath.Join(s.baseDir, tmpDirName, "copy-"+copyID)
+	if err := os.WriteFile(tmpPath, nil, 0644); err != nil {
+		return nil, fmt.Errorf("failed to start copy: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	headers := opts.HTTPHeaders
+	if headers.ContentType == "" {
+		headers.ContentType = "application/octet-stream"
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	return s.replaceBlob(entry, account, containerName, existing, tmpPath, &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders: headers,
+			BlobType:        BlobTypeBlock,
+			AccessTier:      opts.Tier,
+			Copy: &CopyState{
+				ID:         copyID,
+				Source:     opts.SourceURL,
+				Status:     CopyStatusPending,
+				TotalBytes: opts.Size,
+			},
+
+			ImmutabilityPolicy: opts.ImmutabilityPolicy,
+			LegalHold:          opts.LegalHold,
+		},
+		Metadata: metadata,
+		Tags:     opts.Tags,
+	}, time.Now().UTC())
+}
+
+// replaceBlob renames the content at tmpPath into place as the blob described by
+// record, filling in the times, ETag and version ID of a write at now. Like any
+// overwrite, it keeps the creation time and lease of the blob it replaces,
+// existing, if there is one. The caller holds the lock.
+func (s *FileBlobStore) replaceBlob(entry *containerEntry, account, containerName string, existing *blobRecord, tmpPath string, record *blobRecord, now time.Time) (*BlobProperties, error) {
+	blobName := record.Name
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	record.Properties.CreatedAt = now
+	if existing != nil {
+		record.Properties.CreatedAt = existing.Properties.CreatedAt
+		record.Properties.Lease = existing.Properties.Lease
+	}
+	versionID, err := s.keepPreviousState(entry, account, containerName, blobName, existing, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	record.Properties.ModifiedAt = now
+	record.Properties.ETag = newETag()
+	record.Properties.VersionID = versionID
+	if err := s.writeBlobRecord(account, containerName, record); err != nil {
+		return nil, err
+	}
+	entry.blobs[blobName] = record
+	entry.tags.update(blobName, existing.tags(), record.Tags)
+
+	if err := s.discardStagedBlocks(entry, account, containerName, blobName); err != nil {
+		return nil, err
+	}
+
+	props := record.Properties
+	return &props, nil
+}
+
+// UpdateCopyProgress only updates the index: a pending copy doesn't survive a
+// restart, so its progress isn't worth persisting.
+func (s *FileBlobStore) UpdateCopyProgress(ctx context.Context, account, containerName, blobName, copyID string, bytesCopied int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.pendingCopy(account, containerName, blobName, copyID)
+	if err != nil {
+		return err
+	}
+	updated := *record
+	progress := *record.Properties.Copy
+	progress.BytesCopied = bytesCopied
+	updated.Properties.Copy = &progress
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &updated
+	return nil
+}
+
+func (s *FileBlobStore) CompleteCopy(ctx context.Context, account, containerName, blobName, copyID string, content io.Reader) (*BlobProperties, error) {
+	// Like an upload, the content is spooled without holding the lock.
+	tmpPath, size, err := s.spoolTemp(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read copy source: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The copy may have been aborted, or its destination replaced, meanwhile.
+	record, err := s.pendingCopy(account, containerName, blobName, copyID)
+	if err != nil {
+		return nil, err
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		return nil, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	now := time.Now().UTC()
+	updated := *record
+	updated.Properties.Size = size
+	updated.Properties.ModifiedAt = now
+	updated.Properties.ETag = newETag()
+	updated.Properties.Copy = endedCopy(record.Properties.Copy, CopyStatusSuccess, "", now)
+	updated.Properties.Copy.BytesCopied = size
+	updated.Properties.Copy.TotalBytes = size
+	if err := s.writeBlobRecord(account, containerName, &updated); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &updated
+
+	props := updated.Properties
+	return &props, nil
+}
+
+func (s *FileBlobStore) FailCopy(ctx context.Context, account, containerName, blobName, copyID, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.pendingCopy(account, containerName, blobName, copyID)
+	if err != nil {
+		return err
+	}
+	return s.endCopy(account, containerName, record, CopyStatusFailed, description)
+}
+
+func (s *FileBlobStore) AbortCopy(ctx context.Context, account, containerName, blobName, copyID, leaseID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	if err := record.Properties.Lease.checkAccess(leaseID, true, blobLeaseErrors, time.Now()); err != nil {
+		return err
+	}
+	if err := checkPendingCopy(record, copyID); err != nil {
+		return err
+	}
+	return s.endCopy(account, containerName, record, CopyStatusAborted, "")
+}
+
+// pendingCopy returns the record of a blob that is the destination of the
+// pending copy copyID. The caller holds the lock.
+func (s *FileBlobStore) pendingCopy(account, containerName, blobName, copyID string) (*blobRecord, error) {
+	record, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPendingCopy(record, copyID); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// checkPendingCopy checks that record is the destination of the pending copy copyID.
+func checkPendingCopy(record *blobRecord, copyID string) error {
+	if !record.Properties.Copy.pending() {
+		return ErrNoPendingCopyOperation
+	}
+	if record.Properties.Copy.ID != copyID {
+		return ErrCopyIDMismatch
+	}
+	return nil
+}
+
+// endCopy ends the pending copy to the blob of record with status. The blob
+// keeps its empty content. The caller holds the lock.
+func (s *FileBlobStore) endCopy(account, containerName string, record *blobRecord, status CopyStatus, description string) error {
+	updated := *record
+	updated.Properties.Copy = endedCopy(record.Properties.Copy, status, description, time.Now().UTC())
+	if err := s.writeBlobRecord(account, containerName, &updated); err != nil {
+		return err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[record.Name] = &updated
+	return nil
+}
+
+// parseCopySource reads the x-ms-copy-source URL of a request. A URL with the
+// request's host that points into the blob service, e.g.
+// http://localhost:4566/blob/myaccount/mycontainer/myblob?versionid=<id>, names a
+// blob, snapshot or version in the store and local is true. Any other http or
+// https URL is read over HTTP.
+func (s *BlobService) parseCopySource(r *http.Request) (source CopySource, local bool, err error) {
+	raw := r.Header.Get("x-ms-copy-source")
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return CopySource{}, false, errInvalidHeaderValue("x-ms-copy-source")
+	}
+
+	path, ok := strings.CutPrefix(u.Path, "/"+s.Name()+"/")
+	if !ok || !strings.EqualFold(u.Host, r.Host) {
+		return CopySource{URL: raw}, false, nil
+	}
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return CopySource{}, false, errInvalidHeaderValue("x-ms-copy-source")
+	}
+	snapshot, versionID, err := snapshotAndVersionParams(u.Query())
+	if err != nil {
+		return CopySource{}, false, errInvalidHeaderValue("x-ms-copy-source")
+	}
+	return CopySource{
+		URL:       raw,
+		Account:   parts[0],
+		Container: parts[1],
+		Blob:      parts[2],
+		Snapshot:  snapshot,
+		VersionID: versionID,
+	}, true, nil
+}
+
+// fetchCopySource requests a copy source outside the emulator. Like Azure, a
+// source that doesn't answer 200 OK fails the copy with CannotVerifyCopySource
+// and the source's status code.
+func (s *BlobService) fetchCopySource(ctx context.Context, sourceURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return nil, errInvalidHeaderValue("x-ms-copy-source")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errCannotVerifyCopySource(http.StatusBadRequest, fmt.Sprintf("Could not read the copy source: %v", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errCannotVerifyCopySource(resp.StatusCode, fmt.Sprintf("The copy source responded with %s.", resp.Status))
+	}
+	return resp, nil
+}
+
+// sourceHTTPHeaders returns the properties of a copy source read over HTTP,
+// taken from its response headers.
+func sourceHTTPHeaders(h http.Header) BlobHTTPHeaders {
+	headers := BlobHTTPHeaders{
+		ContentType:        h.Get("Content-Type"),
+		ContentEncoding:    h.Get("Content-Encoding"),
+		ContentLanguage:    h.Get("Content-Language"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		CacheControl:       h.Get("Cache-Control"),
+	}
+	if sum, err := base64.StdEncoding.DecodeString(h.Get("Content-MD5")); err == nil && len(sum) == md5.Size {
+		headers.ContentMD5 = sum
+	}
+	return headers
+}
+
+// withSourceHTTPHeaders returns headers with each property that isn't set taken
+// from the copy source's properties.
+func withSourceHTTPHeaders(headers, source BlobHTTPHeaders) BlobHTTPHeaders {
+	fill := func(v *string, sourceValue string) {
+		if *v == "" {
+			*v = sourceValue
+		}
+	}
+	fill(&headers.ContentType, source.ContentType)
+	fill(&headers.ContentEncoding, source.ContentEncoding)
+	fill(&headers.ContentLanguage, source.ContentLanguage)
+	fill(&headers.ContentDisposition, source.ContentDisposition)
+	fill(&headers.CacheControl, source.CacheControl)
+	if len(headers.ContentMD5) == 0 {
+		headers.ContentMD5 = source.ContentMD5
+	}
+	return headers
+}
+
+// openCopySource opens the content and properties of a copy source, either a
+// blob in the store or a URL read over HTTP. The caller must close the content.
+func (s *BlobService) openCopySource(ctx context.Context, source CopySource, local bool) (io.ReadCloser, BlobHTTPHeaders, error) {
+	if !local {
+		resp, err := s.fetchCopySource(ctx, source.URL)
+		if err != nil {
+			return nil, BlobHTTPHeaders{}, err
+		}
+		return resp.Body, sourceHTTPHeaders(resp.Header), nil
+	}
+
+	blob, err := s.store.GetBlob(ctx, source.Account, source.Container, source.Blob, GetBlobOptions{Snapshot: source.Snapshot, VersionID: source.VersionID})
+	if errors.Is(err, ErrBlobNotFound) || errors.Is(err, ErrContainerNotFound) {
+		return nil, BlobHTTPHeaders{}, errCannotVerifyCopySource(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return nil, BlobHTTPHeaders{}, err
+	}
+	content := struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(blob.Content, 0, blob.Size), blob.Content}
+	return content, blob.BlobHTTPHeaders, nil
+}
+
+// copyProgressReader calls report with the number of bytes read so far every
+// copyProgressInterval bytes.
+type copyProgressReader struct {
+	r        io.Reader
+	n        int64
+	reported int64
+	report   func(bytesRead int64)
+}
+
+func (p *copyProgressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.n-p.reported >= copyProgressInterval {
+		p.reported = p.n
+		p.report(p.n)
+	}
+	return n, err
+}
+
+// handleCopyBlob handles PUT /{account}/{container}/{blobName} with an
+// x-ms-copy-source header. Copies of blobs in the emulator complete
+// synchronously. Copies of other URLs run in the background and report
+// x-ms-copy-status: pending, unless x-ms-requires-sync: true asks for a
+// synchronous copy (Copy Blob From URL).
+func (s *BlobService) handleCopyBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	source, local, err := s.parseCopySource(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid copy source")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	tier, err := parseAccessTier(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid access tier")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+	// Without x-ms-meta-* headers, the source's metadata is copied.
+	var metadata map[string]string
+	if m := parseMetadata(r.Header); len(m) > 0 {
+		metadata = m
+	}
+
+	opts := CopyBlobOptions{
+		Metadata:   metadata,
+		Tags:       tags,
+		Tier:       tier,
+		Conditions: conds,
+
+		ImmutabilityPolicy: policy,
+		LegalHold:          legalHold,
+	}
+	var props *BlobProperties
+	if local {
+		props, err = s.store.CopyBlob(r.Context(), account, containerName, blobName, source, opts)
+	} else {
+		props, err = s.copyFromURL(w, r, source.URL, opts)
+	}
+	if err != nil {
+		s.writeStoreError(w, err, "failed to copy blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	// A copy still pending runs in the background, and is recorded by runCopy
+	// once it completes.
+	if props.Copy == nil || props.Copy.Status != CopyStatusPending {
+		s.recordChange(w, r, eventBlobCreated, "CopyBlob", props)
+	}
+	s.logger.Info("blob copy started",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("source", source.URL),
+		logging.String("status", string(props.Copy.Status)),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	w.Header().Set("x-ms-copy-id", props.Copy.ID)
+	w.Header().Set("x-ms-copy-status", string(props.Copy.Status))
+	setVersionIDHeader(w, props)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// copyFromURL copies a URL outside the emulator to the blob of a Copy Blob
+// request. The source is requested before the copy starts, so that an
+// unreadable source fails the request; its content is then streamed into the
+// store by runCopy. A nil opts.Metadata is taken from the source's x-ms-meta-*
+// headers.
+func (s *BlobService) copyFromURL(w http.ResponseWriter, r *http.Request, sourceURL string, opts CopyBlobOptions) (*BlobProperties, error) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	// A background copy outlives its request; only Abort Copy cancels it.
+	requiresSync := strings.EqualFold(r.Header.Get("x-ms-requires-sync"), "true")
+	parent := context.Background()
+	if requiresSync {
+		parent = r.Context()
+	}
+	ctx, cancel := context.WithCancel(parent)
+
+	resp, err := s.fetchCopySource(ctx, sourceURL)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = parseMetadata(resp.Header)
+	}
+
+	copyID := newUUID()
+	props, err := s.store.StartCopy(r.Context(), account, containerName, blobName, copyID, StartCopyOptions{
+		SourceURL:   sourceURL,
+		Size:        resp.ContentLength,
+		HTTPHeaders: sourceHTTPHeaders(resp.Header),
+		Metadata:    metadata,
+		Tags:        opts.Tags,
+		Tier:        opts.Tier,
+		Conditions:  opts.Conditions,
+
+		ImmutabilityPolicy: opts.ImmutabilityPolicy,
+		LegalHold:          opts.LegalHold,
+	})
+	if err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+
+	if requiresSync {
+		defer cancel()
+		return s.runCopy(ctx, account, containerName, blobName, copyID, resp.Body, nil)
+	}
+
+	var created *changeEvent
+	if s.changeFeed != nil {
+		event := s.requestChange(w, r, eventBlobCreated, "CopyBlob")
+		created = &event
+	}
+
+	s.copiesMu.Lock()
+	s.copies[copyID] = cancel
+	s.copiesMu.Unlock()
+	go func() {
+		defer s.forgetCopy(copyID)
+		s.runCopy(ctx, account, containerName, blobName, copyID, resp.Body, created)
+	}()
+	return props, nil
+}
+
+// runCopy streams the body of a copy source into the destination of a pending
+// copy and closes it. If that fails, the copy is marked failed; a copy that was
+// aborted, or whose destination was replaced, is left as it is. Unless created
+// is nil, it is recorded in the change feed once the copy completes.
+func (s *BlobService) runCopy(ctx context.Context, account, containerName, blobName, copyID string, body io.ReadCloser, created *changeEvent) (*BlobProperties, error) {
+	defer body.Close()
+
+	content := &copyProgressReader{r: body, report: func(bytesRead int64) {
+		s.store.UpdateCopyProgress(ctx, account, containerName, blobName, copyID, bytesRead)
+	}}
+	props, err := s.store.CompleteCopy(ctx, account, containerName, blobName, copyID, content)
+	if err == nil {
+		s.logger.Info("blob copy completed",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+			logging.String("copy_id", copyID),
+			logging.Int64("size", props.Size),
+		)
+		if created != nil {
+			s.publishChange(context.Background(), *created, props)
+		}
+		return props, nil
+	}
+
+	var storageErr *StorageError
+	if failErr := s.store.FailCopy(context.Background(), account, containerName, blobName, copyID, err.Error()); failErr != nil && !errors.As(failErr, &storageErr) {
+		s.logger.Error("failed to record blob copy failure",
+			logging.String("copy_id", copyID),
+			logging.ErrorField(failErr),
+		)
+	}
+	s.logger.Warn("blob copy failed",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("copy_id", copyID),
+		logging.ErrorField(err),
+	)
+	return nil, err
+}
+
+// forgetCopy cancels a background copy, if it is still running, and forgets it.
+func (s *BlobService) forgetCopy(copyID string) {
+	s.copiesMu.Lock()
+	cancel := s.copies[copyID]
+	delete(s.copies, copyID)
+	s.copiesMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// handleAbortCopy handles PUT /{account}/{container}/{blobName}?comp=copy&copyid=<id>
+// with x-ms-copy-action: abort. The destination blob is kept, empty, with the
+// copy status aborted.
+func (s *BlobService) handleAbortCopy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	copyID := r.URL.Query().Get("copyid")
+	if copyID == "" {
+		s.writeStoreError(w, errMissingRequiredQueryParameter("copyid"), "")
+		return
+	}
+	switch action := r.Header.Get("x-ms-copy-action"); {
+	case action == "":
+		s.writeStoreError(w, errMissingRequiredHeader("x-ms-copy-action"), "")
+		return
+	case !strings.EqualFold(action, "abort"):
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-copy-action"), "")
+		return
+	}
+
+	if err := s.store.AbortCopy(r.Context(), account, containerName, blobName, copyID, r.Header.Get("x-ms-lease-id")); err != nil {
+		s.writeStoreError(w, err, "failed to abort blob copy",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+	s.forgetCopy(copyID)
+
+	s.logger.Info("blob copy aborted",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("copy_id", copyID),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePutBlobFromURL handles PUT /{account}/{container}/{blobName} with
+// x-ms-copy-source and x-ms-blob-type: BlockBlob. Like Put Blob, it writes a new
+// block blob synchronously, from the content of the source. HTTP properties not
+// set on the request are taken from the source unless
+// x-ms-copy-source-blob-properties is false; metadata is never copied.
+func (s *BlobService) handlePutBlobFromURL(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-blob-type"), "")
+		return
+	}
+	source, local, err := s.parseCopySource(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid copy source")
+		return
+	}
+	headers, err := parseBlobHTTPHeaders(r.Header, false)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob properties")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	tier, err := parseAccessTier(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid access tier")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+	if !s.checkContainerExists(w, r, account, containerName) {
+		return
+	}
+
+	content, sourceHeaders, err := s.openCopySource(r.Context(), source, local)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to read copy source",
+			logging.String("source", source.URL),
+		)
+		return
+	}
+	defer content.Close()
+	if !strings.EqualFold(r.Header.Get("x-ms-copy-source-blob-properties"), "false") {
+		headers = withSourceHTTPHeaders(headers, sourceHeaders)
+	}
+
+	props, err := s.store.PutBlob(r.Context(), account, containerName, blobName, content, PutBlobOptions{
+		HTTPHeaders: headers,
+		Metadata:    parseMetadata(r.Header),
+		Tags:        tags,
+		Tier:        tier,
+		Conditions:  conds,
+
+		ImmutabilityPolicy: policy,
+		LegalHold:          legalHold,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to put blob from URL",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobCreated, "PutBlobFromUrl", props)
+	s.logger.Info("blob uploaded from URL",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("source", source.URL),
+		logging.Int64("size", props.Size),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
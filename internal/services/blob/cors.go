@@ -0,0 +1,281 @@
+package blob
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// Limits on the CORS rules of an account.
+const (
+	maxCorsRules           = 5
+	maxCorsOrigins         = 64
+	maxCorsHeaders         = 64
+	maxCorsPrefixedHeaders = 2
+	maxCorsValueLength     = 256
+)
+
+// corsMethods are the methods a CORS rule may allow.
+var corsMethods = map[string]bool{
+	http.MethodDelete:  true,
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	"MERGE":            true,
+	http.MethodPost:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+}
+
+// corsXML is the <Cors> element of the blob service properties. A Set request
+// with an empty element removes every rule.
+type corsXML struct {
+	Rules []corsRuleXML `xml:"CorsRule"`
+}
+
+// corsRuleXML is a <CorsRule> element. Its lists are comma-separated.
+type corsRuleXML struct {
+	AllowedOrigins  string `xml:"AllowedOrigins"`
+	AllowedMethods  string `xml:"AllowedMethods"`
+	MaxAgeInSeconds int    `xml:"MaxAgeInSeconds"`
+	ExposedHeaders  string `xml:"ExposedHeaders"`
+	AllowedHeaders  string `xml:"AllowedHeaders"`
+}
+
+// newCorsXML converts store CorsRules into their XML form.
+func newCorsXML(rules []CorsRule) *corsXML {
+	x := &corsXML{}
+	for _, rule := range rules {
+		x.Rules = append(x.Rules, corsRuleXML{
+			AllowedOrigins:  strings.Join(rule.AllowedOrigins, ","),
+			AllowedMethods:  strings.Join(rule.AllowedMethods, ","),
+			MaxAgeInSeconds: rule.MaxAgeInSeconds,
+			ExposedHeaders:  strings.Join(rule.ExposedHeaders, ","),
+			AllowedHeaders:  strings.Join(rule.AllowedHeaders, ","),
+		})
+	}
+	return x
+}
+
+// corsRules validates the rules of a request body. An account has at most five
+// rules, each allowing at least one origin and method.
+func (x *corsXML) corsRules() ([]CorsRule, error) {
+	if len(x.Rules) > maxCorsRules {
+		return nil, errInvalidXMLNodeValue("Cors")
+	}
+	var rules []CorsRule
+	for _, r := range x.Rules {
+		rule := CorsRule{
+			AllowedOrigins:  splitCorsList(r.AllowedOrigins),
+			AllowedMethods:  splitCorsList(r.AllowedMethods),
+			AllowedHeaders:  splitCorsList(r.AllowedHeaders),
+			ExposedHeaders:  splitCorsList(r.ExposedHeaders),
+			MaxAgeInSeconds: r.MaxAgeInSeconds,
+		}
+		if len(rule.AllowedOrigins) == 0 || len(rule.AllowedOrigins) > maxCorsOrigins || !validCorsValues(rule.AllowedOrigins) {
+			return nil, errInvalidXMLNodeValue("Cors/CorsRule/AllowedOrigins")
+		}
+		if len(rule.AllowedMethods) == 0 {
+			return nil, errInvalidXMLNodeValue("Cors/CorsRule/AllowedMethods")
+		}
+		for _, method := range rule.AllowedMethods {
+			if !corsMethods[method] {
+				return nil, errInvalidXMLNodeValue("Cors/CorsRule/AllowedMethods")
+			}
+		}
+		if !validCorsHeaders(rule.AllowedHeaders) {
+			return nil, errInvalidXMLNodeValue("Cors/CorsRule/AllowedHeaders")
+		}
+		if !validCorsHeaders(rule.ExposedHeaders) {
+			return nil, errInvalidXMLNodeValue("Cors/CorsRule/ExposedHeaders")
+		}
+		if rule.MaxAgeInSeconds < 0 {
+			return nil, errInvalidXMLNodeValue("Cors/CorsRule/MaxAgeInSeconds")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitCorsList splits a comma-separated list, dropping empty entries.
+func splitCorsList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// validCorsValues reports whether no value is longer than Azure allows.
+func validCorsValues(values []string) bool {
+	for _, value := range values {
+		if len(value) > maxCorsValueLength {
+			return false
+		}
+	}
+	return true
+}
+
+// validCorsHeaders reports whether a rule's header list is within Azure's
+// limits of 64 header names and two prefixes.
+func validCorsHeaders(headers []string) bool {
+	var names, prefixes int
+	for _, header := range headers {
+		if strings.HasSuffix(header, "*") && header != "*" {
+			prefixes++
+		} else {
+			names++
+		}
+	}
+	return names <= maxCorsHeaders && prefixes <= maxCorsPrefixedHeaders && validCorsValues(headers)
+}
+
+// anyOrigin reports whether the rule allows every origin.
+func (rule *CorsRule) anyOrigin() bool {
+	for _, allowed := range rule.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the rule allows a request from origin with method,
+// sending headers. Origins and headers are compared case-insensitively, and
+// methods exactly.
+func (rule *CorsRule) allows(origin, method string, headers []string) bool {
+	originAllowed := rule.anyOrigin()
+	for _, allowed := range rule.AllowedOrigins {
+		originAllowed = originAllowed || strings.EqualFold(allowed, origin)
+	}
+	methodAllowed := false
+	for _, allowed := range rule.AllowedMethods {
+		methodAllowed = methodAllowed || allowed == method
+	}
+	if !originAllowed || !methodAllowed {
+		return false
+	}
+	for _, header := range headers {
+		if !rule.allowsHeader(header) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsHeader reports whether the rule allows a request header, by name or
+// by one of its prefixes.
+func (rule *CorsRule) allowsHeader(header string) bool {
+	header = strings.ToLower(header)
+	for _, allowed := range rule.AllowedHeaders {
+		allowed = strings.ToLower(allowed)
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+			if strings.HasPrefix(header, prefix) {
+				return true
+			}
+		} else if allowed == header {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCorsRule returns the first of the rules that allows a request, or nil.
+func matchCorsRule(rules []CorsRule, origin, method string, headers []string) *CorsRule {
+	for i := range rules {
+		if rules[i].allows(origin, method, headers) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// setCorsHeaders is middleware that adds the Access-Control-* headers to
+// cross-origin requests matching one of the account's CORS rules. Like Azure,
+// only the origin and method of an actual request are matched, and requests
+// that don't match are still served, without the headers, leaving the browser
+// to block the response.
+func (s *BlobService) setCorsHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		props, err := s.store.GetServiceProperties(r.Context(), chi.URLParam(r, "account"))
+		if err != nil || len(props.Cors) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		rule := matchCorsRule(props.Cors, origin, r.Method, nil)
+		switch {
+		case rule == nil:
+			h.Add("Vary", "Origin")
+		case rule.anyOrigin():
+			h.Set("Access-Control-Allow-Origin", "*")
+		default:
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+			h.Add("Vary", "Origin")
+		}
+		if rule != nil && len(rule.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposedHeaders, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlePreflight handles OPTIONS requests, the CORS preflight requests browsers
+// send before a cross-origin request. The request's origin, method and headers
+// must all be allowed by one of the account's CORS rules.
+func (s *BlobService) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		s.writeStoreError(w, errMissingRequiredHeader("Origin"), "")
+		return
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	if method == "" {
+		s.writeStoreError(w, errMissingRequiredHeader("Access-Control-Request-Method"), "")
+		return
+	}
+	requestHeaders := r.Header.Get("Access-Control-Request-Headers")
+
+	props, err := s.store.GetServiceProperties(r.Context(), account)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get service properties",
+			logging.String("account", account),
+		)
+		return
+	}
+	rule := matchCorsRule(props.Cors, origin, method, splitCorsList(requestHeaders))
+	if rule == nil {
+		s.writeStoreError(w, ErrCorsPreflightFailure, "")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", method)
+	if requestHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", requestHeaders)
+	}
+	h.Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAgeInSeconds))
+	h.Set("Access-Control-Allow-Credentials", "true")
+
+	s.logger.Info("preflight request allowed",
+		logging.String("account", account),
+		logging.String("origin", origin),
+		logging.String("method", method),
+	)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,483 @@
+package blob
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StorageError is an error returned by the blob store that maps directly onto an
+// Azure Storage error response. The service layer renders it as an <Error> XML
+// body with the matching HTTP status and x-ms-error-code header.
+type StorageError struct {
+	// StatusCode is the HTTP status code returned to the client.
+	StatusCode int
+
+	// Code is the Azure error code (e.g., "BlobNotFound").
+	Code string
+
+	// Message is the human-readable error description.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *StorageError) Error() string {
+	return e.Message
+}
+
+// Common storage errors returned by BlobStore implementations.
+// Codes and messages follow the Azure Blob Storage REST API.
+var (
+	ErrContainerNotFound = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "ContainerNotFound",
+		Message:    "The specified container does not exist.",
+	}
+	ErrContainerAlreadyExists = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "ContainerAlreadyExists",
+		Message:    "The specified container already exists.",
+	}
+	ErrBlobNotFound = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "BlobNotFound",
+		Message:    "The specified blob does not exist.",
+	}
+	ErrBlobAlreadyExists = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobAlreadyExists",
+		Message:    "The specified blob already exists.",
+	}
+	ErrSnapshotsPresent = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "SnapshotsPresent",
+		Message:    "This operation is not permitted because the blob has snapshots.",
+	}
+
+	// ErrResourceNotFound is returned to anonymous requests that the container's
+	// public access level doesn't allow, so they can't tell whether it exists.
+	ErrResourceNotFound = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "ResourceNotFound",
+		Message:    "The specified resource does not exist.",
+	}
+)
+
+// Conditional request errors. Reads whose If-None-Match or If-Modified-Since
+// condition fails get ErrNotModified; every other failed condition is ErrConditionNotMet.
+var (
+	ErrConditionNotMet = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "ConditionNotMet",
+		Message:    "The condition specified using HTTP conditional header(s) is not met.",
+	}
+	ErrNotModified = &StorageError{
+		StatusCode: http.StatusNotModified,
+		Code:       "ConditionNotMet",
+		Message:    "The condition specified using HTTP conditional header(s) is not met.",
+	}
+)
+
+// errInvalidHeaderValue reports a request header whose value could not be parsed.
+func errInvalidHeaderValue(header string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidHeaderValue",
+		Message:    fmt.Sprintf("The value for one of the HTTP headers is not in the correct format. Header: %s", header),
+	}
+}
+
+// errInvalidQueryParameterValue reports a query parameter whose value is invalid
+// or not allowed for the request.
+func errInvalidQueryParameterValue(name string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidQueryParameterValue",
+		Message:    fmt.Sprintf("Value for one of the query parameters specified in the request URI is invalid. Parameter: %s", name),
+	}
+}
+
+// errOutOfRangeQueryParameterValue reports a query parameter whose value is
+// outside the range the operation allows.
+func errOutOfRangeQueryParameterValue(name string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "OutOfRangeQueryParameterValue",
+		Message:    fmt.Sprintf("One of the query parameters specified in the request URI is outside the permissible range. Parameter: %s", name),
+	}
+}
+
+// errInvalidXMLNodeValue reports an element of a request body whose value is invalid.
+func errInvalidXMLNodeValue(node string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidXmlNodeValue",
+		Message:    fmt.Sprintf("The value for one of the XML nodes is not in the correct format. Node: %s", node),
+	}
+}
+
+// errCannotVerifyCopySource reports a copy source that doesn't exist or can't be read.
+func errCannotVerifyCopySource(statusCode int, message string) *StorageError {
+	return &StorageError{
+		StatusCode: statusCode,
+		Code:       "CannotVerifyCopySource",
+		Message:    message,
+	}
+}
+
+// Copy errors.
+var (
+	ErrPendingCopyOperation = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "PendingCopyOperation",
+		Message:    "There is currently a pending copy operation.",
+	}
+	ErrNoPendingCopyOperation = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "NoPendingCopyOperation",
+		Message:    "There is currently no pending copy operation.",
+	}
+	ErrCopyIDMismatch = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "CopyIdMismatch",
+		Message:    "The specified copy ID did not match the copy ID for the pending copy operation.",
+	}
+)
+
+// Block blob errors.
+var (
+	ErrInvalidBlockID = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidBlockId",
+		Message:    "The specified block ID is invalid. The block ID must be Base64-encoded.",
+	}
+	ErrInvalidBlockList = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidBlockList",
+		Message:    "The specified block list is invalid.",
+	}
+	ErrInvalidBlobOrBlock = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidBlobOrBlock",
+		Message:    "The specified blob or block content is invalid.",
+	}
+	ErrBlockCountExceedsLimit = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlockCountExceedsLimit",
+		Message:    "The uncommitted block count cannot exceed the maximum limit of 100,000 blocks.",
+	}
+	ErrBlockListTooLong = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "BlockListTooLong",
+		Message:    "The block list may not contain more than 50,000 blocks.",
+	}
+	ErrInvalidXMLDocument = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidXmlDocument",
+		Message:    "XML specified is not syntactically valid.",
+	}
+)
+
+// Append blob errors.
+var (
+	ErrInvalidBlobType = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "InvalidBlobType",
+		Message:    "The blob type is invalid for this operation.",
+	}
+	ErrBlobIsSealed = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobIsSealed",
+		Message:    "The blob is sealed and its contents cannot be modified.",
+	}
+	ErrAppendPositionConditionNotMet = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "AppendPositionConditionNotMet",
+		Message:    "The append position condition specified was not met.",
+	}
+	ErrMaxBlobSizeConditionNotMet = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "MaxBlobSizeConditionNotMet",
+		Message:    "The max blob size condition specified was not met.",
+	}
+	ErrCommittedBlockCountExceedsLimit = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlockCountExceedsLimit",
+		Message:    "The committed block count cannot exceed the maximum limit of 50,000 blocks.",
+	}
+	ErrRequestBodyTooLarge = &StorageError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Code:       "RequestBodyTooLarge",
+		Message:    "The request body is too large and exceeds the maximum permissible limit.",
+	}
+)
+
+// Page blob errors.
+var (
+	ErrInvalidPageRange = &StorageError{
+		StatusCode: http.StatusRequestedRangeNotSatisfiable,
+		Code:       "InvalidPageRange",
+		Message:    "The page range specified is invalid.",
+	}
+	ErrSequenceNumberConditionNotMet = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "SequenceNumberConditionNotMet",
+		Message:    "The sequence number condition specified was not met.",
+	}
+	ErrSequenceNumberIncrementTooLarge = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "SequenceNumberIncrementTooLarge",
+		Message:    "The sequence number increment cannot be performed because it would result in overflow of the sequence number.",
+	}
+	ErrPreviousSnapshotNotFound = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "PreviousSnapshotNotFound",
+		Message:    "The previous snapshot is not found.",
+	}
+	ErrPreviousSnapshotCannotBeNewer = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "PreviousSnapshotCannotBeNewer",
+		Message:    "The prevsnapshot query parameter value cannot be newer than snapshot query parameter value.",
+	}
+)
+
+// ErrInvalidRange is returned when a requested range starts beyond the end of a blob.
+var ErrInvalidRange = &StorageError{
+	StatusCode: http.StatusRequestedRangeNotSatisfiable,
+	Code:       "InvalidRange",
+	Message:    "The range specified is invalid for the current size of the resource.",
+}
+
+// errMissingRequiredHeader reports a required request header that was not sent.
+func errMissingRequiredHeader(header string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "MissingRequiredHeader",
+		Message:    fmt.Sprintf("An HTTP header that's mandatory for this request is not specified. Header: %s", header),
+	}
+}
+
+// errMissingRequiredQueryParameter reports a required query parameter that was not sent.
+func errMissingRequiredQueryParameter(name string) *StorageError {
+	return &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "MissingRequiredQueryParameter",
+		Message:    fmt.Sprintf("A query parameter that's mandatory for this request is not specified. Parameter: %s", name),
+	}
+}
+
+// Lease errors returned by lease operations.
+var (
+	ErrLeaseAlreadyPresent = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseAlreadyPresent",
+		Message:    "There is already a lease present.",
+	}
+	ErrLeaseIDMismatchWithLeaseOperation = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseIdMismatchWithLeaseOperation",
+		Message:    "The lease ID specified did not match the lease ID for the resource.",
+	}
+	ErrLeaseNotPresentWithLeaseOperation = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseNotPresentWithLeaseOperation",
+		Message:    "There is currently no lease on the resource.",
+	}
+	ErrLeaseIsBreakingAndCannotBeAcquired = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseIsBreakingAndCannotBeAcquired",
+		Message:    "There is already a breaking lease present.",
+	}
+	ErrLeaseIsBreakingAndCannotBeChanged = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseIsBreakingAndCannotBeChanged",
+		Message:    "The lease ID matched, but the lease is currently in breaking state and cannot be changed.",
+	}
+	ErrLeaseIsBrokenAndCannotBeRenewed = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "LeaseIsBrokenAndCannotBeRenewed",
+		Message:    "The lease ID matched, but the lease has been broken explicitly and cannot be renewed.",
+	}
+)
+
+// Lease errors returned by operations on a leased blob.
+var (
+	ErrLeaseIDMissing = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseIdMissing",
+		Message:    "There is currently a lease on the blob and no lease ID was specified in the request.",
+	}
+	ErrLeaseIDMismatchWithBlobOperation = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseIdMismatchWithBlobOperation",
+		Message:    "The lease ID specified did not match the lease ID for the blob.",
+	}
+	ErrLeaseNotPresentWithBlobOperation = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseNotPresentWithBlobOperation",
+		Message:    "There is currently no lease on the blob.",
+	}
+)
+
+// Lease errors returned by operations on a leased container.
+var (
+	ErrContainerLeaseIDMissing = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseIdMissing",
+		Message:    "There is currently a lease on the container and no lease ID was specified in the request.",
+	}
+	ErrLeaseIDMismatchWithContainerOperation = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseIdMismatchWithContainerOperation",
+		Message:    "The lease ID specified did not match the lease ID for the container.",
+	}
+	ErrLeaseNotPresentWithContainerOperation = &StorageError{
+		StatusCode: http.StatusPreconditionFailed,
+		Code:       "LeaseNotPresentWithContainerOperation",
+		Message:    "There is currently no lease on the container.",
+	}
+)
+
+// Blob batch errors.
+var (
+	ErrEmptyBatch = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidInput",
+		Message:    "The batch request contains no sub-requests.",
+	}
+	ErrTooManyBatchRequests = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidInput",
+		Message:    "The batch request contains more than 256 sub-requests.",
+	}
+	ErrInvalidBatchOperation = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidInput",
+		Message:    "A batch may only contain Delete Blob or Set Blob Tier sub-requests, all of the same type.",
+	}
+	ErrMalformedBatch = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidInput",
+		Message:    "The batch request body is not a valid multipart/mixed body of HTTP requests.",
+	}
+	ErrBatchRequestOutsideContainer = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidInput",
+		Message:    "A sub-request of a container batch addresses a blob in another container.",
+	}
+)
+
+// Access tier errors.
+var (
+	ErrBlobArchived = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobArchived",
+		Message:    "This operation is not permitted on an archived blob.",
+	}
+	ErrBlobBeingRehydrated = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobBeingRehydrated",
+		Message:    "This operation is not permitted because the blob is being rehydrated.",
+	}
+)
+
+// Blob index tag errors.
+var (
+	ErrInvalidTag = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidTag",
+		Message:    "The tags specified are invalid. It contains characters that are not permitted.",
+	}
+	ErrTagsTooLarge = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "TagsTooLarge",
+		Message:    "The tags specified exceed the maximum permissible limit.",
+	}
+)
+
+// Immutability errors.
+var (
+	ErrBlobImmutableDueToPolicy = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobImmutableDueToPolicy",
+		Message:    "This operation is not permitted as the blob is immutable due to a policy.",
+	}
+	ErrBlobImmutableDueToLegalHold = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "BlobImmutableDueToLegalHold",
+		Message:    "This operation is not permitted as the blob is immutable due to a legal hold.",
+	}
+	ErrImmutabilityPolicyLocked = &StorageError{
+		StatusCode: http.StatusConflict,
+		Code:       "ImmutabilityPolicyLocked",
+		Message:    "This operation is not permitted as the immutability policy is locked. A locked policy can only be extended.",
+	}
+	ErrImmutabilityPolicyNotFound = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "ImmutabilityPolicyNotFound",
+		Message:    "The container has no immutability policy.",
+	}
+)
+
+// Content hash errors, returned when an upload doesn't match the Content-MD5 or
+// x-ms-content-crc64 sent with it.
+var (
+	ErrMd5Mismatch = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "Md5Mismatch",
+		Message:    "The MD5 value specified in the request did not match with the MD5 value calculated by the server.",
+	}
+	ErrCrc64Mismatch = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "Crc64Mismatch",
+		Message:    "The CRC64 value specified in the request did not match with the CRC64 value calculated by the server.",
+	}
+)
+
+// Static website errors, returned by the web endpoint.
+var (
+	ErrWebsiteDisabled = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "WebsiteDisabled",
+		Message:    "The requested content does not exist.",
+	}
+	ErrWebContentNotFound = &StorageError{
+		StatusCode: http.StatusNotFound,
+		Code:       "WebContentNotFound",
+		Message:    "The requested content does not exist.",
+	}
+)
+
+// CORS errors.
+var (
+	ErrCorsPreflightFailure = &StorageError{
+		StatusCode: http.StatusForbidden,
+		Code:       "CorsPreflightFailure",
+		Message:    "CORS not enabled or no matching rule found for this request.",
+	}
+)
+
+// Resource name errors, returned for account, container and blob names that
+// Azure doesn't allow.
+var (
+	ErrInvalidResourceName = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidResourceName",
+		Message:    "The specified resource name contains invalid characters.",
+	}
+	ErrInvalidURI = &StorageError{
+		StatusCode: http.StatusBadRequest,
+		Code:       "InvalidUri",
+		Message:    "The requested URI does not represent any resource on the server.",
+	}
+)
+
+// Change feed errors.
+var (
+	// ErrChangeFeedReadOnly is returned for client writes to the change feed
+	// container, which only the service writes to.
+	ErrChangeFeedReadOnly = &StorageError{
+		StatusCode: http.StatusForbidden,
+		Code:       "AuthorizationPermissionMismatch",
+		Message:    "This request is not authorized to perform this operation using this permission.",
+	}
+)
@@ -0,0 +1,525 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// Headers that carry a blob's immutability policy and legal hold. The policy
+// mode header also locks a container's retention policy.
+const (
+	immutabilityUntilHeader = "x-ms-immutability-policy-until-date"
+	immutabilityModeHeader  = "x-ms-immutability-policy-mode"
+	legalHoldHeader         = "x-ms-legal-hold"
+)
+
+// maxImmutabilityPeriodDays is the longest retention period a container's
+// immutability policy may have.
+const maxImmutabilityPeriodDays = 146000
+
+// retainedUntil returns when the policy stops protecting a blob created at createdAt.
+func (p *ContainerImmutabilityPolicy) retainedUntil(createdAt time.Time) time.Time {
+	return createdAt.AddDate(0, 0, p.PeriodDays)
+}
+
+// locked reports whether a blob's immutability policy is locked and still in effect at now.
+func (p *ImmutabilityPolicy) locked(now time.Time) bool {
+	return p != nil && p.Mode == ImmutabilityPolicyLocked && now.Before(p.ExpiresOn)
+}
+
+// checkImmutable returns the error for a write that would modify or delete
+// record, a blob, snapshot or version in the container, while a legal hold, its
+// own immutability policy or the container's retention policy protects it.
+// Appends are let through if the container's policy allows protected append
+// writes. record may be nil, for a blob that doesn't exist.
+func (e *containerEntry) checkImmutable(record *blobRecord, appending bool, now time.Time) error {
+	if record == nil {
+		return nil
+	}
+	props := &record.Properties
+	if props.LegalHold {
+		return ErrBlobImmutableDueToLegalHold
+	}
+	if p := props.ImmutabilityPolicy; p != nil && now.Before(p.ExpiresOn) {
+		return ErrBlobImmutableDueToPolicy
+	}
+	if p := e.container.ImmutabilityPolicy; p != nil && now.Before(p.retainedUntil(props.CreatedAt)) {
+		if !appending || !p.AllowProtectedAppendWrites {
+			return ErrBlobImmutableDueToPolicy
+		}
+	}
+	return nil
+}
+
+// checkDeletable returns the error of the first blob, snapshot or version in
+// the container that can't be deleted at now. The caller holds the lock.
+func (e *containerEntry) checkDeletable(now time.Time) error {
+	for _, record := range e.blobs {
+		if err := e.checkImmutable(record, false, now); err != nil {
+			return err
+		}
+	}
+	for _, records := range []map[string][]*blobRecord{e.snapshots, e.versions} {
+		for _, list := range records {
+			for _, record := range liveRecords(list) {
+				if err := e.checkImmutable(record, false, now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// SetContainerImmutabilityPolicy sets a container's time-based retention policy.
+// An empty policy.State keeps the current policy's state. A locked policy can't
+// be unlocked and its retention period can only be extended.
+func (s *FileBlobStore) SetContainerImmutabilityPolicy(ctx context.Context, account, containerName string, policy ContainerImmutabilityPolicy) (*Container, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	current := entry.container.ImmutabilityPolicy
+	if policy.State == "" {
+		policy.State = ImmutabilityPolicyUnlocked
+		if current != nil {
+			policy.State = current.State
+		}
+	}
+	if current != nil && current.State == ImmutabilityPolicyLocked {
+		if policy.State != ImmutabilityPolicyLocked || policy.PeriodDays < current.PeriodDays ||
+			policy.AllowProtectedAppendWrites != current.AllowProtectedAppendWrites {
+			return nil, ErrImmutabilityPolicyLocked
+		}
+	}
+
+	return s.replaceContainerPolicy(entry, account, &policy)
+}
+
+// DeleteContainerImmutabilityPolicy removes a container's unlocked retention policy.
+func (s *FileBlobStore) DeleteContainerImmutabilityPolicy(ctx context.Context, account, containerName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	switch current := entry.container.ImmutabilityPolicy; {
+	case current == nil:
+		return ErrImmutabilityPolicyNotFound
+	case current.State == ImmutabilityPolicyLocked:
+		return ErrImmutabilityPolicyLocked
+	}
+	_, err = s.replaceContainerPolicy(entry, account, nil)
+	return err
+}
+
+// replaceContainerPolicy persists a container's record with a new retention
+// policy and swaps it into the index. The caller holds the lock.
+func (s *FileBlobStore) replaceContainerPolicy(entry *containerEntry, account string, policy *ContainerImmutabilityPolicy) (*Container, error) {
+	container := entry.container
+	container.ImmutabilityPolicy = policy
+	container.ModifiedAt = time.Now().UTC()
+	container.ETag = newETag()
+	if err := s.writeContainerRecord(account, &container); err != nil {
+		return nil, err
+	}
+	entry.container = container
+	return &container, nil
+}
+
+// SetBlobImmutabilityPolicy sets the immutability policy of a blob or one of its
+// previous versions. A locked policy that is still in effect can't be unlocked,
+// and its expiry can only be extended.
+func (s *FileBlobStore) SetBlobImmutabilityPolicy(ctx context.Context, account, containerName, blobName string, policy ImmutabilityPolicy, opts ImmutabilityOptions) (*BlobProperties, error) {
+	return s.updateImmutability(account, containerName, blobName, opts, func(props *BlobProperties, now time.Time) error {
+		if current := props.ImmutabilityPolicy; current.locked(now) {
+			if policy.Mode != ImmutabilityPolicyLocked || policy.ExpiresOn.Before(current.ExpiresOn) {
+				return ErrImmutabilityPolicyLocked
+			}
+		}
+		props.ImmutabilityPolicy = &policy
+		return nil
+	})
+}
+
+// DeleteBlobImmutabilityPolicy removes the immutability policy of a blob or one
+// of its previous versions, unless it is locked and still in effect.
+func (s *FileBlobStore) DeleteBlobImmutabilityPolicy(ctx context.Context, account, containerName, blobName string, opts ImmutabilityOptions) error {
+	_, err := s.updateImmutability(account, containerName, blobName, opts, func(props *BlobProperties, now time.Time) error {
+		if props.ImmutabilityPolicy.locked(now) {
+			return ErrImmutabilityPolicyLocked
+		}
+		props.ImmutabilityPolicy = nil
+		return nil
+	})
+	return err
+}
+
+// SetBlobLegalHold sets or clears the legal hold of a blob or one of its previous versions.
+func (s *FileBlobStore) SetBlobLegalHold(ctx context.Context, account, containerName, blobName string, hold bool, opts ImmutabilityOptions) (*BlobProperties, error) {
+	return s.updateImmutability(account, containerName, blobName, opts, func(props *BlobProperties, now time.Time) error {
+		props.LegalHold = hold
+		return nil
+	})
+}
+
+// updateImmutability applies update to a copy of the properties of a blob or,
+// with opts.VersionID, one of its previous versions, then persists the record
+// and swaps it into the index. Like tags, a blob's immutability settings are
+// changed without changing its ETag or modification time.
+func (s *FileBlobStore) updateImmutability(account, containerName, blobName string, opts ImmutabilityOptions, update func(props *BlobProperties, now time.Time) error) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+
+	current := entry.blobs[blobName]
+	if opts.VersionID != "" && (current == nil || current.Properties.VersionID != opts.VersionID) {
+		version := findVersion(entry.versions[blobName], opts.VersionID)
+		if version == nil {
+			return nil, ErrBlobNotFound
+		}
+		if err := checkBlobAccess(opts.Conditions, version, false); err != nil {
+			return nil, err
+		}
+		record := *version
+		if err := update(&record.Properties, now); err != nil {
+			return nil, err
+		}
+		path := s.versionPath(account, containerName, blobName, opts.VersionID)
+		if err := s.writeJSON(path+".json", &record); err != nil {
+			return nil, err
+		}
+		entry.versions[blobName] = replaceRecord(entry.versions[blobName], version, &record)
+		props := record.Properties
+		return &props, nil
+	}
+	if current == nil {
+		return nil, ErrBlobNotFound
+	}
+	if err := checkBlobAccess(opts.Conditions, current, false); err != nil {
+		return nil, err
+	}
+
+	record := *current
+	if err := update(&record.Properties, now); err != nil {
+		return nil, err
+	}
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	entry.blobs[blobName] = &record
+	props := record.Properties
+	return &props, nil
+}
+
+// parseImmutabilityPolicy returns the policy set by x-ms-immutability-policy-until-date
+// and x-ms-immutability-policy-mode, or nil if neither is sent. The expiry must
+// be in the future; the mode defaults to Unlocked.
+func parseImmutabilityPolicy(h http.Header) (*ImmutabilityPolicy, error) {
+	until, mode := h.Get(immutabilityUntilHeader), h.Get(immutabilityModeHeader)
+	if until == "" {
+		if mode != "" {
+			return nil, errMissingRequiredHeader(immutabilityUntilHeader)
+		}
+		return nil, nil
+	}
+	expiresOn, err := http.ParseTime(until)
+	if err != nil || !expiresOn.After(time.Now()) {
+		return nil, errInvalidHeaderValue(immutabilityUntilHeader)
+	}
+	policy := &ImmutabilityPolicy{ExpiresOn: expiresOn.UTC(), Mode: ImmutabilityPolicyUnlocked}
+	if mode != "" {
+		if policy.Mode, err = parseImmutabilityMode(mode); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+// parseImmutabilityMode parses the value of x-ms-immutability-policy-mode,
+// without regard to case.
+func parseImmutabilityMode(value string) (ImmutabilityPolicyMode, error) {
+	for _, mode := range []ImmutabilityPolicyMode{ImmutabilityPolicyUnlocked, ImmutabilityPolicyLocked} {
+		if strings.EqualFold(value, string(mode)) {
+			return mode, nil
+		}
+	}
+	return "", errInvalidHeaderValue(immutabilityModeHeader)
+}
+
+// parseLegalHold returns the value of x-ms-legal-hold and whether it was sent.
+func parseLegalHold(h http.Header) (hold, ok bool, err error) {
+	value := h.Get(legalHoldHeader)
+	if value == "" {
+		return false, false, nil
+	}
+	if hold, err = strconv.ParseBool(value); err != nil {
+		return false, false, errInvalidHeaderValue(legalHoldHeader)
+	}
+	return hold, true, nil
+}
+
+// setImmutabilityHeaders reports a blob's immutability policy and legal hold,
+// as returned by Get Blob and Get Blob Properties.
+func setImmutabilityHeaders(h http.Header, props *BlobProperties) {
+	if p := props.ImmutabilityPolicy; p != nil {
+		h.Set(immutabilityUntilHeader, formatHTTPDate(p.ExpiresOn))
+		h.Set(immutabilityModeHeader, string(p.Mode))
+	}
+	if props.LegalHold {
+		h.Set(legalHoldHeader, "true")
+	}
+}
+
+// containerImmutabilityPolicyXML is the body of the container immutability
+// policy requests. State is only returned.
+type containerImmutabilityPolicyXML struct {
+	XMLName                    xml.Name `xml:"ImmutabilityPolicy"`
+	PeriodDays                 int      `xml:"ImmutabilityPeriodSinceCreationInDays"`
+	AllowProtectedAppendWrites bool     `xml:"AllowProtectedAppendWrites"`
+	State                      string   `xml:"State,omitempty"`
+}
+
+func newContainerImmutabilityPolicyXML(p *ContainerImmutabilityPolicy) containerImmutabilityPolicyXML {
+	return containerImmutabilityPolicyXML{
+		PeriodDays:                 p.PeriodDays,
+		AllowProtectedAppendWrites: p.AllowProtectedAppendWrites,
+		State:                      string(p.State),
+	}
+}
+
+// handleSetContainerImmutabilityPolicy handles
+// PUT /{account}/{container}?restype=container&comp=immutabilityPolicies. The
+// body sets the retention period; x-ms-immutability-policy-mode: Locked locks it.
+func (s *BlobService) handleSetContainerImmutabilityPolicy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	var body containerImmutabilityPolicyXML
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeStoreError(w, ErrInvalidXMLDocument, "invalid immutability policy")
+		return
+	}
+	if body.PeriodDays < 1 || body.PeriodDays > maxImmutabilityPeriodDays {
+		s.writeStoreError(w, errInvalidXMLNodeValue("ImmutabilityPeriodSinceCreationInDays"), "invalid immutability policy")
+		return
+	}
+	policy := ContainerImmutabilityPolicy{
+		PeriodDays:                 body.PeriodDays,
+		AllowProtectedAppendWrites: body.AllowProtectedAppendWrites,
+	}
+	if mode := r.Header.Get(immutabilityModeHeader); mode != "" {
+		var err error
+		if policy.State, err = parseImmutabilityMode(mode); err != nil {
+			s.writeStoreError(w, err, "invalid immutability policy")
+			return
+		}
+	}
+
+	container, err := s.store.SetContainerImmutabilityPolicy(r.Context(), account, containerName, policy)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set container immutability policy",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	s.logger.Info("container immutability policy set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.Int("days", container.ImmutabilityPolicy.PeriodDays),
+		logging.String("state", string(container.ImmutabilityPolicy.State)),
+	)
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	s.writeXML(w, http.StatusOK, newContainerImmutabilityPolicyXML(container.ImmutabilityPolicy))
+}
+
+// handleGetContainerImmutabilityPolicy handles
+// GET /{account}/{container}?restype=container&comp=immutabilityPolicies.
+func (s *BlobService) handleGetContainerImmutabilityPolicy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	container, err := s.store.GetContainer(r.Context(), account, containerName)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+	if container.ImmutabilityPolicy == nil {
+		s.writeStoreError(w, ErrImmutabilityPolicyNotFound, "")
+		return
+	}
+
+	w.Header().Set("ETag", container.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	s.writeXML(w, http.StatusOK, newContainerImmutabilityPolicyXML(container.ImmutabilityPolicy))
+}
+
+// handleDeleteContainerImmutabilityPolicy handles
+// DELETE /{account}/{container}?restype=container&comp=immutabilityPolicies.
+func (s *BlobService) handleDeleteContainerImmutabilityPolicy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	if err := s.store.DeleteContainerImmutabilityPolicy(r.Context(), account, containerName); err != nil {
+		s.writeStoreError(w, err, "failed to delete container immutability policy",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	s.logger.Info("container immutability policy deleted",
+		logging.String("account", account),
+		logging.String("container", containerName),
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseImmutabilityOptions reads the versionid and conditions of the blob
+// immutability policy and legal hold requests.
+func parseImmutabilityOptions(r *http.Request) (ImmutabilityOptions, error) {
+	versionID, err := timestampParam(r.URL.Query(), "versionid")
+	if err != nil {
+		return ImmutabilityOptions{}, err
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		return ImmutabilityOptions{}, err
+	}
+	return ImmutabilityOptions{VersionID: versionID, Conditions: conds}, nil
+}
+
+// handleSetBlobImmutabilityPolicy handles
+// PUT /{account}/{container}/{blobName}?comp=immutabilityPolicies.
+func (s *BlobService) handleSetBlobImmutabilityPolicy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parseImmutabilityOptions(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy request")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	if policy == nil {
+		s.writeStoreError(w, errMissingRequiredHeader(immutabilityUntilHeader), "")
+		return
+	}
+
+	props, err := s.store.SetBlobImmutabilityPolicy(r.Context(), account, containerName, blobName, *policy, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set blob immutability policy",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob immutability policy set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("mode", string(policy.Mode)),
+	)
+	setImmutabilityHeaders(w.Header(), props)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDeleteBlobImmutabilityPolicy handles
+// DELETE /{account}/{container}/{blobName}?comp=immutabilityPolicies.
+func (s *BlobService) handleDeleteBlobImmutabilityPolicy(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parseImmutabilityOptions(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy request")
+		return
+	}
+	if err := s.store.DeleteBlobImmutabilityPolicy(r.Context(), account, containerName, blobName, opts); err != nil {
+		s.writeStoreError(w, err, "failed to delete blob immutability policy",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob immutability policy deleted",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetBlobLegalHold handles PUT /{account}/{container}/{blobName}?comp=legalhold.
+func (s *BlobService) handleSetBlobLegalHold(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parseImmutabilityOptions(r)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold request")
+		return
+	}
+	hold, ok, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+	if !ok {
+		s.writeStoreError(w, errMissingRequiredHeader(legalHoldHeader), "")
+		return
+	}
+
+	if _, err := s.store.SetBlobLegalHold(r.Context(), account, containerName, blobName, hold, opts); err != nil {
+		s.writeStoreError(w, err, "failed to set blob legal hold",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob legal hold set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Bool("hold", hold),
+	)
+	w.Header().Set(legalHoldHeader, strconv.FormatBool(hold))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,412 @@
+package blob
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// Limits on lease durations and break periods, in seconds.
+const (
+	minLeaseDuration = 15
+	maxLeaseDuration = 60
+	maxBreakPeriod   = 60
+)
+
+// state returns the state of the lease at the given time.
+func (l Lease) state(now time.Time) LeaseState {
+	switch {
+	case !l.BrokenAt.IsZero():
+		if now.Before(l.BrokenAt) {
+			return LeaseStateBreaking
+		}
+		return LeaseStateBroken
+	case l.ID == "":
+		return LeaseStateAvailable
+	case l.Duration < 0 || now.Before(l.ExpiresAt):
+		return LeaseStateLeased
+	default:
+		return LeaseStateExpired
+	}
+}
+
+// active reports whether the lease still protects its resource: it is either
+// leased or breaking.
+func (l Lease) active(now time.Time) bool {
+	state := l.state(now)
+	return state == LeaseStateLeased || state == LeaseStateBreaking
+}
+
+// newLease returns a lease with the given ID and duration, starting now.
+func newLease(id string, duration int, now time.Time) Lease {
+	lease := Lease{ID: id, Duration: duration}
+	if duration >= 0 {
+		lease.ExpiresAt = now.Add(time.Duration(duration) * time.Second)
+	}
+	return lease
+}
+
+// leaseAccessErrors are the errors for operations on a leased resource, whose
+// codes differ between blobs and containers.
+type leaseAccessErrors struct {
+	missing, mismatch, notPresent *StorageError
+}
+
+var (
+	blobLeaseErrors      = leaseAccessErrors{ErrLeaseIDMissing, ErrLeaseIDMismatchWithBlobOperation, ErrLeaseNotPresentWithBlobOperation}
+	containerLeaseErrors = leaseAccessErrors{ErrContainerLeaseIDMissing, ErrLeaseIDMismatchWithContainerOperation, ErrLeaseNotPresentWithContainerOperation}
+)
+
+// checkAccess enforces the lease for an operation that passed leaseID. Writes
+// to a resource with an active lease need its ID, and a lease ID that is passed
+// must match the active lease, even for reads.
+func (l Lease) checkAccess(leaseID string, write bool, errs leaseAccessErrors, now time.Time) error {
+	active := l.active(now)
+	switch {
+	case leaseID == "":
+		if write && active {
+			return errs.missing
+		}
+	case !active:
+		return errs.notPresent
+	case !strings.EqualFold(leaseID, l.ID):
+		return errs.mismatch
+	}
+	return nil
+}
+
+// apply performs a lease operation and returns the resulting lease, plus the
+// remaining break period in seconds for break.
+func (l Lease) apply(req LeaseRequest, now time.Time) (Lease, int, error) {
+	state := l.state(now)
+	matches := strings.EqualFold(req.LeaseID, l.ID)
+
+	switch req.Action {
+	case LeaseActionAcquire:
+		switch {
+		case state == LeaseStateBreaking:
+			return l, 0, ErrLeaseIsBreakingAndCannotBeAcquired
+		case state == LeaseStateLeased && !strings.EqualFold(req.ProposedLeaseID, l.ID):
+			return l, 0, ErrLeaseAlreadyPresent
+		}
+		id := req.ProposedLeaseID
+		if id == "" {
+			id = newUUID()
+		}
+		return newLease(id, req.Duration, now), 0, nil
+
+	case LeaseActionRenew:
+		switch {
+		case state == LeaseStateAvailable:
+			return l, 0, ErrLeaseNotPresentWithLeaseOperation
+		case !matches:
+			return l, 0, ErrLeaseIDMismatchWithLeaseOperation
+		case state == LeaseStateBreaking || state == LeaseStateBroken:
+			return l, 0, ErrLeaseIsBrokenAndCannotBeRenewed
+		}
+		return newLease(l.ID, l.Duration, now), 0, nil
+
+	case LeaseActionChange:
+		switch {
+		case state != LeaseStateLeased && state != LeaseStateBreaking:
+			return l, 0, ErrLeaseNotPresentWithLeaseOperation
+		case !matches && !strings.EqualFold(req.ProposedLeaseID, l.ID):
+			return l, 0, ErrLeaseIDMismatchWithLeaseOperation
+		case state == LeaseStateBreaking:
+			return l, 0, ErrLeaseIsBreakingAndCannotBeChanged
+		}
+		l.ID = req.ProposedLeaseID
+		return l, 0, nil
+
+	case LeaseActionRelease:
+		switch {
+		case state == LeaseStateAvailable:
+			return l, 0, ErrLeaseNotPresentWithLeaseOperation
+		case !matches:
+			return l, 0, ErrLeaseIDMismatchWithLeaseOperation
+		}
+		return Lease{}, 0, nil
+
+	case LeaseActionBreak:
+		var remaining time.Duration
+		switch state {
+		case LeaseStateAvailable:
+			return l, 0, ErrLeaseNotPresentWithLeaseOperation
+		case LeaseStateBroken:
+			return l, 0, nil
+		case LeaseStateExpired:
+			remaining = 0
+		case LeaseStateBreaking:
+			remaining = l.BrokenAt.Sub(now)
+		case LeaseStateLeased:
+			// An infinite lease breaks immediately unless a break period is given.
+			remaining = 0
+			if l.Duration >= 0 {
+				remaining = l.ExpiresAt.Sub(now)
+			}
+			if l.Duration < 0 && req.BreakPeriod != nil {
+				remaining = time.Duration(*req.BreakPeriod) * time.Second
+			}
+		}
+		if req.BreakPeriod != nil {
+			if period := time.Duration(*req.BreakPeriod) * time.Second; period < remaining {
+				remaining = period
+			}
+		}
+		l.BrokenAt = now.Add(remaining)
+		return l, int(math.Ceil(remaining.Seconds())), nil
+	}
+	return l, 0, errInvalidHeaderValue("x-ms-lease-action")
+}
+
+// setLeaseHeaders writes the lease status, state and duration response headers.
+func setLeaseHeaders(h http.Header, lease Lease) {
+	status, state, duration := leaseProperties(lease, time.Now())
+	h.Set("x-ms-lease-status", status)
+	h.Set("x-ms-lease-state", string(state))
+	if duration != "" {
+		h.Set("x-ms-lease-duration", duration)
+	}
+}
+
+// leaseProperties returns the lease status ("locked" or "unlocked"), state and
+// duration ("infinite", "fixed" or empty unless leased) reported for a lease.
+func leaseProperties(lease Lease, now time.Time) (status string, state LeaseState, duration string) {
+	state = lease.state(now)
+	status = "unlocked"
+	if lease.active(now) {
+		status = "locked"
+	}
+	if state == LeaseStateLeased {
+		duration = "fixed"
+		if lease.Duration < 0 {
+			duration = "infinite"
+		}
+	}
+	return status, state, duration
+}
+
+// LeaseBlob performs a lease operation on a blob. Lease operations don't change
+// the blob's ETag or modification time.
+func (s *FileBlobStore) LeaseBlob(ctx context.Context, account, containerName, blobName string, req LeaseRequest) (*LeaseResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Conditions.check(true, current.Properties.ETag, current.Properties.ModifiedAt, false); err != nil {
+		return nil, err
+	}
+
+	lease, leaseTime, err := current.Properties.Lease.apply(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	record := *current
+	record.Properties.Lease = lease
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &record
+
+	return newLeaseResult(req.Action, lease, leaseTime, record.Properties.ETag, record.Properties.ModifiedAt), nil
+}
+
+// LeaseContainer performs a lease operation on a container.
+func (s *FileBlobStore) LeaseContainer(ctx context.Context, account, containerName string, req LeaseRequest) (*LeaseResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Conditions.check(true, entry.container.ETag, entry.container.ModifiedAt, false); err != nil {
+		return nil, err
+	}
+
+	lease, leaseTime, err := entry.container.Lease.apply(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	container := entry.container
+	container.Lease = lease
+	if err := s.writeContainerRecord(account, &container); err != nil {
+		return nil, err
+	}
+	entry.container = container
+
+	return newLeaseResult(req.Action, lease, leaseTime, container.ETag, container.ModifiedAt), nil
+}
+
+// newLeaseResult builds the result of a lease operation.
+func newLeaseResult(action LeaseAction, lease Lease, leaseTime int, etag string, modifiedAt time.Time) *LeaseResult {
+	result := &LeaseResult{LeaseTime: leaseTime, ETag: etag, ModifiedAt: modifiedAt}
+	if action != LeaseActionRelease && action != LeaseActionBreak {
+		result.LeaseID = lease.ID
+	}
+	return result
+}
+
+// parseLeaseRequest reads a lease operation from the x-ms-lease-* headers.
+func parseLeaseRequest(h http.Header) (LeaseRequest, error) {
+	conds, err := parseAccessConditions(h)
+	if err != nil {
+		return LeaseRequest{}, err
+	}
+	req := LeaseRequest{
+		Action:          LeaseAction(strings.ToLower(h.Get("x-ms-lease-action"))),
+		LeaseID:         conds.LeaseID,
+		ProposedLeaseID: h.Get("x-ms-proposed-lease-id"),
+	}
+	conds.LeaseID = ""
+	req.Conditions = conds
+
+	switch req.Action {
+	case "":
+		return req, errMissingRequiredHeader("x-ms-lease-action")
+	case LeaseActionAcquire:
+		value := h.Get("x-ms-lease-duration")
+		if value == "" {
+			return req, errMissingRequiredHeader("x-ms-lease-duration")
+		}
+		duration, err := strconv.Atoi(value)
+		if err != nil || (duration != -1 && (duration < minLeaseDuration || duration > maxLeaseDuration)) {
+			return req, errInvalidHeaderValue("x-ms-lease-duration")
+		}
+		req.Duration = duration
+	case LeaseActionRenew, LeaseActionRelease:
+		if req.LeaseID == "" {
+			return req, errMissingRequiredHeader("x-ms-lease-id")
+		}
+	case LeaseActionChange:
+		if req.LeaseID == "" {
+			return req, errMissingRequiredHeader("x-ms-lease-id")
+		}
+		if req.ProposedLeaseID == "" {
+			return req, errMissingRequiredHeader("x-ms-proposed-lease-id")
+		}
+	case LeaseActionBreak:
+		if value := h.Get("x-ms-lease-break-period"); value != "" {
+			period, err := strconv.Atoi(value)
+			if err != nil || period < 0 || period > maxBreakPeriod {
+				return req, errInvalidHeaderValue("x-ms-lease-break-period")
+			}
+			req.BreakPeriod = &period
+		}
+	default:
+		return req, errInvalidHeaderValue("x-ms-lease-action")
+	}
+
+	if req.ProposedLeaseID != "" && !isUUID(req.ProposedLeaseID) {
+		return req, errInvalidHeaderValue("x-ms-proposed-lease-id")
+	}
+	return req, nil
+}
+
+// isUUID reports whether s is a UUID in its 36-character textual form.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case !strings.ContainsRune("0123456789abcdefABCDEF", c):
+			return false
+		}
+	}
+	return true
+}
+
+// writeLeaseResponse writes the response of a successful lease operation.
+func writeLeaseResponse(w http.ResponseWriter, action LeaseAction, result *LeaseResult) {
+	h := w.Header()
+	h.Set("ETag", result.ETag)
+	h.Set("Last-Modified", formatHTTPDate(result.ModifiedAt))
+	if result.LeaseID != "" {
+		h.Set("x-ms-lease-id", result.LeaseID)
+	}
+
+	switch action {
+	case LeaseActionAcquire:
+		w.WriteHeader(http.StatusCreated)
+	case LeaseActionBreak:
+		h.Set("x-ms-lease-time", strconv.Itoa(result.LeaseTime))
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleLeaseBlob handles PUT /{account}/{container}/{blobName}?comp=lease.
+// x-ms-lease-action selects acquire, renew, change, release or break.
+func (s *BlobService) handleLeaseBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	req, err := parseLeaseRequest(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid lease request")
+		return
+	}
+
+	result, err := s.store.LeaseBlob(r.Context(), account, containerName, blobName, req)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to lease blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Debug("blob lease updated",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("action", string(req.Action)),
+	)
+	writeLeaseResponse(w, req.Action, result)
+}
+
+// handleLeaseContainer handles PUT /{account}/{container}?restype=container&comp=lease.
+func (s *BlobService) handleLeaseContainer(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	req, err := parseLeaseRequest(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid lease request")
+		return
+	}
+
+	result, err := s.store.LeaseContainer(r.Context(), account, containerName, req)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to lease container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	s.logger.Debug("container lease updated",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("action", string(req.Action)),
+	)
+	writeLeaseResponse(w, req.Action, result)
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package blob
+
+import (
+	"os"
+	"syscall"
+)
+
+// hardLinked reports whether the file described by fi has other hard links.
+func hardLinked(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return !ok || st.Nlink > 1
+}
@@ -0,0 +1,441 @@
+package blob
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// maxListResults is the largest page Azure returns from a listing, and the page
+// size when maxresults isn't given.
+const maxListResults = 5000
+
+// maxResultsParam returns the page size requested by the maxresults query
+// parameter of a listing. Larger values are capped at maxListResults, as in Azure.
+func maxResultsParam(query url.Values) (int, error) {
+	if !query.Has("maxresults") {
+		return maxListResults, nil
+	}
+	n, err := strconv.Atoi(query.Get("maxresults"))
+	if err != nil {
+		return 0, errInvalidQueryParameterValue("maxresults")
+	}
+	if n < 1 {
+		return 0, errOutOfRangeQueryParameterValue("maxresults")
+	}
+	return min(n, maxListResults), nil
+}
+
+// containerListMarker returns the NextMarker of a page that ends before container.
+// Container names can't contain slashes, so the marker is <name> or <name>/<version>.
+func containerListMarker(container Container) string {
+	if container.Version == "" {
+		return container.Name
+	}
+	return container.Name + "/" + container.Version
+}
+
+// listedBefore reports whether the entry at name and key is listed before the one
+// at markerName and markerKey. Listings are in name order, and entries that share
+// a name are ordered by key. A live container has no version for a key, so it
+// comes before soft-deleted containers of the same name.
+func listedBefore(name, key, markerName, markerKey string) bool {
+	if name != markerName {
+		return name < markerName
+	}
+	return key < markerKey
+}
+
+func (s *FileBlobStore) ListContainers(ctx context.Context, account string, opts ListContainersOptions) (*ContainerList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keyPrefix := s.containerKey(account, opts.Prefix)
+	var containers []Container
+	for key, entry := range s.containers {
+		if strings.HasPrefix(key, keyPrefix) {
+			containers = append(containers, entry.container)
+		}
+	}
+	if opts.IncludeDeleted {
+		for key, deleted := range s.deletedContainers {
+			if !strings.HasPrefix(key, keyPrefix) {
+				continue
+			}
+			for _, container := range deleted {
+				containers = append(containers, *container)
+			}
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return listedBefore(containers[i].Name, containers[i].Version, containers[j].Name, containers[j].Version)
+	})
+
+	markerName, markerVersion, _ := strings.Cut(opts.Marker, "/")
+	list := &ContainerList{}
+	for _, container := range containers {
+		if listedBefore(container.Name, container.Version, markerName, markerVersion) {
+			continue
+		}
+		if opts.MaxResults > 0 && len(list.Containers) == opts.MaxResults {
+			list.NextMarker = containerListMarker(container)
+			break
+		}
+		list.Containers = append(list.Containers, container)
+	}
+	return list, nil
+}
+
+// handleListContainers handles GET /{account}?comp=list to list the containers of an account.
+func (s *BlobService) handleListContainers(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	query := r.URL.Query()
+
+	maxResults, err := maxResultsParam(query)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid maxresults")
+		return
+	}
+	opts := ListContainersOptions{
+		Prefix:     query.Get("prefix"),
+		Marker:     query.Get("marker"),
+		MaxResults: maxResults,
+	}
+	includeMetadata := false
+	for _, include := range strings.Split(query.Get("include"), ",") {
+		switch strings.TrimSpace(include) {
+		case "", "system":
+		case "metadata":
+			includeMetadata = true
+		case "deleted":
+			opts.IncludeDeleted = true
+		default:
+			s.writeStoreError(w, errInvalidQueryParameterValue("include"), "invalid include")
+			return
+		}
+	}
+
+	list, err := s.store.ListContainers(r.Context(), account, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to list containers",
+			logging.String("account", account),
+		)
+		return
+	}
+
+	result := ContainerListResult{
+		ServiceEndpoint: serviceEndpoint(r, account),
+		Prefix:          opts.Prefix,
+		Marker:          opts.Marker,
+		NextMarker:      list.NextMarker,
+	}
+	if query.Has("maxresults") {
+		result.MaxResults = maxResults
+	}
+	for _, container := range list.Containers {
+		result.Containers.Container = append(result.Containers.Container, newContainerItemXML(container, includeMetadata))
+	}
+	s.writeXML(w, http.StatusOK, result)
+}
+
+// Keys that order the entries listed under a single blob name: snapshots, oldest
+// first, then previous versions, the current blob, a soft-deleted blob and a blob
+// that only has uncommitted blocks. A BlobPrefix has an empty key.
+const (
+	listKeySnapshot    = "0:"
+	listKeyVersion     = "1:"
+	listKeyCurrent     = "2"
+	listKeyDeleted     = "3"
+	listKeyUncommitted = "4"
+)
+
+// blobListEntry is a blob, snapshot or version listed under a blob name.
+type blobListEntry struct {
+	key  string
+	info BlobInfo
+}
+
+// encodeBlobListMarker returns the NextMarker of a List Blobs page that ends
+// before the entry at name and key. Markers are opaque to clients.
+func encodeBlobListMarker(name, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key + "\n" + name))
+}
+
+// decodeBlobListMarker returns the position encoded in a List Blobs marker.
+func decodeBlobListMarker(marker string) (name, key string, err error) {
+	if marker == "" {
+		return "", "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(marker)
+	key, name, ok := strings.Cut(string(data), "\n")
+	if err != nil || !ok {
+		return "", "", errInvalidQueryParameterValue("marker")
+	}
+	return name, key, nil
+}
+
+// delimitedPrefix returns the BlobPrefix a blob is listed under when listing with
+// prefix and delimiter: its name up to and including the first delimiter after
+// prefix. ok is false if the name has no delimiter after prefix.
+func delimitedPrefix(name, prefix, delimiter string) (blobPrefix string, ok bool) {
+	if delimiter == "" {
+		return "", false
+	}
+	i := strings.Index(name[len(prefix):], delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return name[:len(prefix)+i+len(delimiter)], true
+}
+
+// ListBlobs relies on the names under a BlobPrefix sorting together, right after
+// the prefix itself: a listing with a delimiter emits each prefix once, when it
+// reaches the first name under it, and a page that ends at a prefix resumes there.
+func (s *FileBlobStore) ListBlobs(ctx context.Context, account, containerName string, opts ListBlobsOptions) (*BlobList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	markerName, markerKey, err := decodeBlobListMarker(opts.Marker)
+	if err != nil {
+		return nil, err
+	}
+
+	// Any name with a record of some kind is a candidate; names that end up
+	// with nothing to list are skipped below.
+	seen := make(map[string]bool)
+	var names []string
+	addNames := func(name string) {
+		if !seen[name] && strings.HasPrefix(name, opts.Prefix) {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for name := range entry.blobs {
+		addNames(name)
+	}
+	for name := range entry.snapshots {
+		addNames(name)
+	}
+	for name := range entry.versions {
+		addNames(name)
+	}
+	for name := range entry.deleted {
+		addNames(name)
+	}
+	if opts.IncludeUncommitted {
+		for name := range entry.staged {
+			addNames(name)
+		}
+	}
+	sort.Strings(names)
+
+	list := &BlobList{}
+	full := func() bool {
+		return opts.MaxResults > 0 && len(list.Blobs)+len(list.Prefixes) == opts.MaxResults
+	}
+	var lastPrefix string
+	for _, name := range names {
+		entries := listBlobEntries(entry, name, opts)
+		if len(entries) == 0 {
+			continue
+		}
+		if blobPrefix, ok := delimitedPrefix(name, opts.Prefix, opts.Delimiter); ok {
+			if blobPrefix == lastPrefix || listedBefore(blobPrefix, "", markerName, markerKey) {
+				continue
+			}
+			if full() {
+				list.NextMarker = encodeBlobListMarker(blobPrefix, "")
+				return list, nil
+			}
+			list.Prefixes = append(list.Prefixes, blobPrefix)
+			lastPrefix = blobPrefix
+			continue
+		}
+		for _, e := range entries {
+			if listedBefore(name, e.key, markerName, markerKey) {
+				continue
+			}
+			if full() {
+				list.NextMarker = encodeBlobListMarker(name, e.key)
+				return list, nil
+			}
+			list.Blobs = append(list.Blobs, e.info)
+		}
+	}
+	return list, nil
+}
+
+// listBlobEntries returns the entries List Blobs lists under a blob name, in order.
+func listBlobEntries(entry *containerEntry, name string, opts ListBlobsOptions) []blobListEntry {
+	listed := func(records []*blobRecord) []*blobRecord {
+		if opts.IncludeDeleted {
+			return records
+		}
+		return liveRecords(records)
+	}
+	var entries []blobListEntry
+	add := func(key string, record *blobRecord) {
+		entries = append(entries, blobListEntry{key: key, info: BlobInfo{
+			Name:             name,
+			Snapshot:         record.Snapshot,
+			IsCurrentVersion: isCurrentVersion(entry, record),
+			BlobProperties:   record.Properties,
+			Metadata:         record.Metadata,
+			Tags:             record.Tags,
+		}})
+	}
+
+	if opts.IncludeSnapshots {
+		for _, record := range listed(entry.snapshots[name]) {
+			add(listKeySnapshot+record.Snapshot, record)
+		}
+	}
+	if opts.IncludeVersions {
+		for _, record := range listed(entry.versions[name]) {
+			add(listKeyVersion+record.Properties.VersionID, record)
+		}
+	}
+	current := entry.blobs[name]
+	if current != nil {
+		add(listKeyCurrent, current)
+	}
+	if deleted := entry.deleted[name]; deleted != nil && opts.IncludeDeleted {
+		add(listKeyDeleted, deleted)
+	}
+	if staged := entry.staged[name]; staged != nil && current == nil && opts.IncludeUncommitted {
+		// An uncommitted blob has no content or properties yet.
+		entries = append(entries, blobListEntry{key: listKeyUncommitted, info: BlobInfo{
+			Name: name,
+			BlobProperties: BlobProperties{
+				CreatedAt:  staged.LastStagedAt,
+				ModifiedAt: staged.LastStagedAt,
+				BlobType:   BlobTypeBlock,
+			},
+		}})
+	}
+	return entries
+}
+
+// handleListBlobs handles GET /{account}/{container}?restype=container&comp=list to list blobs in a container.
+func (s *BlobService) handleListBlobs(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	query := r.URL.Query()
+
+	if account == "" || containerName == "" {
+		s.writeError(w, http.StatusBadRequest, "InvalidInput", "Account and container name are required")
+		return
+	}
+
+	maxResults, err := maxResultsParam(query)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid maxresults")
+		return
+	}
+	opts := ListBlobsOptions{
+		Prefix:     query.Get("prefix"),
+		Delimiter:  query.Get("delimiter"),
+		Marker:     query.Get("marker"),
+		MaxResults: maxResults,
+	}
+	includeCopy, includeMetadata, includeTags := false, false, false
+	includeImmutability, includeLegalHold := false, false
+	for _, include := range strings.Split(query.Get("include"), ",") {
+		switch include = strings.TrimSpace(include); {
+		case include == "copy":
+			includeCopy = true
+		case include == "metadata":
+			includeMetadata = true
+		case include == "tags":
+			includeTags = true
+		case include == "immutabilitypolicy":
+			includeImmutability = true
+		case include == "legalhold":
+			includeLegalHold = true
+		case include == "snapshots":
+			opts.IncludeSnapshots = true
+		case include == "versions":
+			opts.IncludeVersions = true
+		case include == "deleted":
+			opts.IncludeDeleted = true
+		case include == "uncommittedblobs":
+			opts.IncludeUncommitted = true
+		case include != "" && !listBlobsIncludes[include]:
+			s.writeStoreError(w, errInvalidQueryParameterValue("include"), "invalid include")
+			return
+		}
+	}
+
+	list, err := s.store.ListBlobs(r.Context(), account, containerName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to list blobs",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	result := BlobListResult{
+		ServiceEndpoint: serviceEndpoint(r, account),
+		ContainerName:   containerName,
+		Prefix:          opts.Prefix,
+		Marker:          opts.Marker,
+		Delimiter:       opts.Delimiter,
+		NextMarker:      list.NextMarker,
+	}
+	if query.Has("maxresults") {
+		result.MaxResults = maxResults
+	}
+	for _, blob := range list.Blobs {
+		item := newBlobItemXML(blob)
+		if includeCopy {
+			item.Properties.setCopy(blob.Copy)
+		}
+		if includeMetadata {
+			item.Metadata = blob.Metadata
+		}
+		if includeTags && len(blob.Tags) > 0 {
+			item.Tags = newTagsXML(blob.Tags)
+		}
+		if includeImmutability {
+			item.Properties.setImmutabilityPolicy(blob.ImmutabilityPolicy)
+		}
+		if includeLegalHold {
+			item.Properties.LegalHold = &blob.LegalHold
+		}
+		result.Blobs.Blob = append(result.Blobs.Blob, item)
+	}
+	for _, blobPrefix := range list.Prefixes {
+		result.Blobs.BlobPrefix = append(result.Blobs.BlobPrefix, blobPrefixXML{Name: blobPrefix})
+	}
+
+	s.writeXML(w, http.StatusOK, result)
+}
+
+// listBlobsIncludes are the include values List Blobs accepts. Datasets the
+// emulator doesn't track are accepted and ignored, so SDK requests don't fail.
+var listBlobsIncludes = map[string]bool{
+	"copy":                true,
+	"deleted":             true,
+	"deletedwithversions": true,
+	"immutabilitypolicy":  true,
+	"legalhold":           true,
+	"metadata":            true,
+	"permissions":         true,
+	"snapshots":           true,
+	"tags":                true,
+	"uncommittedblobs":    true,
+	"versions":            true,
+}
@@ -1,24 +1,150 @@
 package blob
 
-import "time"
+import (
+	"io"
+	"time"
+)
 
 // Container represents an Azure Blob Storage container.
 // This is a simplified model that captures the essential properties.
-// TODO: Add more Azure-specific metadata (ETags, lease state, public access level, etc.)
+// TODO: Add more Azure-specific metadata (public access level, etc.)
 type Container struct {
 	// Name is the unique name of the container within an account.
-	Name string
+	Name string `json:"name"`
 
 	// CreatedAt is when the container was created.
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"createdAt"`
+
+	// ModifiedAt is when the container's properties or metadata were last modified.
+	ModifiedAt time.Time `json:"modifiedAt"`
+
+	// ETag is a strong entity tag that changes whenever the container is modified.
+	ETag string `json:"etag"`
+
+	// Lease is the container's lease, if any.
+	Lease Lease `json:"lease,omitempty"`
 
 	// Metadata holds custom key-value pairs associated with the container.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// PublicAccess is the level of anonymous read access to the container.
+	PublicAccess PublicAccess `json:"publicAccess,omitempty"`
+
+	// SignedIdentifiers are the container's stored access policies, at most five.
+	SignedIdentifiers []SignedIdentifier `json:"signedIdentifiers,omitempty"`
+
+	// ImmutabilityPolicy is the container's time-based retention policy, if any.
+	ImmutabilityPolicy *ContainerImmutabilityPolicy `json:"immutabilityPolicy,omitempty"`
+
+	// Version identifies a soft-deleted container among the deleted containers
+	// of the same name. It is empty for a live container.
+	Version string `json:"version,omitempty"`
+
+	// SoftDeleteState is set once the container is soft-deleted.
+	SoftDeleteState
+}
+
+// PublicAccess is a container's public access level: which reads it allows
+// from requests without credentials.
+type PublicAccess string
+
+const (
+	// PublicAccessNone allows no anonymous reads. Azure calls it "off" and
+	// reports it by omitting x-ms-blob-public-access.
+	PublicAccessNone PublicAccess = ""
+
+	// PublicAccessBlob allows anonymous reads of the container's blobs, but not
+	// of the container itself or its blob list.
+	PublicAccessBlob PublicAccess = "blob"
+
+	// PublicAccessContainer allows anonymous reads of the container's properties,
+	// metadata and blob list as well as its blobs.
+	PublicAccessContainer PublicAccess = "container"
+)
+
+// maxSignedIdentifiers is the number of stored access policies a container may have.
+const maxSignedIdentifiers = 5
+
+// SignedIdentifier is a stored access policy: a named start time, expiry and
+// set of permissions that a shared access signature can refer to.
+type SignedIdentifier struct {
+	// ID names the policy; it is at most 64 characters long.
+	ID string `json:"id"`
+
+	// Start and Expiry bound when the policy is valid; zero if unset.
+	Start  time.Time `json:"start"`
+	Expiry time.Time `json:"expiry"`
+
+	// Permission is the policy's permissions in Azure's letter form, e.g. "rwdl".
+	Permission string `json:"permission,omitempty"`
+}
+
+// ContainerACL is the access control list of a container, as set by Set Container ACL.
+type ContainerACL struct {
+	PublicAccess      PublicAccess
+	SignedIdentifiers []SignedIdentifier
+}
+
+// CreateContainerOptions holds the optional parameters of Create Container.
+type CreateContainerOptions struct {
+	// Metadata is the new container's metadata.
 	Metadata map[string]string
+
+	// PublicAccess is the new container's public access level.
+	PublicAccess PublicAccess
+}
+
+// ImmutabilityPolicyMode is the state of an immutability policy. An unlocked
+// policy can be changed or deleted; a locked one can only be extended.
+type ImmutabilityPolicyMode string
+
+const (
+	ImmutabilityPolicyUnlocked ImmutabilityPolicyMode = "Unlocked"
+	ImmutabilityPolicyLocked   ImmutabilityPolicyMode = "Locked"
+)
+
+// ContainerImmutabilityPolicy is a container's time-based retention policy.
+// While it is in effect, a blob in the container can't be modified or deleted
+// until PeriodDays have passed since the blob was created.
+type ContainerImmutabilityPolicy struct {
+	// PeriodDays is the retention period, from 1 to 146000 days.
+	PeriodDays int `json:"periodDays"`
+
+	State ImmutabilityPolicyMode `json:"state"`
+
+	// AllowProtectedAppendWrites lets protected append blobs still be appended to.
+	AllowProtectedAppendWrites bool `json:"allowProtectedAppendWrites,omitempty"`
+}
+
+// ImmutabilityPolicy is the immutability policy of a single blob or version,
+// which can't be modified or deleted until ExpiresOn.
+type ImmutabilityPolicy struct {
+	ExpiresOn time.Time              `json:"expiresOn"`
+	Mode      ImmutabilityPolicyMode `json:"mode"`
+}
+
+// ImmutabilityOptions holds the optional parameters of setting or deleting a
+// blob's immutability policy or legal hold.
+type ImmutabilityOptions struct {
+	// VersionID, if set, selects a previous version of the blob.
+	VersionID string
+
+	// Conditions must hold for the blob or version.
+	Conditions AccessConditions
+}
+
+// SoftDeleteState records when a soft-deleted blob, snapshot, version or
+// container was deleted and how long it is kept before being purged.
+type SoftDeleteState struct {
+	// DeletedTime is when the resource was deleted, nil if it wasn't.
+	DeletedTime *time.Time `json:"deletedTime,omitempty"`
+
+	// RetentionDays is the retention period in effect when it was deleted.
+	RetentionDays int `json:"retentionDays,omitempty"`
 }
 
 // Blob represents a blob (file) stored in Azure Blob Storage.
 // This is a simplified model that captures essential properties.
-// TODO: Add more Azure-specific properties (ETag, Content-MD5, Content-Type, Lease state, etc.)
 type Blob struct {
 	// Name is the blob name (path) within its container.
 	Name string
@@ -29,48 +155,778 @@ type Blob struct {
 	// Account is the storage account name (for multi-account support).
 	Account string
 
-	// Content is the actual blob data.
-	Content []byte
+	// Snapshot is the snapshot timestamp if this is a snapshot, empty for the base blob.
+	Snapshot string
+
+	// IsCurrentVersion is true if this is the current version of a versioned blob.
+	IsCurrentVersion bool
+
+	// Content is an open handle on the blob data, read straight from disk.
+	// It is nil when only properties were requested; otherwise the caller must close it.
+	Content BlobContent
 
-	// ContentType is the MIME type of the blob content.
-	ContentType string
+	// BlobProperties are the system properties of the blob.
+	BlobProperties
+
+	// Metadata holds custom key-value pairs associated with the blob.
+	Metadata map[string]string
+
+	// Tags are the blob's index tags.
+	Tags map[string]string
+}
+
+// BlobContent is a read-only handle on the content of a blob as it was when the
+// blob was opened. Later writes to the blob don't affect an open handle.
+type BlobContent interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// BlobHTTPHeaders are the standard HTTP properties stored with a blob and
+// returned as response headers when it is read.
+type BlobHTTPHeaders struct {
+	ContentType        string `json:"contentType,omitempty"`
+	ContentEncoding    string `json:"contentEncoding,omitempty"`
+	ContentLanguage    string `json:"contentLanguage,omitempty"`
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	CacheControl       string `json:"cacheControl,omitempty"`
+	ContentMD5         []byte `json:"contentMD5,omitempty"`
+}
+
+// BlobProperties are the system properties of a blob.
+// They are persisted alongside the blob content by the store.
+type BlobProperties struct {
+	BlobHTTPHeaders
 
 	// Size is the size of the blob content in bytes.
-	Size int64
+	Size int64 `json:"size"`
 
 	// CreatedAt is when the blob was created.
-	CreatedAt time.Time
+	CreatedAt time.Time `json:"createdAt"`
 
-	// ModifiedAt is when the blob was last modified.
-	ModifiedAt time.Time
+	// ModifiedAt is when the blob content, properties or metadata were last modified.
+	ModifiedAt time.Time `json:"modifiedAt"`
 
-	// Metadata holds custom key-value pairs associated with the blob.
-	Metadata map[string]string
+	// ETag is a strong entity tag that changes whenever the blob is modified.
+	ETag string `json:"etag"`
+
+	// Lease is the blob's lease, if any. Leasing doesn't change the ETag.
+	Lease Lease `json:"lease,omitempty"`
+
+	// BlobType is the type of the blob: a block, append or page blob.
+	BlobType BlobType `json:"blobType,omitempty"`
+
+	// CommittedBlockCount is the number of blocks appended to an append blob.
+	CommittedBlockCount int `json:"committedBlockCount,omitempty"`
+
+	// Sealed is set once an append blob is sealed; it can't be appended to after that.
+	Sealed bool `json:"sealed,omitempty"`
+
+	// SequenceNumber is a page blob's sequence number, which clients may use
+	// to coordinate writes.
+	SequenceNumber int64 `json:"sequenceNumber,omitempty"`
+
+	// AccessTier is a block blob's access tier. Empty means the account's
+	// default tier, Hot, which is reported as inferred.
+	AccessTier AccessTier `json:"accessTier,omitempty"`
+
+	// AccessTierChangedAt is when Set Blob Tier last changed the tier.
+	AccessTierChangedAt time.Time `json:"accessTierChangedAt,omitempty"`
+
+	// Rehydration is the pending move of an archived blob to an online tier, if any.
+	Rehydration *Rehydration `json:"rehydration,omitempty"`
+
+	// ImmutabilityPolicy is the blob's own immutability policy, if any.
+	ImmutabilityPolicy *ImmutabilityPolicy `json:"immutabilityPolicy,omitempty"`
+
+	// LegalHold is set while the blob is under a legal hold, which keeps it from
+	// being modified or deleted until the hold is cleared.
+	LegalHold bool `json:"legalHold,omitempty"`
+
+	// VersionID identifies this version of the blob. It is empty unless the blob
+	// was written while versioning was enabled for its account.
+	VersionID string `json:"versionId,omitempty"`
+
+	// Copy describes the copy that created the blob, if it was written by Copy Blob.
+	Copy *CopyState `json:"copy,omitempty"`
+
+	// SoftDeleteState is set once the blob, snapshot or version is soft-deleted.
+	SoftDeleteState
 }
 
-// BlobListResult represents the result of listing blobs in a container.
-// This mimics Azure's ListBlobs response structure.
-type BlobListResult struct {
-	// Blobs is the list of blobs in the container.
-	Blobs []BlobInfo `json:"Blobs"`
+// BlobType is the type of a blob, as reported in x-ms-blob-type.
+type BlobType string
+
+const (
+	BlobTypeBlock  BlobType = "BlockBlob"
+	BlobTypeAppend BlobType = "AppendBlob"
+	BlobTypePage   BlobType = "PageBlob"
+)
 
-	// Prefix is the prefix used for filtering (if any).
-	Prefix string `json:"Prefix,omitempty"`
+// AccessTier is the access tier of a block blob, as in x-ms-access-tier.
+type AccessTier string
 
-	// Marker is the continuation token for pagination (if any).
-	Marker string `json:"Marker,omitempty"`
+const (
+	AccessTierHot     AccessTier = "Hot"
+	AccessTierCool    AccessTier = "Cool"
+	AccessTierCold    AccessTier = "Cold"
+	AccessTierArchive AccessTier = "Archive"
+)
 
-	// MaxResults is the maximum number of results requested.
-	MaxResults int `json:"MaxResults,omitempty"`
+// RehydratePriority is how soon an archived blob is rehydrated, as in
+// x-ms-rehydrate-priority.
+type RehydratePriority string
+
+const (
+	RehydratePriorityStandard RehydratePriority = "Standard"
+	RehydratePriorityHigh     RehydratePriority = "High"
+)
+
+// Rehydration is an archived blob's pending move to an online tier. The blob
+// stays archived, and unreadable, until CompletesAt.
+type Rehydration struct {
+	Tier        AccessTier        `json:"tier"`
+	Priority    RehydratePriority `json:"priority"`
+	CompletesAt time.Time         `json:"completesAt"`
+}
+
+// SetBlobTierOptions holds the optional parameters of Set Blob Tier.
+type SetBlobTierOptions struct {
+	// RehydratePriority is the priority of a rehydration from the Archive
+	// tier. Empty means Standard.
+	RehydratePriority RehydratePriority
+
+	// Conditions must hold for the blob.
+	Conditions AccessConditions
+}
+
+// CopyStatus is the state of a blob copy, as reported in x-ms-copy-status.
+type CopyStatus string
+
+const (
+	CopyStatusPending CopyStatus = "pending"
+	CopyStatusSuccess CopyStatus = "success"
+	CopyStatusAborted CopyStatus = "aborted"
+	CopyStatusFailed  CopyStatus = "failed"
+)
+
+// CopyState describes the copy that created a blob. It is kept until the blob
+// is replaced by a write other than a copy.
+type CopyState struct {
+	// ID is the x-ms-copy-id of the copy.
+	ID string `json:"id"`
+
+	// Source is the x-ms-copy-source URL the blob was copied from.
+	Source string `json:"source"`
+
+	Status CopyStatus `json:"status"`
+
+	// StatusDescription says why a copy failed.
+	StatusDescription string `json:"statusDescription,omitempty"`
+
+	// BytesCopied and TotalBytes are the progress of the copy. TotalBytes is
+	// -1 while the size of the source is unknown.
+	BytesCopied int64 `json:"bytesCopied"`
+	TotalBytes  int64 `json:"totalBytes"`
+
+	// CompletionTime is when the copy succeeded, failed or was aborted.
+	CompletionTime time.Time `json:"completionTime"`
 }
 
 // BlobInfo is a lightweight representation of a blob used in list operations.
 // It contains only metadata, not the actual content.
 type BlobInfo struct {
-	Name         string            `json:"Name"`
-	ContentType  string            `json:"ContentType,omitempty"`
-	Size         int64             `json:"ContentLength"`
-	LastModified time.Time         `json:"LastModified"`
-	Metadata     map[string]string `json:"Metadata,omitempty"`
+	Name string
+
+	// Snapshot is the snapshot timestamp if this is a snapshot, empty for the base blob.
+	Snapshot string
+
+	// IsCurrentVersion is true if this is the current version of a versioned blob.
+	IsCurrentVersion bool
+
+	BlobProperties
+	Metadata map[string]string
+	Tags     map[string]string
+}
+
+// PutBlobOptions holds the optional properties stored with a blob on upload.
+type PutBlobOptions struct {
+	// HTTPHeaders are the standard HTTP properties of the blob.
+	// An empty ContentType defaults to application/octet-stream.
+	HTTPHeaders BlobHTTPHeaders
+
+	// Metadata holds the blob's x-ms-meta-* key-value pairs.
+	Metadata map[string]string
+
+	// Tags are the blob's index tags (x-ms-tags).
+	Tags map[string]string
+
+	// Tier is a block blob's access tier (x-ms-access-tier); empty means inferred.
+	Tier AccessTier
+
+	// ImmutabilityPolicy and LegalHold protect the new blob
+	// (x-ms-immutability-policy-until-date and -mode, x-ms-legal-hold).
+	ImmutabilityPolicy *ImmutabilityPolicy
+	LegalHold          bool
+
+	// Conditions must hold for the blob being replaced, if any.
+	Conditions AccessConditions
+}
+
+// AppendBlockOptions holds the optional parameters of Append Block.
+type AppendBlockOptions struct {
+	// AppendPosition, if set, requires the blob to be exactly this long before
+	// the append (x-ms-blob-condition-appendpos).
+	AppendPosition *int64
+
+	// MaxSize, if set, requires the blob to be at most this long after the
+	// append (x-ms-blob-condition-maxsize).
+	MaxSize *int64
+
+	// Conditions must hold for the blob being appended to.
+	Conditions AccessConditions
+}
+
+// AppendBlockResult is the outcome of Append Block.
+type AppendBlockResult struct {
+	// AppendOffset is the offset at which the block was appended.
+	AppendOffset int64
+
+	// BlobProperties are the properties of the blob after the append.
+	BlobProperties
+}
+
+// PageSize is the size of a page blob's pages. Page blob sizes and the ranges
+// pages are written to are multiples of it.
+const PageSize = 512
+
+// PageRange is a range of pages of a page blob. Start and End are byte offsets;
+// End is inclusive, as in the REST API.
+type PageRange struct {
+	Start int64
+	End   int64
+}
+
+// CreatePageBlobOptions holds the parameters of creating a page blob.
+type CreatePageBlobOptions struct {
+	PutBlobOptions
+
+	// Size is the size of the blob, a multiple of PageSize.
+	Size int64
+
+	// SequenceNumber is the blob's initial sequence number.
+	SequenceNumber int64
 }
 
+// PageWriteOptions holds the optional parameters of Put Page.
+type PageWriteOptions struct {
+	// IfSequenceNumberLE, IfSequenceNumberLT and IfSequenceNumberEQ, if set,
+	// require the blob's sequence number to be less than or equal to, less
+	// than, or equal to the value (x-ms-if-sequence-number-le/lt/eq).
+	IfSequenceNumberLE *int64
+	IfSequenceNumberLT *int64
+	IfSequenceNumberEQ *int64
+
+	// Conditions must hold for the blob being written.
+	Conditions AccessConditions
+}
+
+// SequenceNumberAction is how Set Blob Properties changes a page blob's
+// sequence number, as sent in x-ms-sequence-number-action.
+type SequenceNumberAction string
+
+const (
+	SequenceNumberMax       SequenceNumberAction = "max"
+	SequenceNumberUpdate    SequenceNumberAction = "update"
+	SequenceNumberIncrement SequenceNumberAction = "increment"
+)
+
+// PageBlobPropertiesOptions holds the parameters of Set Blob Properties on a
+// page blob that resizes it or changes its sequence number.
+type PageBlobPropertiesOptions struct {
+	// HTTPHeaders, if set, replace the blob's HTTP properties.
+	HTTPHeaders *BlobHTTPHeaders
+
+	// Size, if set, is the new size of the blob, a multiple of PageSize.
+	// Pages beyond it are discarded; new pages are empty.
+	Size *int64
+
+	// SequenceNumberAction, if set, changes the sequence number: to the larger
+	// of the current one and SequenceNumber (max), to SequenceNumber (update),
+	// or by one (increment).
+	SequenceNumberAction SequenceNumberAction
+	SequenceNumber       int64
+
+	// Conditions must hold for the blob being updated.
+	Conditions AccessConditions
+}
+
+// GetPageRangesOptions holds the optional parameters of Get Page Ranges.
+type GetPageRangesOptions struct {
+	// Snapshot and VersionID select a snapshot or previous version, as for reads.
+	Snapshot  string
+	VersionID string
+
+	// PrevSnapshot, if set, lists only the pages written or cleared since this
+	// earlier snapshot of the blob.
+	PrevSnapshot string
+
+	// Range, if set, limits the result to pages within it.
+	Range *PageRange
+
+	// Conditions must hold for the blob being listed.
+	Conditions AccessConditions
+}
+
+// PageList is the outcome of Get Page Ranges.
+type PageList struct {
+	// PageRanges are the ranges of pages that hold data, in offset order.
+	PageRanges []PageRange
+
+	// ClearRanges are the ranges of pages cleared since the previous snapshot.
+	// They are only listed for a diff against one.
+	ClearRanges []PageRange
+
+	// Blob holds the properties of the blob the pages belong to.
+	Blob BlobProperties
+}
+
+// GetBlobOptions holds the optional parameters of a blob read.
+type GetBlobOptions struct {
+	// Snapshot, if set, reads the snapshot with this timestamp instead of the base blob.
+	Snapshot string
+
+	// VersionID, if set, reads this version of the blob instead of the current one.
+	VersionID string
+
+	// Conditions must hold for the blob being read.
+	Conditions AccessConditions
+}
+
+// DeleteBlobOptions holds the optional parameters of a blob delete.
+type DeleteBlobOptions struct {
+	// Snapshot, if set, deletes only the snapshot with this timestamp.
+	Snapshot string
+
+	// VersionID, if set, deletes only this previous version of the blob.
+	VersionID string
+
+	// DeleteSnapshots says what happens to the snapshots of the base blob.
+	// A blob that has snapshots can't be deleted without it.
+	DeleteSnapshots DeleteSnapshotsOption
+
+	// Conditions must hold for the blob being deleted.
+	Conditions AccessConditions
+}
+
+// DeleteSnapshotsOption is the x-ms-delete-snapshots value of a blob delete.
+type DeleteSnapshotsOption string
+
+const (
+	// DeleteSnapshotsInclude deletes the base blob and all of its snapshots.
+	DeleteSnapshotsInclude DeleteSnapshotsOption = "include"
+
+	// DeleteSnapshotsOnly deletes the snapshots and keeps the base blob.
+	DeleteSnapshotsOnly DeleteSnapshotsOption = "only"
+)
+
+// SnapshotOptions holds the optional parameters of Snapshot Blob.
+type SnapshotOptions struct {
+	// Metadata, if not nil, replaces the blob's metadata on the snapshot.
+	Metadata map[string]string
+
+	// Conditions must hold for the blob being snapshotted.
+	Conditions AccessConditions
+}
+
+// SnapshotResult is the outcome of Snapshot Blob.
+type SnapshotResult struct {
+	// Snapshot is the timestamp identifying the new snapshot.
+	Snapshot string
+
+	// ETag and ModifiedAt are those of the base blob, which the snapshot shares.
+	ETag       string
+	ModifiedAt time.Time
+}
+
+// ListBlobsOptions holds the optional parameters of List Blobs.
+type ListBlobsOptions struct {
+	// Prefix filters the results to blobs whose names begin with it.
+	Prefix string
+
+	// Delimiter, if set, groups blobs whose names contain it after Prefix into a
+	// single BlobPrefix, named up to and including the delimiter.
+	Delimiter string
+
+	// Marker is the NextMarker of a previous page; the listing resumes there.
+	Marker string
+
+	// MaxResults limits the number of results, counting blobs, snapshots,
+	// versions and prefixes; zero means no limit.
+	MaxResults int
+
+	// IncludeSnapshots lists each blob's snapshots, oldest first, before the blob itself.
+	IncludeSnapshots bool
+
+	// IncludeVersions lists each blob's previous versions, oldest first, after its
+	// snapshots. Blobs whose current version was deleted are listed by their versions.
+	IncludeVersions bool
+
+	// IncludeDeleted lists soft-deleted blobs, and soft-deleted snapshots and
+	// versions along with the live ones.
+	IncludeDeleted bool
+
+	// IncludeUncommitted lists blobs that only have uncommitted blocks.
+	IncludeUncommitted bool
+}
+
+// BlobList is a page of List Blobs results.
+type BlobList struct {
+	// Blobs are the listed blobs, snapshots and versions, in listing order.
+	Blobs []BlobInfo
+
+	// Prefixes are the BlobPrefix entries of a listing with a delimiter, in name order.
+	Prefixes []string
+
+	// NextMarker continues the listing on the next page, empty on the last page.
+	NextMarker string
+}
+
+// ListContainersOptions holds the optional parameters of List Containers.
+type ListContainersOptions struct {
+	// Prefix filters the results to containers whose names begin with it.
+	Prefix string
+
+	// Marker is the NextMarker of a previous page; the listing resumes there.
+	Marker string
+
+	// MaxResults limits the number of results; zero means no limit.
+	MaxResults int
+
+	// IncludeDeleted lists soft-deleted containers after the live container of
+	// the same name, if any.
+	IncludeDeleted bool
+}
+
+// ContainerList is a page of List Containers results.
+type ContainerList struct {
+	// Containers are the listed containers, in name order.
+	Containers []Container
+
+	// NextMarker continues the listing on the next page, empty on the last page.
+	NextMarker string
+}
+
+// CopySource identifies the blob, snapshot or version a copy reads from.
+type CopySource struct {
+	// URL is the source as given in x-ms-copy-source.
+	URL string
+
+	Account   string
+	Container string
+	Blob      string
+
+	// Snapshot or VersionID, if set, select a snapshot or previous version of the blob.
+	Snapshot  string
+	VersionID string
+}
+
+// StartCopyOptions describes the source and destination of an asynchronous copy.
+type StartCopyOptions struct {
+	// SourceURL is the x-ms-copy-source URL of the copy.
+	SourceURL string
+
+	// Size is the size of the source content, or -1 if it isn't known.
+	Size int64
+
+	// HTTPHeaders, Metadata and Tags are stored with the destination blob.
+	HTTPHeaders BlobHTTPHeaders
+	Metadata    map[string]string
+	Tags        map[string]string
+
+	// Tier is the destination's access tier; empty means inferred.
+	Tier AccessTier
+
+	// ImmutabilityPolicy and LegalHold protect the destination blob.
+	ImmutabilityPolicy *ImmutabilityPolicy
+	LegalHold          bool
+
+	// Conditions must hold for the destination blob, if it exists.
+	Conditions AccessConditions
+}
+
+// CopyBlobOptions holds the optional parameters of Copy Blob.
+type CopyBlobOptions struct {
+	// Metadata, if not nil, replaces the source's metadata on the destination.
+	Metadata map[string]string
+
+	// Tags are the destination's index tags. The source's tags aren't copied.
+	Tags map[string]string
+
+	// Tier is the destination's access tier. The source's tier isn't copied.
+	Tier AccessTier
+
+	// ImmutabilityPolicy and LegalHold protect the destination blob
+	// (x-ms-immutability-policy-until-date and -mode, x-ms-legal-hold). The
+	// source's aren't copied.
+	ImmutabilityPolicy *ImmutabilityPolicy
+	LegalHold          bool
+
+	// Conditions must hold for the destination blob, if it exists.
+	Conditions AccessConditions
+}
+
+// SetBlobTagsOptions holds the optional parameters of Set Blob Tags.
+type SetBlobTagsOptions struct {
+	// VersionID, if set, sets the tags of this version instead of the current blob.
+	VersionID string
+
+	// Conditions must hold for the blob or version being tagged.
+	Conditions AccessConditions
+}
+
+// TagCondition is a comparison in a Find Blobs by Tags filter expression, such
+// as "project" = 'bluestack'. A Key of @container compares the container name.
+type TagCondition struct {
+	Key   string
+	Op    string // =, >, >=, < or <=
+	Value string
+}
+
+// FindBlobsByTagsOptions holds the parameters of Find Blobs by Tags.
+type FindBlobsByTagsOptions struct {
+	// Container, if set, limits the search to one container.
+	Container string
+
+	// Where are the conditions a blob's tags must all meet.
+	Where []TagCondition
+
+	// Marker continues a previous search from its NextMarker.
+	Marker string
+
+	// MaxResults is the most blobs to return; 0 means no limit.
+	MaxResults int
+}
+
+// TaggedBlob is a blob found by Find Blobs by Tags.
+type TaggedBlob struct {
+	Container string
+	Name      string
+
+	// Tags are the blob's tags whose keys appear in the filter expression.
+	Tags map[string]string
+}
+
+// TaggedBlobList is a page of Find Blobs by Tags results.
+type TaggedBlobList struct {
+	// Blobs are the matching blobs, ordered by container and then by name.
+	Blobs []TaggedBlob
+
+	// NextMarker continues the search on the next page, empty on the last page.
+	NextMarker string
+}
+
+// ServiceProperties are the account-level settings of the blob service.
+type ServiceProperties struct {
+	// VersioningEnabled makes every overwrite, metadata change and delete keep
+	// the previous version of the blob.
+	VersioningEnabled bool `json:"versioningEnabled,omitempty"`
+
+	// DeleteRetentionPolicy soft-deletes blobs, snapshots and versions instead
+	// of removing them.
+	DeleteRetentionPolicy RetentionPolicy `json:"deleteRetentionPolicy,omitempty"`
+
+	// ContainerDeleteRetentionPolicy soft-deletes containers instead of removing them.
+	ContainerDeleteRetentionPolicy RetentionPolicy `json:"containerDeleteRetentionPolicy,omitempty"`
+
+	// StaticWebsite serves the account's $web container as a website.
+	StaticWebsite StaticWebsite `json:"staticWebsite,omitempty"`
+
+	// Cors are the CORS rules of the account, in the order they are evaluated.
+	// Cross-origin requests are refused while there are none.
+	Cors []CorsRule `json:"cors,omitempty"`
+}
+
+// CorsRule allows cross-origin requests from browsers. A request matches a rule
+// if its origin and method are allowed, and, for a preflight request, every
+// header it asks to send.
+type CorsRule struct {
+	// AllowedOrigins are the origins allowed to make requests, or "*" for any.
+	AllowedOrigins []string `json:"allowedOrigins"`
+
+	// AllowedMethods are the HTTP methods the origins may use.
+	AllowedMethods []string `json:"allowedMethods"`
+
+	// AllowedHeaders are the request headers the origins may send. An entry
+	// ending in "*", such as x-ms-meta-*, allows every header with its prefix.
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+
+	// ExposedHeaders are the response headers browsers may expose to the origins.
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+
+	// MaxAgeInSeconds is how long browsers may cache a preflight response.
+	MaxAgeInSeconds int `json:"maxAgeInSeconds,omitempty"`
+}
+
+// StaticWebsite is an account's static website, served from its $web container
+// on the web endpoint.
+type StaticWebsite struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// IndexDocument is the name of the blob served for a directory, such as
+	// index.html; empty if directories aren't resolved.
+	IndexDocument string `json:"indexDocument,omitempty"`
+
+	// ErrorDocument404Path is the path of the blob served, with 404 Not Found,
+	// when nothing else matches a request; empty for a plain error page.
+	ErrorDocument404Path string `json:"errorDocument404Path,omitempty"`
+}
+
+// RetentionPolicy is a soft delete policy: while it is enabled, deleted data is
+// kept for Days days (1 to 365) and can be restored until then.
+type RetentionPolicy struct {
+	Enabled bool `json:"enabled,omitempty"`
+	Days    int  `json:"days,omitempty"`
+}
+
+// AccessConditions are the If-Match, If-None-Match, If-Modified-Since and
+// If-Unmodified-Since conditions of a request. Stores evaluate them against the
+// current state of a resource atomically with the operation itself.
+// The zero value has no conditions.
+type AccessConditions struct {
+	// IfMatch is a comma-separated list of ETags, or "*" to match any existing resource.
+	IfMatch string
+
+	// IfNoneMatch is a comma-separated list of ETags, or "*" to match any existing resource.
+	IfNoneMatch string
+
+	// IfModifiedSince, if set, requires a modification after this time.
+	IfModifiedSince *time.Time
+
+	// IfUnmodifiedSince, if set, requires no modification after this time.
+	IfUnmodifiedSince *time.Time
+
+	// LeaseID is the x-ms-lease-id of the request. Writes to a resource with an
+	// active lease must carry its ID, and any request that carries one fails
+	// unless it matches the active lease.
+	LeaseID string
+}
+
+// StageBlockOptions holds the optional parameters of Put Block.
+type StageBlockOptions struct {
+	// LeaseID must match the blob's active lease, if it has one.
+	LeaseID string
+}
+
+// Lease is the lease on a blob or container. Its state is derived from the
+// current time, so finite leases expire and break periods end without any
+// further writes.
+type Lease struct {
+	// ID is the current lease ID. It is empty if the resource was never leased
+	// or its lease was released.
+	ID string `json:"id,omitempty"`
+
+	// Duration is the lease duration in seconds, or -1 for an infinite lease.
+	Duration int `json:"duration,omitempty"`
+
+	// ExpiresAt is when a finite lease expires.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+
+	// BrokenAt is set once the lease is broken: the lease is breaking until
+	// this time and broken afterwards.
+	BrokenAt time.Time `json:"brokenAt,omitempty"`
+}
+
+// LeaseState is the state of a lease, as reported in x-ms-lease-state.
+type LeaseState string
+
+const (
+	LeaseStateAvailable LeaseState = "available"
+	LeaseStateLeased    LeaseState = "leased"
+	LeaseStateExpired   LeaseState = "expired"
+	LeaseStateBreaking  LeaseState = "breaking"
+	LeaseStateBroken    LeaseState = "broken"
+)
+
+// LeaseAction is a lease operation, as passed in x-ms-lease-action.
+type LeaseAction string
+
+const (
+	LeaseActionAcquire LeaseAction = "acquire"
+	LeaseActionRenew   LeaseAction = "renew"
+	LeaseActionChange  LeaseAction = "change"
+	LeaseActionRelease LeaseAction = "release"
+	LeaseActionBreak   LeaseAction = "break"
+)
+
+// LeaseRequest is a lease operation on a blob or container.
+type LeaseRequest struct {
+	Action LeaseAction
+
+	// LeaseID is the current lease ID, required by renew, change and release.
+	LeaseID string
+
+	// ProposedLeaseID is the new lease ID for acquire (optional) and change (required).
+	ProposedLeaseID string
+
+	// Duration is the duration of an acquired lease: -1 or 15 to 60 seconds.
+	Duration int
+
+	// BreakPeriod, if set, is how long a broken lease keeps breaking, 0 to 60 seconds.
+	BreakPeriod *int
+
+	// Conditions must hold for the leased resource.
+	Conditions AccessConditions
+}
+
+// LeaseResult is the outcome of a lease operation.
+type LeaseResult struct {
+	// LeaseID is the ID of the lease after the operation; empty after release and break.
+	LeaseID string
+
+	// LeaseTime is the number of seconds until a broken lease is broken.
+	LeaseTime int
+
+	// ETag and ModifiedAt are those of the leased resource.
+	ETag       string
+	ModifiedAt time.Time
+}
+
+// Block describes a block of a block blob, as reported by Get Block List.
+type Block struct {
+	// ID is the base64-encoded block ID supplied by the client.
+	ID string `json:"id"`
+
+	// Size is the size of the block in bytes.
+	Size int64 `json:"size"`
+}
+
+// BlockList holds the committed and uncommitted blocks of a block blob.
+type BlockList struct {
+	Committed   []Block
+	Uncommitted []Block
+
+	// Blob holds the properties of the committed blob, or nil if the blob only
+	// has uncommitted blocks.
+	Blob *BlobProperties
+}
+
+// BlockListSource selects which block list a Put Block List entry is looked up in.
+type BlockListSource string
+
+const (
+	// BlockSourceLatest uses the uncommitted block if one exists, otherwise the committed one.
+	BlockSourceLatest BlockListSource = "Latest"
+
+	// BlockSourceCommitted uses a block from the current committed block list.
+	BlockSourceCommitted BlockListSource = "Committed"
+
+	// BlockSourceUncommitted uses a staged, uncommitted block.
+	BlockSourceUncommitted BlockListSource = "Uncommitted"
+)
+
+// BlockListEntry is one block of the list passed to Put Block List.
+type BlockListEntry struct {
+	ID     string
+	Source BlockListSource
+}
@@ -0,0 +1,101 @@
+package blob
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxBlobNameLength is the longest blob name Azure accepts.
+const maxBlobNameLength = 1024
+
+// reservedContainers are the containers whose names start with "$". Azure
+// creates them for the root of an account, static websites and the change feed.
+var reservedContainers = map[string]bool{
+	"$root":             true,
+	webContainer:        true,
+	changeFeedContainer: true,
+}
+
+// validAccountName reports whether name is a valid Azure storage account name:
+// 3 to 24 lowercase letters and digits.
+func validAccountName(name string) bool {
+	if len(name) < 3 || len(name) > 24 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validContainerName reports whether name is a valid Azure container name: 3 to
+// 63 lowercase letters, digits and hyphens, starting and ending with a letter or
+// digit, without consecutive hyphens. Reserved containers are also allowed.
+func validContainerName(name string) bool {
+	if reservedContainers[name] {
+		return true
+	}
+	if len(name) < 3 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateBlobName returns the error for a blob name Bluestack can't store: one
+// longer than 1024 characters, or with an empty, "." or ".." segment, which
+// would not map onto a file inside the container's directory.
+func validateBlobName(name string) error {
+	if len(name) > maxBlobNameLength {
+		return ErrInvalidResourceName
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return ErrInvalidURI
+		}
+	}
+	return nil
+}
+
+// checkResourceNames is middleware that rejects requests whose account,
+// container or blob name Azure doesn't allow, before they reach the store.
+func (s *BlobService) checkResourceNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validAccountName(chi.URLParam(r, "account")) {
+			s.writeStoreError(w, ErrInvalidResourceName, "")
+			return
+		}
+		if containerName := chi.URLParam(r, "container"); containerName != "" && !validContainerName(containerName) {
+			s.writeStoreError(w, ErrInvalidResourceName, "")
+			return
+		}
+		if strings.HasSuffix(chi.RouteContext(r.Context()).RoutePattern(), "/{container}/*") {
+			if err := validateBlobName(blobNameParam(r)); err != nil {
+				s.writeStoreError(w, err, "")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// joinWithin joins name onto dir, as a path that must lie inside dir. Names are
+// validated before they reach the store; this keeps a name that slipped through
+// from reading or writing anywhere else.
+func joinWithin(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	path := filepath.Join(dir, name)
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", ErrInvalidResourceName
+	}
+	return path, nil
+}
@@ -0,0 +1,1106 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+const (
+	// maxPageBlobSize is the largest page blob: 8 TiB.
+	maxPageBlobSize = 8 << 40
+
+	// maxPutPageSize is the most content a single Put Page may write.
+	maxPutPageSize = 4 << 20
+)
+
+// A page blob's content file is a sparse file as long as the blob: pages that
+// were never written, or were cleared, are holes that read as zeros. Put Page,
+// Clear Pages and resizing change the file in place only while nothing else
+// shares it. Snapshots, versions, soft-deleted copies and copies share content
+// files through hard links, as they do for other blobs, and Get Blob shares it
+// with the handle it returns. A shared file is never changed: the change is
+// applied to a sparse copy of the pages that hold data, which is renamed into
+// place.
+//
+// Which pages hold data is tracked in the blob's record as segments, each
+// tagged with the page write that last touched it. A snapshot remembers how
+// many page writes its blob had seen, so a diff against it is the segments
+// written since.
+
+// pageSegment is a run of pages of a page blob that were last written, or
+// cleared, by the same page write. End is exclusive. Pages that were never
+// written have no segment.
+type pageSegment struct {
+	Start   int64 `json:"start"`
+	End     int64 `json:"end"`
+	Write   int64 `json:"write"`
+	Cleared bool  `json:"cleared,omitempty"`
+}
+
+// setPages returns a copy of segs in which seg replaces whatever covered its pages.
+func setPages(segs []pageSegment, seg pageSegment) []pageSegment {
+	out := make([]pageSegment, 0, len(segs)+2)
+	for _, old := range segs {
+		if old.Start < seg.Start {
+			old.End = min(old.End, seg.Start)
+			out = append(out, old)
+		}
+	}
+	out = append(out, seg)
+	for _, old := range segs {
+		if old.End > seg.End {
+			old.Start = max(old.Start, seg.End)
+			out = append(out, old)
+		}
+	}
+	return out
+}
+
+// truncatePages returns a copy of segs without the pages at or beyond size.
+func truncatePages(segs []pageSegment, size int64) []pageSegment {
+	var out []pageSegment
+	for _, seg := range segs {
+		if seg.Start >= size {
+			break
+		}
+		seg.End = min(seg.End, size)
+		out = append(out, seg)
+	}
+	return out
+}
+
+// compactPages returns a copy of segs with adjacent segments merged, and
+// cleared segments dropped, wherever that makes no difference to a diff
+// against one of the blob's snapshots. marks are the page write counts of
+// those snapshots.
+func compactPages(segs []pageSegment, marks []int64) []pageSegment {
+	// separated reports whether a snapshot was taken between page writes a and b.
+	separated := func(a, b int64) bool {
+		lo, hi := min(a, b), max(a, b)
+		for _, m := range marks {
+			if lo <= m && m < hi {
+				return true
+			}
+		}
+		return false
+	}
+
+	out := make([]pageSegment, 0, len(segs))
+	for _, seg := range segs {
+		if seg.Cleared && !separated(0, seg.Write) {
+			continue
+		}
+		if n := len(out); n > 0 {
+			last := &out[n-1]
+			if last.End == seg.Start && last.Cleared == seg.Cleared && !separated(last.Write, seg.Write) {
+				last.End = seg.End
+				last.Write = max(last.Write, seg.Write)
+				continue
+			}
+		}
+		out = append(out, seg)
+	}
+	return out
+}
+
+// listPages returns the pages of segs within [from, to) that were last touched
+// after page write since: the ranges that hold data and the ranges that were
+// cleared. Adjacent ranges are merged.
+func listPages(segs []pageSegment, since, from, to int64) (pages, cleared []PageRange) {
+	add := func(ranges []PageRange, start, end int64) []PageRange {
+		if n := len(ranges); n > 0 && ranges[n-1].End+1 == start {
+			ranges[n-1].End = end - 1
+			return ranges
+		}
+		return append(ranges, PageRange{Start: start, End: end - 1})
+	}
+	for _, seg := range segs {
+		start, end := max(seg.Start, from), min(seg.End, to)
+		if seg.Write <= since || start >= end {
+			continue
+		}
+		if seg.Cleared {
+			cleared = add(cleared, start, end)
+		} else {
+			pages = add(pages, start, end)
+		}
+	}
+	return pages, cleared
+}
+
+// snapshotPageWrites returns the page write counts of a blob's snapshots.
+func snapshotPageWrites(entry *containerEntry, blobName string) []int64 {
+	var marks []int64
+	for _, snap := range entry.snapshots[blobName] {
+		marks = append(marks, snap.PageWrites)
+	}
+	return marks
+}
+
+// replacePages sets the pages of record, a page blob about to replace
+// existing, to the pages of src that hold data (none if src is nil). They
+// count as a single page write; if existing is a page blob, that write also
+// clears all of its pages, so that diffs against its snapshots see the whole
+// blob change.
+func (s *FileBlobStore) replacePages(entry *containerEntry, record, existing *blobRecord, src []pageSegment) {
+	write := int64(1)
+	var segs []pageSegment
+	if existing != nil && existing.Properties.BlobType == BlobTypePage {
+		write = existing.PageWrites + 1
+		if existing.Properties.Size > 0 {
+			segs = []pageSegment{{End: existing.Properties.Size, Write: write, Cleared: true}}
+		}
+	}
+	for _, seg := range src {
+		if !seg.Cleared {
+			segs = setPages(segs, pageSegment{Start: seg.Start, End: seg.End, Write: write})
+		}
+	}
+	record.Pages = compactPages(truncatePages(segs, record.Properties.Size), snapshotPageWrites(entry, record.Name))
+	record.PageWrites = write
+}
+
+// copyPageBlobFile makes a sparse copy of a page blob's content file at src:
+// a file of the given size at dst, holding the pages of segs that hold data.
+// Unwritten and cleared pages are left as holes.
+func copyPageBlobFile(src, dst string, size int64, segs []pageSegment) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = out.Truncate(size)
+	for _, seg := range truncatePages(segs, size) {
+		if err != nil {
+			break
+		}
+		if !seg.Cleared {
+			_, err = io.Copy(io.NewOffsetWriter(out, seg.Start), io.NewSectionReader(in, seg.Start, seg.End-seg.Start))
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// trackedContent is an open handle on a page blob's content, counted among the
+// blob's readers until it is closed.
+type trackedContent struct {
+	*os.File
+	release sync.Once
+	done    func()
+}
+
+func (c *trackedContent) Close() error {
+	c.release.Do(c.done)
+	return c.File.Close()
+}
+
+// trackReader counts f among the readers of a page blob until it is closed.
+func (s *FileBlobStore) trackReader(account, containerName, blobName string, f *os.File) BlobContent {
+	key := s.containerKey(account, containerName) + "/" + blobName
+	s.readersMu.Lock()
+	s.readers[key]++
+	s.readersMu.Unlock()
+	return &trackedContent{File: f, done: func() {
+		s.readersMu.Lock()
+		defer s.readersMu.Unlock()
+		if s.readers[key]--; s.readers[key] == 0 {
+			delete(s.readers, key)
+		}
+	}}
+}
+
+// pageContentShared reports whether the content file of a page blob at path is
+// shared: hard linked, or open for reading. The caller holds the lock, for
+// reading at least.
+func (s *FileBlobStore) pageContentShared(account, containerName, blobName, path string) (bool, error) {
+	s.readersMu.Lock()
+	readers := s.readers[s.containerKey(account, containerName)+"/"+blobName]
+	s.readersMu.Unlock()
+	if readers > 0 {
+		return true, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return hardLinked(fi), nil
+}
+
+// createSparseFile creates an empty sparse file of the given size at path.
+func createSparseFile(path string, size int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileAt writes the content of the file at src into the file at path,
+// starting at offset.
+func writeFileAt(path, src string, offset int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(io.NewOffsetWriter(f, offset), in)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// clearFileRange turns the bytes in [start, end) of the page blob file at path
+// back into zeros, wherever segs says pages there hold data.
+func clearFileRange(path string, segs []pageSegment, start, end int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		from, to := max(seg.Start, start), min(seg.End, end)
+		if seg.Cleared || from >= to {
+			continue
+		}
+		if err = punchHole(f, from, to-from); err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// zeroRange writes length zero bytes to f at offset. It backs punchHole on
+// file systems that can't deallocate space.
+func zeroRange(f *os.File, offset, length int64) error {
+	zeros := make([]byte, min(length, 64<<10))
+	for length > 0 {
+		n := min(length, int64(len(zeros)))
+		if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// checkPageRange checks that rng covers whole pages of a page blob of the given size.
+func checkPageRange(rng PageRange, size int64) error {
+	if rng.Start%PageSize != 0 || (rng.End+1)%PageSize != 0 || rng.End >= size {
+		return ErrInvalidPageRange
+	}
+	return nil
+}
+
+// check reports whether a page blob with sequence number n meets the
+// sequence number conditions of opts.
+func (opts PageWriteOptions) check(n int64) error {
+	switch {
+	case opts.IfSequenceNumberLE != nil && n > *opts.IfSequenceNumberLE,
+		opts.IfSequenceNumberLT != nil && n >= *opts.IfSequenceNumberLT,
+		opts.IfSequenceNumberEQ != nil && n != *opts.IfSequenceNumberEQ:
+		return ErrSequenceNumberConditionNotMet
+	}
+	return nil
+}
+
+func (s *FileBlobStore) CreatePageBlob(ctx context.Context, account, containerName, blobName string, opts CreatePageBlobOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return nil, err
+	}
+	existing := entry.blobs[blobName]
+	if err := checkBlobWrite(opts.Conditions, existing); err != nil {
+		return nil, err
+	}
+	if err := entry.checkImmutable(existing, false, time.Now()); err != nil {
+		return nil, err
+	}
+
+	tmpPath := filepath.Join(s.baseDir, tmpDirName, "page-"+newUUID())
+	if err := createSparseFile(tmpPath, opts.Size); err != nil {
+		return nil, fmt.Errorf("failed to create page blob: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	headers := opts.HTTPHeaders
+	if headers.ContentType == "" {
+		headers.ContentType = "application/octet-stream"
+	}
+	metadata := opts.Metadata
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	record := &blobRecord{
+		Name: blobName,
+		Properties: BlobProperties{
+			BlobHTTPHeaders: headers,
+			Size:            opts.Size,
+			BlobType:        BlobTypePage,
+			SequenceNumber:  opts.SequenceNumber,
+
+			ImmutabilityPolicy: opts.ImmutabilityPolicy,
+			LegalHold:          opts.LegalHold,
+		},
+		Metadata: metadata,
+		Tags:     opts.Tags,
+	}
+	s.replacePages(entry, record, existing, nil)
+	return s.replaceBlob(entry, account, containerName, existing, tmpPath, record, time.Now().UTC())
+}
+
+// pageBlob returns the record of a page blob that may be written to with
+// conds: it must exist, be a page blob, meet conds and not be protected by an
+// immutability policy or legal hold. The caller holds the lock.
+func (s *FileBlobStore) pageBlob(account, containerName, blobName string, conds AccessConditions) (*blobRecord, error) {
+	record, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(conds, record, true); err != nil {
+		return nil, err
+	}
+	if record.Properties.BlobType != BlobTypePage {
+		return nil, ErrInvalidBlobType
+	}
+	if record.Properties.Copy.pending() {
+		return nil, ErrPendingCopyOperation
+	}
+	if err := s.containers[s.containerKey(account, containerName)].checkImmutable(record, false, time.Now()); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// writePages applies a page write of rng to a page blob with write, and
+// records it. A content file that isn't shared is written in place. A shared
+// one is copied first, and the copy, with write applied, replaces it. Like the
+// content of a block list commit, the copy is made without the write lock, and
+// made again if the blob changes meanwhile.
+func (s *FileBlobStore) writePages(ctx context.Context, account, containerName, blobName string, rng PageRange, opts PageWriteOptions, cleared bool, write func(path string, segs []pageSegment) error) (*BlobProperties, error) {
+	for attempt := 0; attempt < maxOptimisticAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		props, retry, err := s.writePagesOnce(account, containerName, blobName, rng, opts, cleared, write, false)
+		if !retry {
+			return props, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	props, _, err := s.writePagesOnce(account, containerName, blobName, rng, opts, cleared, write, true)
+	return props, err
+}
+
+// writePagesOnce makes one attempt at a page write. The bool result is true if
+// the blob changed while its shared content was copied, and the write must be
+// retried. With locked set, the copy is made under the write lock instead, and
+// the write can't need a retry.
+func (s *FileBlobStore) writePagesOnce(account, containerName, blobName string, rng PageRange, opts PageWriteOptions, cleared bool, write func(path string, segs []pageSegment) error, locked bool) (*BlobProperties, bool, error) {
+	var tmpPath, copiedETag string
+	if !locked {
+		var err error
+		if tmpPath, copiedETag, err = s.copySharedPages(account, containerName, blobName, rng, opts); err != nil {
+			return nil, false, err
+		}
+		if tmpPath != "" {
+			defer os.Remove(tmpPath)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, blobPath, shared, err := s.pageWriteTarget(account, containerName, blobName, rng, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	target := blobPath
+	switch {
+	case !shared:
+		// Nothing else sees the file, so it is written in place.
+	case tmpPath != "" && current.Properties.ETag == copiedETag:
+		target = tmpPath
+	case !locked:
+		return nil, true, nil
+	default:
+		tmpPath = filepath.Join(s.baseDir, tmpDirName, "page-"+newUUID())
+		if err := copyPageBlobFile(blobPath, tmpPath, current.Properties.Size, current.Pages); err != nil {
+			return nil, false, fmt.Errorf("failed to write pages: %w", err)
+		}
+		defer os.Remove(tmpPath)
+		target = tmpPath
+	}
+	if err := write(target, current.Pages); err != nil {
+		return nil, false, fmt.Errorf("failed to write pages: %w", err)
+	}
+	if target != blobPath {
+		if err := os.Rename(target, blobPath); err != nil {
+			return nil, false, fmt.Errorf("failed to write pages: %w", err)
+		}
+	}
+
+	entry := s.containers[s.containerKey(account, containerName)]
+	record := *current
+	record.PageWrites++
+	record.Pages = compactPages(setPages(current.Pages, pageSegment{
+		Start:   rng.Start,
+		End:     rng.End + 1,
+		Write:   record.PageWrites,
+		Cleared: cleared,
+	}), snapshotPageWrites(entry, blobName))
+	record.Properties.ModifiedAt = time.Now().UTC()
+	record.Properties.ETag = newETag()
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, false, err
+	}
+	entry.blobs[blobName] = &record
+
+	props := record.Properties
+	return &props, false, nil
+}
+
+// copySharedPages copies the content file of a page blob about to be written,
+// if it is shared, without holding the write lock. It returns the path of the
+// copy, "" if none was needed, and the ETag of the blob it was copied from.
+func (s *FileBlobStore) copySharedPages(account, containerName, blobName string, rng PageRange, opts PageWriteOptions) (string, string, error) {
+	s.mu.RLock()
+	current, blobPath, shared, err := s.pageWriteTarget(account, containerName, blobName, rng, opts)
+	s.mu.RUnlock()
+	if err != nil || !shared {
+		return "", "", err
+	}
+
+	// A write meanwhile may leave the copy torn, but it also changes the ETag,
+	// so the copy is then thrown away.
+	tmpPath := filepath.Join(s.baseDir, tmpDirName, "page-"+newUUID())
+	if err := copyPageBlobFile(blobPath, tmpPath, current.Properties.Size, current.Pages); err != nil {
+		return "", "", fmt.Errorf("failed to write pages: %w", err)
+	}
+	return tmpPath, current.Properties.ETag, nil
+}
+
+// pageWriteTarget checks a page write of rng against a page blob, and returns
+// the blob's record, the path of its content file and whether the file is
+// shared. The caller holds the lock, for reading at least.
+func (s *FileBlobStore) pageWriteTarget(account, containerName, blobName string, rng PageRange, opts PageWriteOptions) (*blobRecord, string, bool, error) {
+	current, err := s.pageBlob(account, containerName, blobName, opts.Conditions)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if err := opts.check(current.Properties.SequenceNumber); err != nil {
+		return nil, "", false, err
+	}
+	if err := checkPageRange(rng, current.Properties.Size); err != nil {
+		return nil, "", false, err
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, "", false, err
+	}
+	shared, err := s.pageContentShared(account, containerName, blobName, blobPath)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to write pages: %w", err)
+	}
+	return current, blobPath, shared, nil
+}
+
+func (s *FileBlobStore) UploadPages(ctx context.Context, account, containerName, blobName string, rng PageRange, content io.Reader, opts PageWriteOptions) (*BlobProperties, error) {
+	length := rng.End - rng.Start + 1
+	if length > maxPutPageSize {
+		return nil, ErrRequestBodyTooLarge
+	}
+	// As with Put Blob, the content is spooled before taking the lock.
+	tmpPath, size, err := s.spoolTemp(io.LimitReader(content, length+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pages: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	if size != length {
+		return nil, errInvalidHeaderValue("Content-Length")
+	}
+
+	return s.writePages(ctx, account, containerName, blobName, rng, opts, false, func(path string, _ []pageSegment) error {
+		return writeFileAt(path, tmpPath, rng.Start)
+	})
+}
+
+func (s *FileBlobStore) ClearPages(ctx context.Context, account, containerName, blobName string, rng PageRange, opts PageWriteOptions) (*BlobProperties, error) {
+	return s.writePages(ctx, account, containerName, blobName, rng, opts, true, func(path string, segs []pageSegment) error {
+		return clearFileRange(path, segs, rng.Start, rng.End+1)
+	})
+}
+
+func (s *FileBlobStore) GetPageRanges(ctx context.Context, account, containerName, blobName string, opts GetPageRangesOptions) (*PageList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, _, err := s.readableBlob(account, containerName, blobName, opts.Snapshot, opts.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, record, false); err != nil {
+		return nil, err
+	}
+	if record.Properties.BlobType != BlobTypePage {
+		return nil, ErrInvalidBlobType
+	}
+
+	var since int64
+	if opts.PrevSnapshot != "" {
+		if opts.Snapshot != "" && opts.PrevSnapshot > opts.Snapshot {
+			return nil, ErrPreviousSnapshotCannotBeNewer
+		}
+		entry := s.containers[s.containerKey(account, containerName)]
+		prev := findSnapshot(entry.snapshots[blobName], opts.PrevSnapshot)
+		if prev == nil || prev.Properties.BlobType != BlobTypePage {
+			return nil, ErrPreviousSnapshotNotFound
+		}
+		since = prev.PageWrites
+	}
+
+	from, to := int64(0), record.Properties.Size
+	if opts.Range != nil {
+		from, to = max(from, opts.Range.Start), min(to, opts.Range.End+1)
+	}
+	list := &PageList{Blob: record.Properties}
+	pages, cleared := listPages(record.Pages, since, from, to)
+	list.PageRanges = pages
+	if opts.PrevSnapshot != "" {
+		list.ClearRanges = cleared
+	}
+	return list, nil
+}
+
+func (s *FileBlobStore) SetPageBlobProperties(ctx context.Context, account, containerName, blobName string, opts PageBlobPropertiesOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.pageBlob(account, containerName, blobName, opts.Conditions)
+	if err != nil {
+		return nil, err
+	}
+
+	record := *current
+	switch opts.SequenceNumberAction {
+	case SequenceNumberMax:
+		record.Properties.SequenceNumber = max(record.Properties.SequenceNumber, opts.SequenceNumber)
+	case SequenceNumberUpdate:
+		record.Properties.SequenceNumber = opts.SequenceNumber
+	case SequenceNumberIncrement:
+		if record.Properties.SequenceNumber == math.MaxInt64 {
+			return nil, ErrSequenceNumberIncrementTooLarge
+		}
+		record.Properties.SequenceNumber++
+	}
+	if opts.HTTPHeaders != nil {
+		record.Properties.BlobHTTPHeaders = *opts.HTTPHeaders
+		// As in Azure, setting the properties of a copied blob drops its copy state.
+		record.Properties.Copy = nil
+	}
+	if opts.Size != nil {
+		// The file is resized first: if the record can't be written after,
+		// recovery takes the size from the file. A shared file is replaced by a
+		// resized copy instead.
+		blobPath, err := s.blobPath(account, containerName, blobName)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := s.pageContentShared(account, containerName, blobName, blobPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize blob: %w", err)
+		}
+		if !shared {
+			if err := os.Truncate(blobPath, *opts.Size); err != nil {
+				return nil, fmt.Errorf("failed to resize blob: %w", err)
+			}
+		} else {
+			tmpPath := filepath.Join(s.baseDir, tmpDirName, "page-"+newUUID())
+			if err := copyPageBlobFile(blobPath, tmpPath, *opts.Size, current.Pages); err != nil {
+				return nil, fmt.Errorf("failed to resize blob: %w", err)
+			}
+			defer os.Remove(tmpPath)
+			if err := os.Rename(tmpPath, blobPath); err != nil {
+				return nil, fmt.Errorf("failed to resize blob: %w", err)
+			}
+		}
+		record.Properties.Size = *opts.Size
+		record.Pages = truncatePages(record.Pages, *opts.Size)
+	}
+	record.Properties.ModifiedAt = time.Now().UTC()
+	record.Properties.ETag = newETag()
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &record
+
+	props := record.Properties
+	return &props, nil
+}
+
+// parsePageRange reads the range of a Put Page or Get Page Ranges request from
+// x-ms-range or Range, in the form "bytes=start-end". x-ms-range takes
+// precedence. ok is false if neither header is present.
+func parsePageRange(h http.Header) (rng PageRange, ok bool, err error) {
+	header := "x-ms-range"
+	value := h.Get(header)
+	if value == "" {
+		header = "Range"
+		value = h.Get(header)
+	}
+	if value == "" {
+		return PageRange{}, false, nil
+	}
+
+	spec, found := strings.CutPrefix(strings.TrimSpace(value), "bytes=")
+	first, last, cut := strings.Cut(spec, "-")
+	start, startErr := strconv.ParseInt(first, 10, 64)
+	end, endErr := strconv.ParseInt(last, 10, 64)
+	if !found || !cut || startErr != nil || endErr != nil || start < 0 || end < start {
+		return PageRange{}, false, errInvalidHeaderValue(header)
+	}
+	return PageRange{Start: start, End: end}, true, nil
+}
+
+// parsePageBlobSize reads the size of a page blob from x-ms-blob-content-length.
+func parsePageBlobSize(h http.Header) (int64, error) {
+	const header = "x-ms-blob-content-length"
+	value := h.Get(header)
+	if value == "" {
+		return 0, errMissingRequiredHeader(header)
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 || size%PageSize != 0 || size > maxPageBlobSize {
+		return 0, errInvalidHeaderValue(header)
+	}
+	return size, nil
+}
+
+// parseSequenceNumber reads a sequence number from a header; it is nil if the
+// header is absent.
+func parseSequenceNumber(h http.Header, header string) (*int64, error) {
+	value := h.Get(header)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return nil, errInvalidHeaderValue(header)
+	}
+	return &n, nil
+}
+
+// parsePageWriteOptions reads the conditions of Put Page from its request headers.
+func parsePageWriteOptions(h http.Header) (PageWriteOptions, error) {
+	conds, err := parseAccessConditions(h)
+	if err != nil {
+		return PageWriteOptions{}, err
+	}
+	opts := PageWriteOptions{Conditions: conds}
+	for _, c := range []struct {
+		header string
+		value  **int64
+	}{
+		{"x-ms-if-sequence-number-le", &opts.IfSequenceNumberLE},
+		{"x-ms-if-sequence-number-lt", &opts.IfSequenceNumberLT},
+		{"x-ms-if-sequence-number-eq", &opts.IfSequenceNumberEQ},
+	} {
+		if *c.value, err = parseSequenceNumber(h, c.header); err != nil {
+			return PageWriteOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// setSequenceNumberHeader reports a page blob's sequence number.
+func setSequenceNumberHeader(h http.Header, props *BlobProperties) {
+	h.Set("x-ms-blob-sequence-number", strconv.FormatInt(props.SequenceNumber, 10))
+}
+
+// pageListXML is the body of Get Page Ranges. Page and clear ranges are listed
+// together in offset order, each element named after its kind.
+type pageListXML struct {
+	XMLName xml.Name `xml:"PageList"`
+	Ranges  []pageRangeXML
+}
+
+// pageRangeXML is a <PageRange> or <ClearRange> in a page list.
+type pageRangeXML struct {
+	XMLName xml.Name
+	Start   int64 `xml:"Start"`
+	End     int64 `xml:"End"`
+}
+
+// newPageListXML converts a page list into its Get Page Ranges representation.
+func newPageListXML(list *PageList) pageListXML {
+	body := pageListXML{}
+	pages, cleared := list.PageRanges, list.ClearRanges
+	for len(pages) > 0 || len(cleared) > 0 {
+		name := "PageRange"
+		var rng PageRange
+		if len(cleared) == 0 || (len(pages) > 0 && pages[0].Start < cleared[0].Start) {
+			rng, pages = pages[0], pages[1:]
+		} else {
+			name = "ClearRange"
+			rng, cleared = cleared[0], cleared[1:]
+		}
+		body.Ranges = append(body.Ranges, pageRangeXML{XMLName: xml.Name{Local: name}, Start: rng.Start, End: rng.End})
+	}
+	return body
+}
+
+// handleCreatePageBlob handles PUT /{account}/{container}/{blobName} with
+// x-ms-blob-type: PageBlob. It creates a page blob of x-ms-blob-content-length
+// bytes with no pages written, so the request must not have a body.
+func (s *BlobService) handleCreatePageBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	if r.ContentLength > 0 {
+		s.writeStoreError(w, errInvalidHeaderValue("Content-Length"), "")
+		return
+	}
+	size, err := parsePageBlobSize(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid page blob size")
+		return
+	}
+	sequenceNumber, err := parseSequenceNumber(r.Header, "x-ms-blob-sequence-number")
+	if err != nil {
+		s.writeStoreError(w, err, "invalid sequence number")
+		return
+	}
+	headers, err := parseBlobHTTPHeaders(r.Header, true)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob properties")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	tags, err := parseTagsHeader(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+	policy, err := parseImmutabilityPolicy(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid immutability policy")
+		return
+	}
+	legalHold, _, err := parseLegalHold(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid legal hold")
+		return
+	}
+
+	opts := CreatePageBlobOptions{
+		PutBlobOptions: PutBlobOptions{
+			HTTPHeaders: headers,
+			Metadata:    parseMetadata(r.Header),
+			Tags:        tags,
+			Conditions:  conds,
+
+			ImmutabilityPolicy: policy,
+			LegalHold:          legalHold,
+		},
+		Size: size,
+	}
+	if sequenceNumber != nil {
+		opts.SequenceNumber = *sequenceNumber
+	}
+	props, err := s.store.CreatePageBlob(r.Context(), account, containerName, blobName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to create page blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobCreated, "PutBlob", props)
+	s.logger.Info("page blob created",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Int64("size", size),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setVersionIDHeader(w, props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handlePutPage handles PUT /{account}/{container}/{blobName}?comp=page. With
+// x-ms-page-write: update the body is written to the pages in the range; with
+// x-ms-page-write: clear the pages are emptied.
+func (s *BlobService) handlePutPage(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	opts, err := parsePageWriteOptions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	rng, ok, err := parsePageRange(r.Header)
+	if err == nil && !ok {
+		err = errMissingRequiredHeader("Range")
+	}
+	if err != nil {
+		s.writeStoreError(w, err, "invalid page range")
+		return
+	}
+
+	var props *BlobProperties
+	body := &requestBody{ReadCloser: r.Body}
+	pageWrite := strings.ToLower(r.Header.Get("x-ms-page-write"))
+	switch pageWrite {
+	case "update":
+		length := rng.End - rng.Start + 1
+		if length > maxPutPageSize {
+			s.writeStoreError(w, ErrRequestBodyTooLarge, "")
+			return
+		}
+		if r.ContentLength != length {
+			s.writeStoreError(w, errInvalidHeaderValue("Content-Length"), "")
+			return
+		}
+		props, err = s.store.UploadPages(r.Context(), account, containerName, blobName, rng, body, opts)
+	case "clear":
+		if r.ContentLength > 0 {
+			s.writeStoreError(w, errInvalidHeaderValue("Content-Length"), "")
+			return
+		}
+		props, err = s.store.ClearPages(r.Context(), account, containerName, blobName, rng, opts)
+	case "":
+		s.writeStoreError(w, errMissingRequiredHeader("x-ms-page-write"), "")
+		return
+	default:
+		s.writeStoreError(w, errInvalidHeaderValue("x-ms-page-write"), "")
+		return
+	}
+	if err != nil {
+		if body.err != nil {
+			s.writeError(w, http.StatusBadRequest, "InvalidInput", "Failed to read request body")
+			return
+		}
+		s.writeStoreError(w, err, "failed to put pages",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Debug("pages written",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("page_write", pageWrite),
+		logging.Int64("start", rng.Start),
+		logging.Int64("end", rng.End),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setSequenceNumberHeader(w.Header(), props)
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleGetPageRanges handles GET /{account}/{container}/{blobName}?comp=pagelist.
+// With ?prevsnapshot= it lists the pages written and cleared since that
+// snapshot instead of all the pages that hold data.
+func (s *BlobService) handleGetPageRanges(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "invalid snapshot or version")
+		return
+	}
+	prevSnapshot, err := timestampParam(r.URL.Query(), "prevsnapshot")
+	if err != nil {
+		s.writeStoreError(w, err, "invalid previous snapshot")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	opts := GetPageRangesOptions{
+		Snapshot:     snapshot,
+		VersionID:    versionID,
+		PrevSnapshot: prevSnapshot,
+		Conditions:   conds,
+	}
+	rng, ok, err := parsePageRange(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid page range")
+		return
+	}
+	if ok {
+		opts.Range = &rng
+	}
+
+	list, err := s.store.GetPageRanges(r.Context(), account, containerName, blobName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get page ranges",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	w.Header().Set("ETag", list.Blob.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(list.Blob.ModifiedAt))
+	w.Header().Set("x-ms-blob-content-length", strconv.FormatInt(list.Blob.Size, 10))
+	s.writeXML(w, http.StatusOK, newPageListXML(list))
+}
+
+// isPageBlobPropertiesRequest reports whether a Set Blob Properties request
+// resizes a page blob or changes its sequence number.
+func isPageBlobPropertiesRequest(h http.Header) bool {
+	return h.Get("x-ms-blob-content-length") != "" || h.Get("x-ms-sequence-number-action") != ""
+}
+
+// hasBlobHTTPHeaders reports whether a request sets any HTTP property of a blob.
+func hasBlobHTTPHeaders(h http.Header) bool {
+	for _, name := range []string{"Content-Type", "Content-Encoding", "Content-Language", "Content-Disposition", "Cache-Control", "Content-MD5"} {
+		if h.Get("x-ms-blob-"+name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSetPageBlobProperties handles PUT /{account}/{container}/{blobName}?comp=properties
+// with x-ms-blob-content-length or x-ms-sequence-number-action. Unlike a plain
+// Set Blob Properties, it leaves the HTTP properties alone unless the request
+// sets at least one of them.
+func (s *BlobService) handleSetPageBlobProperties(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	opts := PageBlobPropertiesOptions{Conditions: conds}
+	if hasBlobHTTPHeaders(r.Header) {
+		headers, err := parseBlobHTTPHeaders(r.Header, false)
+		if err != nil {
+			s.writeStoreError(w, err, "invalid blob properties")
+			return
+		}
+		opts.HTTPHeaders = &headers
+	}
+	if r.Header.Get("x-ms-blob-content-length") != "" {
+		size, err := parsePageBlobSize(r.Header)
+		if err != nil {
+			s.writeStoreError(w, err, "invalid page blob size")
+			return
+		}
+		opts.Size = &size
+	}
+	if action := r.Header.Get("x-ms-sequence-number-action"); action != "" {
+		opts.SequenceNumberAction = SequenceNumberAction(strings.ToLower(action))
+		n, err := parseSequenceNumber(r.Header, "x-ms-blob-sequence-number")
+		switch {
+		case err != nil:
+		case opts.SequenceNumberAction == SequenceNumberMax, opts.SequenceNumberAction == SequenceNumberUpdate:
+			if n == nil {
+				err = errMissingRequiredHeader("x-ms-blob-sequence-number")
+			} else {
+				opts.SequenceNumber = *n
+			}
+		case opts.SequenceNumberAction == SequenceNumberIncrement:
+			if n != nil {
+				err = errInvalidHeaderValue("x-ms-blob-sequence-number")
+			}
+		default:
+			err = errInvalidHeaderValue("x-ms-sequence-number-action")
+		}
+		if err != nil {
+			s.writeStoreError(w, err, "invalid sequence number")
+			return
+		}
+	}
+
+	props, err := s.store.SetPageBlobProperties(r.Context(), account, containerName, blobName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set page blob properties",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobPropertiesUpdated, "SetBlobProperties", props)
+	s.logger.Info("page blob properties set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Int64("size", props.Size),
+		logging.Int64("sequence_number", props.SequenceNumber),
+	)
+	w.Header().Set("ETag", props.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(props.ModifiedAt))
+	setSequenceNumberHeader(w.Header(), props)
+	w.WriteHeader(http.StatusOK)
+}
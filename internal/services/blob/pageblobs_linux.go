@@ -0,0 +1,21 @@
+package blob
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate modes, from linux/falloc.h.
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// punchHole deallocates length bytes of f at offset, leaving a hole that reads
+// as zeros. File systems that can't punch holes get zeros written instead.
+func punchHole(f *os.File, offset, length int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length); err == nil {
+		return nil
+	}
+	return zeroRange(f, offset, length)
+}
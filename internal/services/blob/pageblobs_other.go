@@ -0,0 +1,10 @@
+//go:build !linux
+
+package blob
+
+import "os"
+
+// punchHole zeros length bytes of f at offset. Only Linux deallocates them.
+func punchHole(f *os.File, offset, length int64) error {
+	return zeroRange(f, offset, length)
+}
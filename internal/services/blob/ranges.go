@@ -0,0 +1,112 @@
+package blob
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxRangeMD5Size is the largest range for which x-ms-range-get-content-md5 or
+// x-ms-range-get-content-crc64 may be requested.
+const maxRangeMD5Size = 4 << 20
+
+// byteRange is an inclusive range of bytes within a blob.
+type byteRange struct {
+	start, end int64
+}
+
+// length returns the number of bytes in the range.
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+// contentRange formats the range as a Content-Range header value.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// requestedRange returns the range a read request asked for, resolved against a
+// blob of the given size. x-ms-range takes precedence over Range. ok is false if
+// neither header is present.
+//
+// Only a single range is supported: "bytes=start-end", "bytes=start-" or the
+// suffix form "bytes=-count". An end beyond the blob is clamped to its last byte;
+// a range that starts beyond it yields ErrInvalidRange.
+func requestedRange(h http.Header, size int64) (rng byteRange, ok bool, err error) {
+	header := "x-ms-range"
+	value := h.Get(header)
+	if value == "" {
+		header = "Range"
+		value = h.Get(header)
+	}
+	if value == "" {
+		return byteRange{}, false, nil
+	}
+
+	spec, found := strings.CutPrefix(strings.TrimSpace(value), "bytes=")
+	if !found || spec == "" || strings.Contains(spec, ",") {
+		return byteRange{}, false, errInvalidHeaderValue(header)
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return byteRange{}, false, errInvalidHeaderValue(header)
+	}
+
+	if first == "" {
+		// Suffix range: the last count bytes.
+		count, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || count < 0 {
+			return byteRange{}, false, errInvalidHeaderValue(header)
+		}
+		if count == 0 || size == 0 {
+			return byteRange{}, false, ErrInvalidRange
+		}
+		if count > size {
+			count = size
+		}
+		return byteRange{start: size - count, end: size - 1}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, errInvalidHeaderValue(header)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false, errInvalidHeaderValue(header)
+		}
+	}
+	if start >= size {
+		return byteRange{}, false, ErrInvalidRange
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return byteRange{start: start, end: end}, true, nil
+}
+
+// rangeContentMD5 returns the base64 MD5 hash of a range of content, as returned
+// for x-ms-range-get-content-md5.
+func rangeContentMD5(content io.ReaderAt, rng byteRange) (string, error) {
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(content, rng.start, rng.length())); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// rangeContentCRC64 returns the base64 CRC64 of a range of content, as returned
+// for x-ms-range-get-content-crc64.
+func rangeContentCRC64(content io.ReaderAt, rng byteRange) (string, error) {
+	hash := crc64.New(crc64Table)
+	if _, err := io.Copy(hash, io.NewSectionReader(content, rng.start, rng.length())); err != nil {
+		return "", err
+	}
+	return encodeCRC64(hash.Sum64()), nil
+}
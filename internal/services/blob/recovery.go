@@ -0,0 +1,547 @@
+package blob
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecoveryReport summarizes what NewFileBlobStore found when it loaded existing
+// data from DATA_DIR.
+type RecoveryReport struct {
+	// Containers is the number of containers loaded.
+	Containers int
+
+	// Blobs is the number of blobs loaded.
+	Blobs int
+
+	// Snapshots is the number of blob snapshots loaded.
+	Snapshots int
+
+	// Versions is the number of previous blob versions loaded.
+	Versions int
+
+	// SoftDeleted is the number of soft-deleted blobs, snapshots, versions and
+	// containers loaded. Snapshots and versions are also counted above.
+	SoftDeleted int
+
+	// Repaired lists entries whose records were missing or inconsistent and were
+	// rebuilt from the content on disk.
+	Repaired []string
+
+	// Quarantined lists corrupt or orphaned entries that were moved to
+	// DATA_DIR/blob/.quarantine/<timestamp>/ instead of being loaded.
+	Quarantined []string
+}
+
+// RecoveryReport returns the outcome of the startup scan of the data directory.
+func (s *FileBlobStore) RecoveryReport() RecoveryReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recovery
+}
+
+// recover rebuilds the in-memory index from the data directory.
+// Layout:
+//   - <account>/<container>/<blobName> - blob content
+//   - .meta/<account>/<container>/container.json - container record
+//   - .meta/<account>/<container>/blobs/<hh>/<hash>/blob.json - blob record
+//   - .meta/<account>/<container>/blobs/<hh>/<hash>/blocks.json, blocks/ - uncommitted blocks
+//   - .meta/<account>/<container>/blobs/<hh>/<hash>/snapshots/<id>, <id>.json - snapshots
+//   - .meta/<account>/<container>/blobs/<hh>/<hash>/versions/<id>, <id>.json - previous versions
+//   - .meta/<account>/<container>/blobs/<hh>/<hash>/deleted, deleted.json - soft-deleted blob
+//   - .meta/<account>/service.json - blob service properties
+//   - .deleted/<account>/<container>/<version>/content/, meta/ - soft-deleted container
+//
+// Blobs without a record (e.g. written by an older version) get one rebuilt from
+// the content file. Records that can't be decoded, records without content, and
+// stray files where directories are expected are moved to quarantine.
+func (s *FileBlobStore) recover() error {
+	// Leftovers from interrupted writes are never needed.
+	tmpDir := filepath.Join(s.baseDir, tmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to clear temp directory: %w", err)
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+
+	accounts, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	quarantineRun := time.Now().UTC().Format("20060102T150405Z")
+	for _, account := range accounts {
+		if strings.HasPrefix(account.Name(), ".") {
+			continue // bookkeeping directories
+		}
+		if !account.IsDir() {
+			if err := s.quarantine(quarantineRun, account.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		containers, err := os.ReadDir(filepath.Join(s.baseDir, account.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read account %s: %w", account.Name(), err)
+		}
+		for _, container := range containers {
+			if !container.IsDir() {
+				if err := s.quarantine(quarantineRun, filepath.Join(account.Name(), container.Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.recoverContainer(quarantineRun, account.Name(), container.Name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.recoverRecordDirs(quarantineRun); err != nil {
+		return err
+	}
+	return s.recoverDeletedContainers(quarantineRun)
+}
+
+// recoverContainer loads a container's record and indexes all of its blobs.
+func (s *FileBlobStore) recoverContainer(run, account, containerName string) error {
+	recordPath := filepath.Join(s.containerMetaPath(account, containerName), "container.json")
+
+	var container Container
+	data, err := os.ReadFile(recordPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &container); err != nil || container.Name != containerName {
+			if err := s.quarantine(run, s.relPath(recordPath)); err != nil {
+				return err
+			}
+			container = Container{}
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read container record: %w", err)
+	}
+
+	containerPath, err := s.containerPath(account, containerName)
+	if err != nil {
+		return err
+	}
+	if container.Name == "" {
+		info, err := os.Stat(containerPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat container: %w", err)
+		}
+		container = Container{Name: containerName, CreatedAt: info.ModTime().UTC()}
+		s.recovery.Repaired = append(s.recovery.Repaired, s.containerKey(account, containerName))
+	}
+	if container.ETag == "" {
+		// Rebuilt records, and records written before ETags were tracked.
+		if container.ModifiedAt.IsZero() {
+			container.ModifiedAt = container.CreatedAt
+		}
+		container.ETag = newETag()
+		if err := s.writeContainerRecord(account, &container); err != nil {
+			return err
+		}
+	}
+	if container.Metadata == nil {
+		container.Metadata = make(map[string]string)
+	}
+
+	entry := &containerEntry{
+		container: container,
+		blobs:     make(map[string]*blobRecord),
+		staged:    make(map[string]*stagedBlocks),
+		snapshots: make(map[string][]*blobRecord),
+		versions:  make(map[string][]*blobRecord),
+		deleted:   make(map[string]*blobRecord),
+		tags:      make(tagIndex),
+	}
+	s.containers[s.containerKey(account, containerName)] = entry
+	s.recovery.Containers++
+
+	return filepath.WalkDir(containerPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(containerPath, path)
+		if err != nil {
+			return err
+		}
+		blobName := filepath.ToSlash(relPath)
+
+		if !d.Type().IsRegular() {
+			return s.quarantine(run, s.relPath(path))
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat blob: %w", err)
+		}
+		record, err := s.recoverBlob(run, account, containerName, blobName, info)
+		if err != nil {
+			return err
+		}
+		entry.blobs[blobName] = record
+		entry.tags.update(blobName, nil, record.Tags)
+		if record.Properties.Rehydration != nil {
+			s.scheduleRehydration(account, containerName, record)
+		}
+		s.recovery.Blobs++
+		return nil
+	})
+}
+
+// recoverBlob loads a blob's record, rebuilding it from the content file if it is
+// missing or unreadable.
+func (s *FileBlobStore) recoverBlob(run, account, containerName, blobName string, info os.FileInfo) (*blobRecord, error) {
+	recordPath := filepath.Join(s.blobMetaPath(account, containerName, blobName), "blob.json")
+
+	var record blobRecord
+	data, err := os.ReadFile(recordPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &record); err != nil || record.Name != blobName {
+			if err := s.quarantine(run, s.relPath(recordPath)); err != nil {
+				return nil, err
+			}
+			record = blobRecord{}
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read blob record: %w", err)
+	}
+
+	key := s.containerKey(account, containerName) + "/" + blobName
+	switch {
+	case record.Name == "":
+		record = blobRecord{
+			Name: blobName,
+			Properties: BlobProperties{
+				BlobHTTPHeaders: BlobHTTPHeaders{ContentType: "application/octet-stream"},
+				Size:            info.Size(),
+				CreatedAt:       info.ModTime().UTC(),
+				ModifiedAt:      info.ModTime().UTC(),
+			},
+		}
+	case record.Properties.Size != info.Size():
+		// The content was replaced without its record being updated.
+		record.Properties.Size = info.Size()
+		record.Properties.ModifiedAt = info.ModTime().UTC()
+		record.CommittedBlocks = nil
+		record.Pages = truncatePages(record.Pages, info.Size())
+	default:
+		record.setDefaults()
+		switch {
+		case record.Properties.ETag == "":
+			// Written before ETags were tracked.
+			record.Properties.ETag = newETag()
+		case record.Properties.Copy.pending():
+			// The copy can't be resumed; as in Azure, the empty destination remains.
+			record.Properties.Copy = endedCopy(record.Properties.Copy, CopyStatusFailed, "The copy was interrupted by an emulator restart.", time.Now().UTC())
+		default:
+			return &record, nil
+		}
+		if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+
+	record.setDefaults()
+	record.Properties.ETag = newETag()
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.recovery.Repaired = append(s.recovery.Repaired, key)
+	return &record, nil
+}
+
+// recoverRecordDirs walks the metadata tree, loading service properties,
+// uncommitted block lists, snapshots, versions and soft-deleted blobs and moving
+// container and blob records that have no matching content out of the way.
+func (s *FileBlobStore) recoverRecordDirs(run string) error {
+	metaRoot := filepath.Join(s.baseDir, metaDirName)
+	accounts, err := os.ReadDir(metaRoot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read metadata directory: %w", err)
+	}
+
+	for _, account := range accounts {
+		containers, err := os.ReadDir(filepath.Join(metaRoot, account.Name()))
+		if err != nil {
+			if err := s.quarantine(run, filepath.Join(metaDirName, account.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, container := range containers {
+			if container.Name() == serviceRecordName {
+				if err := s.recoverServiceProperties(run, account.Name()); err != nil {
+					return err
+				}
+				continue
+			}
+			metaPath := s.containerMetaPath(account.Name(), container.Name())
+			entry, ok := s.containers[s.containerKey(account.Name(), container.Name())]
+			if !ok {
+				if err := s.quarantine(run, s.relPath(metaPath)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := s.recoverContainerRecordDirs(run, entry, metaPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverContainerRecordDirs checks the blob record directories of a container
+// whose records are in metaPath.
+func (s *FileBlobStore) recoverContainerRecordDirs(run string, entry *containerEntry, metaPath string) error {
+	dirs, err := filepath.Glob(filepath.Join(metaPath, "blobs", "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := s.recoverRecordDir(run, entry, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverRecordDir checks a single blob record directory. A directory is kept if
+// its blob.json belongs to an indexed blob, or it holds previous versions, a
+// soft-deleted blob, soft-deleted snapshots or live uncommitted blocks; expired
+// uncommitted blocks are garbage collected. Live snapshots are only loaded for
+// indexed blobs.
+func (s *FileBlobStore) recoverRecordDir(run string, entry *containerEntry, dir string) error {
+	recordPath := filepath.Join(dir, "blob.json")
+	var record blobRecord
+	_, recordErr := os.Stat(recordPath)
+	hasRecord := readJSONFile(recordPath, &record) == nil && entry.blobs[record.Name] != nil
+
+	var staged stagedBlocks
+	hasStaged := readJSONFile(filepath.Join(dir, "blocks.json"), &staged) == nil && staged.Name != ""
+	expiredStaged := hasStaged && staged.expired(time.Now())
+	if expiredStaged {
+		if err := os.RemoveAll(filepath.Join(dir, "blocks")); err != nil {
+			return fmt.Errorf("failed to delete uncommitted blocks: %w", err)
+		}
+		if err := os.Remove(filepath.Join(dir, "blocks.json")); err != nil {
+			return fmt.Errorf("failed to delete uncommitted block list: %w", err)
+		}
+		hasStaged = false
+	}
+
+	deleted, err := s.recoverDeletedBlob(run, dir, hasRecord)
+	if err != nil {
+		return err
+	}
+	versions, err := s.recoverRecordList(run, dir, "versions", func(r *blobRecord) string { return r.Properties.VersionID }, true)
+	if err != nil {
+		return err
+	}
+	snapshots, err := s.recoverRecordList(run, dir, "snapshots", func(r *blobRecord) string { return r.Snapshot }, hasRecord)
+	if err != nil {
+		return err
+	}
+
+	if !hasRecord && !hasStaged && deleted == nil && len(versions) == 0 && len(snapshots) == 0 {
+		if expiredStaged && os.IsNotExist(recordErr) {
+			return os.RemoveAll(dir)
+		}
+		return s.quarantine(run, s.relPath(dir))
+	}
+	if !hasRecord && recordErr == nil {
+		// The committed blob is gone, but other state of the blob is still usable.
+		if err := s.quarantine(run, s.relPath(recordPath)); err != nil {
+			return err
+		}
+	}
+
+	if hasStaged {
+		entry.staged[staged.Name] = &staged
+	}
+	if deleted != nil {
+		entry.deleted[deleted.Name] = deleted
+		s.recovery.SoftDeleted++
+	}
+	for _, list := range []struct {
+		m       map[string][]*blobRecord
+		records []*blobRecord
+		count   *int
+	}{
+		{entry.versions, versions, &s.recovery.Versions},
+		{entry.snapshots, snapshots, &s.recovery.Snapshots},
+	} {
+		if len(list.records) == 0 {
+			continue
+		}
+		list.m[list.records[0].Name] = list.records
+		*list.count += len(list.records)
+		s.recovery.SoftDeleted += len(list.records) - len(liveRecords(list.records))
+	}
+	return nil
+}
+
+// recoverDeletedBlob loads the soft-deleted blob in a blob record directory, if
+// any. A soft-deleted blob that can't be loaded, or whose blob exists again
+// because a crash interrupted its restore, is quarantined.
+func (s *FileBlobStore) recoverDeletedBlob(run, dir string, hasRecord bool) (*blobRecord, error) {
+	path := filepath.Join(dir, deletedBlobName)
+	_, recordErr := os.Stat(path + ".json")
+	info, contentErr := os.Stat(path)
+	if os.IsNotExist(recordErr) && os.IsNotExist(contentErr) {
+		return nil, nil
+	}
+
+	var record blobRecord
+	if !hasRecord && readJSONFile(path+".json", &record) == nil && record.Properties.IsDeleted() &&
+		blobNameHash(record.Name) == filepath.Base(dir) && contentErr == nil && info.Mode().IsRegular() {
+		record.setDefaults()
+		return &record, nil
+	}
+	for _, p := range []string{path + ".json", path} {
+		if _, err := os.Stat(p); err == nil {
+			if err := s.quarantine(run, s.relPath(p)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// recoverRecordList loads the snapshots or versions stored in a subdirectory of a
+// blob record directory, sorted by the timestamp that id returns. Unless
+// liveAllowed is set, only soft-deleted records are loaded. Records that can't
+// be decoded, belong to another blob or have no content, and content without a
+// record, are quarantined.
+func (s *FileBlobStore) recoverRecordList(run, dir, subdir string, id func(*blobRecord) string, liveAllowed bool) ([]*blobRecord, error) {
+	listDir := filepath.Join(dir, subdir)
+	files, err := os.ReadDir(listDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", subdir, err)
+	}
+
+	var records []*blobRecord
+	loaded := make(map[string]bool) // file names belonging to loaded records
+	for _, file := range files {
+		contentName, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		var record blobRecord
+		if err := readJSONFile(filepath.Join(listDir, file.Name()), &record); err != nil ||
+			blobNameHash(record.Name) != filepath.Base(dir) || id(&record) == "" ||
+			(!liveAllowed && !record.Properties.IsDeleted()) {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(listDir, contentName)); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		record.setDefaults()
+		records = append(records, &record)
+		loaded[file.Name()] = true
+		loaded[contentName] = true
+	}
+
+	for _, file := range files {
+		if !loaded[file.Name()] {
+			if err := s.quarantine(run, s.relPath(filepath.Join(listDir, file.Name()))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool { return id(records[i]) < id(records[j]) })
+	return records, nil
+}
+
+// recoverDeletedContainers loads the records of soft-deleted containers. Their
+// blobs are only indexed when a container is restored. Directories without a
+// valid record are quarantined.
+func (s *FileBlobStore) recoverDeletedContainers(run string) error {
+	root := filepath.Join(s.baseDir, deletedDirName)
+	dirs, err := filepath.Glob(filepath.Join(root, "*", "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		account, containerName, version := parts[0], parts[1], parts[2]
+
+		var container Container
+		if err := readJSONFile(filepath.Join(dir, "meta", "container.json"), &container); err != nil ||
+			container.Name != containerName || container.Version != version || !container.IsDeleted() {
+			if err := s.quarantine(run, s.relPath(dir)); err != nil {
+				return err
+			}
+			continue
+		}
+		key := s.containerKey(account, containerName)
+		s.deletedContainers[key] = append(s.deletedContainers[key], &container)
+		s.recovery.SoftDeleted++
+	}
+	for _, containers := range s.deletedContainers {
+		sort.Slice(containers, func(i, j int) bool { return containers[i].DeletedTime.Before(*containers[j].DeletedTime) })
+	}
+	return nil
+}
+
+// readJSONFile decodes the JSON file at path into v.
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// quarantine moves a path (relative to DATA_DIR/blob) into the quarantine directory
+// of the current recovery run, preserving its relative location.
+func (s *FileBlobStore) quarantine(run, relPath string) error {
+	target := filepath.Join(s.baseDir, quarantineDirName, run, relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(s.baseDir, relPath), target); err != nil {
+		return fmt.Errorf("failed to quarantine %s: %w", relPath, err)
+	}
+	s.recovery.Quarantined = append(s.recovery.Quarantined, filepath.ToSlash(relPath))
+	return nil
+}
+
+// relPath returns path relative to DATA_DIR/blob.
+func (s *FileBlobStore) relPath(path string) string {
+	rel, err := filepath.Rel(s.baseDir, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,362 @@
+package blob
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// BlobListResult is the XML body returned by List Blobs.
+// It mirrors Azure's EnumerationResults response structure so that the official
+// SDKs can decode it.
+type BlobListResult struct {
+	XMLName         xml.Name `xml:"EnumerationResults"`
+	ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+	ContainerName   string   `xml:"ContainerName,attr"`
+
+	// Prefix is the prefix used for filtering (if any).
+	Prefix string `xml:"Prefix,omitempty"`
+
+	// Marker is the continuation token for pagination (if any).
+	Marker string `xml:"Marker,omitempty"`
+
+	// MaxResults is the maximum number of results requested.
+	MaxResults int `xml:"MaxResults,omitempty"`
+
+	// Delimiter groups blob names into BlobPrefix entries (if any).
+	Delimiter string `xml:"Delimiter,omitempty"`
+
+	// Blobs is the list of blobs and blob prefixes in the container.
+	Blobs blobListEntries `xml:"Blobs"`
+
+	// NextMarker is the continuation token for the next page, empty on the last page.
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ContainerListResult is the XML body returned by List Containers.
+type ContainerListResult struct {
+	XMLName         xml.Name `xml:"EnumerationResults"`
+	ServiceEndpoint string   `xml:"ServiceEndpoint,attr"`
+
+	// Prefix is the prefix used for filtering (if any).
+	Prefix string `xml:"Prefix,omitempty"`
+
+	// Marker is the continuation token the page started from (if any).
+	Marker string `xml:"Marker,omitempty"`
+
+	// MaxResults is the maximum number of results requested.
+	MaxResults int `xml:"MaxResults,omitempty"`
+
+	// Containers is the list of containers in the account.
+	Containers containerListEntries `xml:"Containers"`
+
+	// NextMarker is the continuation token for the next page, empty on the last page.
+	NextMarker string `xml:"NextMarker"`
+}
+
+// containerListEntries is the <Containers> element of a List Containers response.
+type containerListEntries struct {
+	Container []containerItemXML `xml:"Container"`
+}
+
+// containerItemXML is a single <Container> element of a List Containers response.
+type containerItemXML struct {
+	Name       string                 `xml:"Name"`
+	Deleted    bool                   `xml:"Deleted,omitempty"`
+	Version    string                 `xml:"Version,omitempty"`
+	Properties containerPropertiesXML `xml:"Properties"`
+	Metadata   metadataXML            `xml:"Metadata,omitempty"`
+}
+
+// containerPropertiesXML is the <Properties> element of a listed container.
+type containerPropertiesXML struct {
+	LastModified          string `xml:"Last-Modified"`
+	Etag                  string `xml:"Etag"`
+	LeaseStatus           string `xml:"LeaseStatus"`
+	LeaseState            string `xml:"LeaseState"`
+	LeaseDuration         string `xml:"LeaseDuration,omitempty"`
+	PublicAccess          string `xml:"PublicAccess,omitempty"`
+	HasImmutabilityPolicy bool   `xml:"HasImmutabilityPolicy"`
+	HasLegalHold          bool   `xml:"HasLegalHold"`
+
+	// Soft-deleted containers only.
+	DeletedTime            string `xml:"DeletedTime,omitempty"`
+	RemainingRetentionDays int    `xml:"RemainingRetentionDays,omitempty"`
+}
+
+// newContainerItemXML converts a store Container into its List Containers
+// representation. Metadata is only included when requested.
+func newContainerItemXML(container Container, includeMetadata bool) containerItemXML {
+	now := time.Now()
+	leaseStatus, leaseState, leaseDuration := leaseProperties(container.Lease, now)
+	item := containerItemXML{
+		Name:    container.Name,
+		Version: container.Version,
+		Properties: containerPropertiesXML{
+			LastModified:  formatHTTPDate(container.ModifiedAt),
+			Etag:          container.ETag,
+			LeaseStatus:   leaseStatus,
+			LeaseState:    string(leaseState),
+			LeaseDuration: leaseDuration,
+			PublicAccess:  string(container.PublicAccess),
+
+			HasImmutabilityPolicy: container.ImmutabilityPolicy != nil,
+		},
+	}
+	if includeMetadata {
+		item.Metadata = container.Metadata
+	}
+	if container.IsDeleted() {
+		item.Deleted = true
+		item.Properties.DeletedTime = formatHTTPDate(*container.DeletedTime)
+		item.Properties.RemainingRetentionDays = container.RemainingRetentionDays(now)
+	}
+	return item
+}
+
+// blobListEntries is the <Blobs> element of a List Blobs response.
+type blobListEntries struct {
+	Blob       []blobItemXML   `xml:"Blob"`
+	BlobPrefix []blobPrefixXML `xml:"BlobPrefix"`
+}
+
+// blobPrefixXML is a <BlobPrefix> element, a virtual directory in a listing with a delimiter.
+type blobPrefixXML struct {
+	Name string `xml:"Name"`
+}
+
+// blobItemXML is a single <Blob> element of a List Blobs response.
+type blobItemXML struct {
+	Name             string            `xml:"Name"`
+	Snapshot         string            `xml:"Snapshot,omitempty"`
+	VersionID        string            `xml:"VersionId,omitempty"`
+	IsCurrentVersion bool              `xml:"IsCurrentVersion,omitempty"`
+	Deleted          bool              `xml:"Deleted,omitempty"`
+	Properties       blobPropertiesXML `xml:"Properties"`
+	Metadata         metadataXML       `xml:"Metadata,omitempty"`
+	Tags             *tagsXML          `xml:"Tags,omitempty"`
+}
+
+// blobPropertiesXML is the <Properties> element of a listed blob.
+type blobPropertiesXML struct {
+	CreationTime       string `xml:"Creation-Time"`
+	LastModified       string `xml:"Last-Modified"`
+	Etag               string `xml:"Etag"`
+	ContentLength      int64  `xml:"Content-Length"`
+	ContentType        string `xml:"Content-Type"`
+	ContentEncoding    string `xml:"Content-Encoding"`
+	ContentLanguage    string `xml:"Content-Language"`
+	ContentMD5         string `xml:"Content-MD5"`
+	CacheControl       string `xml:"Cache-Control"`
+	ContentDisposition string `xml:"Content-Disposition"`
+	BlobType           string `xml:"BlobType"`
+	LeaseStatus        string `xml:"LeaseStatus"`
+	LeaseState         string `xml:"LeaseState"`
+	LeaseDuration      string `xml:"LeaseDuration,omitempty"`
+
+	// Sealed append blobs only.
+	Sealed bool `xml:"Sealed,omitempty"`
+
+	// Page blobs only.
+	SequenceNumber *int64 `xml:"x-ms-blob-sequence-number,omitempty"`
+
+	// Block blobs only.
+	AccessTier           string `xml:"AccessTier,omitempty"`
+	AccessTierInferred   bool   `xml:"AccessTierInferred,omitempty"`
+	AccessTierChangeTime string `xml:"AccessTierChangeTime,omitempty"`
+	ArchiveStatus        string `xml:"ArchiveStatus,omitempty"`
+	RehydratePriority    string `xml:"RehydratePriority,omitempty"`
+
+	// Blobs with index tags only.
+	TagCount int `xml:"TagCount,omitempty"`
+
+	// With include=immutabilitypolicy and include=legalhold only.
+	ImmutabilityPolicyUntilDate string `xml:"ImmutabilityPolicyUntilDate,omitempty"`
+	ImmutabilityPolicyMode      string `xml:"ImmutabilityPolicyMode,omitempty"`
+	LegalHold                   *bool  `xml:"LegalHold,omitempty"`
+
+	// Blobs written by Copy Blob, with include=copy only.
+	CopyID                string `xml:"CopyId,omitempty"`
+	CopySource            string `xml:"CopySource,omitempty"`
+	CopyStatus            string `xml:"CopyStatus,omitempty"`
+	CopyProgress          string `xml:"CopyProgress,omitempty"`
+	CopyCompletionTime    string `xml:"CopyCompletionTime,omitempty"`
+	CopyStatusDescription string `xml:"CopyStatusDescription,omitempty"`
+
+	ServerEncrypted bool `xml:"ServerEncrypted"`
+
+	// Soft-deleted blobs only.
+	DeletedTime            string `xml:"DeletedTime,omitempty"`
+	RemainingRetentionDays int    `xml:"RemainingRetentionDays,omitempty"`
+}
+
+// newBlobItemXML converts a store BlobInfo into its List Blobs representation.
+func newBlobItemXML(info BlobInfo) blobItemXML {
+	leaseStatus, leaseState, leaseDuration := leaseProperties(info.Lease, time.Now())
+	item := blobItemXML{
+		Name:             info.Name,
+		Snapshot:         info.Snapshot,
+		VersionID:        info.VersionID,
+		IsCurrentVersion: info.IsCurrentVersion,
+		Properties: blobPropertiesXML{
+			CreationTime:       formatHTTPDate(info.CreatedAt),
+			LastModified:       formatHTTPDate(info.ModifiedAt),
+			Etag:               info.ETag,
+			ContentLength:      info.Size,
+			ContentType:        info.ContentType,
+			ContentEncoding:    info.ContentEncoding,
+			ContentLanguage:    info.ContentLanguage,
+			CacheControl:       info.CacheControl,
+			ContentDisposition: info.ContentDisposition,
+			BlobType:           string(info.BlobType),
+			LeaseStatus:        leaseStatus,
+			LeaseState:         string(leaseState),
+			LeaseDuration:      leaseDuration,
+			Sealed:             info.Sealed,
+			TagCount:           len(info.Tags),
+		},
+	}
+	switch info.BlobType {
+	case BlobTypeBlock:
+		item.Properties.setAccessTier(&info.BlobProperties)
+	case BlobTypePage:
+		sequenceNumber := info.SequenceNumber
+		item.Properties.SequenceNumber = &sequenceNumber
+	}
+	if len(info.ContentMD5) > 0 {
+		item.Properties.ContentMD5 = base64.StdEncoding.EncodeToString(info.ContentMD5)
+	}
+	if info.IsDeleted() {
+		item.Deleted = true
+		item.Properties.DeletedTime = formatHTTPDate(*info.DeletedTime)
+		item.Properties.RemainingRetentionDays = info.RemainingRetentionDays(time.Now())
+	}
+	return item
+}
+
+// setAccessTier adds a block blob's access tier and any pending rehydration.
+func (p *blobPropertiesXML) setAccessTier(props *BlobProperties) {
+	p.AccessTier = string(props.AccessTier)
+	if props.AccessTier == "" {
+		p.AccessTier = string(AccessTierHot)
+		p.AccessTierInferred = true
+	}
+	if !props.AccessTierChangedAt.IsZero() {
+		p.AccessTierChangeTime = formatHTTPDate(props.AccessTierChangedAt)
+	}
+	if r := props.Rehydration; r != nil {
+		p.ArchiveStatus = r.archiveStatus()
+		p.RehydratePriority = string(r.Priority)
+	}
+}
+
+// setImmutabilityPolicy adds a blob's immutability policy. policy may be nil.
+func (p *blobPropertiesXML) setImmutabilityPolicy(policy *ImmutabilityPolicy) {
+	if policy == nil {
+		return
+	}
+	p.ImmutabilityPolicyUntilDate = formatHTTPDate(policy.ExpiresOn)
+	p.ImmutabilityPolicyMode = string(policy.Mode)
+}
+
+// setCopy adds the copy properties of a blob written by Copy Blob. c may be nil.
+func (p *blobPropertiesXML) setCopy(c *CopyState) {
+	if c == nil {
+		return
+	}
+	p.CopyID = c.ID
+	p.CopySource = c.Source
+	p.CopyStatus = string(c.Status)
+	p.CopyProgress = c.progress()
+	if !c.CompletionTime.IsZero() {
+		p.CopyCompletionTime = formatHTTPDate(c.CompletionTime)
+	}
+	p.CopyStatusDescription = c.StatusDescription
+}
+
+// blockListXML is the body returned by Get Block List. A nil list is omitted,
+// so only the block lists selected by blocklisttype are emitted.
+type blockListXML struct {
+	XMLName           xml.Name            `xml:"BlockList"`
+	CommittedBlocks   *blockListBlocksXML `xml:"CommittedBlocks,omitempty"`
+	UncommittedBlocks *blockListBlocksXML `xml:"UncommittedBlocks,omitempty"`
+}
+
+// blockListBlocksXML is a <CommittedBlocks> or <UncommittedBlocks> element.
+type blockListBlocksXML struct {
+	Block []blockXML `xml:"Block"`
+}
+
+// blockXML is a single <Block> of a block list.
+type blockXML struct {
+	Name string `xml:"Name"`
+	Size int64  `xml:"Size"`
+}
+
+// newBlockListBlocksXML converts blocks into their Get Block List representation.
+func newBlockListBlocksXML(blocks []Block) *blockListBlocksXML {
+	result := &blockListBlocksXML{}
+	for _, block := range blocks {
+		result.Block = append(result.Block, blockXML{Name: block.ID, Size: block.Size})
+	}
+	return result
+}
+
+// storageErrorXML is the <Error> body Azure returns for failed requests.
+type storageErrorXML struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// metadataXML marshals user metadata as <Metadata><key>value</key>...</Metadata>.
+// Keys are emitted in sorted order so responses are deterministic.
+type metadataXML map[string]string
+
+// MarshalXML implements xml.Marshaler.
+func (m metadataXML) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := e.EncodeElement(m[k], xml.StartElement{Name: xml.Name{Local: k}}); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (m *metadataXML) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*m = make(metadataXML)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			(*m)[t.Name.Local] = value
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// formatHTTPDate formats a timestamp the way Azure does in headers and XML bodies (RFC 1123, GMT).
+func formatHTTPDate(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
@@ -0,0 +1,188 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// serviceRecordName is the file holding an account's blob service properties in
+// DATA_DIR/blob/.meta/<account>/. Container names can't contain dots, so it
+// can't collide with a container's record directory.
+const serviceRecordName = "service.json"
+
+// serviceRecordPath returns the path of an account's blob service properties.
+func (s *FileBlobStore) serviceRecordPath(account string) string {
+	return filepath.Join(s.baseDir, metaDirName, account, serviceRecordName)
+}
+
+func (s *FileBlobStore) GetServiceProperties(ctx context.Context, account string) (*ServiceProperties, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	props := s.services[account]
+	return &props, nil
+}
+
+func (s *FileBlobStore) SetServiceProperties(ctx context.Context, account string, props ServiceProperties) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writeJSON(s.serviceRecordPath(account), &props); err != nil {
+		return err
+	}
+	s.services[account] = props
+	return nil
+}
+
+// recoverServiceProperties loads an account's blob service properties. A record
+// that can't be decoded is quarantined and the defaults are used.
+func (s *FileBlobStore) recoverServiceProperties(run, account string) error {
+	path := s.serviceRecordPath(account)
+	var props ServiceProperties
+	if err := readJSONFile(path, &props); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return s.quarantine(run, s.relPath(path))
+	}
+	s.services[account] = props
+	return nil
+}
+
+// servicePropertiesXML is the <StorageServiceProperties> body of Get and Set Blob
+// Service Properties. Settings missing from a Set request are left unchanged.
+type servicePropertiesXML struct {
+	XMLName xml.Name `xml:"StorageServiceProperties"`
+
+	Cors                  *corsXML            `xml:"Cors,omitempty"`
+	DeleteRetentionPolicy *retentionPolicyXML `xml:"DeleteRetentionPolicy,omitempty"`
+	StaticWebsite         *staticWebsiteXML   `xml:"StaticWebsite,omitempty"`
+
+	// IsVersioningEnabled and ContainerDeleteRetentionPolicy are Bluestack
+	// extensions. Azure configures them through the management plane, which the
+	// emulator doesn't have.
+	IsVersioningEnabled            *bool               `xml:"IsVersioningEnabled,omitempty"`
+	ContainerDeleteRetentionPolicy *retentionPolicyXML `xml:"ContainerDeleteRetentionPolicy,omitempty"`
+}
+
+// retentionPolicyXML is a <DeleteRetentionPolicy> element. Days is omitted
+// while the policy is disabled.
+type retentionPolicyXML struct {
+	Enabled bool `xml:"Enabled"`
+	Days    int  `xml:"Days,omitempty"`
+}
+
+// newRetentionPolicyXML converts a store RetentionPolicy into its XML form.
+func newRetentionPolicyXML(policy RetentionPolicy) *retentionPolicyXML {
+	return &retentionPolicyXML{Enabled: policy.Enabled, Days: policy.Days}
+}
+
+// retentionPolicy validates a policy from a request body. node names its
+// element in errors. Enabled policies must keep data for 1 to 365 days.
+func (p *retentionPolicyXML) retentionPolicy(node string) (RetentionPolicy, error) {
+	if !p.Enabled {
+		return RetentionPolicy{}, nil
+	}
+	if p.Days < 1 || p.Days > 365 {
+		return RetentionPolicy{}, errInvalidXMLNodeValue(node + "/Days")
+	}
+	return RetentionPolicy{Enabled: true, Days: p.Days}, nil
+}
+
+// handleGetServiceProperties handles GET /{account}?restype=service&comp=properties.
+func (s *BlobService) handleGetServiceProperties(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+
+	props, err := s.store.GetServiceProperties(r.Context(), account)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get service properties",
+			logging.String("account", account),
+		)
+		return
+	}
+
+	s.writeXML(w, http.StatusOK, servicePropertiesXML{
+		Cors:                           newCorsXML(props.Cors),
+		DeleteRetentionPolicy:          newRetentionPolicyXML(props.DeleteRetentionPolicy),
+		StaticWebsite:                  newStaticWebsiteXML(props.StaticWebsite),
+		IsVersioningEnabled:            &props.VersioningEnabled,
+		ContainerDeleteRetentionPolicy: newRetentionPolicyXML(props.ContainerDeleteRetentionPolicy),
+	})
+}
+
+// handleSetServiceProperties handles PUT /{account}?restype=service&comp=properties.
+func (s *BlobService) handleSetServiceProperties(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+
+	var body servicePropertiesXML
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+		s.writeStoreError(w, ErrInvalidXMLDocument, "invalid service properties")
+		return
+	}
+
+	props, err := s.store.GetServiceProperties(r.Context(), account)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get service properties",
+			logging.String("account", account),
+		)
+		return
+	}
+	if body.IsVersioningEnabled != nil {
+		props.VersioningEnabled = *body.IsVersioningEnabled
+	}
+	if body.DeleteRetentionPolicy != nil {
+		if props.DeleteRetentionPolicy, err = body.DeleteRetentionPolicy.retentionPolicy("DeleteRetentionPolicy"); err != nil {
+			s.writeStoreError(w, err, "invalid service properties")
+			return
+		}
+	}
+	if body.ContainerDeleteRetentionPolicy != nil {
+		if props.ContainerDeleteRetentionPolicy, err = body.ContainerDeleteRetentionPolicy.retentionPolicy("ContainerDeleteRetentionPolicy"); err != nil {
+			s.writeStoreError(w, err, "invalid service properties")
+			return
+		}
+	}
+	if body.StaticWebsite != nil {
+		props.StaticWebsite = body.StaticWebsite.staticWebsite()
+	}
+	if body.Cors != nil {
+		if props.Cors, err = body.Cors.corsRules(); err != nil {
+			s.writeStoreError(w, err, "invalid service properties")
+			return
+		}
+	}
+	if err := s.store.SetServiceProperties(r.Context(), account, *props); err != nil {
+		s.writeStoreError(w, err, "failed to set service properties",
+			logging.String("account", account),
+		)
+		return
+	}
+	// Like Azure, enabling the static website creates the $web container.
+	if props.StaticWebsite.Enabled {
+		err := s.store.CreateContainer(r.Context(), account, webContainer, CreateContainerOptions{})
+		if err != nil && !errors.Is(err, ErrContainerAlreadyExists) {
+			s.writeStoreError(w, err, "failed to create website container",
+				logging.String("account", account),
+			)
+			return
+		}
+	}
+
+	s.logger.Info("service properties set",
+		logging.String("account", account),
+		logging.Bool("versioning", props.VersioningEnabled),
+		logging.Int("blob_retention_days", props.DeleteRetentionPolicy.Days),
+		logging.Int("container_retention_days", props.ContainerDeleteRetentionPolicy.Days),
+		logging.Bool("static_website", props.StaticWebsite.Enabled),
+		logging.Int("cors_rules", len(props.Cors)),
+	)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,295 @@
+package blob
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// snapshotTimeFormat is the format of snapshot timestamps and version IDs, e.g.
+// 2011-03-09T01:42:34.9360000Z. Timestamps in this format sort chronologically as strings.
+const snapshotTimeFormat = "2006-01-02T15:04:05.0000000Z"
+
+// snapshotPath returns the file holding a snapshot's content. Its record is stored
+// next to it with a .json extension. Snapshot content is never modified, and a
+// blob's content file is only ever replaced, never rewritten, so the two can
+// share data through a hard link.
+func (s *FileBlobStore) snapshotPath(account, containerName, blobName, snapshot string) string {
+	return filepath.Join(s.blobMetaPath(account, containerName, blobName), "snapshots", hex.EncodeToString([]byte(snapshot)))
+}
+
+// findSnapshot returns the live snapshot with the given timestamp, or nil.
+func findSnapshot(snapshots []*blobRecord, snapshot string) *blobRecord {
+	for _, record := range snapshots {
+		if record.Snapshot == snapshot && !record.Properties.IsDeleted() {
+			return record
+		}
+	}
+	return nil
+}
+
+// nextTimestamp returns the timestamp for a snapshot or version created at now.
+// Timestamps have a resolution of 100ns; one created in the same tick as the
+// latest existing timestamp, last, is moved forward so that it is still unique.
+func nextTimestamp(last string, now time.Time) string {
+	t := now.UTC().Truncate(100 * time.Nanosecond)
+	if prev, err := time.Parse(snapshotTimeFormat, last); err == nil && !t.After(prev) {
+		t = prev.Add(100 * time.Nanosecond)
+	}
+	return t.Format(snapshotTimeFormat)
+}
+
+// timestampParam returns the named snapshot or versionid query parameter in
+// canonical form, or "" if it is absent. Any RFC 3339 timestamp is accepted.
+func timestampParam(query url.Values, name string) (string, error) {
+	if !query.Has(name) {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, query.Get(name))
+	if err != nil {
+		return "", errInvalidQueryParameterValue(name)
+	}
+	return t.UTC().Format(snapshotTimeFormat), nil
+}
+
+// parseDeleteSnapshots reads the x-ms-delete-snapshots header of a blob delete.
+// It only applies to deletes of the base blob, not of a snapshot or version.
+func parseDeleteSnapshots(h http.Header, baseBlob bool) (DeleteSnapshotsOption, error) {
+	option := DeleteSnapshotsOption(h.Get("x-ms-delete-snapshots"))
+	switch {
+	case option == "":
+		return "", nil
+	case !baseBlob, option != DeleteSnapshotsInclude && option != DeleteSnapshotsOnly:
+		return "", errInvalidHeaderValue("x-ms-delete-snapshots")
+	}
+	return option, nil
+}
+
+func (s *FileBlobStore) CreateSnapshot(ctx context.Context, account, containerName, blobName string, opts SnapshotOptions) (*SnapshotResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	// Taking a snapshot doesn't modify the blob, so a lease ID is optional, but
+	// failed conditions are still reported as 412.
+	if err := record.Properties.Lease.checkAccess(opts.Conditions.LeaseID, false, blobLeaseErrors, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := opts.Conditions.check(true, record.Properties.ETag, record.Properties.ModifiedAt, false); err != nil {
+		return nil, err
+	}
+	if record.Properties.archived() {
+		return nil, ErrBlobArchived
+	}
+
+	entry := s.containers[s.containerKey(account, containerName)]
+	snap := *record
+	if opts.Metadata != nil {
+		snap.Metadata = opts.Metadata
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := s.saveSnapshot(entry, account, containerName, blobPath, snap, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotResult{
+		Snapshot:   saved.Snapshot,
+		ETag:       record.Properties.ETag,
+		ModifiedAt: record.Properties.ModifiedAt,
+	}, nil
+}
+
+// saveSnapshot stores snap, with the content at contentPath, as a new snapshot
+// of its blob taken at now. The caller holds the lock.
+func (s *FileBlobStore) saveSnapshot(entry *containerEntry, account, containerName, contentPath string, snap blobRecord, now time.Time) (*blobRecord, error) {
+	var last string
+	if n := len(entry.snapshots[snap.Name]); n > 0 {
+		last = entry.snapshots[snap.Name][n-1].Snapshot
+	}
+	snap.Snapshot = nextTimestamp(last, now)
+	snap.Properties.Lease = Lease{}
+	snap.Properties.VersionID = ""
+
+	path := s.snapshotPath(account, containerName, snap.Name, snap.Snapshot)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	if err := linkOrCopyFile(contentPath, path); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := s.writeJSON(path+".json", &snap); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	entry.snapshots[snap.Name] = append(entry.snapshots[snap.Name], &snap)
+	return &snap, nil
+}
+
+// deleteSnapshot deletes a single snapshot of a blob. The caller holds the lock.
+func (s *FileBlobStore) deleteSnapshot(account, containerName, blobName string, opts DeleteBlobOptions) error {
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	snapshots := entry.snapshots[blobName]
+	record := findSnapshot(snapshots, opts.Snapshot)
+	if record == nil {
+		return ErrBlobNotFound
+	}
+	if err := checkBlobAccess(opts.Conditions, record, true); err != nil {
+		return err
+	}
+	if err := entry.checkImmutable(record, false, time.Now()); err != nil {
+		return err
+	}
+
+	path := s.snapshotPath(account, containerName, blobName, opts.Snapshot)
+	if err := s.removeListedRecord(account, entry.snapshots, path, record, time.Now()); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return s.pruneBlobMetaDir(entry, account, containerName, blobName)
+}
+
+// deleteAllSnapshots deletes every live snapshot of a blob, or none if any of
+// them is protected. The caller holds the lock.
+func (s *FileBlobStore) deleteAllSnapshots(entry *containerEntry, account, containerName, blobName string) error {
+	now := time.Now()
+	for _, record := range liveRecords(entry.snapshots[blobName]) {
+		if err := entry.checkImmutable(record, false, now); err != nil {
+			return err
+		}
+	}
+	for _, record := range liveRecords(entry.snapshots[blobName]) {
+		path := s.snapshotPath(account, containerName, blobName, record.Snapshot)
+		if err := s.removeListedRecord(account, entry.snapshots, path, record, now); err != nil {
+			return fmt.Errorf("failed to delete snapshots: %w", err)
+		}
+	}
+	return s.pruneBlobMetaDir(entry, account, containerName, blobName)
+}
+
+// removeRecordFile removes a snapshot or version: its record at path.json and
+// its content at path.
+func removeRecordFile(path string) error {
+	if err := os.Remove(path + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// withoutRecord returns a copy of records without record.
+func withoutRecord(records []*blobRecord, record *blobRecord) []*blobRecord {
+	remaining := make([]*blobRecord, 0, len(records))
+	for _, r := range records {
+		if r != record {
+			remaining = append(remaining, r)
+		}
+	}
+	return remaining
+}
+
+// setRecordList stores the snapshots or versions of a blob in an index map,
+// removing the key when there are none left.
+func setRecordList(m map[string][]*blobRecord, blobName string, records []*blobRecord) {
+	if len(records) == 0 {
+		delete(m, blobName)
+		return
+	}
+	m[blobName] = records
+}
+
+// linkOrCopyFile makes the content of src available at dst, preferably as a hard
+// link. File systems without hard links get a copy instead.
+func linkOrCopyFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, -1)
+}
+
+// copyFile copies the first n bytes of src to a new file at dst, or all of src
+// if n is negative.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = in
+	if n >= 0 {
+		r = io.LimitReader(in, n)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// handleSnapshotBlob handles PUT /{account}/{container}/{blobName}?comp=snapshot.
+// Any x-ms-meta-* headers replace the blob's metadata on the snapshot.
+func (s *BlobService) handleSnapshotBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	opts := SnapshotOptions{Conditions: conds}
+	if metadata := parseMetadata(r.Header); len(metadata) > 0 {
+		opts.Metadata = metadata
+	}
+
+	result, err := s.store.CreateSnapshot(r.Context(), account, containerName, blobName, opts)
+	if err != nil {
+		s.writeStoreError(w, err, "failed to snapshot blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob snapshot created",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("snapshot", result.Snapshot),
+	)
+	w.Header().Set("x-ms-snapshot", result.Snapshot)
+	w.Header().Set("ETag", result.ETag)
+	w.Header().Set("Last-Modified", formatHTTPDate(result.ModifiedAt))
+	w.Header().Set("x-ms-request-server-encrypted", "false")
+	w.WriteHeader(http.StatusCreated)
+}
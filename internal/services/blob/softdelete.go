@@ -0,0 +1,496 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// deletedBlobName is the name of the content file of a soft-deleted blob in its
+// record directory. Its record is stored next to it with a .json extension.
+const deletedBlobName = "deleted"
+
+// IsDeleted reports whether the resource is soft-deleted.
+func (d SoftDeleteState) IsDeleted() bool {
+	return d.DeletedTime != nil
+}
+
+// RemainingRetentionDays returns the number of days, rounded up, until the
+// soft-deleted resource is purged.
+func (d SoftDeleteState) RemainingRetentionDays(now time.Time) int {
+	remaining := d.purgeTime().Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return int((remaining + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// purgeTime returns when the soft-deleted resource's retention period ends.
+func (d SoftDeleteState) purgeTime() time.Time {
+	return d.DeletedTime.AddDate(0, 0, d.RetentionDays)
+}
+
+// expired reports whether the resource is soft-deleted and its retention period has ended.
+func (d SoftDeleteState) expired(now time.Time) bool {
+	return d.IsDeleted() && !now.Before(d.purgeTime())
+}
+
+// newSoftDeleteState returns the state of a resource soft-deleted at now under policy.
+func newSoftDeleteState(policy RetentionPolicy, now time.Time) SoftDeleteState {
+	deletedTime := now.UTC()
+	return SoftDeleteState{DeletedTime: &deletedTime, RetentionDays: policy.Days}
+}
+
+// liveRecords returns the records that aren't soft-deleted.
+func liveRecords(records []*blobRecord) []*blobRecord {
+	var live []*blobRecord
+	for _, record := range records {
+		if !record.Properties.IsDeleted() {
+			live = append(live, record)
+		}
+	}
+	return live
+}
+
+// replaceRecord returns a copy of records with old replaced by new.
+func replaceRecord(records []*blobRecord, old, new *blobRecord) []*blobRecord {
+	replaced := make([]*blobRecord, len(records))
+	for i, r := range records {
+		if r == old {
+			r = new
+		}
+		replaced[i] = r
+	}
+	return replaced
+}
+
+// deletedBlobPath returns the file holding the content of a soft-deleted blob.
+func (s *FileBlobStore) deletedBlobPath(account, containerName, blobName string) string {
+	return filepath.Join(s.blobMetaPath(account, containerName, blobName), deletedBlobName)
+}
+
+// removeListedRecord deletes a snapshot or version stored at path and indexed in
+// m. With blob soft delete enabled for the account it is only marked as deleted.
+// The caller holds the lock.
+func (s *FileBlobStore) removeListedRecord(account string, m map[string][]*blobRecord, path string, record *blobRecord, now time.Time) error {
+	records := m[record.Name]
+	policy := s.services[account].DeleteRetentionPolicy
+	if !policy.Enabled {
+		if err := removeRecordFile(path); err != nil {
+			return err
+		}
+		setRecordList(m, record.Name, withoutRecord(records, record))
+		return nil
+	}
+
+	deleted := *record
+	deleted.Properties.SoftDeleteState = newSoftDeleteState(policy, now)
+	if err := s.writeJSON(path+".json", &deleted); err != nil {
+		return err
+	}
+	m[record.Name] = replaceRecord(records, record, &deleted)
+	return nil
+}
+
+// keepPreviousState is called before a write replaces a blob; existing is nil if
+// the blob doesn't exist. With versioning enabled, the replaced blob is kept as a
+// previous version and the new blob's version ID is returned. Otherwise, with
+// blob soft delete enabled, it is kept as a soft-deleted snapshot, as in Azure.
+// A soft-deleted blob of the same name is always kept as a soft-deleted
+// snapshot, so that it can still be restored. The caller holds the lock.
+func (s *FileBlobStore) keepPreviousState(entry *containerEntry, account, containerName, blobName string, existing *blobRecord, now time.Time) (string, error) {
+	if err := s.retireDeletedBlob(entry, account, containerName, blobName, now); err != nil {
+		return "", err
+	}
+
+	props := s.services[account]
+	if props.VersioningEnabled {
+		return s.keepPreviousVersion(entry, account, containerName, blobName, existing, now)
+	}
+	if existing != nil && props.DeleteRetentionPolicy.Enabled {
+		snap := *existing
+		snap.Properties.SoftDeleteState = newSoftDeleteState(props.DeleteRetentionPolicy, now)
+		blobPath, err := s.blobPath(account, containerName, blobName)
+		if err != nil {
+			return "", err
+		}
+		if _, err := s.saveSnapshot(entry, account, containerName, blobPath, snap, now); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// keepDeletedBlob saves a blob that is about to be deleted as a soft-deleted
+// blob. The caller holds the lock and removes the blob itself.
+func (s *FileBlobStore) keepDeletedBlob(entry *containerEntry, account, containerName, blobName string, record *blobRecord, policy RetentionPolicy, now time.Time) error {
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return err
+	}
+	if err := s.retireDeletedBlob(entry, account, containerName, blobName, now); err != nil {
+		return err
+	}
+
+	deleted := *record
+	deleted.Properties.Lease = Lease{}
+	deleted.Properties.SoftDeleteState = newSoftDeleteState(policy, now)
+	path := s.deletedBlobPath(account, containerName, blobName)
+	if err := linkOrCopyFile(blobPath, path); err != nil {
+		return fmt.Errorf("failed to keep deleted blob: %w", err)
+	}
+	if err := s.writeJSON(path+".json", &deleted); err != nil {
+		os.Remove(path)
+		return err
+	}
+	entry.deleted[blobName] = &deleted
+	return nil
+}
+
+// retireDeletedBlob turns the soft-deleted blob of a name, if any, into a
+// soft-deleted snapshot, making room for a new blob or a newer soft-deleted one.
+// The caller holds the lock.
+func (s *FileBlobStore) retireDeletedBlob(entry *containerEntry, account, containerName, blobName string, now time.Time) error {
+	deleted := entry.deleted[blobName]
+	if deleted == nil {
+		return nil
+	}
+	path := s.deletedBlobPath(account, containerName, blobName)
+	if _, err := s.saveSnapshot(entry, account, containerName, path, *deleted, now); err != nil {
+		return err
+	}
+	if err := removeRecordFile(path); err != nil {
+		return fmt.Errorf("failed to delete soft-deleted blob: %w", err)
+	}
+	delete(entry.deleted, blobName)
+	return nil
+}
+
+func (s *FileBlobStore) UndeleteBlob(ctx context.Context, account, containerName, blobName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+
+	found := entry.blobs[blobName] != nil
+	if deleted := entry.deleted[blobName]; deleted != nil && !found {
+		found = true
+		record := *deleted
+		record.Properties.SoftDeleteState = SoftDeleteState{}
+		path := s.deletedBlobPath(account, containerName, blobName)
+		blobPath, err := s.blobPath(account, containerName, blobName)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return fmt.Errorf("failed to create blob directory: %w", err)
+		}
+		if err := linkOrCopyFile(path, blobPath); err != nil {
+			return fmt.Errorf("failed to restore blob: %w", err)
+		}
+		if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+			return err
+		}
+		entry.blobs[blobName] = &record
+		entry.tags.update(blobName, nil, record.Tags)
+		if err := removeRecordFile(path); err != nil {
+			return fmt.Errorf("failed to delete soft-deleted blob: %w", err)
+		}
+		delete(entry.deleted, blobName)
+	}
+
+	restore := func(m map[string][]*blobRecord, path func(*blobRecord) string) error {
+		for _, record := range m[blobName] {
+			if !record.Properties.IsDeleted() {
+				continue
+			}
+			found = true
+			restored := *record
+			restored.Properties.SoftDeleteState = SoftDeleteState{}
+			if err := s.writeJSON(path(record)+".json", &restored); err != nil {
+				return err
+			}
+			m[blobName] = replaceRecord(m[blobName], record, &restored)
+		}
+		return nil
+	}
+	if err := restore(entry.snapshots, func(r *blobRecord) string {
+		return s.snapshotPath(account, containerName, blobName, r.Snapshot)
+	}); err != nil {
+		return err
+	}
+	if err := restore(entry.versions, func(r *blobRecord) string {
+		return s.versionPath(account, containerName, blobName, r.Properties.VersionID)
+	}); err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrBlobNotFound
+	}
+	return nil
+}
+
+// deletedContainerPath returns the directory holding a soft-deleted container:
+// its content tree in content/ and its records in meta/.
+func (s *FileBlobStore) deletedContainerPath(account, containerName, version string) string {
+	return filepath.Join(s.baseDir, deletedDirName, account, containerName, version)
+}
+
+// softDeleteContainer moves a container and all of its blobs out of the index and
+// into DATA_DIR/blob/.deleted. The caller holds the lock and has checked access.
+func (s *FileBlobStore) softDeleteContainer(entry *containerEntry, account string, policy RetentionPolicy, now time.Time) error {
+	container := entry.container
+	container.Lease = Lease{}
+	container.Version = fmt.Sprintf("%016X", now.UnixNano())
+	container.SoftDeleteState = newSoftDeleteState(policy, now)
+
+	containerPath, err := s.containerPath(account, container.Name)
+	if err != nil {
+		return err
+	}
+	dir := s.deletedContainerPath(account, container.Name, container.Version)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create deleted container directory: %w", err)
+	}
+	if err := os.Rename(s.containerMetaPath(account, container.Name), filepath.Join(dir, "meta")); err != nil {
+		return fmt.Errorf("failed to move container records: %w", err)
+	}
+	if err := s.writeJSON(filepath.Join(dir, "meta", "container.json"), &container); err != nil {
+		return err
+	}
+	if err := os.Rename(containerPath, filepath.Join(dir, "content")); err != nil {
+		return fmt.Errorf("failed to move container directory: %w", err)
+	}
+
+	key := s.containerKey(account, container.Name)
+	delete(s.containers, key)
+	s.deletedContainers[key] = append(s.deletedContainers[key], &container)
+	return nil
+}
+
+func (s *FileBlobStore) RestoreContainer(ctx context.Context, account, containerName, deletedName, deletedVersion string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.containers[s.containerKey(account, containerName)]; exists {
+		return ErrContainerAlreadyExists
+	}
+	deletedKey := s.containerKey(account, deletedName)
+	var deleted *Container
+	for _, c := range s.deletedContainers[deletedKey] {
+		if c.Version == deletedVersion {
+			deleted = c
+		}
+	}
+	if deleted == nil {
+		return ErrContainerNotFound
+	}
+
+	containerPath, err := s.containerPath(account, containerName)
+	if err != nil {
+		return err
+	}
+	dir := s.deletedContainerPath(account, deletedName, deletedVersion)
+	metaPath := s.containerMetaPath(account, containerName)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return fmt.Errorf("failed to create container records directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "meta"), metaPath); err != nil {
+		return fmt.Errorf("failed to restore container records: %w", err)
+	}
+	container := *deleted
+	container.Name = containerName
+	container.Version = ""
+	container.SoftDeleteState = SoftDeleteState{}
+	if err := s.writeContainerRecord(account, &container); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.baseDir, account), 0755); err != nil {
+		return fmt.Errorf("failed to create account directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "content"), containerPath); err != nil {
+		return fmt.Errorf("failed to restore container directory: %w", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to delete deleted container directory: %w", err)
+	}
+	remaining := make([]*Container, 0, len(s.deletedContainers[deletedKey]))
+	for _, c := range s.deletedContainers[deletedKey] {
+		if c != deleted {
+			remaining = append(remaining, c)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(s.deletedContainers, deletedKey)
+	} else {
+		s.deletedContainers[deletedKey] = remaining
+	}
+
+	// Index the restored container the same way it is loaded at startup,
+	// without counting it in the startup report.
+	report := s.recovery
+	defer func() { s.recovery = report }()
+	run := time.Now().UTC().Format("20060102T150405Z")
+	if err := s.recoverContainer(run, account, containerName); err != nil {
+		return err
+	}
+	return s.recoverContainerRecordDirs(run, s.containers[s.containerKey(account, containerName)], metaPath)
+}
+
+// PurgeExpired permanently deletes the soft-deleted blobs, snapshots, versions
+// and containers whose retention period has ended by now. It returns the number
+// of items deleted.
+func (s *FileBlobStore) PurgeExpired(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for key, entry := range s.containers {
+		account, containerName, _ := strings.Cut(key, "/")
+		touched := make(map[string]bool) // blob names whose record directory may now be empty
+
+		for blobName, record := range entry.deleted {
+			if !record.Properties.expired(now) {
+				continue
+			}
+			if err := removeRecordFile(s.deletedBlobPath(account, containerName, blobName)); err != nil {
+				return purged, fmt.Errorf("failed to purge blob: %w", err)
+			}
+			delete(entry.deleted, blobName)
+			touched[blobName] = true
+			purged++
+		}
+
+		purgeList := func(m map[string][]*blobRecord, path func(*blobRecord) string) error {
+			for blobName, records := range m {
+				remaining := records[:0:0]
+				for i, record := range records {
+					if !record.Properties.expired(now) {
+						remaining = append(remaining, record)
+						continue
+					}
+					if err := removeRecordFile(path(record)); err != nil {
+						// Forget only the records already purged.
+						setRecordList(m, blobName, append(remaining, records[i:]...))
+						return err
+					}
+					touched[blobName] = true
+					purged++
+				}
+				setRecordList(m, blobName, remaining)
+			}
+			return nil
+		}
+		if err := purgeList(entry.snapshots, func(r *blobRecord) string {
+			return s.snapshotPath(account, containerName, r.Name, r.Snapshot)
+		}); err != nil {
+			return purged, fmt.Errorf("failed to purge snapshot: %w", err)
+		}
+		if err := purgeList(entry.versions, func(r *blobRecord) string {
+			return s.versionPath(account, containerName, r.Name, r.Properties.VersionID)
+		}); err != nil {
+			return purged, fmt.Errorf("failed to purge version: %w", err)
+		}
+
+		for blobName := range touched {
+			if err := s.pruneBlobMetaDir(entry, account, containerName, blobName); err != nil {
+				return purged, err
+			}
+		}
+	}
+
+	for key, containers := range s.deletedContainers {
+		account, _, _ := strings.Cut(key, "/")
+		var remaining []*Container
+		for _, c := range containers {
+			if !c.expired(now) {
+				remaining = append(remaining, c)
+				continue
+			}
+			if err := os.RemoveAll(s.deletedContainerPath(account, c.Name, c.Version)); err != nil {
+				return purged, fmt.Errorf("failed to purge container: %w", err)
+			}
+			purged++
+		}
+		if len(remaining) == 0 {
+			delete(s.deletedContainers, key)
+		} else {
+			s.deletedContainers[key] = remaining
+		}
+	}
+	return purged, nil
+}
+
+// handleUndeleteBlob handles PUT /{account}/{container}/{blobName}?comp=undelete.
+func (s *BlobService) handleUndeleteBlob(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	if err := s.store.UndeleteBlob(r.Context(), account, containerName, blobName); err != nil {
+		s.writeStoreError(w, err, "failed to undelete blob",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob undeleted",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleRestoreContainer handles PUT /{account}/{container}?restype=container&comp=undelete.
+// The x-ms-deleted-container-name and x-ms-deleted-container-version headers
+// select the soft-deleted container to restore.
+func (s *BlobService) handleRestoreContainer(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+
+	deletedName := r.Header.Get("x-ms-deleted-container-name")
+	if deletedName == "" {
+		s.writeStoreError(w, errMissingRequiredHeader("x-ms-deleted-container-name"), "")
+		return
+	}
+	deletedVersion := r.Header.Get("x-ms-deleted-container-version")
+	if deletedVersion == "" {
+		s.writeStoreError(w, errMissingRequiredHeader("x-ms-deleted-container-version"), "")
+		return
+	}
+
+	if err := s.store.RestoreContainer(r.Context(), account, containerName, deletedName, deletedVersion); err != nil {
+		s.writeStoreError(w, err, "failed to restore container",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("version", deletedVersion),
+		)
+		return
+	}
+	if container, err := s.store.GetContainer(r.Context(), account, containerName); err == nil {
+		w.Header().Set("ETag", container.ETag)
+		w.Header().Set("Last-Modified", formatHTTPDate(container.ModifiedAt))
+	}
+
+	s.logger.Info("container restored",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("version", deletedVersion),
+	)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,611 @@
+package blob
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// Azure's limits on a blob's index tags.
+const (
+	maxTags           = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// tagsHeader is the header that sets a blob's index tags on upload.
+const tagsHeader = "x-ms-tags"
+
+// containerTagKey is the pseudo tag key that compares container names in a
+// Find Blobs by Tags filter expression.
+const containerTagKey = "@container"
+
+// validTagString reports whether s may be a tag key or value of at most maxLen
+// characters: ASCII letters and digits, space and + - . / : = _.
+func validTagString(s string, maxLen int) bool {
+	if len(s) > maxLen {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.ContainsRune(" +-./:=_", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateTags checks a blob's index tags against Azure's limits.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return ErrTagsTooLarge
+	}
+	for k, v := range tags {
+		if k == "" || !validTagString(k, maxTagKeyLength) || !validTagString(v, maxTagValueLength) {
+			return ErrInvalidTag
+		}
+	}
+	return nil
+}
+
+// parseTagsHeader returns the index tags in x-ms-tags, a URL-encoded query
+// string such as project=bluestack&env=dev. A request without it sets no tags.
+func parseTagsHeader(h http.Header) (map[string]string, error) {
+	value := h.Get(tagsHeader)
+	if value == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(value)
+	if err != nil {
+		return nil, errInvalidHeaderValue(tagsHeader)
+	}
+	tags := make(map[string]string, len(values))
+	for k, v := range values {
+		if len(v) > 1 {
+			return nil, ErrInvalidTag
+		}
+		tags[k] = v[0]
+	}
+	if err := validateTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// tagsXML is the body of Get and Set Blob Tags, and the <Tags> element of
+// listed blobs.
+type tagsXML struct {
+	XMLName xml.Name  `xml:"Tags"`
+	TagSet  tagSetXML `xml:"TagSet"`
+}
+
+// tagSetXML is the <TagSet> element of a <Tags> body.
+type tagSetXML struct {
+	Tags []tagXML `xml:"Tag"`
+}
+
+// tagXML is a single index tag.
+type tagXML struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// newTagsXML converts index tags into their XML representation, ordered by key.
+func newTagsXML(tags map[string]string) *tagsXML {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	body := &tagsXML{}
+	for _, k := range keys {
+		body.TagSet.Tags = append(body.TagSet.Tags, tagXML{Key: k, Value: tags[k]})
+	}
+	return body
+}
+
+// tags validates the index tags of a Set Blob Tags body.
+func (b tagsXML) tags() (map[string]string, error) {
+	tags := make(map[string]string, len(b.TagSet.Tags))
+	for _, t := range b.TagSet.Tags {
+		if _, ok := tags[t.Key]; ok {
+			return nil, ErrInvalidTag
+		}
+		tags[t.Key] = t.Value
+	}
+	if err := validateTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// parseTagFilter parses a Find Blobs by Tags filter expression: conditions of
+// the form "key" op 'value' joined by AND, where op is one of = > >= < <=.
+// The bare key @container compares the container name, and only with =.
+func parseTagFilter(where string) ([]TagCondition, error) {
+	invalid := errInvalidQueryParameterValue("where")
+
+	// cutQuoted splits a string starting with a quote q into the quoted text
+	// and what follows the closing quote.
+	cutQuoted := func(s string, q byte) (quoted, rest string, ok bool) {
+		if len(s) == 0 || s[0] != q {
+			return "", s, false
+		}
+		i := strings.IndexByte(s[1:], q)
+		if i < 0 {
+			return "", s, false
+		}
+		return s[1 : i+1], s[i+2:], true
+	}
+
+	var conds []TagCondition
+	hasTag := false
+	rest := strings.TrimLeft(where, " ")
+	for {
+		var cond TagCondition
+		var ok bool
+		if cond.Key, rest, ok = cutQuoted(rest, '"'); ok {
+			if cond.Key == "" || !validTagString(cond.Key, maxTagKeyLength) {
+				return nil, invalid
+			}
+			hasTag = true
+		} else if rest, ok = strings.CutPrefix(rest, containerTagKey); ok {
+			cond.Key = containerTagKey
+		} else {
+			return nil, invalid
+		}
+
+		rest = strings.TrimLeft(rest, " ")
+		for _, op := range []string{">=", "<=", "=", ">", "<"} {
+			if after, found := strings.CutPrefix(rest, op); found {
+				cond.Op, rest = op, after
+				break
+			}
+		}
+		if cond.Op == "" || (cond.Key == containerTagKey && cond.Op != "=") {
+			return nil, invalid
+		}
+
+		rest = strings.TrimLeft(rest, " ")
+		if cond.Value, rest, ok = cutQuoted(rest, '\''); !ok || !validTagString(cond.Value, maxTagValueLength) {
+			return nil, invalid
+		}
+		conds = append(conds, cond)
+
+		trimmed := strings.TrimLeft(rest, " ")
+		if trimmed == "" {
+			break
+		}
+		if trimmed == rest || len(trimmed) < 4 || !strings.EqualFold(trimmed[:3], "and") || trimmed[3] != ' ' {
+			return nil, invalid
+		}
+		rest = strings.TrimLeft(trimmed[3:], " ")
+	}
+	if !hasTag {
+		return nil, invalid
+	}
+	return conds, nil
+}
+
+// matches reports whether value meets the condition. Tag values compare as strings.
+func (c TagCondition) matches(value string) bool {
+	switch c.Op {
+	case "=":
+		return value == c.Value
+	case ">":
+		return value > c.Value
+	case ">=":
+		return value >= c.Value
+	case "<":
+		return value < c.Value
+	case "<=":
+		return value <= c.Value
+	}
+	return false
+}
+
+// tagsMatch reports whether a blob in containerName with the given tags meets
+// all of conds.
+func tagsMatch(containerName string, tags map[string]string, conds []TagCondition) bool {
+	for _, c := range conds {
+		value, ok := tags[c.Key]
+		if c.Key == containerTagKey {
+			value, ok = containerName, true
+		}
+		if !ok || !c.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagIndex maps a tag key and value to the names of the blobs in a container
+// that have the tag, so Find Blobs by Tags doesn't scan every blob.
+type tagIndex map[string]map[string]map[string]struct{}
+
+// update moves a blob in the index from its old tags to its new tags. Either may be nil.
+func (ix tagIndex) update(blobName string, old, new map[string]string) {
+	for k, v := range old {
+		if nv, ok := new[k]; ok && nv == v {
+			continue
+		}
+		names := ix[k][v]
+		delete(names, blobName)
+		if len(names) == 0 {
+			delete(ix[k], v)
+		}
+		if len(ix[k]) == 0 {
+			delete(ix, k)
+		}
+	}
+	for k, v := range new {
+		if ov, ok := old[k]; ok && ov == v {
+			continue
+		}
+		values := ix[k]
+		if values == nil {
+			values = make(map[string]map[string]struct{})
+			ix[k] = values
+		}
+		names := values[v]
+		if names == nil {
+			names = make(map[string]struct{})
+			values[v] = names
+		}
+		names[blobName] = struct{}{}
+	}
+}
+
+// lookup returns the names of the blobs whose tags meet cond, in order.
+func (ix tagIndex) lookup(cond TagCondition) []string {
+	var names []string
+	for value, set := range ix[cond.Key] {
+		if !cond.matches(value) {
+			continue
+		}
+		for name := range set {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tags returns the index tags of a blob record, which may be nil.
+func (r *blobRecord) tags() map[string]string {
+	if r == nil {
+		return nil
+	}
+	return r.Tags
+}
+
+// encodeTagFilterMarker returns the Find Blobs by Tags marker that continues at
+// a blob. Container names can't contain newlines.
+func encodeTagFilterMarker(containerName, blobName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(containerName + "\n" + blobName))
+}
+
+// decodeTagFilterMarker returns the position encoded in a Find Blobs by Tags marker.
+func decodeTagFilterMarker(marker string) (containerName, blobName string, err error) {
+	if marker == "" {
+		return "", "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(marker)
+	containerName, blobName, ok := strings.Cut(string(data), "\n")
+	if err != nil || !ok {
+		return "", "", errInvalidQueryParameterValue("marker")
+	}
+	return containerName, blobName, nil
+}
+
+func (s *FileBlobStore) GetBlobTags(ctx context.Context, account, containerName, blobName string, opts GetBlobOptions) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, _, err := s.readableBlob(account, containerName, blobName, opts.Snapshot, opts.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, record, false); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(record.Tags))
+	for k, v := range record.Tags {
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+func (s *FileBlobStore) SetBlobTags(ctx context.Context, account, containerName, blobName string, tags map[string]string, opts SetBlobTagsOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.container(account, containerName)
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	// Only the current version of a blob is indexed; a previous version's
+	// tags are just stored with it.
+	current := entry.blobs[blobName]
+	if opts.VersionID != "" && (current == nil || current.Properties.VersionID != opts.VersionID) {
+		version := findVersion(entry.versions[blobName], opts.VersionID)
+		if version == nil {
+			return ErrBlobNotFound
+		}
+		if err := checkBlobAccess(opts.Conditions, version, true); err != nil {
+			return err
+		}
+		record := *version
+		record.Tags = tags
+		path := s.versionPath(account, containerName, blobName, opts.VersionID)
+		if err := s.writeJSON(path+".json", &record); err != nil {
+			return err
+		}
+		entry.versions[blobName] = replaceRecord(entry.versions[blobName], version, &record)
+		return nil
+	}
+	if current == nil {
+		return ErrBlobNotFound
+	}
+	if err := checkBlobAccess(opts.Conditions, current, true); err != nil {
+		return err
+	}
+
+	record := *current
+	record.Tags = tags
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return err
+	}
+	entry.blobs[blobName] = &record
+	entry.tags.update(blobName, current.Tags, tags)
+	return nil
+}
+
+func (s *FileBlobStore) FindBlobsByTags(ctx context.Context, account string, opts FindBlobsByTagsOptions) (*TaggedBlobList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	markerContainer, markerBlob, err := decodeTagFilterMarker(opts.Marker)
+	if err != nil {
+		return nil, err
+	}
+
+	var containerNames []string
+	if opts.Container != "" {
+		if _, err := s.container(account, opts.Container); err != nil {
+			return nil, err
+		}
+		containerNames = []string{opts.Container}
+	} else {
+		keyPrefix := s.containerKey(account, "")
+		for key, entry := range s.containers {
+			if strings.HasPrefix(key, keyPrefix) {
+				containerNames = append(containerNames, entry.container.Name)
+			}
+		}
+		sort.Strings(containerNames)
+	}
+
+	// The index is searched for one tag condition, preferably an equality;
+	// the blobs it finds are then checked against the rest.
+	var indexed TagCondition
+	for _, c := range opts.Where {
+		if c.Key != containerTagKey && (indexed.Key == "" || (c.Op == "=" && indexed.Op != "=")) {
+			indexed = c
+		}
+	}
+
+	list := &TaggedBlobList{}
+	for _, containerName := range containerNames {
+		if containerName < markerContainer {
+			continue
+		}
+		entry := s.containers[s.containerKey(account, containerName)]
+		for _, name := range entry.tags.lookup(indexed) {
+			if containerName == markerContainer && name < markerBlob {
+				continue
+			}
+			record := entry.blobs[name]
+			if !tagsMatch(containerName, record.Tags, opts.Where) {
+				continue
+			}
+			if opts.MaxResults > 0 && len(list.Blobs) == opts.MaxResults {
+				list.NextMarker = encodeTagFilterMarker(containerName, name)
+				return list, nil
+			}
+			// Only the tags the expression refers to are returned.
+			tags := make(map[string]string)
+			for _, c := range opts.Where {
+				if value, ok := record.Tags[c.Key]; ok {
+					tags[c.Key] = value
+				}
+			}
+			list.Blobs = append(list.Blobs, TaggedBlob{Container: containerName, Name: name, Tags: tags})
+		}
+	}
+	return list, nil
+}
+
+// filterBlobsResultXML is the body returned by Find Blobs by Tags.
+type filterBlobsResultXML struct {
+	XMLName         xml.Name           `xml:"EnumerationResults"`
+	ServiceEndpoint string             `xml:"ServiceEndpoint,attr"`
+	Where           string             `xml:"Where"`
+	Blobs           filterBlobsListXML `xml:"Blobs"`
+	NextMarker      string             `xml:"NextMarker"`
+}
+
+// filterBlobsListXML is the <Blobs> element of a Find Blobs by Tags response.
+type filterBlobsListXML struct {
+	Blob []filterBlobItemXML `xml:"Blob"`
+}
+
+// filterBlobItemXML is a single blob found by Find Blobs by Tags.
+type filterBlobItemXML struct {
+	Name          string   `xml:"Name"`
+	ContainerName string   `xml:"ContainerName"`
+	Tags          *tagsXML `xml:"Tags,omitempty"`
+}
+
+// handleGetBlobTags handles GET /{account}/{container}/{blobName}?comp=tags.
+// ?snapshot= and ?versionid= read the tags of a snapshot or previous version.
+func (s *BlobService) handleGetBlobTags(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	snapshot, versionID, err := snapshotAndVersionParams(r.URL.Query())
+	if err != nil {
+		s.writeStoreError(w, err, "")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	tags, err := s.store.GetBlobTags(r.Context(), account, containerName, blobName, GetBlobOptions{
+		Snapshot:   snapshot,
+		VersionID:  versionID,
+		Conditions: conds,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to get blob tags",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+	s.writeXML(w, http.StatusOK, newTagsXML(tags))
+}
+
+// handleSetBlobTags handles PUT /{account}/{container}/{blobName}?comp=tags.
+// The <Tags> body replaces all of the blob's tags; ?versionid= sets the tags of
+// a previous version.
+func (s *BlobService) handleSetBlobTags(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	versionID, err := timestampParam(r.URL.Query(), "versionid")
+	if err != nil {
+		s.writeStoreError(w, err, "")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+	var body tagsXML
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		s.writeStoreError(w, ErrInvalidXMLDocument, "invalid blob tags")
+		return
+	}
+	tags, err := body.tags()
+	if err != nil {
+		s.writeStoreError(w, err, "invalid blob tags")
+		return
+	}
+
+	err = s.store.SetBlobTags(r.Context(), account, containerName, blobName, tags, SetBlobTagsOptions{
+		VersionID:  versionID,
+		Conditions: conds,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set blob tags",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.logger.Info("blob tags set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.Int("tags", len(tags)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFindBlobsByTags handles GET /{account}?comp=blobs&where={expression} and
+// GET /{account}/{container}?restype=container&comp=blobs&where={expression}.
+func (s *BlobService) handleFindBlobsByTags(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	query := r.URL.Query()
+
+	where := query.Get("where")
+	if where == "" {
+		s.writeStoreError(w, errMissingRequiredQueryParameter("where"), "")
+		return
+	}
+	conds, err := parseTagFilter(where)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid filter expression")
+		return
+	}
+	if containerName != "" {
+		// Within a container, @container has nothing to select.
+		for _, c := range conds {
+			if c.Key == containerTagKey {
+				s.writeStoreError(w, errInvalidQueryParameterValue("where"), "invalid filter expression")
+				return
+			}
+		}
+	}
+	maxResults, err := maxResultsParam(query)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid maxresults")
+		return
+	}
+
+	list, err := s.store.FindBlobsByTags(r.Context(), account, FindBlobsByTagsOptions{
+		Container:  containerName,
+		Where:      conds,
+		Marker:     query.Get("marker"),
+		MaxResults: maxResults,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to find blobs by tags",
+			logging.String("account", account),
+			logging.String("container", containerName),
+		)
+		return
+	}
+
+	result := filterBlobsResultXML{
+		ServiceEndpoint: serviceEndpoint(r, account),
+		Where:           where,
+		NextMarker:      list.NextMarker,
+	}
+	for _, blob := range list.Blobs {
+		result.Blobs.Blob = append(result.Blobs.Blob, filterBlobItemXML{
+			Name:          blob.Name,
+			ContainerName: blob.Container,
+			Tags:          newTagsXML(blob.Tags),
+		})
+	}
+	s.writeXML(w, http.StatusOK, result)
+}
@@ -0,0 +1,303 @@
+package blob
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// accessTierHeader is the header that carries a block blob's access tier.
+const accessTierHeader = "x-ms-access-tier"
+
+// defaultRehydrationDelays are how long Azure may take to rehydrate a blob from
+// the Archive tier: up to 15 hours, or under an hour at high priority.
+var defaultRehydrationDelays = map[RehydratePriority]time.Duration{
+	RehydratePriorityStandard: 15 * time.Hour,
+	RehydratePriorityHigh:     time.Hour,
+}
+
+// archived reports whether a blob is in the Archive tier, including while it is
+// being rehydrated. An archived blob's content can't be read or modified.
+func (p *BlobProperties) archived() bool {
+	return p.AccessTier == AccessTierArchive
+}
+
+// archiveStatus returns the x-ms-archive-status of a blob being rehydrated,
+// such as rehydrate-pending-to-hot.
+func (r *Rehydration) archiveStatus() string {
+	return "rehydrate-pending-to-" + strings.ToLower(string(r.Tier))
+}
+
+// RehydrationFunc is called when the rehydration of a blob from the Archive
+// tier completes, with the blob's properties in its new tier. If the new tier
+// couldn't be recorded, props is nil and err says why.
+type RehydrationFunc func(account, containerName, blobName string, props *BlobProperties, err error)
+
+// OnRehydrationComplete sets the function called when a rehydration completes.
+func (s *FileBlobStore) OnRehydrationComplete(fn RehydrationFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onRehydrated = fn
+}
+
+// SetRehydrationDelays sets how long rehydrations from the Archive tier take at
+// standard and at high priority. Rehydrations already pending keep their delay.
+func (s *FileBlobStore) SetRehydrationDelays(standard, highPriority time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rehydrationDelays = map[RehydratePriority]time.Duration{
+		RehydratePriorityStandard: standard,
+		RehydratePriorityHigh:     highPriority,
+	}
+}
+
+func (s *FileBlobStore) SetBlobTier(ctx context.Context, account, containerName, blobName string, tier AccessTier, opts SetBlobTierOptions) (*BlobProperties, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlobAccess(opts.Conditions, current, true); err != nil {
+		return nil, err
+	}
+	if current.Properties.BlobType != BlobTypeBlock {
+		return nil, ErrInvalidBlobType
+	}
+	priority := opts.RehydratePriority
+	if priority == "" {
+		priority = RehydratePriorityStandard
+	}
+
+	// Like Azure, changing the tier changes neither the ETag nor Last-Modified.
+	now := time.Now().UTC()
+	record := *current
+	switch pending := current.Properties.Rehydration; {
+	case pending != nil:
+		if tier != pending.Tier {
+			return nil, ErrBlobBeingRehydrated
+		}
+		if priority != RehydratePriorityHigh || pending.Priority == RehydratePriorityHigh {
+			props := current.Properties
+			return &props, nil
+		}
+		// Raising the priority can only bring the rehydration forward.
+		raised := *pending
+		raised.Priority = RehydratePriorityHigh
+		if due := now.Add(s.rehydrationDelays[RehydratePriorityHigh]); due.Before(raised.CompletesAt) {
+			raised.CompletesAt = due
+		}
+		record.Properties.Rehydration = &raised
+	case current.Properties.archived() && tier != AccessTierArchive:
+		record.Properties.Rehydration = &Rehydration{
+			Tier:        tier,
+			Priority:    priority,
+			CompletesAt: now.Add(s.rehydrationDelays[priority]),
+		}
+	default:
+		record.Properties.AccessTier = tier
+		record.Properties.AccessTierChangedAt = now
+	}
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &record
+	if record.Properties.Rehydration != nil {
+		s.scheduleRehydration(account, containerName, &record)
+	}
+
+	props := record.Properties
+	return &props, nil
+}
+
+// scheduleRehydration completes a blob's pending rehydration once it is due.
+func (s *FileBlobStore) scheduleRehydration(account, containerName string, record *blobRecord) {
+	blobName, due := record.Name, record.Properties.Rehydration.CompletesAt
+	time.AfterFunc(time.Until(due), func() {
+		s.mu.Lock()
+		props, err := s.completeRehydration(account, containerName, blobName, due)
+		notify := s.onRehydrated
+		s.mu.Unlock()
+
+		if notify != nil && (props != nil || err != nil) {
+			notify(account, containerName, blobName, props, err)
+		}
+	})
+}
+
+// completeRehydration moves a blob whose rehydration is due at due to its new
+// tier, and returns its properties. Nothing happens, and nil is returned, if
+// the blob has since been replaced or deleted, or its rehydration brought
+// forward. If the record can't be written, the rehydration stays pending until
+// the next startup. The caller holds the lock.
+func (s *FileBlobStore) completeRehydration(account, containerName, blobName string, due time.Time) (*BlobProperties, error) {
+	current, err := s.blob(account, containerName, blobName)
+	if err != nil {
+		return nil, nil
+	}
+	pending := current.Properties.Rehydration
+	if pending == nil || !pending.CompletesAt.Equal(due) {
+		return nil, nil
+	}
+
+	record := *current
+	record.Properties.AccessTier = pending.Tier
+	record.Properties.AccessTierChangedAt = due
+	record.Properties.Rehydration = nil
+	if err := s.writeBlobRecord(account, containerName, &record); err != nil {
+		return nil, err
+	}
+	s.containers[s.containerKey(account, containerName)].blobs[blobName] = &record
+
+	props := record.Properties
+	return &props, nil
+}
+
+// parseAccessTier returns the access tier in x-ms-access-tier, or "" if the
+// header isn't set. Tier names are matched without regard to case.
+func parseAccessTier(h http.Header) (AccessTier, error) {
+	value := h.Get(accessTierHeader)
+	if value == "" {
+		return "", nil
+	}
+	for _, tier := range []AccessTier{AccessTierHot, AccessTierCool, AccessTierCold, AccessTierArchive} {
+		if strings.EqualFold(value, string(tier)) {
+			return tier, nil
+		}
+	}
+	return "", errInvalidHeaderValue(accessTierHeader)
+}
+
+// parseRehydratePriority returns the priority in x-ms-rehydrate-priority, or ""
+// if the header isn't set.
+func parseRehydratePriority(h http.Header) (RehydratePriority, error) {
+	switch priority := RehydratePriority(h.Get("x-ms-rehydrate-priority")); priority {
+	case "", RehydratePriorityStandard, RehydratePriorityHigh:
+		return priority, nil
+	default:
+		return "", errInvalidHeaderValue("x-ms-rehydrate-priority")
+	}
+}
+
+// setAccessTierHeaders reports a block blob's access tier and any pending
+// rehydration, as returned by Get Blob and Get Blob Properties.
+func setAccessTierHeaders(h http.Header, props *BlobProperties) {
+	if props.AccessTier == "" {
+		h.Set(accessTierHeader, string(AccessTierHot))
+		h.Set("x-ms-access-tier-inferred", "true")
+	} else {
+		h.Set(accessTierHeader, string(props.AccessTier))
+	}
+	if !props.AccessTierChangedAt.IsZero() {
+		h.Set("x-ms-access-tier-change-time", formatHTTPDate(props.AccessTierChangedAt))
+	}
+	if r := props.Rehydration; r != nil {
+		h.Set("x-ms-archive-status", r.archiveStatus())
+		h.Set("x-ms-rehydrate-priority", string(r.Priority))
+	}
+}
+
+// handleSetBlobTier handles PUT /{account}/{container}/{blobName}?comp=tier.
+// Moving an archived blob to an online tier starts a rehydration and returns
+// 202 Accepted; the blob stays archived until the rehydration completes.
+func (s *BlobService) handleSetBlobTier(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	containerName := chi.URLParam(r, "container")
+	blobName := blobNameParam(r)
+
+	tier, err := parseAccessTier(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid access tier")
+		return
+	}
+	if tier == "" {
+		s.writeStoreError(w, errMissingRequiredHeader(accessTierHeader), "")
+		return
+	}
+	priority, err := parseRehydratePriority(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid rehydrate priority")
+		return
+	}
+	conds, err := parseAccessConditions(r.Header)
+	if err != nil {
+		s.writeStoreError(w, err, "invalid conditional headers")
+		return
+	}
+
+	props, err := s.store.SetBlobTier(r.Context(), account, containerName, blobName, tier, SetBlobTierOptions{
+		RehydratePriority: priority,
+		Conditions:        conds,
+	})
+	if err != nil {
+		s.writeStoreError(w, err, "failed to set blob tier",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+		)
+		return
+	}
+
+	s.recordChange(w, r, eventBlobTierChanged, "SetBlobTier", props)
+	if props.Rehydration != nil {
+		s.logger.Info("blob rehydration pending",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+			logging.String("tier", string(props.Rehydration.Tier)),
+			logging.String("priority", string(props.Rehydration.Priority)),
+		)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	s.logger.Info("blob tier set",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("tier", string(tier)),
+	)
+	w.WriteHeader(http.StatusOK)
+}
+
+// rehydrationCompleted is called by the store when a blob's rehydration from
+// the Archive tier completes, which records the tier change in the change feed.
+// A rehydration that failed to complete is only logged: the store retries it
+// at the next startup.
+func (s *BlobService) rehydrationCompleted(account, containerName, blobName string, props *BlobProperties, err error) {
+	if err != nil {
+		s.logger.Error("failed to complete blob rehydration",
+			logging.String("account", account),
+			logging.String("container", containerName),
+			logging.String("blob", blobName),
+			logging.ErrorField(err),
+		)
+		return
+	}
+	s.logger.Info("blob rehydrated",
+		logging.String("account", account),
+		logging.String("container", containerName),
+		logging.String("blob", blobName),
+		logging.String("tier", string(props.AccessTier)),
+	)
+	if s.changeFeed == nil {
+		return
+	}
+	s.publishChange(context.Background(), changeEvent{
+		EventType: eventBlobTierChanged,
+		API:       "SetBlobTier",
+		Account:   account,
+		Container: containerName,
+		Blob:      blobName,
+		// No request completes a rehydration, so it has no request IDs of its own.
+		RequestID:       newUUID(),
+		ClientRequestID: "00000000-0000-0000-0000-000000000000",
+	}, props)
+}
@@ -0,0 +1,120 @@
+package blob
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// versionPath returns the file holding the content of a previous version of a
+// blob. Its record is stored next to it with a .json extension.
+func (s *FileBlobStore) versionPath(account, containerName, blobName, versionID string) string {
+	return filepath.Join(s.blobMetaPath(account, containerName, blobName), "versions", hex.EncodeToString([]byte(versionID)))
+}
+
+// findVersion returns the live previous version with the given ID, or nil.
+func findVersion(versions []*blobRecord, versionID string) *blobRecord {
+	for _, record := range versions {
+		if record.Properties.VersionID == versionID && !record.Properties.IsDeleted() {
+			return record
+		}
+	}
+	return nil
+}
+
+// isCurrentVersion reports whether record is the current version of a versioned blob.
+func isCurrentVersion(entry *containerEntry, record *blobRecord) bool {
+	return record.Properties.VersionID != "" && entry.blobs[record.Name] == record
+}
+
+// keepPreviousVersion is called before a write replaces or deletes a blob; existing
+// is nil if the blob doesn't exist. If versioning is enabled for the account, it
+// saves existing as a previous version and returns the version ID for the blob
+// written at now. Otherwise it returns "". The caller holds the lock.
+func (s *FileBlobStore) keepPreviousVersion(entry *containerEntry, account, containerName, blobName string, existing *blobRecord, now time.Time) (string, error) {
+	if !s.services[account].VersioningEnabled {
+		return "", nil
+	}
+
+	versions := entry.versions[blobName]
+	var last string
+	if n := len(versions); n > 0 {
+		last = versions[n-1].Properties.VersionID
+	}
+	if existing == nil {
+		return nextTimestamp(last, now), nil
+	}
+
+	version := *existing
+	version.Properties.Lease = Lease{}
+	if version.Properties.VersionID == "" {
+		// Written before versioning was enabled.
+		version.Properties.VersionID = nextTimestamp(last, version.Properties.ModifiedAt)
+	}
+	blobPath, err := s.blobPath(account, containerName, blobName)
+	if err != nil {
+		return "", err
+	}
+	path := s.versionPath(account, containerName, blobName, version.Properties.VersionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create version directory: %w", err)
+	}
+	if err := linkOrCopyFile(blobPath, path); err != nil {
+		return "", fmt.Errorf("failed to write version: %w", err)
+	}
+	if err := s.writeJSON(path+".json", &version); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	entry.versions[blobName] = append(versions, &version)
+	return nextTimestamp(version.Properties.VersionID, now), nil
+}
+
+// deleteVersion deletes a previous version of a blob. The caller holds the lock.
+func (s *FileBlobStore) deleteVersion(entry *containerEntry, account, containerName, blobName string, opts DeleteBlobOptions) error {
+	versions := entry.versions[blobName]
+	record := findVersion(versions, opts.VersionID)
+	if record == nil {
+		return ErrBlobNotFound
+	}
+	if err := checkBlobAccess(opts.Conditions, record, true); err != nil {
+		return err
+	}
+	if err := entry.checkImmutable(record, false, time.Now()); err != nil {
+		return err
+	}
+
+	path := s.versionPath(account, containerName, blobName, opts.VersionID)
+	if err := s.removeListedRecord(account, entry.versions, path, record, time.Now()); err != nil {
+		return fmt.Errorf("failed to delete version: %w", err)
+	}
+	return s.pruneBlobMetaDir(entry, account, containerName, blobName)
+}
+
+// snapshotAndVersionParams returns the snapshot and versionid query parameters of
+// a request or copy source URL that reads or deletes a blob. At most one of them
+// may be given.
+func snapshotAndVersionParams(query url.Values) (snapshot, versionID string, err error) {
+	if snapshot, err = timestampParam(query, "snapshot"); err != nil {
+		return "", "", err
+	}
+	if versionID, err = timestampParam(query, "versionid"); err != nil {
+		return "", "", err
+	}
+	if snapshot != "" && versionID != "" {
+		return "", "", errInvalidQueryParameterValue("versionid")
+	}
+	return snapshot, versionID, nil
+}
+
+// setVersionIDHeader sets x-ms-version-id on the response to a write that
+// created a new version of a blob.
+func setVersionIDHeader(w http.ResponseWriter, props *BlobProperties) {
+	if props.VersionID != "" {
+		w.Header().Set("x-ms-version-id", props.VersionID)
+	}
+}
@@ -0,0 +1,218 @@
+package blob
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/asad/bluestack/internal/core"
+	"github.com/asad/bluestack/internal/logging"
+)
+
+// webContainer is the container an account's static website is served from.
+const webContainer = "$web"
+
+// staticWebsiteXML is the <StaticWebsite> element of the blob service properties.
+type staticWebsiteXML struct {
+	Enabled              bool   `xml:"Enabled"`
+	IndexDocument        string `xml:"IndexDocument,omitempty"`
+	ErrorDocument404Path string `xml:"ErrorDocument404Path,omitempty"`
+}
+
+// newStaticWebsiteXML converts a store StaticWebsite into its XML form.
+func newStaticWebsiteXML(website StaticWebsite) *staticWebsiteXML {
+	return &staticWebsiteXML{
+		Enabled:              website.Enabled,
+		IndexDocument:        website.IndexDocument,
+		ErrorDocument404Path: website.ErrorDocument404Path,
+	}
+}
+
+// staticWebsite returns the settings of a request body. The documents of a
+// disabled website are dropped, and the error document's path is taken from
+// the root of $web, with or without a leading slash.
+func (x *staticWebsiteXML) staticWebsite() StaticWebsite {
+	if !x.Enabled {
+		return StaticWebsite{}
+	}
+	return StaticWebsite{
+		Enabled:              true,
+		IndexDocument:        x.IndexDocument,
+		ErrorDocument404Path: strings.TrimPrefix(x.ErrorDocument404Path, "/"),
+	}
+}
+
+// WebService is the web endpoint of the blob service: it serves each account's
+// $web container as a static website, if the account has one enabled. Requests
+// are anonymous and read-only, whatever the container's access level.
+type WebService struct {
+	store  BlobStore
+	logger logging.Logger
+}
+
+// NewWebService creates the web endpoint for the accounts of a blob store.
+func NewWebService(store BlobStore, logger logging.Logger) *WebService {
+	return &WebService{
+		store:  store,
+		logger: logger,
+	}
+}
+
+// Name returns the service identifier.
+func (s *WebService) Name() string {
+	return "web"
+}
+
+// RegisterRoutes sets up the routes of the web endpoint:
+//   - GET /{account}/{path} - Get a page of the account's static website
+//   - HEAD /{account}/{path} - Get the headers of a page
+//
+// A path that names a blob in $web serves it. Otherwise, a path naming a
+// directory serves the index document in it, and anything else the 404
+// document with 404 Not Found.
+func (s *WebService) RegisterRoutes(router chi.Router) {
+	router.Use(commonHeaders)
+
+	router.Get("/{account}", s.handleWebRequest)
+	router.Head("/{account}", s.handleWebRequest)
+	router.Get("/{account}/*", s.handleWebRequest)
+	router.Head("/{account}/*", s.handleWebRequest)
+}
+
+// handleWebRequest serves a page of an account's static website.
+func (s *WebService) handleWebRequest(w http.ResponseWriter, r *http.Request) {
+	account := chi.URLParam(r, "account")
+	pagePath := blobNameParam(r)
+
+	props, err := s.store.GetServiceProperties(r.Context(), account)
+	if err != nil {
+		s.writeError(w, r, err, "failed to get service properties", logging.String("account", account))
+		return
+	}
+	website := props.StaticWebsite
+	if !website.Enabled {
+		s.writeError(w, r, ErrWebsiteDisabled, "")
+		return
+	}
+
+	// A path is tried as a blob, then as a directory holding the index document.
+	var candidates []string
+	if pagePath != "" && !strings.HasSuffix(pagePath, "/") {
+		candidates = append(candidates, pagePath)
+	}
+	if website.IndexDocument != "" {
+		dir := strings.TrimSuffix(pagePath, "/")
+		candidates = append(candidates, path.Join(dir, website.IndexDocument))
+	}
+	for _, name := range candidates {
+		blob, err := s.store.GetBlob(r.Context(), account, webContainer, name, GetBlobOptions{})
+		if errors.Is(err, ErrBlobNotFound) || errors.Is(err, ErrContainerNotFound) {
+			continue
+		}
+		if err != nil {
+			s.writeError(w, r, err, "failed to get website content",
+				logging.String("account", account),
+				logging.String("blob", name),
+			)
+			return
+		}
+		defer blob.Content.Close()
+
+		s.logger.Info("website content served",
+			logging.String("account", account),
+			logging.String("path", pagePath),
+			logging.String("blob", name),
+		)
+		setWebContentHeaders(w.Header(), blob)
+		http.ServeContent(w, r, name, blob.ModifiedAt, io.NewSectionReader(blob.Content, 0, blob.Size))
+		return
+	}
+
+	if website.ErrorDocument404Path != "" {
+		blob, err := s.store.GetBlob(r.Context(), account, webContainer, website.ErrorDocument404Path, GetBlobOptions{})
+		if err == nil {
+			defer blob.Content.Close()
+			setWebContentHeaders(w.Header(), blob)
+			w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method != http.MethodHead {
+				io.Copy(w, io.NewSectionReader(blob.Content, 0, blob.Size))
+			}
+			return
+		}
+	}
+	s.writeError(w, r, ErrWebContentNotFound, "")
+}
+
+// setWebContentHeaders sets the headers of a blob served by the web endpoint.
+// A blob stored with no content type, or the application/octet-stream default,
+// gets the type of its extension, so browsers render pages and scripts uploaded
+// without one.
+func setWebContentHeaders(h http.Header, blob *Blob) {
+	contentType := blob.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(path.Ext(blob.Name)); byExt != "" {
+			contentType = byExt
+		}
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("ETag", blob.ETag)
+	h.Set("Last-Modified", formatHTTPDate(blob.ModifiedAt))
+	if blob.ContentEncoding != "" {
+		h.Set("Content-Encoding", blob.ContentEncoding)
+	}
+	if blob.ContentLanguage != "" {
+		h.Set("Content-Language", blob.ContentLanguage)
+	}
+	if blob.CacheControl != "" {
+		h.Set("Cache-Control", blob.CacheControl)
+	}
+	if blob.ContentDisposition != "" {
+		h.Set("Content-Disposition", blob.ContentDisposition)
+	}
+	if len(blob.ContentMD5) > 0 {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(blob.ContentMD5))
+	}
+}
+
+// writeError writes an error page. Like Azure's web endpoint, errors are HTML
+// rather than XML, with the error code in x-ms-error-code. Errors that aren't
+// StorageErrors are logged with the given message and fields.
+func (s *WebService) writeError(w http.ResponseWriter, r *http.Request, err error, msg string, fields ...logging.Field) {
+	var storageErr *StorageError
+	if !errors.As(err, &storageErr) {
+		s.logger.Error(msg, append(fields, logging.ErrorField(err))...)
+		storageErr = &StorageError{
+			StatusCode: http.StatusInternalServerError,
+			Code:       "InternalError",
+			Message:    "Server encountered an internal error. Please try again after some time.",
+		}
+	}
+
+	body := fmt.Sprintf("<!DOCTYPE html><html><head><title>%s</title></head><body>"+
+		"<h1>%s</h1><ul><li>HttpStatusCode: %d</li><li>ErrorCode: %s</li><li>RequestId: %s</li><li>TimeStamp: %s</li></ul>"+
+		"</body></html>",
+		storageErr.Code, html.EscapeString(storageErr.Message), storageErr.StatusCode, storageErr.Code,
+		w.Header().Get("x-ms-request-id"), time.Now().UTC().Format(time.RFC3339Nano))
+
+	w.Header().Set("x-ms-error-code", storageErr.Code)
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(storageErr.StatusCode)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, body)
+	}
+}
+
+// Ensure WebService implements the Service interface.
+var _ core.Service = (*WebService)(nil)